@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible"
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/task/command"
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/task/set_fact"
+	"github.com/state-of-the-art/ansiblego/pkg/transport/local"
+)
+
+// Set for the test binary to act as the agent
+const test_agent_env = "ANSIBLEGO_TEST_AGENT"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(test_agent_env) != "" {
+		getTask = testTask
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Returns the compiled module, so the agent doesn't need interp
+func testTask(name string) (ansible.TaskV2Interface, error) {
+	switch name {
+	case "command":
+		return &ansible.TaskV1Adapter{Task: &command.TaskV1{}}, nil
+	case "set_fact":
+		return &ansible.TaskV1Adapter{Task: &set_fact.TaskV1{}}, nil
+	}
+	return nil, fmt.Errorf("Unable to find module %q", name)
+}
+
+// Runs the module through the test agent started by the local transport
+func runAgent(t *testing.T, name string, args any, vars map[string]any) (ansible.OrderedMap, error) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runAgentExe(t, exe, name, args, vars)
+}
+
+func runAgentExe(t *testing.T, exe, name string, args any, vars map[string]any) (ansible.OrderedMap, error) {
+	t.Helper()
+	t.Setenv(test_agent_env, "1")
+	client, err := local.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	module, err := testTask(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data ansible.OrderedMap
+	data.Set(name, args)
+	if err = module.SetData(&data); err != nil {
+		t.Fatal(err)
+	}
+	return ansible.RunAgent(context.Background(), client, runtime.GOOS, exe, module, vars)
+}
+
+func TestAgentCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Requires echo executable")
+	}
+	vars := map[string]any{"inventory_hostname": "localhost"}
+
+	var map_args ansible.OrderedMap
+	map_args.Set("cmd", "echo")
+	map_args.Set("argv", []any{"hello  world"})
+
+	// Free form and map args are passed to the agent the same way
+	for _, args := range []any{`echo "hello  world"`, map_args} {
+		out, err := runAgent(t, "command", args, vars)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val, _ := out.Get("stdout"); val != "hello  world" {
+			t.Errorf("Bad stdout: %#v", val)
+		}
+		if val, _ := out.Get("rc"); val != 0 {
+			t.Errorf("Bad rc: %#v", val)
+		}
+		if val, _ := out.Get("changed"); val != true {
+			t.Errorf("Bad changed: %#v", val)
+		}
+	}
+}
+
+func TestAgentEnvironment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Requires sh executable")
+	}
+	vars := map[string]any{
+		"_ansible_environment": map[string]any{"TEST_AGENT_ENV": "it's value", "TEST_AGENT_NUM": 42},
+	}
+	out, err := runAgent(t, "command", `sh -c 'echo "$TEST_AGENT_ENV $TEST_AGENT_NUM"'`, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := out.Get("stdout"); val != "it's value 42" {
+		t.Errorf("Environment is not passed to the module: %#v", val)
+	}
+}
+
+func TestAgentFailed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Requires sh executable")
+	}
+	out, err := runAgent(t, "command", "sh -c 'echo broken >&2; exit 3'", map[string]any{})
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("Expected module error, got: %v", err)
+	}
+	if val, _ := out.Get("failed"); val != true {
+		t.Errorf("Bad failed: %#v", val)
+	}
+	if val, _ := out.Get("rc"); val != 3 {
+		t.Errorf("Bad rc: %#v", val)
+	}
+}
+
+func TestAgentFacts(t *testing.T) {
+	var args ansible.OrderedMap
+	args.Set("test_fact", "value")
+	args.Set("cacheable", true)
+	out, err := runAgent(t, "set_fact", args, map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	facts_data, _ := out.Get("ansible_facts")
+	facts, ok := facts_data.(ansible.OrderedMap)
+	if !ok {
+		t.Fatalf("Bad facts: %#v", facts_data)
+	}
+	if val, _ := facts.Get("test_fact"); val != "value" {
+		t.Errorf("Bad fact: %#v", val)
+	}
+	if val, _ := out.Get("_ansible_facts_cacheable"); val != true {
+		t.Errorf("Facts are not cacheable: %#v", val)
+	}
+}
+
+func TestAgentBecome(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() != 0 {
+		t.Skip("Requires root to become another user without password")
+	}
+	if _, err := exec.LookPath("su"); err != nil {
+		t.Skip("Requires su executable")
+	}
+
+	// Become user should be able to run the agent like the uploaded one
+	dir := t.TempDir()
+	for path := dir; path != filepath.Dir(path) && strings.HasPrefix(path, os.TempDir()+"/"); path = filepath.Dir(path) {
+		if err := os.Chmod(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := filepath.Join(dir, "ansiblego")
+	if err = os.WriteFile(agent, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	vars := map[string]any{
+		"ansible_become":        true,
+		"ansible_become_method": "su",
+		"ansible_become_user":   "nobody",
+		// Service users usually have nologin shell
+		"ansible_become_flags": "-s /bin/sh",
+	}
+	out, err := runAgentExe(t, agent, "command", "id -un", vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := out.Get("stdout"); val != "nobody" {
+		t.Errorf("Module is not running as become user: %#v", val)
+	}
+}
+
+func TestAgentBecomePassword(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Requires linux terminal")
+	}
+
+	// Fake su is asking for the password on the terminal like the real one does, so the vars and
+	// the task are passed to the agent through the terminal of any user
+	dir := t.TempDir()
+	script := "#!/bin/sh\nprintf 'Password: '\nread -r pass\n[ \"$pass\" = secret ] || exit 1\nexec /bin/sh -c \"$3\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "su"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	vars := map[string]any{
+		"ansible_become":          true,
+		"ansible_become_method":   "su",
+		"ansible_become_user":     "other",
+		"ansible_become_password": "secret",
+		"long_var":                strings.Repeat("value ", 2000),
+	}
+	out, err := runAgent(t, "command", "echo hello", vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := out.Get("stdout"); val != "hello" {
+		t.Errorf("Bad stdout: %#v", val)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
@@ -94,15 +96,17 @@ var (
 
 				log.Debug("Reading tasks from stdin yaml/json stream and execute them...")
 				for {
-					var task_data map[string]ansible.OrderedMap
+					// The task args could be a map or a free form string like in the playbook
+					var task_data ansible.OrderedMap
 					if err := yaml_decoder.Decode(&task_data); err != nil {
 						if err == io.EOF {
 							break
 						}
 						return log.Errorf("Unable to parse yaml/json from stdin stream: %v", err)
 					}
-					for name, data := range task_data {
-						if err := runTask(name, data, vars); err != nil {
+					for _, name := range task_data.Keys() {
+						args, _ := task_data.Get(name)
+						if err := runTask(name, args, vars); err != nil {
 							return log.Errorf("Executing of task %q ended with error: %v", name, err)
 						}
 					}
@@ -201,29 +205,56 @@ func main() {
 	}
 }
 
-func runTask(name string, args ansible.OrderedMap, vars map[string]any) error {
+// Module loader, could be replaced to run the tasks without interp
+var getTask = ansible.GetTask
+
+func runTask(name string, args any, vars map[string]any) error {
 	log.Debugf("Loading task %q", name)
-	module_data, err := ansible.GetTaskV1(name)
+	module_data, err := getTask(name)
 	if err != nil {
 		return log.Errorf("Unable to find %q task: %v", name, err)
 	}
-	if err = module_data.SetData(&args); err != nil {
+	// Modules are expecting the args under the module name key like in the playbook task
+	data := ansible.OrderedMap{}
+	data.Set(name, args)
+	if err = module_data.SetData(&data); err != nil {
 		return log.Errorf("Unable to set data for task module `%s`: %s", name, err)
 	}
 
 	log.Debugf("Running task %q", name)
-	out, err := module_data.Run(vars)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var out ansible.OrderedMap
+	if b, ok := ansible.BecomeFromVars(vars); ok {
+		log.Debugf("Running task %q as user %q with %s", name, b.User, b.Method)
+		out, err = ansible.RunBecome(ctx, b, module_data, vars)
+	} else {
+		var task_ctx *ansible.TaskV2Context
+		if task_ctx, err = ansible.NewTaskV2Context(ctx, vars); err != nil {
+			return log.Errorf("Unable to prepare task %q: %v", name, err)
+		}
+		task_ctx.ModuleName = name
+		defer task_ctx.Cleanup()
+		out, err = module_data.Run(task_ctx)
+	}
 	if err != nil {
-		return log.Errorf("Error during running task %q: %v", name, err)
+		// Controller gets the output of the failed module with the error message
+		out.Set("failed", true)
+		if _, ok := out.Get("msg"); !ok {
+			out.Set("msg", err.Error())
+		}
 	}
 
-	// Print task data output to stdin as yaml
-	y, err := out.Yaml()
-	if err != nil {
-		return log.Errorf("Unable to encode task output to YAML: %v", err)
+	// Print task data output to stdout as yaml
+	y, yaml_err := out.Yaml()
+	if yaml_err != nil {
+		return log.Errorf("Unable to encode task output to YAML: %v", yaml_err)
 	}
 	fmt.Println(y)
 
+	if err != nil {
+		return log.Errorf("Error during running task %q: %v", name, err)
+	}
 	return nil
 }
 
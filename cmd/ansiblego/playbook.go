@@ -1,19 +1,36 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 
 	"github.com/state-of-the-art/ansiblego/pkg/ansible"
 	"github.com/state-of-the-art/ansiblego/pkg/ansible/inventory"
 	"github.com/state-of-the-art/ansiblego/pkg/core"
+	"github.com/state-of-the-art/ansiblego/pkg/factcache"
 	"github.com/state-of-the-art/ansiblego/pkg/log"
 	"github.com/state-of-the-art/ansiblego/pkg/util"
 )
 
+var p_tags *[]string
 var p_skip_tags *[]string
+var p_list_tags *bool
 var p_inventory *[]string
+var p_limit *string
+var p_forks *int
+var p_become *bool
+var p_become_user *string
+var p_become_method *string
+var p_ask_become_pass *bool
+var p_check *bool
+var p_diff *bool
 
 var playbook_cmd = &cobra.Command{
 	Use:     "playbook",
@@ -45,15 +62,53 @@ var playbook_cmd = &cobra.Command{
 				}
 			}
 		}
+		if p_tags != nil {
+			cfg.Tags = *p_tags
+		}
 		if p_skip_tags != nil {
 			cfg.SkipTags = *p_skip_tags
 		}
+		if p_limit != nil {
+			cfg.Limit = *p_limit
+		}
+		if *p_check {
+			cfg.Check = true
+		}
+		if *p_diff {
+			cfg.Diff = true
+		}
+		if *p_become {
+			cfg.Become = true
+		}
+		if *p_become_user != "" {
+			cfg.BecomeUser = *p_become_user
+		}
+		if *p_become_method != "" {
+			cfg.BecomeMethod = *p_become_method
+		}
+		if *p_ask_become_pass {
+			fmt.Fprint(os.Stderr, "BECOME password: ")
+			password, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return log.Errorf("Unable to read become password: %v", err)
+			}
+			cfg.BecomePassword = string(password)
+		}
+		if cmd.Flags().Changed("forks") {
+			cfg.Forks = *p_forks
+		}
 		if p_inventory != nil {
 			if cfg.Inventory, err = inventory.New(*p_inventory); err != nil {
 				return log.Errorf("Unable to process provided inventory: %v", err)
 			}
 		}
 
+		fact_caching_timeout := time.Duration(cfg.FactCachingTimeout) * time.Second
+		if cfg.FactCache, err = factcache.New(cfg.FactCaching, cfg.FactCachingConnection, fact_caching_timeout); err != nil {
+			return log.Errorf("Unable to initialize fact cache: %v", err)
+		}
+
 		ango, err := core.New(&cfg.CommonConfig)
 		if err != nil {
 			return err
@@ -88,6 +143,14 @@ var playbook_cmd = &cobra.Command{
 			playbooks_to_apply = append(playbooks_to_apply, pf...)
 		}
 
+		if *p_list_tags {
+			for i, pb := range playbooks_to_apply {
+				fmt.Printf("play #%d (%s): %s\tTAGS: [%s]\n", i+1, pb.Hosts.Pattern(), pb.Name, strings.Join(pb.Tags, ", "))
+				fmt.Printf("\tTASK TAGS: [%s]\n", strings.Join(pb.ListTags(cfg.Tags, cfg.SkipTags), ", "))
+			}
+			return nil
+		}
+
 		//
 		// Start execute stage
 		//
@@ -97,11 +160,21 @@ var playbook_cmd = &cobra.Command{
 			return nil
 		}
 
-		for _, host := range cfg.Inventory.Hosts {
-			for _, pb := range playbooks_to_apply {
-				if err := pb.Run(cfg, host); err != nil {
-					return fmt.Errorf("Playbook execution error: %v", err)
-				}
+		// Interrupt stops the execution of the next tasks and cancels the running ones
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		for _, pb := range playbooks_to_apply {
+			hosts, err := pb.MatchHosts(cfg)
+			if err != nil {
+				return err
+			}
+			if len(hosts) < 1 {
+				log.Warnf("No hosts matched for playbook '%s', skipping", pb.Name)
+				continue
+			}
+			if err := pb.Run(ctx, cfg, hosts); err != nil {
+				return fmt.Errorf("Playbook execution error: %v", err)
 			}
 		}
 
@@ -115,7 +188,17 @@ var playbook_cmd = &cobra.Command{
 
 func init() {
 	playbook_cmd.Flags().SortFlags = false
+	p_tags = playbook_cmd.Flags().StringSliceP("tags", "t", nil, "only run plays and tasks tagged with these values (comma-separated)")
 	p_skip_tags = playbook_cmd.Flags().StringSlice("skip-tags", nil, "only run plays and tasks whose tags do not match these values (comma-separated)")
-	p_inventory = playbook_cmd.Flags().StringSliceP("inventory", "i", nil, "specify inventory host path or comma separated host list.")
+	p_list_tags = playbook_cmd.Flags().Bool("list-tags", false, "list all available tags")
+	p_inventory = playbook_cmd.Flags().StringArrayP("inventory", "i", nil, "specify inventory host path, directory, dynamic inventory script or comma separated host list (can occur multiple times)")
+	p_limit = playbook_cmd.Flags().StringP("limit", "l", "", "further limit selected hosts to an additional pattern")
+	p_check = playbook_cmd.Flags().BoolP("check", "C", false, "don't make any changes; instead, try to predict some of the changes that may occur")
+	p_diff = playbook_cmd.Flags().BoolP("diff", "D", false, "when changing (small) files and templates, show the differences in those files")
+	p_become = playbook_cmd.Flags().BoolP("become", "b", false, "run operations with become (does not imply password prompting)")
+	p_become_user = playbook_cmd.Flags().String("become-user", "", "run operations as this user (default=root)")
+	p_become_method = playbook_cmd.Flags().String("become-method", "", "privilege escalation method to use (default=sudo), use one of: sudo, su, doas, runas")
+	p_ask_become_pass = playbook_cmd.Flags().BoolP("ask-become-pass", "K", false, "ask for privilege escalation password")
+	p_forks = playbook_cmd.Flags().IntP("forks", "f", 5, "specify number of parallel processes to use")
 	root_cmd.AddCommand(playbook_cmd)
 }
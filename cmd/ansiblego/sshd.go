@@ -10,6 +10,7 @@ import (
 var sshd_user string
 var sshd_password string
 var sshd_address string
+var sshd_forward_allow []string
 
 var sshd_cmd = &cobra.Command{
 	Use:   "sshd",
@@ -17,7 +18,7 @@ var sshd_cmd = &cobra.Command{
 	Long:  "An embedded cross-platform ssh server to simplify setup of the minimal environments",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		log.Infof("AnsibleGo SSHD running on %s...\n", sshd_address)
-		sshd.Run(sshd_user, sshd_password, sshd_address)
+		sshd.Run(sshd_user, sshd_password, sshd_address, sshd.Options{ForwardAllow: sshd_forward_allow})
 		return nil
 	},
 }
@@ -27,5 +28,6 @@ func init() {
 	sshd_cmd.Flags().StringVarP(&sshd_user, "user", "u", "", "sshd username for login or token if password is not set")
 	sshd_cmd.Flags().StringVarP(&sshd_password, "password", "p", "", "sshd password for login")
 	sshd_cmd.Flags().StringVarP(&sshd_address, "address", "a", "0.0.0.0:2222", "sshd address to listen on")
+	sshd_cmd.Flags().StringArrayVar(&sshd_forward_allow, "forward-allow", nil, "allow clients to use sshd as jump host to the host:port address, wildcards are supported (can occur multiple times)")
 	root_cmd.AddCommand(sshd_cmd)
 }
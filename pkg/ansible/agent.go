@@ -0,0 +1,101 @@
+package ansible
+
+// Remote execution is done by the agent uploaded to the host: the vars and the task data are
+// streamed to the agent stdin and the module output is read from its stdout
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/state-of-the-art/ansiblego/pkg/embedbin"
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+	"github.com/state-of-the-art/ansiblego/pkg/transport/local"
+)
+
+// Path of the uploaded agent on the target system
+const agent_path = "/tmp/ansiblego"
+
+// Uploads the agent binary for the target system and returns the system kernel and the agent
+// path. Local transport is running the current executable since the system is the same.
+func uploadAgent(client transport.Transport) (kernel, exe string, err error) {
+	if _, ok := client.(*local.TransportLocal); ok {
+		if exe, err = os.Executable(); err != nil {
+			return kernel, exe, fmt.Errorf("Unable to find the agent executable: %v", err)
+		}
+		return runtime.GOOS, exe, nil
+	}
+
+	kernel, arch, err := client.Check()
+	if err != nil {
+		return kernel, exe, fmt.Errorf("Failed to execute remote system check: %v", err)
+	}
+	log.Debug("Remote system is:", kernel, arch)
+
+	// Getting fitting embed ansiblego exec data
+	embed_fd, err := embedbin.GetEmbeddedBinary(kernel, arch)
+	if err != nil {
+		return kernel, exe, fmt.Errorf("Unable to find ansiblego binary for target system: %v", err)
+	}
+	defer embed_fd.Close()
+
+	// Agent is running itself as the become user, so it should be executable by everyone
+	if err = client.Copy(embed_fd, agent_path, 0755); err != nil {
+		return kernel, exe, fmt.Errorf("Failed to copy ansiblego agent to target system: %v", err)
+	}
+	return kernel, agent_path, nil
+}
+
+// Runs the task module by the agent through the transport and returns the module output. The
+// output of the failed module is returned with the error.
+func RunAgent(ctx context.Context, client transport.Transport, kernel, exe string, task TaskV2Interface, vars map[string]any) (out OrderedMap, err error) {
+	env, err := TaskV1Environment(vars)
+	if err != nil {
+		return out, fmt.Errorf("Unable to prepare agent environment: %v", err)
+	}
+	// Environment is rendered here, so the agent modules are getting the same values
+	agent_vars := make(map[string]any, len(vars))
+	for key, val := range vars {
+		agent_vars[key] = val
+	}
+	agent_env := make(map[string]any, len(env))
+	for key, val := range env {
+		agent_env[key] = val
+	}
+	agent_vars[environment_var] = agent_env
+
+	// Agent reads the vars document and then the task documents from the stdin stream
+	vars_data, err := ToYaml(agent_vars)
+	if err != nil {
+		return out, fmt.Errorf("Unable to encode vars for agent: %v", err)
+	}
+	task_data, err := ToYaml(task.GetData())
+	if err != nil {
+		return out, fmt.Errorf("Unable to encode task for agent: %v", err)
+	}
+	stdin := strings.NewReader(vars_data + task_data)
+
+	// The agent process gets the environment too, like the become command running it
+	cmd := strings.Join([]string{exe, "-v", log.VerbosityName(), "--timestamp=false", "-e", "-", "-m", "-"}, " ")
+
+	var stdout bytes.Buffer
+	_, run_err := client.ExecuteInput(ctx, environmentCommand(kernel, env, cmd), stdin, &stdout, os.Stderr)
+	if stdout.Len() > 0 {
+		if err = yaml.Unmarshal(stdout.Bytes(), &out); err != nil {
+			return out, fmt.Errorf("Unable to parse the agent output: %v", err)
+		}
+	}
+	if run_err != nil {
+		if msg, ok := out.Get("msg"); ok && varBool(out.Data()["failed"]) {
+			return out, fmt.Errorf("%v", msg)
+		}
+		return out, fmt.Errorf("Failed to execute ansiblego agent: %v", run_err)
+	}
+	return out, nil
+}
@@ -0,0 +1,114 @@
+package ansible
+
+// Privilege escalation is done by running the agent as the become user with the task to execute
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/state-of-the-art/ansiblego/pkg/become"
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+)
+
+// Vars containing the become password, they are not passed to the escalated agent
+var become_password_vars = []string{"ansible_become_password", "ansible_become_pass"}
+
+// Returns the become settings from vars if become is enabled and the current user is not the
+// become user already
+func BecomeFromVars(vars map[string]any) (*become.Become, bool) {
+	if !varBool(vars["ansible_become"]) {
+		return nil, false
+	}
+
+	b := &become.Become{}
+	b.Method, _ = vars["ansible_become_method"].(string)
+	b.User, _ = vars["ansible_become_user"].(string)
+	b.Flags, _ = vars["ansible_become_flags"].(string)
+	for _, key := range become_password_vars {
+		if password, ok := vars[key].(string); ok {
+			b.Password = password
+			break
+		}
+	}
+	if b.Method == "" {
+		b.Method = become.DefaultMethod
+		if runtime.GOOS == "windows" {
+			b.Method = become.DefaultWindowsMethod
+		}
+	}
+
+	if become.IsUser(b.User) {
+		log.Debugf("Already running as become user %q", b.User)
+		return b, false
+	}
+	return b, true
+}
+
+// Runs the task module by the agent executed as the become user and returns the module output
+func RunBecome(ctx context.Context, b *become.Become, task TaskV2Interface, vars map[string]any) (out OrderedMap, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return out, fmt.Errorf("Unable to find the agent executable: %v", err)
+	}
+
+	// Escalated agent should not escalate again and doesn't need the password
+	child_vars := make(map[string]any, len(vars))
+	for key, val := range vars {
+		child_vars[key] = val
+	}
+	child_vars["ansible_become"] = false
+	for _, key := range become_password_vars {
+		delete(child_vars, key)
+	}
+
+	// Vars and task are streamed to the agent stdin, so they are not stored on disk and the
+	// unprivileged become user doesn't need the access to the files of the current user
+	vars_data, err := ToYaml(child_vars)
+	if err != nil {
+		return out, fmt.Errorf("Unable to encode vars for become: %v", err)
+	}
+	task_data, err := ToYaml(task.GetData())
+	if err != nil {
+		return out, fmt.Errorf("Unable to encode task for become: %v", err)
+	}
+	stdin := strings.NewReader(vars_data + task_data)
+
+	var stdout bytes.Buffer
+	run_err := b.Run(ctx, stdin, &stdout, os.Stderr, exe, "-v", log.VerbosityName(), "--timestamp=false", "-e", "-", "-m", "-")
+	if stdout.Len() > 0 {
+		if err = yaml.Unmarshal(stdout.Bytes(), &out); err != nil {
+			return out, fmt.Errorf("Unable to parse the become agent output: %v", err)
+		}
+	}
+	if run_err != nil {
+		if msg, ok := out.Get("msg"); ok && varBool(out.Data()["failed"]) {
+			return out, fmt.Errorf("%v", msg)
+		}
+		return out, fmt.Errorf("Become %s to user %q failed: %v", b.Method, b.User, run_err)
+	}
+	return out, nil
+}
+
+// Inventory vars are strings, so the booleans could be set like `yes` or `true`
+func varBool(val any) bool {
+	switch v := val.(type) {
+	case bool:
+		return v
+	case string:
+		switch strings.ToLower(v) {
+		case "yes", "true", "on", "1", "y":
+			return true
+		}
+	}
+	return false
+}
+
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'"'"'`) + "'"
+}
@@ -0,0 +1,611 @@
+package ansible
+
+// Resolving of the connection settings from the vars the same way Ansible does
+// Doc: https://docs.ansible.com/ansible/2.9/reference_appendices/special_variables.html#connection-variables
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-shellwords"
+
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+	"github.com/state-of-the-art/ansiblego/pkg/transport/chroot"
+	"github.com/state-of-the-art/ansiblego/pkg/transport/docker"
+	"github.com/state-of-the-art/ansiblego/pkg/transport/local"
+	"github.com/state-of-the-art/ansiblego/pkg/transport/ssh"
+	"github.com/state-of-the-art/ansiblego/pkg/transport/winrm"
+)
+
+// Connection settings of the host
+type Connection struct {
+	// Connection type: ssh, winrm, docker, podman, chroot or local
+	Type string
+	// Address of the host, container name for docker and podman or root directory for chroot
+	Host string
+	Port int
+	User string
+
+	Password       string
+	PrivateKeyFile string
+	// Identity files from ssh_config, used when the private key file is not set
+	IdentityFiles []string
+	// Passphrase of the encrypted SSH private key
+	PrivateKeyPassphrase string
+	// OpenSSH user certificate for the private key
+	CertificateFile string
+	// Use the keys of SSH agent
+	UseAgent bool
+
+	// SSH host key verification settings
+	HostKey ssh.HostKeyConfig
+	// SSH jump hosts chain in ProxyJump format
+	ProxyJump string
+	// SSH keepalive settings from ServerAliveInterval and ServerAliveCountMax options
+	KeepaliveInterval time.Duration
+	KeepaliveCountMax int
+
+	// WinRM auth, TLS and timeouts settings, the address and credentials are set on connect
+	WinRM winrm.Config
+
+	// Container engine API address of docker and podman connections, the host is the container
+	EngineHost string
+}
+
+// Vars aliases of the connection settings, the first found var is used so the connection
+// specific vars (like `ansible_ssh_host`) are overriding the generic ones (like `ansible_host`)
+type connectionAliases struct {
+	host        []string
+	port        []string
+	user        []string
+	password    []string
+	private_key []string
+
+	default_port int
+}
+
+var connection_aliases = map[string]connectionAliases{
+	"ssh": {
+		host:         []string{"ansible_ssh_host", "ansible_host"},
+		port:         []string{"ansible_ssh_port", "ansible_port"},
+		user:         []string{"ansible_ssh_user", "ansible_user"},
+		password:     []string{"ansible_ssh_password", "ansible_ssh_pass", "ansible_password"},
+		private_key:  []string{"ansible_ssh_private_key_file", "ansible_private_key_file"},
+		default_port: 22,
+	},
+	"winrm": {
+		host:         []string{"ansible_winrm_host", "ansible_host"},
+		port:         []string{"ansible_winrm_port", "ansible_port"},
+		user:         []string{"ansible_winrm_user", "ansible_user"},
+		password:     []string{"ansible_winrm_password", "ansible_winrm_pass", "ansible_password"},
+		default_port: 5986,
+	},
+	"docker": {
+		host: []string{"ansible_docker_host", "ansible_host"},
+		user: []string{"ansible_docker_user", "ansible_user"},
+	},
+	"podman": {
+		host: []string{"ansible_podman_host", "ansible_host"},
+		user: []string{"ansible_podman_user", "ansible_user"},
+	},
+	"chroot": {
+		host: []string{"ansible_chroot_host", "ansible_host"},
+	},
+}
+
+// Returns the connection settings from the vars, the error contains all the missing vars
+func ConnectionFromVars(vars map[string]any) (*Connection, error) {
+	out := &Connection{Type: "ssh"}
+	if val, ok := vars["ansible_connection"]; ok && val != nil {
+		out.Type = fmt.Sprintf("%v", val)
+	}
+	if out.Type == "local" {
+		return out, nil
+	}
+
+	aliases, ok := connection_aliases[out.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unable to find connection plugin for %q", out.Type)
+	}
+
+	var missing []string
+
+	// Host is the inventory name if the address is not set
+	if out.Host, _ = varString(vars, aliases.host...); out.Host == "" {
+		if out.Host, _ = varString(vars, "inventory_hostname"); out.Host == "" {
+			missing = append(missing, strings.Join(aliases.host, " or "))
+		}
+	}
+
+	out.Port = aliases.default_port
+	port, port_key := varFirst(vars, aliases.port...)
+	if port_key != "" {
+		var err error
+		if out.Port, err = varInt(port); err != nil {
+			return nil, fmt.Errorf("Unable to use port from var %q: %v", port_key, err)
+		}
+		if out.Port < 1 || out.Port > 65535 {
+			return nil, fmt.Errorf("Port %d from var %q is out of range", out.Port, port_key)
+		}
+	}
+
+	out.User, _ = varString(vars, aliases.user...)
+	out.Password, _ = varString(vars, aliases.password...)
+	if len(aliases.private_key) > 0 {
+		out.PrivateKeyFile, _ = varString(vars, aliases.private_key...)
+	}
+
+	switch out.Type {
+	case "ssh":
+		var err error
+		if out.HostKey, err = hostKeyFromVars(vars); err != nil {
+			return nil, err
+		}
+		args, err := sshArgsFromVars(vars)
+		if err != nil {
+			return nil, err
+		}
+		// Jump hosts chain from the var or from `-J` and `-o ProxyJump=` of the ssh args
+		if out.ProxyJump, _ = varString(vars, "ansible_ssh_proxy_jump"); out.ProxyJump == "" {
+			out.ProxyJump = sshArgOption(args, "-J", "ProxyJump")
+		}
+		if out.KeepaliveInterval, out.KeepaliveCountMax, err = keepaliveFromArgs(args); err != nil {
+			return nil, err
+		}
+		// Settings from ssh_config are used when the vars are not set, like ssh client does
+		cfg, err := ssh.LookupConfig(out.Host)
+		if err != nil {
+			log.Warnf("Unable to use ssh config for host '%s': %v", out.Host, err)
+			cfg = &ssh.HostConfig{}
+		}
+		if cfg.HostName != "" {
+			out.Host = cfg.HostName
+		}
+		if out.User == "" {
+			out.User = cfg.User
+		}
+		if port_key == "" && cfg.Port != 0 {
+			out.Port = cfg.Port
+		}
+		out.IdentityFiles = cfg.IdentityFiles
+		if out.ProxyJump == "" {
+			out.ProxyJump = cfg.ProxyJump
+		}
+		// Like ssh client does the current user is used by default
+		if out.User == "" {
+			if current, err := user.Current(); err == nil {
+				out.User = current.Username
+			} else {
+				missing = append(missing, strings.Join(aliases.user, " or "))
+			}
+		}
+		out.PrivateKeyPassphrase, _ = varString(vars, "ansible_ssh_private_key_passphrase")
+		out.CertificateFile, _ = varString(vars, "ansible_ssh_certificate_file")
+		out.UseAgent = true
+		if val, key := varFirst(vars, "ansible_ssh_use_agent"); key != "" {
+			out.UseAgent = varBool(val)
+		}
+		// Agent and identity files of ssh_config or the default ones could be used if nothing is set
+		has_agent := out.UseAgent && os.Getenv("SSH_AUTH_SOCK") != ""
+		identity_files := out.IdentityFiles
+		if len(identity_files) == 0 {
+			identity_files = ssh.DefaultKeyFiles()
+		}
+		if out.Password == "" && out.PrivateKeyFile == "" && !has_agent && len(identity_files) == 0 {
+			missing = append(missing, strings.Join(append(aliases.password, aliases.private_key...), " or "))
+		}
+	case "winrm":
+		var err error
+		explicit_port := 0
+		if port_key != "" {
+			explicit_port = out.Port
+		}
+		if out.WinRM, err = winrmFromVars(vars, out.User, explicit_port); err != nil {
+			return nil, err
+		}
+		if port_key == "" && !out.WinRM.HTTPS {
+			out.Port = 5985
+		}
+		if out.User == "" && out.WinRM.Transport != winrm.AuthCertificate {
+			missing = append(missing, strings.Join(aliases.user, " or "))
+		}
+		switch out.WinRM.Transport {
+		case winrm.AuthBasic, winrm.AuthNTLM:
+			if out.Password == "" {
+				missing = append(missing, strings.Join(aliases.password, " or "))
+			}
+		case winrm.AuthCertificate:
+			if out.WinRM.CertFile == "" {
+				missing = append(missing, "ansible_winrm_cert_pem")
+			}
+			if out.WinRM.CertKeyFile == "" {
+				missing = append(missing, "ansible_winrm_cert_key_pem")
+			}
+		}
+	case "docker", "podman":
+		// The docker_api connection of community.docker is using `docker_host` option
+		keys := []string{"ansible_" + out.Type + "_engine_host"}
+		if out.Type == "docker" {
+			keys = append(keys, "ansible_docker_docker_host")
+		}
+		if out.EngineHost, _ = varString(vars, keys...); out.EngineHost == "" {
+			out.EngineHost = docker.DefaultHost(out.Type)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Unable to connect via %s, the required vars are not set: %s", out.Type, strings.Join(missing, "; "))
+	}
+
+	return out, nil
+}
+
+// Creates the transport to the host
+func (c *Connection) Connect() (client transport.Transport, err error) {
+	switch c.Type {
+	case "ssh":
+		log.Debugf("Connecting via SSH to '%s@%s:%d'", c.User, c.Host, c.Port)
+		cfg := &ssh.Config{
+			User: c.User,
+			Host: c.Host,
+			Port: c.Port,
+			Auth: ssh.AuthConfig{
+				Password:        c.Password,
+				IdentityFiles:   c.IdentityFiles,
+				Passphrase:      c.PrivateKeyPassphrase,
+				CertificateFile: c.CertificateFile,
+				UseAgent:        c.UseAgent,
+			},
+			HostKey: c.HostKey,
+
+			KeepaliveInterval: c.KeepaliveInterval,
+			KeepaliveCountMax: c.KeepaliveCountMax,
+		}
+		if c.PrivateKeyFile != "" {
+			cfg.Auth.PrivateKeyFiles = []string{c.PrivateKeyFile}
+		}
+		if cfg.Jumps, err = ssh.ResolveProxyJump(c.ProxyJump); err != nil {
+			return nil, err
+		}
+		if len(cfg.Jumps) > 0 {
+			log.Debugf("Connecting to '%s' through jump hosts '%s'", c.Host, c.ProxyJump)
+		}
+		if client, err = ssh.New(cfg); err != nil {
+			return nil, fmt.Errorf("Unable to connect to SSH: %v", err)
+		}
+	case "winrm":
+		log.Debugf("Connecting via WinRM to '%s@%s:%d'", c.User, c.Host, c.Port)
+		cfg := c.WinRM
+		cfg.User, cfg.Password, cfg.Host, cfg.Port = c.User, c.Password, c.Host, c.Port
+		if client, err = winrm.New(&cfg); err != nil {
+			return nil, fmt.Errorf("Unable to connect to WinRM: %v", err)
+		}
+	case "docker", "podman":
+		log.Debugf("Connecting via %s engine '%s' to container '%s'", c.Type, c.EngineHost, c.Host)
+		cfg := &docker.Config{Host: c.EngineHost, Container: c.Host, User: c.User}
+		if client, err = docker.New(cfg); err != nil {
+			return nil, fmt.Errorf("Unable to connect to %s container: %v", c.Type, err)
+		}
+	case "local":
+		log.Debug("Connecting to local system")
+		if client, err = local.New(); err != nil {
+			return nil, fmt.Errorf("Unable to connect to local system: %v", err)
+		}
+	case "chroot":
+		log.Debugf("Connecting via chroot to '%s'", c.Host)
+		if client, err = chroot.New(&chroot.Config{Root: c.Host}); err != nil {
+			return nil, fmt.Errorf("Unable to connect to chroot: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("Unable to find connection plugin for %q", c.Type)
+	}
+	return client, nil
+}
+
+// Connection of the play shared by the tasks, the first task is connecting and the others wait
+type playConnection struct {
+	ready  chan struct{}
+	client transport.Transport
+	err    error
+}
+
+// Returns the transport to the host and the function to release it. In the play the
+// transports are reused by the tasks and closed at the end of the play.
+func connectHost(ctx context.Context, conn *Connection) (transport.Transport, func(), error) {
+	state := playStateFrom(ctx)
+	if state == nil {
+		client, err := conn.Connect()
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func() { client.Close() }, nil
+	}
+
+	// Settings are the key, so the hosts with the same address but different users are not mixed
+	key := fmt.Sprintf("%+v", *conn)
+	state.mu.Lock()
+	pc, found := state.conns[key]
+	if !found {
+		pc = &playConnection{ready: make(chan struct{})}
+		state.conns[key] = pc
+	}
+	state.mu.Unlock()
+
+	if !found {
+		if pc.client, pc.err = conn.Connect(); pc.err != nil {
+			// Failed connection is not cached to try again with the next task
+			state.mu.Lock()
+			delete(state.conns, key)
+			state.mu.Unlock()
+		}
+		close(pc.ready)
+	} else {
+		select {
+		case <-pc.ready:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+	if pc.err != nil {
+		return nil, nil, pc.err
+	}
+	return pc.client, func() {}, nil
+}
+
+// Closes the connections opened during the play
+func (s *playState) closeConnections() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = make(map[string]*playConnection)
+	s.mu.Unlock()
+
+	for _, pc := range conns {
+		<-pc.ready
+		if pc.client != nil {
+			pc.client.Close()
+		}
+	}
+}
+
+// Returns the SSH host key checking settings, the checking could be boolean like in Ansible or
+// one of the modes, pinned fingerprints are set as list or comma separated string
+func hostKeyFromVars(vars map[string]any) (out ssh.HostKeyConfig, err error) {
+	out.Mode = ssh.HostKeyStrict
+	if val, key := varFirst(vars, "ansible_ssh_host_key_checking", "ansible_host_key_checking"); key != "" {
+		switch mode := strings.ToLower(fmt.Sprintf("%v", val)); mode {
+		case "true", "yes", "on", "1", ssh.HostKeyStrict:
+			out.Mode = ssh.HostKeyStrict
+		case "false", "no", "off", "0", ssh.HostKeyIgnore:
+			out.Mode = ssh.HostKeyIgnore
+		case ssh.HostKeyAcceptNew, "tofu":
+			out.Mode = ssh.HostKeyAcceptNew
+		default:
+			return out, fmt.Errorf("Unknown host key checking %q in var %q", val, key)
+		}
+	}
+
+	out.KnownHostsFile, _ = varString(vars, "ansible_ssh_known_hosts_file")
+
+	switch fps := vars["ansible_ssh_host_key_fingerprint"].(type) {
+	case string:
+		for _, fp := range strings.Split(fps, ",") {
+			if fp = strings.TrimSpace(fp); fp != "" {
+				out.Fingerprints = append(out.Fingerprints, fp)
+			}
+		}
+	case []any:
+		for _, fp := range fps {
+			out.Fingerprints = append(out.Fingerprints, fmt.Sprintf("%v", fp))
+		}
+	}
+
+	return out, nil
+}
+
+// Returns the WinRM settings from the vars, the port is zero if not set. Like in Ansible the
+// scheme is https unless the port is 5985 and the kerberos transport is used by default for `user@REALM` users.
+func winrmFromVars(vars map[string]any, user string, port int) (out winrm.Config, err error) {
+	out.HTTPS = true
+	if scheme, key := varString(vars, "ansible_winrm_scheme"); key != "" {
+		switch strings.ToLower(scheme) {
+		case "http":
+			out.HTTPS = false
+		case "https":
+		default:
+			return out, fmt.Errorf("Unknown scheme %q in var %q", scheme, key)
+		}
+	} else if port == 5985 {
+		out.HTTPS = false
+	}
+
+	out.Transport = winrm.AuthNTLM
+	if strings.Contains(user, "@") {
+		out.Transport = winrm.AuthKerberos
+	}
+	// Transport could be set as list or comma separated string, only the first one is used
+	switch val := vars["ansible_winrm_transport"].(type) {
+	case string:
+		if val = strings.TrimSpace(strings.Split(val, ",")[0]); val != "" {
+			out.Transport = strings.ToLower(val)
+		}
+	case []any:
+		if len(val) > 0 {
+			out.Transport = strings.ToLower(fmt.Sprintf("%v", val[0]))
+		}
+	}
+	switch out.Transport {
+	case winrm.AuthBasic, winrm.AuthNTLM, winrm.AuthKerberos, winrm.AuthCertificate:
+	case "plaintext", "ssl":
+		// Old pywinrm names of basic auth
+		out.Transport = winrm.AuthBasic
+	default:
+		return out, fmt.Errorf("Unknown transport %q in var %q", out.Transport, "ansible_winrm_transport")
+	}
+
+	if val, key := varString(vars, "ansible_winrm_server_cert_validation"); key != "" {
+		switch strings.ToLower(val) {
+		case "validate":
+		case "ignore":
+			out.Insecure = true
+		default:
+			return out, fmt.Errorf("Unknown cert validation %q in var %q", val, key)
+		}
+	}
+	out.CACertPath, _ = varString(vars, "ansible_winrm_ca_trust_path")
+	out.CertFile, _ = varString(vars, "ansible_winrm_cert_pem")
+	out.CertKeyFile, _ = varString(vars, "ansible_winrm_cert_key_pem")
+
+	if val, key := varString(vars, "ansible_winrm_message_encryption"); key != "" {
+		switch out.MessageEncryption = strings.ToLower(val); out.MessageEncryption {
+		case winrm.EncryptionAuto, winrm.EncryptionAlways, winrm.EncryptionNever:
+		default:
+			return out, fmt.Errorf("Unknown message encryption %q in var %q", val, key)
+		}
+	}
+
+	// Service principal is `<service>/<host>`, the host is the connection address by default
+	service, _ := varString(vars, "ansible_winrm_service")
+	spn_host, _ := varString(vars, "ansible_winrm_kerberos_hostname_override")
+	if service != "" || spn_host != "" {
+		if service == "" {
+			service = "HTTP"
+		}
+		if spn_host == "" {
+			spn_host, _ = varString(vars, "ansible_winrm_host", "ansible_host", "inventory_hostname")
+		}
+		out.KerberosSPN = service + "/" + spn_host
+	}
+
+	for key, dst := range map[string]*time.Duration{
+		"ansible_winrm_operation_timeout_sec": &out.OperationTimeout,
+		"ansible_winrm_read_timeout_sec":      &out.ReadTimeout,
+	} {
+		if val, ok := vars[key]; ok && val != nil && val != "" {
+			seconds, err := varInt(val)
+			if err != nil || seconds <= 0 {
+				return out, fmt.Errorf("Bad timeout %v in var %q", val, key)
+			}
+			*dst = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return out, nil
+}
+
+// Returns the ssh client args from the vars, the extra args are going first since ssh uses
+// the first obtained value of the option
+func sshArgsFromVars(vars map[string]any) (out []string, err error) {
+	for _, key := range []string{"ansible_ssh_extra_args", "ansible_ssh_common_args"} {
+		val, _ := varString(vars, key)
+		if val == "" {
+			continue
+		}
+		args, err := shellwords.Parse(val)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse var %q: %v", key, err)
+		}
+		out = append(out, args...)
+	}
+	return out, nil
+}
+
+// Returns the value of the ssh option from the args set as `-o Name=value`, `-o "Name value"`
+// or with the short flag (like `-J value`) if it's not empty
+func sshArgOption(args []string, flag, name string) string {
+	for i := 0; i < len(args); i++ {
+		var opt string
+		switch arg := args[i]; {
+		case arg == "-o" || flag != "" && arg == flag:
+			if i+1 >= len(args) {
+				return ""
+			}
+			i++
+			if arg == flag {
+				return args[i]
+			}
+			opt = args[i]
+		case flag != "" && strings.HasPrefix(arg, flag):
+			return arg[len(flag):]
+		case strings.HasPrefix(arg, "-o"):
+			opt = arg[2:]
+		default:
+			continue
+		}
+		parts := strings.FieldsFunc(opt, func(r rune) bool { return r == '=' || r == ' ' || r == '\t' })
+		if len(parts) == 2 && strings.EqualFold(parts[0], name) {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+// Returns the keepalive settings from the ssh args, zero interval disables the keepalives like
+// in OpenSSH
+func keepaliveFromArgs(args []string) (interval time.Duration, count_max int, err error) {
+	if val := sshArgOption(args, "", "ServerAliveInterval"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err != nil || seconds < 0 {
+			return 0, 0, fmt.Errorf("Bad ServerAliveInterval %q in ssh args", val)
+		}
+		interval = time.Duration(seconds) * time.Second
+		if seconds == 0 {
+			interval = -1
+		}
+	}
+	if val := sshArgOption(args, "", "ServerAliveCountMax"); val != "" {
+		if count_max, err = strconv.Atoi(val); err != nil || count_max < 1 {
+			return 0, 0, fmt.Errorf("Bad ServerAliveCountMax %q in ssh args", val)
+		}
+	}
+	return interval, count_max, nil
+}
+
+// Returns the value of the first found var and its name
+func varFirst(vars map[string]any, keys ...string) (any, string) {
+	for _, key := range keys {
+		if val, ok := vars[key]; ok && val != nil && val != "" {
+			return val, key
+		}
+	}
+	return nil, ""
+}
+
+// Returns the first found var as string and its name
+func varString(vars map[string]any, keys ...string) (string, string) {
+	val, key := varFirst(vars, keys...)
+	if key == "" {
+		return "", ""
+	}
+	return fmt.Sprintf("%v", val), key
+}
+
+// Inventory vars are strings, but yaml and extra vars could contain numbers
+func varInt(val any) (int, error) {
+	switch v := val.(type) {
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case uint64:
+		return int(v), nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("%v is not an integer", v)
+		}
+		return int(v), nil
+	case string:
+		out, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return 0, fmt.Errorf("%q is not an integer", v)
+		}
+		return out, nil
+	}
+	return 0, fmt.Errorf("%v of type %T is not an integer", val, val)
+}
@@ -0,0 +1,36 @@
+package ansible
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConnectionFromVarsIdentityFiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := "Host withkey\n  IdentityFile ~/.ssh/custom_key\n"
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "config"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Identity file of ssh_config is the credentials source
+	conn, err := ConnectionFromVars(map[string]any{"inventory_hostname": "withkey", "ansible_user": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{filepath.Join(home, ".ssh", "custom_key")}; !reflect.DeepEqual(conn.IdentityFiles, expected) {
+		t.Errorf("Identity files are %q, expected %q", conn.IdentityFiles, expected)
+	}
+
+	_, err = ConnectionFromVars(map[string]any{"inventory_hostname": "other", "ansible_user": "test"})
+	if err == nil || !strings.Contains(err.Error(), "ansible_ssh_private_key_file") {
+		t.Errorf("Expected missing credentials error, got: %v", err)
+	}
+}
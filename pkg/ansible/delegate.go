@@ -0,0 +1,244 @@
+package ansible
+
+// Delegation of the tasks to the other hosts and running the tasks once for the batch
+// Doc: https://docs.ansible.com/ansible/2.9/user_guide/playbooks_delegation.html
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/inventory"
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+	"github.com/state-of-the-art/ansiblego/pkg/template"
+)
+
+// Internal var marking the tasks of the run_once block
+const run_once_var = "_ansible_run_once"
+
+// Vars describing the connection, the ones ending with `_` are prefixes. When the task is
+// delegated they are taken from the delegated host instead of the target one.
+var connection_vars = []string{
+	"ansible_connection",
+	"ansible_host",
+	"ansible_port",
+	"ansible_user",
+	"ansible_password",
+	"ansible_private_key_file",
+	"ansible_ssh_",
+	"ansible_winrm_",
+	"ansible_shell_",
+}
+
+func isConnectionVar(key string) bool {
+	for _, name := range connection_vars {
+		if key == name || strings.HasSuffix(name, "_") && strings.HasPrefix(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// State of the play shared between the hosts, the tasks are receiving it through the context
+type playState struct {
+	inventory *inventory.Inventory
+	// Names of the hosts the play is running on
+	hosts map[string]bool
+
+	mu sync.Mutex
+	// Results of the run_once tasks in the current batch
+	once map[*Task]*onceResult
+	// Results with facts delegated to the hosts, applied before the next step of the host
+	facts map[string][]OrderedMap
+	// Connections to the hosts reused by the tasks
+	conns map[string]*playConnection
+}
+
+type onceResult struct {
+	done chan struct{}
+	data OrderedMap
+	err  error
+}
+
+type playStateKey struct{}
+
+func newPlayState(inv *inventory.Inventory, hosts []*inventory.Host) *playState {
+	out := &playState{
+		inventory: inv,
+		hosts:     make(map[string]bool, len(hosts)),
+		once:      make(map[*Task]*onceResult),
+		facts:     make(map[string][]OrderedMap),
+		conns:     make(map[string]*playConnection),
+	}
+	for _, host := range hosts {
+		out.hosts[host.Name] = true
+	}
+	return out
+}
+
+func withPlayState(ctx context.Context, state *playState) context.Context {
+	return context.WithValue(ctx, playStateKey{}, state)
+}
+
+// Returns the play state or nil if the task is executed outside of the play (by agent)
+func playStateFrom(ctx context.Context) *playState {
+	state, _ := ctx.Value(playStateKey{}).(*playState)
+	return state
+}
+
+// The run_once tasks are executed again in the next serial batch
+func (s *playState) newBatch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.once = make(map[*Task]*onceResult)
+}
+
+// Runs the task by the first host reaching it, the other hosts are waiting and getting the result
+func (s *playState) runOnce(ctx context.Context, t *Task, vars map[string]any) (data OrderedMap, err error) {
+	s.mu.Lock()
+	res, found := s.once[t]
+	if !found {
+		res = &onceResult{done: make(chan struct{})}
+		s.once[t] = res
+	}
+	s.mu.Unlock()
+
+	if !found {
+		res.data, res.err = t.runModule(ctx, vars)
+		close(res.done)
+		return res.data, res.err
+	}
+
+	select {
+	case <-res.done:
+	case <-ctx.Done():
+		return data, ctx.Err()
+	}
+	log.Debugf("Using the result of run_once task '%s'", t.Name)
+	if res.err == nil {
+		t.applyResult(ctx, res.data, vars)
+	}
+	return res.data, res.err
+}
+
+func (s *playState) delegateFacts(host string, data OrderedMap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.facts[host] = append(s.facts[host], data)
+}
+
+// Sets the facts delegated to the host by the other hosts tasks
+func (s *playState) applyDelegatedFacts(host string, vars map[string]any) {
+	s.mu.Lock()
+	results := s.facts[host]
+	delete(s.facts, host)
+	s.mu.Unlock()
+
+	for _, data := range results {
+		applyFacts(data, vars)
+	}
+}
+
+// Returns the delegated host name or empty string if the task is not delegated
+func (t *Task) delegateHost(vars map[string]any) (string, error) {
+	if t.Delegate_to.IsEmpty() {
+		return "", nil
+	}
+	name := t.Delegate_to.String()
+	if template.IsTemplate(name) {
+		var err error
+		if name, err = template.Process(name, vars); err != nil {
+			return "", fmt.Errorf("Unable to render delegate_to: %v", err)
+		}
+	}
+	return strings.TrimSpace(name), nil
+}
+
+// Returns the vars to execute the task with the connection vars of the delegated host
+func (t *Task) delegateVars(ctx context.Context, host string, vars map[string]any) map[string]any {
+	out := make(map[string]any, len(vars))
+	for key, val := range vars {
+		if !isConnectionVar(key) {
+			out[key] = val
+		}
+	}
+	out["ansible_connection"] = "ssh"
+
+	var found *inventory.Host
+	if state := playStateFrom(ctx); state != nil && state.inventory != nil {
+		found = state.inventory.Hosts[host]
+	}
+	if found == nil {
+		// Implicit host which is not in the inventory
+		log.Debugf("Delegated host '%s' is not in inventory, using it as address", host)
+		out["ansible_host"] = host
+	} else {
+		for key, val := range found.Vars {
+			out[key] = val
+		}
+		// Inventory name is the address of the delegated host, not the target inventory_hostname
+		if found.Vars["ansible_host"] == "" && found.Vars["ansible_ssh_host"] == "" {
+			out["ansible_host"] = host
+		}
+	}
+	// Implicit localhost is executed without connection like Ansible does
+	if (host == "localhost" || host == "127.0.0.1") && (found == nil || found.Vars["ansible_connection"] == "") {
+		out["ansible_connection"] = "local"
+	}
+
+	return out
+}
+
+// Applies the facts from the task result to the target host or to the delegated one
+func (t *Task) applyResult(ctx context.Context, data OrderedMap, vars map[string]any) {
+	if t.Delegate_facts.Val() {
+		host, err := t.delegateHost(vars)
+		state := playStateFrom(ctx)
+		if err == nil && host != "" && host != vars["inventory_hostname"] && state != nil {
+			// Facts are applied to the vars of the play hosts only, so the other hosts can't get them
+			if !state.hosts[host] {
+				reason := "not in the play"
+				if state.inventory == nil || state.inventory.Hosts[host] == nil {
+					reason = "not in the inventory"
+				}
+				log.Warnf("Dropping facts of task '%s' delegated to host '%s': the host is %s", t.Name, host, reason)
+				return
+			}
+			log.Debugf("Delegating facts of task '%s' to host '%s'", t.Name, host)
+			state.delegateFacts(host, data)
+			return
+		}
+	}
+	applyFacts(data, vars)
+}
+
+// Converts the `local_action` value to the module name and args delegated to localhost
+func parseLocalAction(node *yaml.Node) (name string, args any, err error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		// Free form: `local_action: command echo hello`
+		parts := strings.SplitN(strings.TrimSpace(node.Value), " ", 2)
+		name = parts[0]
+		if len(parts) > 1 {
+			args = strings.TrimSpace(parts[1])
+		}
+	case yaml.MappingNode:
+		// Map form: `local_action: {module: copy, src: a, dest: b}`
+		var fmap OrderedMap
+		if err = node.Decode(&fmap); err != nil {
+			return
+		}
+		module, _ := fmap.Pop("module")
+		name, _ = module.(string)
+		args = fmap
+	default:
+		return "", nil, fmt.Errorf("The 'local_action' must be string or map")
+	}
+	if name == "" {
+		return "", nil, fmt.Errorf("Unable to find module name in 'local_action'")
+	}
+	return name, args, nil
+}
@@ -0,0 +1,78 @@
+package ansible
+
+import (
+	"context"
+	"testing"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/inventory"
+)
+
+func TestApplyResultDelegateFacts(t *testing.T) {
+	inv, err := inventory.ReadHostList("host1,host2,host3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := newPlayState(inv, []*inventory.Host{inv.Hosts["host1"], inv.Hosts["host2"]})
+	ctx := withPlayState(context.Background(), state)
+
+	var facts, data OrderedMap
+	facts.Set("test_fact", "value")
+	data.Set("ansible_facts", facts)
+
+	for host, delegated := range map[string]bool{"host2": true, "host3": false, "unknown": false} {
+		task := &Task{Delegate_to: NewTString(host), Delegate_facts: NewTBool(true)}
+		vars := map[string]any{"inventory_hostname": "host1"}
+		task.applyResult(ctx, data, vars)
+
+		if _, ok := vars["test_fact"]; ok {
+			t.Errorf("Facts delegated to %q are applied to the target host", host)
+		}
+		if _, ok := state.facts[host]; ok != delegated {
+			t.Errorf("Facts delegated to %q are stored: %v, expected: %v", host, ok, delegated)
+		}
+	}
+
+	vars := map[string]any{}
+	state.applyDelegatedFacts("host2", vars)
+	if vars["test_fact"] != "value" {
+		t.Errorf("Delegated facts are not applied to host2: %v", vars)
+	}
+}
+
+func TestDelegateVarsConnection(t *testing.T) {
+	inv, err := inventory.ReadHostList("host1,host2,host3,host4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.Hosts["host3"].Vars["ansible_host"] = "10.0.0.3"
+	inv.Hosts["host4"].Vars["ansible_ssh_host"] = "10.0.0.4"
+	state := newPlayState(inv, []*inventory.Host{inv.Hosts["host1"]})
+	ctx := withPlayState(context.Background(), state)
+	// Agent is the credentials source of the delegated hosts without the connection vars
+	t.Setenv("SSH_AUTH_SOCK", "/nonexistent/agent.sock")
+
+	for host, expected := range map[string]string{
+		"host2":    "host2",
+		"host3":    "10.0.0.3",
+		"host4":    "10.0.0.4",
+		"10.0.0.9": "10.0.0.9",
+	} {
+		vars := map[string]any{
+			"inventory_hostname": "host1",
+			"ansible_connection": "ssh",
+			"ansible_host":       "192.168.0.1",
+			"ansible_user":       "target",
+		}
+		task := &Task{Delegate_to: NewTString(host)}
+		conn, err := ConnectionFromVars(task.delegateVars(ctx, host, vars))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.Host != expected {
+			t.Errorf("Task delegated to %q connects to %q, expected %q", host, conn.Host, expected)
+		}
+		if conn.User == "target" {
+			t.Errorf("Task delegated to %q uses the target host user", host)
+		}
+	}
+}
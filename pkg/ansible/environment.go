@@ -0,0 +1,129 @@
+package ansible
+
+// The environment is merged play -> role -> block -> task and passed to the executed commands
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/state-of-the-art/ansiblego/pkg/template"
+)
+
+// Internal var containing the merged environment, values are rendered right before the execution
+const environment_var = "_ansible_environment"
+
+// Sets the var and returns function to restore the previous value
+func overrideVar(vars map[string]any, key string, val any) func() {
+	prev, ok := vars[key]
+	vars[key] = val
+	return func() {
+		if ok {
+			vars[key] = prev
+		} else {
+			delete(vars, key)
+		}
+	}
+}
+
+// Returns the environment from vars merged with the additional variables
+func mergeEnvironment(vars map[string]any, env map[string]string) map[string]any {
+	out := map[string]any{}
+	if prev, ok := vars[environment_var].(map[string]any); ok {
+		for key, val := range prev {
+			out[key] = val
+		}
+	}
+	for key, val := range env {
+		out[key] = val
+	}
+	return out
+}
+
+// Converts the play or role environment map to strings
+func orderedMapEnvironment(m *OrderedMap) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, m.Size())
+	for _, key := range m.Keys() {
+		val, _ := m.Get(key)
+		out[key] = fmt.Sprintf("%v", val)
+	}
+	return out
+}
+
+// Converts the task environment map to strings, templates are kept as is
+func (t *Task) environment() map[string]string {
+	if t.Environment == nil {
+		return nil
+	}
+	out := make(map[string]string, len(*t.Environment))
+	for key, val := range *t.Environment {
+		out[key.String()] = val.String()
+	}
+	return out
+}
+
+// Returns the environment for the task rendered with the vars
+func TaskV1Environment(vars map[string]any) (map[string]string, error) {
+	raw, _ := vars[environment_var].(map[string]any)
+	out := make(map[string]string, len(raw))
+	for key, val := range raw {
+		str := fmt.Sprintf("%v", val)
+		if template.IsTemplate(str) {
+			var err error
+			if str, err = template.Process(str, vars); err != nil {
+				return nil, fmt.Errorf("Unable to render environment variable %q: %v", key, err)
+			}
+		}
+		out[key] = str
+	}
+	return out, nil
+}
+
+// Returns the process environment with the task environment applied to use in exec.Cmd.Env
+func TaskV1Environ(vars map[string]any) ([]string, error) {
+	env, err := TaskV1Environment(vars)
+	if err != nil {
+		return nil, err
+	}
+	return environ(env), nil
+}
+
+func environ(env map[string]string) []string {
+	out := os.Environ()
+	for _, key := range environmentKeys(env) {
+		out = append(out, key+"="+env[key])
+	}
+	return out
+}
+
+// Prepends the environment to the command line executed on the remote system
+func environmentCommand(kernel string, env map[string]string, cmd string) string {
+	if len(env) == 0 {
+		return cmd
+	}
+	var parts []string
+	if kernel == "windows" {
+		for _, key := range environmentKeys(env) {
+			parts = append(parts, fmt.Sprintf("set \"%s=%s\"", key, env[key]))
+		}
+		return strings.Join(append(parts, cmd), " && ")
+	}
+	parts = append(parts, "env")
+	for _, key := range environmentKeys(env) {
+		parts = append(parts, shellQuote(key+"="+env[key]))
+	}
+	return strings.Join(append(parts, cmd), " ")
+}
+
+func environmentKeys(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,33 @@
+package windows_env
+
+// Doc: https://github.com/ansible/ansible/blob/stable-2.9/lib/ansible/modules/windows/setup.ps1
+
+import (
+	"strings"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible"
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+	"github.com/state-of-the-art/ansiblego/pkg/sysinfo"
+)
+
+func Collect() (data ansible.OrderedMap) {
+	if !sysinfo.IsWindows() {
+		log.Debug("Skipping windows env facts collecting: Not a windows system")
+		return
+	}
+
+	var env ansible.OrderedMap
+	for _, kv := range sysinfo.Environ() {
+		// Windows has special variables like `=C:` which are not useful as facts
+		if strings.HasPrefix(kv, "=") {
+			continue
+		}
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) == 2 {
+			env.Set(pair[0], pair[1])
+		}
+	}
+	data.Set("env", env)
+
+	return data
+}
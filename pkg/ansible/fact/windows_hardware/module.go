@@ -0,0 +1,57 @@
+package windows_hardware
+
+// Doc: https://github.com/ansible/ansible/blob/stable-2.9/lib/ansible/modules/windows/setup.ps1
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible"
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+	"github.com/state-of-the-art/ansiblego/pkg/sysinfo"
+)
+
+func Collect() (data ansible.OrderedMap) {
+	if !sysinfo.IsWindows() {
+		log.Debug("Skipping windows hardware facts collecting: Not a windows system")
+		return
+	}
+
+	if cs_list, err := sysinfo.WMIQuery("Win32_ComputerSystem", "", []string{"TotalPhysicalMemory", "NumberOfProcessors", "NumberOfLogicalProcessors", "Manufacturer", "Model"}); err == nil && len(cs_list) > 0 {
+		cs := cs_list[0]
+		// Memory is returned in bytes, sometimes as string because of uint64 in json
+		if mem, err := strconv.ParseFloat(fmt.Sprintf("%v", cs["TotalPhysicalMemory"]), 64); err == nil {
+			data.Set("memtotal_mb", int64(mem)/1024/1024)
+		}
+		data.Set("processor_count", cs["NumberOfProcessors"])
+		data.Set("processor_vcpus", cs["NumberOfLogicalProcessors"])
+		data.Set("system_vendor", cs["Manufacturer"])
+		data.Set("product_name", cs["Model"])
+	} else if err != nil {
+		log.Debugf("Unable to get windows computer system info: %v", err)
+	}
+
+	if cpu_list, err := sysinfo.WMIQuery("Win32_Processor", "", []string{"Name", "NumberOfCores", "NumberOfLogicalProcessors"}); err == nil {
+		var processor []any
+		cores := 0
+		for i, cpu := range cpu_list {
+			processor = append(processor, strconv.Itoa(i), fmt.Sprintf("%v", cpu["Name"]))
+			if n, err := strconv.Atoi(fmt.Sprintf("%v", cpu["NumberOfCores"])); err == nil {
+				cores += n
+			}
+		}
+		data.Set("processor", processor)
+		data.Set("processor_cores", cores)
+	} else {
+		log.Debugf("Unable to get windows processor info: %v", err)
+	}
+
+	if bios_list, err := sysinfo.WMIQuery("Win32_Bios", "", []string{"SerialNumber", "SMBIOSBIOSVersion"}); err == nil && len(bios_list) > 0 {
+		data.Set("product_serial", bios_list[0]["SerialNumber"])
+		data.Set("bios_version", bios_list[0]["SMBIOSBIOSVersion"])
+	} else if err != nil {
+		log.Debugf("Unable to get windows bios info: %v", err)
+	}
+
+	return data
+}
@@ -0,0 +1,70 @@
+package windows_network
+
+// Doc: https://github.com/ansible/ansible/blob/stable-2.9/lib/ansible/modules/windows/setup.ps1
+
+import (
+	"fmt"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible"
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+	"github.com/state-of-the-art/ansiblego/pkg/sysinfo"
+)
+
+func Collect() (data ansible.OrderedMap) {
+	if !sysinfo.IsWindows() {
+		log.Debug("Skipping windows network facts collecting: Not a windows system")
+		return
+	}
+
+	adapters, err := sysinfo.WMIQuery("Win32_NetworkAdapterConfiguration", "IPEnabled = True",
+		[]string{"Description", "InterfaceIndex", "MACAddress", "IPAddress", "DefaultIPGateway", "DNSDomain"})
+	if err != nil {
+		log.Debugf("Skipping windows network facts collecting: %v", err)
+		return
+	}
+
+	// Connection names are not in the adapter configuration, so mapping them by the index
+	conn_names := map[string]string{}
+	if nics, err := sysinfo.WMIQuery("Win32_NetworkAdapter", "NetEnabled = True", []string{"InterfaceIndex", "NetConnectionID"}); err == nil {
+		for _, nic := range nics {
+			conn_names[fmt.Sprintf("%v", nic["InterfaceIndex"])] = fmt.Sprintf("%v", nic["NetConnectionID"])
+		}
+	}
+
+	var interfaces []any
+	var ip_addresses []any
+	for _, adapter := range adapters {
+		var iface ansible.OrderedMap
+		index := fmt.Sprintf("%v", adapter["InterfaceIndex"])
+		iface.Set("connection_name", conn_names[index])
+		iface.Set("default_gateway", firstItem(adapter["DefaultIPGateway"]))
+		iface.Set("dns_domain", adapter["DNSDomain"])
+		iface.Set("interface_index", adapter["InterfaceIndex"])
+		iface.Set("interface_name", adapter["Description"])
+		iface.Set("macaddress", adapter["MACAddress"])
+		interfaces = append(interfaces, iface)
+
+		// Single address is not returned as list by ConvertTo-Json
+		switch addrs := adapter["IPAddress"].(type) {
+		case []any:
+			ip_addresses = append(ip_addresses, addrs...)
+		case string:
+			ip_addresses = append(ip_addresses, addrs)
+		}
+	}
+
+	data.Set("interfaces", interfaces)
+	data.Set("ip_addresses", ip_addresses)
+
+	return data
+}
+
+func firstItem(val any) any {
+	if lst, ok := val.([]any); ok {
+		if len(lst) > 0 {
+			return lst[0]
+		}
+		return nil
+	}
+	return val
+}
@@ -0,0 +1,111 @@
+package windows_os
+
+// Doc: https://github.com/ansible/ansible/blob/stable-2.9/lib/ansible/modules/windows/setup.ps1
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible"
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+	"github.com/state-of-the-art/ansiblego/pkg/sysinfo"
+)
+
+const (
+	key_current_version = `SOFTWARE\Microsoft\Windows NT\CurrentVersion`
+	key_environment     = `SYSTEM\CurrentControlSet\Control\Session Manager\Environment`
+	key_powershell      = `SOFTWARE\Microsoft\PowerShell\3\PowerShellEngine`
+)
+
+func Collect() (data ansible.OrderedMap) {
+	if !sysinfo.IsWindows() {
+		log.Debug("Skipping windows os facts collecting: Not a windows system")
+		return
+	}
+
+	data.Set("os_family", "Windows")
+	data.Set("system", "Win32NT")
+
+	product_name, _ := sysinfo.RegistryGetString(key_current_version, "ProductName")
+	data.Set("distribution", product_name)
+	data.Set("os_name", product_name)
+
+	// Windows 10+ has the major/minor numbers, the older ones have just version string
+	version, _ := sysinfo.RegistryGetString(key_current_version, "CurrentVersion")
+	if major, err := sysinfo.RegistryGetInteger(key_current_version, "CurrentMajorVersionNumber"); err == nil {
+		minor, _ := sysinfo.RegistryGetInteger(key_current_version, "CurrentMinorVersionNumber")
+		version = fmt.Sprintf("%d.%d", major, minor)
+	}
+	build, _ := sysinfo.RegistryGetString(key_current_version, "CurrentBuildNumber")
+	revision, _ := sysinfo.RegistryGetInteger(key_current_version, "UBR")
+	full_version := fmt.Sprintf("%s.%s.%d", version, build, revision)
+	data.Set("distribution_version", full_version)
+	data.Set("distribution_major_version", strings.Split(version, ".")[0])
+	data.Set("kernel", full_version)
+	if release, err := sysinfo.RegistryGetString(key_current_version, "DisplayVersion"); err == nil {
+		data.Set("distribution_release", release)
+	}
+
+	// Product type is not in registry in a usable form, so getting it from WMI
+	if os_list, err := sysinfo.WMIQuery("Win32_OperatingSystem", "", []string{"ProductType"}); err == nil && len(os_list) > 0 {
+		product_type := "unknown"
+		switch fmt.Sprintf("%v", os_list[0]["ProductType"]) {
+		case "1":
+			product_type = "workstation"
+		case "2":
+			product_type = "domain_controller"
+		case "3":
+			product_type = "server"
+		}
+		data.Set("os_product_type", product_type)
+	} else if err != nil {
+		log.Debugf("Unable to get windows product type: %v", err)
+	}
+
+	if arch, err := sysinfo.RegistryGetString(key_environment, "PROCESSOR_ARCHITECTURE"); err == nil {
+		data.Set("architecture", windowsArchitecture(arch))
+		data.Set("machine", strings.ToLower(arch))
+	}
+
+	// Computer and domain names
+	if cs_list, err := sysinfo.WMIQuery("Win32_ComputerSystem", "", []string{"Name", "DNSHostName", "Domain", "PartOfDomain"}); err == nil && len(cs_list) > 0 {
+		cs := cs_list[0]
+		hostname := fmt.Sprintf("%v", cs["DNSHostName"])
+		if cs["DNSHostName"] == nil || hostname == "" {
+			hostname = fmt.Sprintf("%v", cs["Name"])
+		}
+		domain := ""
+		if cs["Domain"] != nil {
+			domain = fmt.Sprintf("%v", cs["Domain"])
+		}
+		fqdn := hostname
+		if domain != "" && domain != "WORKGROUP" {
+			fqdn = hostname + "." + domain
+		}
+		data.Set("hostname", hostname)
+		data.Set("nodename", fqdn)
+		data.Set("fqdn", fqdn)
+		data.Set("domain", domain)
+		data.Set("windows_domain", domain)
+		data.Set("windows_domain_member", cs["PartOfDomain"] == true)
+		data.Set("netbios_name", fmt.Sprintf("%v", cs["Name"]))
+	} else if err != nil {
+		log.Debugf("Unable to get windows computer system info: %v", err)
+	}
+
+	// PowerShell 1 & 2 are using separated key, but they are too old to care
+	if ps_version, err := sysinfo.RegistryGetString(key_powershell, "PowerShellVersion"); err == nil {
+		data.Set("powershell_version", strings.Split(ps_version, ".")[0])
+	}
+
+	return data
+}
+
+// Ansible uses bitness here instead of the processor architecture
+func windowsArchitecture(arch string) string {
+	switch strings.ToUpper(arch) {
+	case "AMD64", "ARM64", "IA64":
+		return "64-bit"
+	}
+	return "32-bit"
+}
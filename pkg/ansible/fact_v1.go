@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"time"
 
 	"github.com/cosmos72/gomacro/fast"
 
@@ -12,6 +13,10 @@ import (
 )
 
 func factInterp(name string) (*fast.Interp, error) {
+	mu := moduleCreateLock("fact", name)
+	mu.Lock()
+	defer mu.Unlock()
+
 	// Looking in cache first
 	interp := ModuleGetCache("fact", name)
 	if interp != nil {
@@ -85,6 +90,10 @@ func CollectV1(name string) (out *OrderedMap, err error) {
 		return nil, err
 	}
 
+	mu := ModuleLock(interp)
+	mu.Lock()
+	defer mu.Unlock()
+
 	fact_data, _ := interp.Eval1("Collect()")
 	if err != nil { // Could be an error after interp.Eval1 panic
 		return nil, fmt.Errorf("Fact '%s' can't execute Collect(): %s", name, err)
@@ -96,3 +105,30 @@ func CollectV1(name string) (out *OrderedMap, err error) {
 
 	return &fact_map, nil
 }
+
+// Runs the fact collector, but gives up waiting for it after timeout. Gomacro interp can't be
+// interrupted so the collector could still run in background and its result will be dropped,
+// the interp it occupies is removed from cache so the next collecting will not wait for it.
+func CollectV1Timeout(name string, timeout time.Duration) (*OrderedMap, error) {
+	if timeout <= 0 {
+		return CollectV1(name)
+	}
+
+	type result struct {
+		out *OrderedMap
+		err error
+	}
+	res_ch := make(chan result, 1)
+	go func() {
+		out, err := CollectV1(name)
+		res_ch <- result{out, err}
+	}()
+
+	select {
+	case res := <-res_ch:
+		return res.out, res.err
+	case <-time.After(timeout):
+		ModuleDropCache("fact", name)
+		return nil, fmt.Errorf("Fact '%s' collecting timed out after %v", name, timeout)
+	}
+}
@@ -0,0 +1,140 @@
+package ansible
+
+// Useful utils for fact modules which is available through binding
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+	"github.com/state-of-the-art/ansiblego/pkg/util"
+)
+
+// Collects local facts from `*.fact` files located in fact_path. The executable files are
+// executed and their stdout is used, otherwise the file content is read. The data is parsed
+// as JSON first and as INI if it's not JSON. Each file becomes a key without `.fact` suffix.
+func FactV1Local(fact_path string, timeout time.Duration) (out OrderedMap, err error) {
+	if _, err := os.Stat(fact_path); os.IsNotExist(err) {
+		log.Debugf("Skipping local facts collecting: No fact path %q found", fact_path)
+		return out, nil
+	}
+
+	// Glob returns the sorted list so the order of facts is always the same
+	fact_files, err := filepath.Glob(filepath.Join(fact_path, "*.fact"))
+	if err != nil {
+		return out, fmt.Errorf("Unable to list local facts in %q: %v", fact_path, err)
+	}
+
+	for _, fact_file := range fact_files {
+		info, err := os.Stat(fact_file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(fact_file), ".fact")
+
+		var content string
+		if info.Mode()&0111 != 0 {
+			log.Debugf("Executing local fact script %q", fact_file)
+			stdout, _, err := util.RunCommand(timeout, fact_file)
+			if err != nil {
+				log.Warnf("Failure executing local fact script %q: %v", fact_file, err)
+				out.Set(name, fmt.Sprintf("Failure executing fact script: %v", err))
+				continue
+			}
+			content = stdout
+		} else {
+			log.Debugf("Reading local fact file %q", fact_file)
+			data, err := os.ReadFile(fact_file)
+			if err != nil {
+				log.Warnf("Unable to read local fact file %q: %v", fact_file, err)
+				out.Set(name, fmt.Sprintf("error loading fact - unable to read file: %v", err))
+				continue
+			}
+			content = string(data)
+		}
+
+		out.Set(name, parseLocalFact(fact_file, content))
+	}
+
+	return out, nil
+}
+
+// Tries JSON and then INI to parse the local fact content
+func parseLocalFact(fact_file, content string) any {
+	if json.Valid([]byte(content)) {
+		// JSON is a subset of YAML, so using yaml decoder to get OrderedMap for objects
+		var node yaml.Node
+		if err := yaml.Unmarshal([]byte(content), &node); err == nil && len(node.Content) > 0 {
+			if node.Content[0].Kind == yaml.MappingNode {
+				var val OrderedMap
+				if err = node.Content[0].Decode(&val); err == nil {
+					return val
+				}
+			} else {
+				var val any
+				if err = node.Content[0].Decode(&val); err == nil {
+					return val
+				}
+			}
+		}
+	}
+
+	val, err := parseIni(content)
+	if err != nil {
+		log.Warnf("Unable to parse local fact file %q as JSON or INI: %v", fact_file, err)
+		return "error loading fact - please check content"
+	}
+
+	return val
+}
+
+// Simple INI parser for the local facts, the keys are lowercased like python ConfigParser does
+func parseIni(content string) (out OrderedMap, err error) {
+	var sections []string
+	section_data := map[string]*OrderedMap{}
+
+	var current *OrderedMap
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := section_data[name]; !ok {
+				sections = append(sections, name)
+				section_data[name] = &OrderedMap{}
+			}
+			current = section_data[name]
+			continue
+		}
+
+		if current == nil {
+			return out, fmt.Errorf("No section header found before line %d", i+1)
+		}
+
+		sep := strings.IndexAny(line, "=:")
+		if sep < 1 {
+			return out, fmt.Errorf("Unable to parse line %d: %q", i+1, line)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:sep]))
+		current.Set(key, strings.TrimSpace(line[sep+1:]))
+	}
+
+	if len(sections) == 0 {
+		return out, fmt.Errorf("No sections found")
+	}
+
+	for _, name := range sections {
+		out.Set(name, *section_data[name])
+	}
+
+	return out, nil
+}
@@ -0,0 +1,129 @@
+package ansible
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func iniSection(pairs ...string) (out OrderedMap) {
+	for i := 0; i < len(pairs); i += 2 {
+		out.Set(pairs[i], pairs[i+1])
+	}
+	return out
+}
+
+func TestParseIni(t *testing.T) {
+	for name, test := range map[string]struct {
+		content  string
+		expected []string
+		sections map[string]OrderedMap
+	}{
+		"simple": {
+			"[general]\nkey=value\n",
+			[]string{"general"},
+			map[string]OrderedMap{"general": iniSection("key", "value")},
+		},
+		"comments_and_colon": {
+			"# comment\n; other\n\n[Main]\nName : Value with = sign\nOther= spaced  \n",
+			[]string{"Main"},
+			map[string]OrderedMap{"Main": iniSection("name", "Value with = sign", "other", "spaced")},
+		},
+		"repeated_section": {
+			"[b]\nx=1\n[a]\ny=2\n[b]\nz=3\nx=4\n",
+			[]string{"b", "a"},
+			map[string]OrderedMap{"b": iniSection("x", "4", "z", "3"), "a": iniSection("y", "2")},
+		},
+		"empty_value": {
+			"[s]\nkey=\n",
+			[]string{"s"},
+			map[string]OrderedMap{"s": iniSection("key", "")},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			out, err := parseIni(test.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Keys(), test.expected) {
+				t.Errorf("Sections are %q, expected %q", out.Keys(), test.expected)
+			}
+			for section, expected := range test.sections {
+				val, _ := out.Get(section)
+				got, _ := val.(OrderedMap)
+				if !reflect.DeepEqual(got.Data(), expected.Data()) {
+					t.Errorf("Section %q is %v, expected %v", section, got.Data(), expected.Data())
+				}
+			}
+		})
+	}
+
+	for name, content := range map[string]string{
+		"no_section": "key=value\n[s]\n",
+		"no_sep":     "[s]\njust a line\n",
+		"no_key":     "[s]\n=value\n",
+		"empty":      "# only comment\n",
+	} {
+		if _, err := parseIni(content); err == nil {
+			t.Errorf("Bad ini %q is parsed", name)
+		}
+	}
+}
+
+func TestFactV1Local(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"json.fact":   `{"b": 1, "a": [1, 2]}`,
+		"ini.fact":    "[sec]\nkey=value\n",
+		"scalar.fact": `"just string"`,
+		"bad.fact":    "not ini or json",
+		"skip.txt":    "[sec]\nkey=value\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runtime.GOOS != "windows" {
+		if err := os.WriteFile(filepath.Join(dir, "exec.fact"), []byte("#!/bin/sh\necho '{\"generated\": true}'\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := FactV1Local(dir, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"bad", "ini", "json", "scalar"}
+	if runtime.GOOS != "windows" {
+		expected = []string{"bad", "exec", "ini", "json", "scalar"}
+	}
+	if !reflect.DeepEqual(out.Keys(), expected) {
+		t.Fatalf("Local facts are %q, expected %q", out.Keys(), expected)
+	}
+
+	val, _ := out.Get("json")
+	if json_fact, ok := val.(OrderedMap); !ok || !reflect.DeepEqual(json_fact.Keys(), []string{"b", "a"}) {
+		t.Errorf("JSON fact is %#v", val)
+	}
+	if val, _ = out.Get("scalar"); val != "just string" {
+		t.Errorf("Scalar fact is %#v", val)
+	}
+	if val, _ = out.Get("bad"); val != "error loading fact - please check content" {
+		t.Errorf("Bad fact is %#v", val)
+	}
+	if runtime.GOOS != "windows" {
+		val, _ = out.Get("exec")
+		if exec_fact, ok := val.(OrderedMap); !ok || exec_fact.Data()["generated"] != true {
+			t.Errorf("Executable fact is %#v", val)
+		}
+	}
+
+	// Missing fact path is not an error
+	if out, err = FactV1Local(filepath.Join(dir, "missing"), time.Second); err != nil || out.Size() != 0 {
+		t.Errorf("Missing fact path returned %v, %v", out.Data(), err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/cosmos72/gomacro/imports"
 
 	"github.com/state-of-the-art/ansiblego/pkg/log"
+	"github.com/state-of-the-art/ansiblego/pkg/sysinfo"
 	"github.com/state-of-the-art/ansiblego/pkg/template"
 	"github.com/state-of-the-art/ansiblego/pkg/util"
 )
@@ -35,8 +36,24 @@ func init() {
 	// Import util
 	imports.Packages["github.com/state-of-the-art/ansiblego/pkg/util"] = imports.Package{
 		Binds: map[string]reflect.Value{
-			"RunCommand":      reflect.ValueOf(util.RunCommand),
-			"RunCommandRetry": reflect.ValueOf(util.RunCommandRetry),
+			"RunCommand":         reflect.ValueOf(util.RunCommand),
+			"RunCommandRetry":    reflect.ValueOf(util.RunCommandRetry),
+			"RunCommandEnv":      reflect.ValueOf(util.RunCommandEnv),
+			"RunCommandRetryEnv": reflect.ValueOf(util.RunCommandRetryEnv),
+		},
+		Types:    map[string]reflect.Type{},
+		Proxies:  map[string]reflect.Type{},
+		Untypeds: map[string]string{},
+		Wrappers: map[string][]string{},
+	}
+
+	// Import sysinfo
+	imports.Packages["github.com/state-of-the-art/ansiblego/pkg/sysinfo"] = imports.Package{
+		Binds: map[string]reflect.Value{
+			"IsWindows":          reflect.ValueOf(sysinfo.IsWindows),
+			"RegistryGetString":  reflect.ValueOf(sysinfo.RegistryGetString),
+			"RegistryGetInteger": reflect.ValueOf(sysinfo.RegistryGetInteger),
+			"WMIQuery":           reflect.ValueOf(sysinfo.WMIQuery),
 		},
 		Types:    map[string]reflect.Type{},
 		Proxies:  map[string]reflect.Type{},
@@ -48,6 +65,7 @@ func init() {
 	imports.Packages["github.com/state-of-the-art/ansiblego/pkg/template"] = imports.Package{
 		Binds: map[string]reflect.Value{
 			"IsTemplate": reflect.ValueOf(template.IsTemplate),
+			"Process":    reflect.ValueOf(template.Process),
 		},
 		Types:    map[string]reflect.Type{},
 		Proxies:  map[string]reflect.Type{},
@@ -58,31 +76,50 @@ func init() {
 	// Import the TaskV1 interface
 	imports.Packages["github.com/state-of-the-art/ansiblego/pkg/ansible"] = imports.Package{
 		Binds: map[string]reflect.Value{
-			"CollectV1":     reflect.ValueOf(CollectV1),
-			"TaskV1SetData": reflect.ValueOf(TaskV1SetData),
-			"TaskV1GetData": reflect.ValueOf(TaskV1GetData),
-			"ModulesList":   reflect.ValueOf(ModulesList),
-			"ToYaml":        reflect.ValueOf(ToYaml),
+			"CollectV1":          reflect.ValueOf(CollectV1),
+			"CollectV1Timeout":   reflect.ValueOf(CollectV1Timeout),
+			"FactV1Local":        reflect.ValueOf(FactV1Local),
+			"TaskV1SetData":      reflect.ValueOf(TaskV1SetData),
+			"TaskV1GetData":      reflect.ValueOf(TaskV1GetData),
+			"TaskV1CheckMode":    reflect.ValueOf(TaskV1CheckMode),
+			"TaskV1DiffMode":     reflect.ValueOf(TaskV1DiffMode),
+			"TaskV1Diff":         reflect.ValueOf(TaskV1Diff),
+			"TaskV1WriteFile":    reflect.ValueOf(TaskV1WriteFile),
+			"TaskV1FileAttrs":    reflect.ValueOf(TaskV1FileAttrs),
+			"TaskV1Environment":  reflect.ValueOf(TaskV1Environment),
+			"TaskV1Environ":      reflect.ValueOf(TaskV1Environ),
+			"TaskV1SplitCmdline": reflect.ValueOf(TaskV1SplitCmdline),
+			"GetTask":            reflect.ValueOf(GetTask),
+			"ModulesList":        reflect.ValueOf(ModulesList),
+			"ToYaml":             reflect.ValueOf(ToYaml),
 		},
 		Types: map[string]reflect.Type{
-			"Task":            reflect.TypeOf((*Task)(nil)).Elem(),
-			"TaskV1Interface": reflect.TypeOf((*TaskV1Interface)(nil)).Elem(),
-			"OrderedMap":      reflect.TypeOf((*OrderedMap)(nil)).Elem(),
-			"TAny":            reflect.TypeOf((*TAny)(nil)).Elem(),
-			"TAnyMap":         reflect.TypeOf((*TAnyMap)(nil)).Elem(),
-			"TAnyList":        reflect.TypeOf((*TAnyList)(nil)).Elem(),
-			"TString":         reflect.TypeOf((*TString)(nil)).Elem(),
-			"TStringMap":      reflect.TypeOf((*TStringMap)(nil)).Elem(),
-			"TStringList":     reflect.TypeOf((*TStringList)(nil)).Elem(),
-			"TInt":            reflect.TypeOf((*TInt)(nil)).Elem(),
-			"TIntMap":         reflect.TypeOf((*TIntMap)(nil)).Elem(),
-			"TIntList":        reflect.TypeOf((*TIntList)(nil)).Elem(),
-			"TBool":           reflect.TypeOf((*TBool)(nil)).Elem(),
-			"TBoolMap":        reflect.TypeOf((*TBoolMap)(nil)).Elem(),
-			"TBoolList":       reflect.TypeOf((*TBoolList)(nil)).Elem(),
+			"Task":                    reflect.TypeOf((*Task)(nil)).Elem(),
+			"TaskV1Interface":         reflect.TypeOf((*TaskV1Interface)(nil)).Elem(),
+			"TaskV1SupportsCheckMode": reflect.TypeOf((*TaskV1SupportsCheckMode)(nil)).Elem(),
+			"TaskV2Interface":         reflect.TypeOf((*TaskV2Interface)(nil)).Elem(),
+			"TaskV2SupportsCheckMode": reflect.TypeOf((*TaskV2SupportsCheckMode)(nil)).Elem(),
+			"TaskV2Context":           reflect.TypeOf((*TaskV2Context)(nil)).Elem(),
+			"TaskV2Become":            reflect.TypeOf((*TaskV2Become)(nil)).Elem(),
+			"TaskV2Logger":            reflect.TypeOf((*TaskV2Logger)(nil)).Elem(),
+			"TaskV2Result":            reflect.TypeOf((*TaskV2Result)(nil)).Elem(),
+			"OrderedMap":              reflect.TypeOf((*OrderedMap)(nil)).Elem(),
+			"TAny":                    reflect.TypeOf((*TAny)(nil)).Elem(),
+			"TAnyMap":                 reflect.TypeOf((*TAnyMap)(nil)).Elem(),
+			"TAnyList":                reflect.TypeOf((*TAnyList)(nil)).Elem(),
+			"TString":                 reflect.TypeOf((*TString)(nil)).Elem(),
+			"TStringMap":              reflect.TypeOf((*TStringMap)(nil)).Elem(),
+			"TStringList":             reflect.TypeOf((*TStringList)(nil)).Elem(),
+			"TInt":                    reflect.TypeOf((*TInt)(nil)).Elem(),
+			"TIntMap":                 reflect.TypeOf((*TIntMap)(nil)).Elem(),
+			"TIntList":                reflect.TypeOf((*TIntList)(nil)).Elem(),
+			"TBool":                   reflect.TypeOf((*TBool)(nil)).Elem(),
+			"TBoolMap":                reflect.TypeOf((*TBoolMap)(nil)).Elem(),
+			"TBoolList":               reflect.TypeOf((*TBoolList)(nil)).Elem(),
 		},
 		Proxies: map[string]reflect.Type{
 			"TaskV1Interface": reflect.TypeOf((*P_TaskV1Interface)(nil)).Elem(),
+			"TaskV2Interface": reflect.TypeOf((*P_TaskV2Interface)(nil)).Elem(),
 		},
 		Untypeds: map[string]string{},
 		Wrappers: map[string][]string{},
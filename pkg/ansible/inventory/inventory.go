@@ -1,7 +1,13 @@
 package inventory
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/relex/aini"
 
@@ -10,29 +16,249 @@ import (
 
 type Inventory = aini.InventoryData
 type Host = aini.Host
+type Group = aini.Group
 
-// Input is a file with inventory data or a list of hosts
+// Files in inventory directory with those extensions are not used as inventory sources
+var ignore_exts = []string{"~", ".orig", ".bak", ".cfg", ".retry", ".pyc", ".pyo", ".md", ".txt"}
+
+// Input is a list of inventory sources: file (ini, yaml or executable script), directory with
+// inventory sources or a comma separated list of hosts. All of them are merged together.
 func New(input []string) (*Inventory, error) {
-	out := &Inventory{}
-	for _, host := range input {
-		if _, err := os.Stat(host); err == nil {
-			// File path that contains inventory - loading it and return
-			out, err = ReadIniFile(host)
-			if err != nil {
-				return nil, log.Errorf("Unable to load inventory file by ini parser: %s", host)
-			}
-			log.Debugf("Ini data: %q", out)
-			return out, nil
-		} else {
-			// List of hosts
-			log.Error("TODO: list of hosts not supported, to be implemented")
+	out := newInventory()
+	for _, source := range input {
+		inv, err := readSource(source)
+		if err != nil {
+			return nil, log.Errorf("Unable to load inventory source %q: %v", source, err)
 		}
+		merge(out, inv)
 	}
+	out.Reconcile()
 
+	log.Debugf("Inventory data: %q", out)
 	return out, nil
 }
 
+func readSource(source string) (*Inventory, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		if strings.Contains(source, ",") {
+			return ReadHostList(source)
+		}
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return ReadDir(source)
+	}
+	if info.Mode()&0111 != 0 {
+		return ReadScript(source)
+	}
+	switch strings.ToLower(filepath.Ext(source)) {
+	case ".yml", ".yaml", ".json":
+		return ReadYamlFile(source)
+	}
+
+	inv, err := ReadIniFile(source)
+	if err != nil {
+		// Could be the yaml file without extension
+		if yaml_inv, yaml_err := ReadYamlFile(source); yaml_err == nil {
+			return yaml_inv, nil
+		}
+		return nil, fmt.Errorf("Unable to parse inventory file by ini parser: %v", err)
+	}
+	return inv, nil
+}
+
 func ReadIniFile(path string) (inv *Inventory, err error) {
 	// Open and parse
-	return aini.ParseFile(path)
+	if inv, err = aini.ParseFile(path); err != nil {
+		return nil, err
+	}
+
+	// Port from the host pattern (like `host:2222`) is used as ansible_port, the parser sets the
+	// default 22 so it's not possible to distinguish it and the default port of connection is used
+	for _, host := range inv.Hosts {
+		if _, ok := host.InventoryVars["ansible_port"]; !ok && host.Port > 0 && host.Port != 22 {
+			host.InventoryVars["ansible_port"] = strconv.Itoa(host.Port)
+		}
+	}
+	inv.Reconcile()
+
+	return inv, nil
+}
+
+// Reads the inventory sources from directory in alphabetical order and merges them together
+func ReadDir(path string) (inv *Inventory, err error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	inv = newInventory()
+	for _, entry := range entries {
+		name := entry.Name()
+		// Vars directories and hidden files are not inventory sources
+		if strings.HasPrefix(name, ".") || name == "group_vars" || name == "host_vars" {
+			continue
+		}
+		ignored := false
+		for _, ext := range ignore_exts {
+			if strings.HasSuffix(name, ext) {
+				ignored = true
+				break
+			}
+		}
+		if ignored {
+			log.Debugf("Skipping inventory file with ignored extension: %s", name)
+			continue
+		}
+
+		source_inv, err := readSource(filepath.Join(path, name))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load %q: %v", name, err)
+		}
+		merge(inv, source_inv)
+	}
+	inv.Reconcile()
+
+	return inv, nil
+}
+
+// Parses the list of hosts like "host1,host2:2222," - all of them will be ungrouped
+func ReadHostList(list string) (inv *Inventory, err error) {
+	inv = newInventory()
+	ungrouped := getOrCreateGroup(inv, "ungrouped")
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, port := item, 0
+		// Only the last part is the port, because IPv6 address contains colons too
+		if sep := strings.LastIndex(item, ":"); sep > 0 && strings.Count(item, ":") == 1 {
+			if port, err = strconv.Atoi(item[sep+1:]); err != nil {
+				return nil, fmt.Errorf("Unable to parse port of host %q: %v", item, err)
+			}
+			name = item[:sep]
+		}
+
+		host := getOrCreateHost(inv, name)
+		if port > 0 {
+			host.Port = port
+			host.InventoryVars["ansible_port"] = strconv.Itoa(port)
+		}
+		host.DirectGroups[ungrouped.Name] = ungrouped
+	}
+	inv.Reconcile()
+
+	return inv, nil
+}
+
+func newInventory() *Inventory {
+	return &Inventory{
+		Groups: make(map[string]*Group),
+		Hosts:  make(map[string]*Host),
+	}
+}
+
+func getOrCreateGroup(inv *Inventory, name string) *Group {
+	if group, ok := inv.Groups[name]; ok {
+		return group
+	}
+	group := &Group{
+		Name:     name,
+		Hosts:    make(map[string]*Host),
+		Vars:     make(map[string]string),
+		Children: make(map[string]*Group),
+		Parents:  make(map[string]*Group),
+
+		DirectParents: make(map[string]*Group),
+		InventoryVars: make(map[string]string),
+		FileVars:      make(map[string]string),
+	}
+	inv.Groups[name] = group
+	return group
+}
+
+func getOrCreateHost(inv *Inventory, name string) *Host {
+	if host, ok := inv.Hosts[name]; ok {
+		return host
+	}
+	host := &Host{
+		Name:   name,
+		Port:   22,
+		Groups: make(map[string]*Group),
+		Vars:   make(map[string]string),
+
+		DirectGroups:  make(map[string]*Group),
+		InventoryVars: make(map[string]string),
+		FileVars:      make(map[string]string),
+	}
+	inv.Hosts[name] = host
+	return host
+}
+
+// Places the direct relations and variables of src inventory to dst one, dst needs
+// to be reconciled after that to calculate the resulting variables and relations
+func merge(dst, src *Inventory) {
+	// Sorted to make the variables override order stable
+	group_names := make([]string, 0, len(src.Groups))
+	for name := range src.Groups {
+		group_names = append(group_names, name)
+	}
+	sort.Strings(group_names)
+
+	for _, name := range group_names {
+		src_group := src.Groups[name]
+		group := getOrCreateGroup(dst, name)
+		for key, val := range src_group.InventoryVars {
+			group.InventoryVars[key] = val
+		}
+		for key, val := range src_group.FileVars {
+			group.FileVars[key] = val
+		}
+		for parent_name := range src_group.DirectParents {
+			group.DirectParents[parent_name] = getOrCreateGroup(dst, parent_name)
+		}
+	}
+
+	for name, src_host := range src.Hosts {
+		host := getOrCreateHost(dst, name)
+		// The parsers are setting the default port, so it should not override the port
+		// obtained from the other source
+		if src_host.Port != 0 && (src_host.Port != 22 || host.Port == 0) {
+			host.Port = src_host.Port
+		}
+		for key, val := range src_host.InventoryVars {
+			host.InventoryVars[key] = val
+		}
+		for key, val := range src_host.FileVars {
+			host.FileVars[key] = val
+		}
+		for group_name := range src_host.DirectGroups {
+			host.DirectGroups[group_name] = getOrCreateGroup(dst, group_name)
+		}
+		// Host could be ungrouped in one source and grouped in another
+		if len(host.DirectGroups) > 1 {
+			delete(host.DirectGroups, "ungrouped")
+		}
+	}
+}
+
+// Inventory variables are strings, so the complex values are stored as json
+func varToString(val any) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprintf("%v", v)
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Sprintf("%v", val)
+	}
+	return string(data)
 }
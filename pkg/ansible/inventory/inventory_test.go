@@ -0,0 +1,40 @@
+package inventory
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadDirKeepsPort(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"01-hosts.ini": "host1:2222\nhost2\n",
+		"02-hosts.ini": "[web]\nhost1\nhost2:2200\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inv, err := ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, port := range map[string]int{"host1": 2222, "host2": 2200} {
+		host, ok := inv.Hosts[name]
+		if !ok {
+			t.Fatalf("Host %q is not found", name)
+		}
+		if host.Port != port {
+			t.Errorf("Host %q port is %d, expected %d", name, host.Port, port)
+		}
+		if _, ok := host.Groups["web"]; !ok {
+			t.Errorf("Host %q is not in group web", name)
+		}
+	}
+	if val := inv.Hosts["host1"].Vars["ansible_port"]; val != "2222" {
+		t.Errorf("Host var ansible_port is %q, expected %q", val, "2222")
+	}
+}
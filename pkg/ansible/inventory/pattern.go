@@ -0,0 +1,235 @@
+package inventory
+
+// Doc: https://docs.ansible.com/ansible/2.9/user_guide/intro_patterns.html
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/relex/aini"
+)
+
+// Subscript in the end of the pattern like `webservers[0]`, `webservers[0:2]` or `webservers[1-]`
+var subscript_regex = regexp.MustCompile(`^(.+)\[(-?[0-9]+)?(?:([:-])(-?[0-9]+)?)?\]$`)
+
+// Returns the hosts matching the Ansible host pattern in the order of their names. Pattern
+// supports `all`, union `a:b` or `a,b`, intersection `a:&b`, exclusion `a:!b`, wildcards `web*`,
+// regex `~web\d+` and subscripts `web[0:2]` which are applied to the group or wildcard match.
+// IPv6 address combined with other terms by colons should be set in brackets `[fe80::1]`.
+func MatchHosts(inv *Inventory, pattern string) (out []*Host, err error) {
+	terms := splitPattern(pattern)
+
+	// Just like Ansible - processing union first, then intersections and exclusions in the end
+	var union, intersect, exclude []string
+	for _, term := range terms {
+		switch {
+		case strings.HasPrefix(term, "&"):
+			intersect = append(intersect, term[1:])
+		case strings.HasPrefix(term, "!"):
+			exclude = append(exclude, term[1:])
+		default:
+			union = append(union, term)
+		}
+	}
+	if len(union) == 0 {
+		union = append(union, "all")
+	}
+
+	selected := map[string]bool{}
+	for _, term := range union {
+		hosts, err := matchTerm(inv, term)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			if !selected[host.Name] {
+				selected[host.Name] = true
+				out = append(out, host)
+			}
+		}
+	}
+
+	for _, term := range intersect {
+		hosts, err := matchTerm(inv, term)
+		if err != nil {
+			return nil, err
+		}
+		found := hostNames(hosts)
+		out = filterHosts(out, func(host *Host) bool { return found[host.Name] })
+	}
+
+	for _, term := range exclude {
+		hosts, err := matchTerm(inv, term)
+		if err != nil {
+			return nil, err
+		}
+		found := hostNames(hosts)
+		out = filterHosts(out, func(host *Host) bool { return !found[host.Name] })
+	}
+
+	return out, nil
+}
+
+// Returns the hosts which are present in both lists, useful to apply --limit
+func IntersectHosts(hosts, limit []*Host) []*Host {
+	found := hostNames(limit)
+	return filterHosts(hosts, func(host *Host) bool { return found[host.Name] })
+}
+
+// Pattern could be separated by commas or by colons, but colons are used in subscripts, regex
+// and IPv6 addresses, so they are separating terms only outside of those
+func splitPattern(pattern string) (out []string) {
+	var terms []string
+	if strings.Contains(pattern, ",") || isAddress(pattern) {
+		terms = strings.Split(pattern, ",")
+	} else {
+		level := 0
+		start := 0
+		for i, c := range pattern {
+			switch c {
+			case '[':
+				level++
+			case ']':
+				level--
+			case ':':
+				// Regex takes the rest of the pattern, the same way as Ansible does
+				if level == 0 && !strings.HasPrefix(strings.TrimLeft(pattern[start:], "&!"), "~") {
+					terms = append(terms, pattern[start:i])
+					start = i + 1
+				}
+			}
+		}
+		terms = append(terms, pattern[start:])
+	}
+
+	for _, term := range terms {
+		if term = strings.TrimSpace(term); term != "" {
+			out = append(out, term)
+		}
+	}
+	return out
+}
+
+// Checks the pattern is a single IP address, optionally in brackets or with `&` / `!` prefix
+func isAddress(pattern string) bool {
+	pattern = strings.TrimLeft(strings.TrimSpace(pattern), "&!")
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(pattern, "["), "]")) != nil
+}
+
+func matchTerm(inv *Inventory, term string) ([]*Host, error) {
+	// IPv6 address could be set in brackets to separate it from the other terms
+	if strings.HasPrefix(term, "[") && isAddress(term) {
+		term = term[1 : len(term)-1]
+	}
+	term, subscript := splitSubscript(term)
+
+	var hosts []*Host
+	if strings.HasPrefix(term, "~") {
+		re, err := regexp.Compile(term[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regex in host pattern %q: %v", term, err)
+		}
+		hosts = matchHostsFunc(inv, re.MatchString)
+	} else if term == "all" || term == "*" {
+		hosts = aini.HostMapListValues(inv.Hosts)
+	} else if group, ok := inv.Groups[term]; ok {
+		hosts = aini.HostMapListValues(group.Hosts)
+	} else if host, ok := inv.Hosts[term]; ok {
+		hosts = []*Host{host}
+	} else {
+		if _, err := path.Match(term, ""); err != nil {
+			return nil, fmt.Errorf("Invalid wildcard in host pattern %q: %v", term, err)
+		}
+		hosts = matchHostsFunc(inv, func(name string) bool {
+			ok, _ := path.Match(term, name)
+			return ok
+		})
+	}
+
+	if subscript != nil {
+		return subscript(hosts)
+	}
+	return hosts, nil
+}
+
+// Collects hosts with the names matching or included in the groups with names matching
+func matchHostsFunc(inv *Inventory, match func(string) bool) []*Host {
+	found := map[string]*Host{}
+	for name, group := range inv.Groups {
+		if match(name) {
+			for host_name, host := range group.Hosts {
+				found[host_name] = host
+			}
+		}
+	}
+	for name, host := range inv.Hosts {
+		if match(name) {
+			found[name] = host
+		}
+	}
+	return aini.HostMapListValues(found)
+}
+
+// Cuts the subscript from the term and returns the function to apply it
+func splitSubscript(term string) (string, func([]*Host) ([]*Host, error)) {
+	// Regex could contain brackets, so not touching it
+	if strings.HasPrefix(term, "~") {
+		return term, nil
+	}
+	match := subscript_regex.FindStringSubmatch(term)
+	if match == nil {
+		return term, nil
+	}
+
+	name, start_str, sep, end_str := match[1], match[2], match[3], match[4]
+	return name, func(hosts []*Host) ([]*Host, error) {
+		start, end := 0, len(hosts)-1
+		if start_str != "" {
+			start, _ = strconv.Atoi(start_str)
+		}
+		if sep == "" {
+			// Single index
+			end = start
+		} else if end_str != "" {
+			end, _ = strconv.Atoi(end_str)
+		}
+		// Negative index is counted from the end
+		if start < 0 {
+			start += len(hosts)
+		}
+		if end < 0 {
+			end += len(hosts)
+		}
+		if start < 0 || start >= len(hosts) {
+			return nil, fmt.Errorf("Subscript [%s] of pattern %q is out of range of %d hosts", term[len(name)+1:len(term)-1], name, len(hosts))
+		}
+		if end >= len(hosts) {
+			end = len(hosts) - 1
+		}
+		if end < start {
+			return nil, nil
+		}
+		return hosts[start : end+1], nil
+	}
+}
+
+func hostNames(hosts []*Host) map[string]bool {
+	out := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		out[host.Name] = true
+	}
+	return out
+}
+
+func filterHosts(hosts []*Host, keep func(*Host) bool) (out []*Host) {
+	for _, host := range hosts {
+		if keep(host) {
+			out = append(out, host)
+		}
+	}
+	return out
+}
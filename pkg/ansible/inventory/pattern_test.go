@@ -0,0 +1,52 @@
+package inventory
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitPattern(t *testing.T) {
+	for pattern, expected := range map[string][]string{
+		"web:db":            {"web", "db"},
+		"web, db ,":         {"web", "db"},
+		"web:&staging:!db1": {"web", "&staging", "!db1"},
+		"web[0:2]:db[1-]":   {"web[0:2]", "db[1-]"},
+		"web:~db\\d:[0-9]+": {"web", "~db\\d:[0-9]+"},
+		"web:!~db:1":        {"web", "!~db:1"},
+		"fe80::1":           {"fe80::1"},
+		"!fe80::1":          {"!fe80::1"},
+		"[fe80::1]":         {"[fe80::1]"},
+		"web:[fe80::1]:db":  {"web", "[fe80::1]", "db"},
+		"fe80::1,10.0.0.1":  {"fe80::1", "10.0.0.1"},
+	} {
+		if out := splitPattern(pattern); !reflect.DeepEqual(out, expected) {
+			t.Errorf("Pattern %q is split to %q, expected %q", pattern, out, expected)
+		}
+	}
+}
+
+func TestMatchHostsAddress(t *testing.T) {
+	inv, err := ReadHostList("fe80::1,web1,web2,db1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pattern, expected := range map[string][]string{
+		"fe80::1":         {"fe80::1"},
+		"web1:[fe80::1]":  {"web1", "fe80::1"},
+		"all:![fe80::1]":  {"db1", "web1", "web2"},
+		"all:!~web[12]:1": {"db1", "fe80::1", "web1", "web2"},
+		"all:!~(web|db)1": {"fe80::1", "web2"},
+	} {
+		hosts, err := MatchHosts(inv, pattern)
+		if err != nil {
+			t.Fatalf("Unable to match pattern %q: %v", pattern, err)
+		}
+		var names []string
+		for _, host := range hosts {
+			names = append(names, host.Name)
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("Pattern %q matched %q, expected %q", pattern, names, expected)
+		}
+	}
+}
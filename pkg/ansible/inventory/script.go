@@ -0,0 +1,112 @@
+package inventory
+
+// Doc: https://docs.ansible.com/ansible/2.9/dev_guide/developing_inventory.html#inventory-script-conventions
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+	"github.com/state-of-the-art/ansiblego/pkg/util"
+)
+
+// Dynamic inventory scripts could take some time to request the cloud API
+const script_timeout = 5 * time.Minute
+
+type scriptGroup struct {
+	Hosts    []string       `json:"hosts"`
+	Vars     map[string]any `json:"vars"`
+	Children []string       `json:"children"`
+}
+
+type scriptMeta struct {
+	Hostvars map[string]map[string]any `json:"hostvars"`
+}
+
+// Executes the dynamic inventory script with `--list` and `--host <name>` if `_meta` is not set
+func ReadScript(path string) (inv *Inventory, err error) {
+	log.Debugf("Executing dynamic inventory script: %s --list", path)
+	stdout, _, err := util.RunCommand(script_timeout, path, "--list")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to execute inventory script: %v", err)
+	}
+
+	return parseScriptOutput([]byte(stdout), func(host string) (map[string]any, error) {
+		log.Debugf("Executing dynamic inventory script: %s --host %s", path, host)
+		stdout, _, err := util.RunCommand(script_timeout, path, "--host", host)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to execute inventory script for host %q: %v", host, err)
+		}
+		var vars map[string]any
+		if err = json.Unmarshal([]byte(stdout), &vars); err != nil {
+			return nil, fmt.Errorf("Unable to parse inventory script output for host %q: %v", host, err)
+		}
+		return vars, nil
+	})
+}
+
+func parseScriptOutput(data []byte, host_vars func(string) (map[string]any, error)) (inv *Inventory, err error) {
+	var groups map[string]json.RawMessage
+	if err = json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("Unable to parse inventory script output: %v", err)
+	}
+
+	var meta *scriptMeta
+	if meta_data, ok := groups["_meta"]; ok {
+		meta = &scriptMeta{}
+		if err = json.Unmarshal(meta_data, meta); err != nil {
+			return nil, fmt.Errorf("Unable to parse inventory script _meta: %v", err)
+		}
+		delete(groups, "_meta")
+	}
+
+	inv = newInventory()
+	for name, raw := range groups {
+		group := getOrCreateGroup(inv, name)
+
+		// Group could be just a list of hosts
+		var data scriptGroup
+		if err = json.Unmarshal(raw, &data.Hosts); err != nil {
+			data = scriptGroup{}
+			if err = json.Unmarshal(raw, &data); err != nil {
+				return nil, fmt.Errorf("Unable to parse inventory script group %q: %v", name, err)
+			}
+		}
+
+		for key, val := range data.Vars {
+			group.InventoryVars[key] = varToString(val)
+		}
+		for _, host_name := range data.Hosts {
+			host := getOrCreateHost(inv, host_name)
+			if name != "all" && name != "ungrouped" {
+				host.DirectGroups[group.Name] = group
+				delete(host.DirectGroups, "ungrouped")
+			} else if len(host.DirectGroups) == 0 {
+				host.DirectGroups["ungrouped"] = getOrCreateGroup(inv, "ungrouped")
+			}
+		}
+		for _, child_name := range data.Children {
+			if name == "all" {
+				getOrCreateGroup(inv, child_name)
+				continue
+			}
+			getOrCreateGroup(inv, child_name).DirectParents[group.Name] = group
+		}
+	}
+
+	for name, host := range inv.Hosts {
+		var vars map[string]any
+		if meta != nil {
+			vars = meta.Hostvars[name]
+		} else if vars, err = host_vars(name); err != nil {
+			return nil, err
+		}
+		for key, val := range vars {
+			host.InventoryVars[key] = varToString(val)
+		}
+	}
+	inv.Reconcile()
+
+	return inv, nil
+}
@@ -0,0 +1,73 @@
+package inventory
+
+// Doc: https://docs.ansible.com/ansible/2.9/plugins/inventory/yaml.html
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+type yamlGroup struct {
+	Hosts    map[string]map[string]any `yaml:"hosts"`
+	Vars     map[string]any            `yaml:"vars"`
+	Children map[string]*yamlGroup     `yaml:"children"`
+}
+
+func ReadYamlFile(path string) (inv *Inventory, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseYaml(data)
+}
+
+func ParseYaml(data []byte) (inv *Inventory, err error) {
+	var groups map[string]*yamlGroup
+	if err = yaml.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("Unable to parse yaml inventory: %v", err)
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("No groups found in yaml inventory")
+	}
+
+	inv = newInventory()
+	for name, group := range groups {
+		addYamlGroup(inv, nil, name, group)
+	}
+	inv.Reconcile()
+
+	return inv, nil
+}
+
+func addYamlGroup(inv *Inventory, parent *Group, name string, data *yamlGroup) {
+	group := getOrCreateGroup(inv, name)
+	if parent != nil && parent.Name != "all" {
+		group.DirectParents[parent.Name] = parent
+	}
+	if data == nil {
+		return
+	}
+
+	for key, val := range data.Vars {
+		group.InventoryVars[key] = varToString(val)
+	}
+	for host_name, host_vars := range data.Hosts {
+		host := getOrCreateHost(inv, host_name)
+		// The hosts of `all` group are ungrouped unless defined in other group
+		if name != "all" {
+			host.DirectGroups[group.Name] = group
+			delete(host.DirectGroups, "ungrouped")
+		} else if len(host.DirectGroups) == 0 {
+			host.DirectGroups["ungrouped"] = getOrCreateGroup(inv, "ungrouped")
+		}
+		for key, val := range host_vars {
+			host.InventoryVars[key] = varToString(val)
+		}
+	}
+	for child_name, child := range data.Children {
+		addYamlGroup(inv, group, child_name, child)
+	}
+}
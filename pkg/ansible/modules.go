@@ -8,6 +8,7 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/cosmos72/gomacro/fast"
 
@@ -20,7 +21,19 @@ var modules embed.FS
 
 var modules_cache = map[string]*fast.Interp{}
 
+// Fact collectors are running concurrently so the cache access need to be guarded
+var modules_cache_mu sync.RWMutex
+
+// Gomacro interp is not safe for concurrent use, so the module code execution is serialized
+var modules_locks = map[*fast.Interp]*sync.Mutex{}
+
+// Interp creation is slow, so the module is created once and the others are waiting for it
+var modules_create_locks = map[string]*sync.Mutex{}
+
 func InitEmbeddedModules() {
+	modules_cache_mu.Lock()
+	defer modules_cache_mu.Unlock()
+
 	mtypes, _ := modules.ReadDir(".")
 	for _, mtype := range mtypes {
 		mods, _ := modules.ReadDir(mtype.Name())
@@ -52,6 +65,9 @@ func InitEmbeddedModules() {
 
 // Lists the modules of specified type
 func ModulesList(typ string) (out []string) {
+	modules_cache_mu.RLock()
+	defer modules_cache_mu.RUnlock()
+
 	typ = typ + "/"
 	for key, _ := range modules_cache {
 		if strings.HasPrefix(key, typ) {
@@ -63,23 +79,75 @@ func ModulesList(typ string) (out []string) {
 
 // Checks if the module is available
 func ModuleIsTask(name string) bool {
+	modules_cache_mu.RLock()
+	defer modules_cache_mu.RUnlock()
+
 	_, ok := modules_cache["task/"+name]
 
 	return ok
 }
 
 func ModuleIsFact(name string) bool {
+	modules_cache_mu.RLock()
+	defer modules_cache_mu.RUnlock()
+
 	_, ok := modules_cache["fact/"+name]
 
 	return ok
 }
 
 func ModuleSetCache(typ, name string, interp *fast.Interp) {
+	modules_cache_mu.Lock()
+	defer modules_cache_mu.Unlock()
+
 	p := path.Join(typ, name)
 	modules_cache[p] = interp
 }
 
 func ModuleGetCache(typ, name string) *fast.Interp {
+	modules_cache_mu.RLock()
+	defer modules_cache_mu.RUnlock()
+
 	p := path.Join(typ, name)
 	return modules_cache[p]
 }
+
+// Removes the interp from cache, so the next module usage will create the new one
+func ModuleDropCache(typ, name string) {
+	modules_cache_mu.Lock()
+	defer modules_cache_mu.Unlock()
+
+	p := path.Join(typ, name)
+	if interp := modules_cache[p]; interp != nil {
+		delete(modules_locks, interp)
+		modules_cache[p] = nil
+	}
+}
+
+// Returns the lock to execute the code of the interp, it's the same for all the module objects
+// created by the interp
+func ModuleLock(interp *fast.Interp) *sync.Mutex {
+	modules_cache_mu.Lock()
+	defer modules_cache_mu.Unlock()
+
+	mu, ok := modules_locks[interp]
+	if !ok {
+		mu = &sync.Mutex{}
+		modules_locks[interp] = mu
+	}
+	return mu
+}
+
+// Returns the lock to check and create the module interp in cache
+func moduleCreateLock(typ, name string) *sync.Mutex {
+	modules_cache_mu.Lock()
+	defer modules_cache_mu.Unlock()
+
+	p := path.Join(typ, name)
+	mu, ok := modules_create_locks[p]
+	if !ok {
+		mu = &sync.Mutex{}
+		modules_create_locks[p] = mu
+	}
+	return mu
+}
@@ -0,0 +1,147 @@
+package ansible_test
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible"
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/task"
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/task/command"
+)
+
+// Module takes the args under its name key like in the playbook task
+func moduleData(t *testing.T, name string, args any) *ansible.OrderedMap {
+	t.Helper()
+	var data ansible.OrderedMap
+	data.Set(name, args)
+	return &data
+}
+
+func checkResult(t *testing.T, out ansible.OrderedMap, expected map[string]any) {
+	t.Helper()
+	for key, exp := range expected {
+		if val, _ := out.Get(key); !reflect.DeepEqual(val, exp) {
+			t.Errorf("Result %q is %#v, expected %#v", key, val, exp)
+		}
+	}
+}
+
+func TestCommandFreeForm(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Requires echo executable")
+	}
+	cmdline := `echo "hello  world" 'a b' c\ d`
+	module := &command.TaskV1{}
+	if err := module.SetData(moduleData(t, "command", cmdline)); err != nil {
+		t.Fatal(err)
+	}
+	out, err := module.Run(map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResult(t, out, map[string]any{
+		"cmd":    []string{"echo", "hello  world", "a b", "c d"},
+		"stdout": "hello  world a b c d",
+		"rc":     0,
+	})
+
+	data := module.GetData()
+	if val, _ := data.Get("command"); val != cmdline {
+		t.Errorf("Free form command is returned as %#v", val)
+	}
+
+	// Unbalanced quotes are not executed
+	module = &command.TaskV1{}
+	if err = module.SetData(moduleData(t, "command", `echo "hello`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = module.Run(map[string]any{}); err == nil {
+		t.Error("Command with unbalanced quotes is executed")
+	}
+}
+
+func TestCommandMap(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Requires echo executable")
+	}
+	var args ansible.OrderedMap
+	args.Set("cmd", "echo")
+	args.Set("argv", []any{"a  b", "$HOME"})
+	module := &command.TaskV1{}
+	if err := module.SetData(moduleData(t, "command", args)); err != nil {
+		t.Fatal(err)
+	}
+	out, err := module.Run(map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResult(t, out, map[string]any{
+		"cmd":    []string{"echo", "a  b", "$HOME"},
+		"stdout": "a  b $HOME",
+	})
+
+	// Command without cmd has nothing to run
+	if err = (&command.TaskV1{}).SetData(moduleData(t, "command", ansible.OrderedMap{})); err == nil {
+		t.Error("Command without cmd is accepted")
+	}
+}
+
+func TestShellFreeForm(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Requires /bin/sh")
+	}
+	cmdline := "echo $((1 + 2)) | tr 3 x"
+	module := &task.TaskV1{}
+	if err := module.SetData(moduleData(t, "shell", cmdline)); err != nil {
+		t.Fatal(err)
+	}
+	out, err := module.Run(map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResult(t, out, map[string]any{
+		"cmd":    cmdline,
+		"stdout": "x",
+		"rc":     0,
+	})
+
+	data := module.GetData()
+	if val, _ := data.Get("shell"); val != cmdline {
+		t.Errorf("Free form shell is returned as %#v", val)
+	}
+}
+
+func TestShellMap(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Requires /bin/sh")
+	}
+	var args ansible.OrderedMap
+	args.Set("cmd", "pwd; cat")
+	args.Set("chdir", "/")
+	args.Set("stdin", "input")
+	module := &task.TaskV1{}
+	if err := module.SetData(moduleData(t, "shell", args)); err != nil {
+		t.Fatal(err)
+	}
+	out, err := module.Run(map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResult(t, out, map[string]any{
+		"stdout": "/\ninput",
+	})
+
+	// Failed command returns the result and error
+	args = ansible.OrderedMap{}
+	args.Set("cmd", "exit 3")
+	module = &task.TaskV1{}
+	if err = module.SetData(moduleData(t, "shell", args)); err != nil {
+		t.Fatal(err)
+	}
+	out, err = module.Run(map[string]any{})
+	if err == nil {
+		t.Error("Failed shell command is not reported")
+	}
+	checkResult(t, out, map[string]any{"rc": 3})
+}
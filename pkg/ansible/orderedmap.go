@@ -1,6 +1,8 @@
 package ansible
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 
 	"gopkg.in/yaml.v3"
@@ -122,7 +124,8 @@ func (om *OrderedMap) UnmarshalYAML(node *yaml.Node) error {
 	return nil
 }
 
-func (om *OrderedMap) MarshalYAML() (interface{}, error) {
+// Value receiver to encode the OrderedMap values of the maps and the task data too
+func (om OrderedMap) MarshalYAML() (interface{}, error) {
 	nodes := make([]*yaml.Node, len(om.order)*2)
 	for i, key := range om.order {
 		keyn := &yaml.Node{}
@@ -174,6 +177,30 @@ func (om *OrderedMap) MarshalYAML() (interface{}, error) {
 	}, nil
 }
 
+// Value receiver to encode the nested OrderedMap values too, the keys order is preserved
+func (om OrderedMap) MarshalJSON() ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, key := range om.order {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(om.data[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
 func (om *OrderedMap) Yaml() (string, error) {
 	return ToYaml(om)
 }
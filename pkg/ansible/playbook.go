@@ -1,7 +1,12 @@
 package ansible
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/creasty/defaults"
 	"gopkg.in/yaml.v3"
@@ -12,9 +17,20 @@ import (
 )
 
 type Playbook struct {
-	Name         string      `yaml:",omitempty"`
-	Gather_facts bool        `default:"true" yaml:",omitempty"`
-	Environment  *OrderedMap `yaml:",omitempty"`
+	Name         string        `yaml:",omitempty"`
+	Hosts        PlaybookHosts `yaml:",omitempty"`
+	Gather_facts *bool         `yaml:",omitempty"`
+	Environment  *OrderedMap   `yaml:",omitempty"`
+	Tags         Tags          `yaml:",omitempty"`
+
+	Become        *bool  `yaml:",omitempty"`
+	Become_user   string `yaml:",omitempty"`
+	Become_method string `yaml:",omitempty"`
+
+	Strategy            string         `yaml:",omitempty"`
+	Serial              PlaybookSerial `yaml:",omitempty"`
+	Max_fail_percentage *float64       `yaml:",omitempty"`
+	Any_errors_fatal    bool           `yaml:",omitempty"`
 
 	Pre_tasks []*Task `yaml:",omitempty"`
 
@@ -23,68 +39,218 @@ type Playbook struct {
 	Roles []*Role `yaml:",omitempty"`
 
 	Post_tasks []*Task `yaml:",omitempty"`
+
+	// Directory of the playbook file, used to find the relative files
+	dir string
 }
 
 type PlaybookFile []Playbook
 
-func (p *Playbook) Yaml() (string, error) {
-	return ToYaml(p)
+// Hosts pattern could be set as a string or a list of patterns
+type PlaybookHosts []string
+
+func (ph *PlaybookHosts) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var pattern string
+		if err := node.Decode(&pattern); err != nil {
+			return err
+		}
+		*ph = PlaybookHosts{pattern}
+		return nil
+	}
+	var patterns []string
+	if err := node.Decode(&patterns); err != nil {
+		return err
+	}
+	*ph = patterns
+	return nil
+}
+
+func (ph PlaybookHosts) MarshalYAML() (any, error) {
+	if len(ph) == 1 {
+		return ph[0], nil
+	}
+	return []string(ph), nil
 }
 
-func (p *Playbook) Run(cfg *core.PlaybookConfig, host *inventory.Host) (err error) {
-	log.Infof("Running playbook '%s' on host '%s'...", p.Name, host.Name)
+func (ph PlaybookHosts) Pattern() string {
+	return strings.Join(ph, ",")
+}
 
-	// Collecting variables
-	vars := make(map[string]any)
-	p.fillVariables(cfg, host, vars)
+// Serial batch sizes could be set as a number, percentage or a list of them
+type PlaybookSerial []string
 
-	// Getting facts and store them in vars
-	if p.Gather_facts {
-		facts := make(map[string]any)
-		module_data, err := GetTaskV1("setup")
-		if err != nil {
-			return log.Errorf("Unable to find 'setup' task: %v", err)
-		}
-		facts_task := Task{
-			Name:       NewTString("Getting playbook facts"),
-			ModuleName: "setup",
-			ModuleData: module_data,
+func (ps *PlaybookSerial) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*ps = PlaybookSerial{node.Value}
+		return nil
+	}
+	var sizes []string
+	if err := node.Decode(&sizes); err != nil {
+		return err
+	}
+	*ps = sizes
+	return nil
+}
+
+func (ps PlaybookSerial) MarshalYAML() (any, error) {
+	if len(ps) == 1 {
+		return ps[0], nil
+	}
+	return []string(ps), nil
+}
+
+// Splits the number of hosts to the batch sizes, the last serial value is repeated until all
+// the hosts are covered. Percentage is counted from the total number of hosts (at least 1).
+func (ps PlaybookSerial) Batches(hosts int) (out []int, err error) {
+	if len(ps) == 0 {
+		return []int{hosts}, nil
+	}
+
+	item := 0
+	for left := hosts; left > 0; {
+		val := strings.TrimSpace(ps[item])
+		var size int
+		if strings.HasSuffix(val, "%") {
+			pct, err := strconv.ParseFloat(strings.TrimSuffix(val, "%"), 64)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse serial percentage %q: %v", val, err)
+			}
+			if size = int(float64(hosts) * pct / 100); size < 1 {
+				size = 1
+			}
+		} else if size, err = strconv.Atoi(val); err != nil {
+			return nil, fmt.Errorf("Unable to parse serial value %q: %v", val, err)
 		}
-		data, err := facts_task.Run(vars)
-		if err != nil {
-			return log.Errorf("Error during getting target facts for playbook: %v", err)
+		// Zero or negative means the rest of the hosts
+		if size <= 0 || size > left {
+			size = left
 		}
-		for _, key := range data.Keys() {
-			facts[key], _ = data.Get(key)
+		out = append(out, size)
+		left -= size
+
+		if item < len(ps)-1 {
+			item++
 		}
-		vars["ansible_facts"] = facts
 	}
 
-	// Running tasks & roles
-	for _, task := range p.Pre_tasks {
-		if _, err = task.Run(vars); err != nil {
-			return log.Errorf("Error during playbook execution: %v", err)
-		}
+	return out, nil
+}
+
+func (p *Playbook) Yaml() (string, error) {
+	return ToYaml(p)
+}
+
+// Returns the inventory hosts matching the play hosts pattern and limit
+func (p *Playbook) MatchHosts(cfg *core.PlaybookConfig) ([]*inventory.Host, error) {
+	if len(p.Hosts) == 0 {
+		return nil, log.Errorf("The field 'hosts' is required but was not set for playbook '%s'", p.Name)
 	}
-	for _, task := range p.Tasks {
-		if _, err = task.Run(vars); err != nil {
-			return log.Errorf("Error during playbook execution: %v", err)
-		}
+
+	hosts, err := inventory.MatchHosts(cfg.Inventory, p.Hosts.Pattern())
+	if err != nil {
+		return nil, log.Errorf("Unable to match hosts pattern %q: %v", p.Hosts.Pattern(), err)
 	}
-	for _, role := range p.Roles {
-		if _, err = role.Run(vars); err != nil {
-			return log.Errorf("Error during playbook execution: %v", err)
+
+	if cfg.Limit != "" {
+		limit_hosts, err := inventory.MatchHosts(cfg.Inventory, cfg.Limit)
+		if err != nil {
+			return nil, log.Errorf("Unable to match limit pattern %q: %v", cfg.Limit, err)
 		}
+		hosts = inventory.IntersectHosts(hosts, limit_hosts)
 	}
-	for _, task := range p.Post_tasks {
-		if _, err = task.Run(vars); err != nil {
-			return log.Errorf("Error during playbook execution: %v", err)
-		}
+
+	return hosts, nil
+}
+
+// Gathers the facts according to the gathering policy, the cached facts are already in vars
+func (p *Playbook) gatherFacts(ctx context.Context, cfg *core.PlaybookConfig, host *inventory.Host, vars map[string]any) error {
+	// Facts set by set_fact are not skipping the gathering, only the ones collected by setup
+	facts, _ := vars["ansible_facts"].(map[string]any)
+	cached := facts["module_setup"] == true
+
+	gather := p.Gather_facts == nil || *p.Gather_facts
+	switch cfg.Gathering {
+	case "explicit":
+		gather = p.Gather_facts != nil && *p.Gather_facts
+	case "smart":
+		gather = gather && !cached
+	}
+	if !gather {
+		log.Debugf("Skipping facts gathering for playbook '%s'", p.Name)
+		return nil
+	}
+
+	module_data, err := getTask("setup")
+	if err != nil {
+		return log.Errorf("Unable to find 'setup' task: %v", err)
+	}
+	facts_task := Task{
+		Name:       NewTString("Getting playbook facts"),
+		ModuleName: "setup",
+		ModuleData: module_data,
 	}
+	data, err := facts_task.Run(ctx, vars)
+	if err != nil {
+		return log.Errorf("Error during getting target facts for playbook: %v", err)
+	}
+	p.injectFacts(cfg, &data, vars)
+	p.setFact(cfg, vars, "module_setup", true)
+	p.cacheFacts(cfg, host, vars)
 
 	return nil
 }
 
+// Places the cached facts of the host to vars, they are available even if gathering is
+// disabled for the play
+func (p *Playbook) loadCachedFacts(cfg *core.PlaybookConfig, host *inventory.Host, vars map[string]any) {
+	if cfg.FactCache == nil {
+		return
+	}
+	cached_facts, ok := cfg.FactCache.Get(host.Name)
+	if !ok {
+		return
+	}
+	log.Debugf("Using cached facts for host '%s'", host.Name)
+	for key, val := range cached_facts {
+		p.setFact(cfg, vars, key, val)
+	}
+}
+
+// Saves the host facts to the fact cache if it's configured
+func (p *Playbook) cacheFacts(cfg *core.PlaybookConfig, host *inventory.Host, vars map[string]any) {
+	facts, ok := vars["ansible_facts"].(map[string]any)
+	if cfg.FactCache == nil || !ok {
+		return
+	}
+	if err := cfg.FactCache.Set(host.Name, facts); err != nil {
+		log.Warnf("Unable to store facts of host '%s' in cache: %v", host.Name, err)
+	}
+}
+
+// Places the facts to `ansible_facts` without prefix and as top-level `ansible_` prefixed vars
+// the same way Ansible does with INJECT_FACTS_AS_VARS enabled
+func (p *Playbook) injectFacts(cfg *core.PlaybookConfig, data *OrderedMap, vars map[string]any) {
+	for _, key := range data.Keys() {
+		val, _ := data.Get(key)
+		p.setFact(cfg, vars, key, val)
+	}
+}
+
+func (p *Playbook) setFact(cfg *core.PlaybookConfig, vars map[string]any, key string, val any) {
+	facts, ok := vars["ansible_facts"].(map[string]any)
+	if !ok {
+		facts = make(map[string]any)
+		vars["ansible_facts"] = facts
+	}
+
+	name := strings.TrimPrefix(key, "ansible_")
+	facts[name] = val
+	if cfg.InjectFactsAsVars {
+		vars["ansible_"+name] = val
+	}
+}
+
 // Will collect all the variables except for the facts in the right order to create vars
 // https://docs.ansible.com/ansible/2.9/user_guide/playbooks_variables.html#variable-precedence-where-should-i-put-a-variable
 // 01. command line values (eg “-u user”)
@@ -112,6 +278,33 @@ func (p *Playbook) Run(cfg *core.PlaybookConfig, host *inventory.Host) (err erro
 func (p *Playbook) fillVariables(cfg *core.PlaybookConfig, host *inventory.Host, vars map[string]any) {
 	// 00. Filling defaults
 	vars["ansible_connection"] = "ssh"
+	vars["ansible_check_mode"] = cfg.Check
+	vars["ansible_diff_mode"] = cfg.Diff
+	vars["playbook_dir"] = p.dir
+	vars["inventory_hostname"] = host.Name
+
+	// Become from command line and config could be overridden by play, inventory and task
+	vars["ansible_become"] = cfg.Become
+	if p.Become != nil {
+		vars["ansible_become"] = *p.Become
+	}
+	for key, val := range map[string]string{
+		"ansible_become_user":     firstNonEmpty(p.Become_user, cfg.BecomeUser),
+		"ansible_become_method":   firstNonEmpty(p.Become_method, cfg.BecomeMethod),
+		"ansible_become_password": cfg.BecomePassword,
+	} {
+		if val != "" {
+			vars[key] = val
+		}
+	}
+
+	// Host key checking from config could be overridden by inventory
+	if cfg.HostKeyChecking != "" {
+		vars["ansible_host_key_checking"] = cfg.HostKeyChecking
+	}
+
+	// Play environment is the base for the roles, blocks and tasks environment
+	vars[environment_var] = mergeEnvironment(vars, orderedMapEnvironment(p.Environment))
 
 	// 03. Adding host variables from inventory
 	for key, val := range host.Vars {
@@ -119,6 +312,9 @@ func (p *Playbook) fillVariables(cfg *core.PlaybookConfig, host *inventory.Host,
 		vars[key] = val
 	}
 
+	// 11. Adding cached facts
+	p.loadCachedFacts(cfg, host, vars)
+
 	// 22. Setting extra vars
 	for key, val := range cfg.ExtraVars {
 		log.Tracef("Setting extra var '%s': %q", key, val)
@@ -126,6 +322,15 @@ func (p *Playbook) fillVariables(cfg *core.PlaybookConfig, host *inventory.Host,
 	}
 }
 
+func firstNonEmpty(vals ...string) string {
+	for _, val := range vals {
+		if val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
 // Allows to set defaults from struct definition
 func (p *Playbook) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	defaults.Set(p)
@@ -145,7 +350,19 @@ func (pf *PlaybookFile) Load(yml_path string) error {
 		return err
 	}
 
-	return pf.Parse(data)
+	if err = pf.Parse(data); err != nil {
+		return err
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(yml_path))
+	if err != nil {
+		return err
+	}
+	for i := range *pf {
+		(*pf)[i].dir = dir
+	}
+
+	return nil
 }
 
 func (pf *PlaybookFile) Parse(data []byte) error {
@@ -0,0 +1,115 @@
+package ansible
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/inventory"
+	"github.com/state-of-the-art/ansiblego/pkg/core"
+	"github.com/state-of-the-art/ansiblego/pkg/factcache"
+)
+
+func TestFillVariablesCachedFacts(t *testing.T) {
+	cache, err := factcache.New("memory", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Set("host1", map[string]any{"os_family": "Debian"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &core.PlaybookConfig{FactCache: cache, InjectFactsAsVars: true}
+	p := &Playbook{}
+
+	vars := make(map[string]any)
+	p.fillVariables(cfg, &inventory.Host{Name: "host1", Vars: map[string]string{"ansible_connection": "ssh"}}, vars)
+	facts, ok := vars["ansible_facts"].(map[string]any)
+	if !ok || facts["os_family"] != "Debian" {
+		t.Fatalf("Cached facts are not in ansible_facts: %v", vars["ansible_facts"])
+	}
+	if vars["ansible_os_family"] != "Debian" {
+		t.Fatalf("Cached facts are not injected as vars: %v", vars["ansible_os_family"])
+	}
+
+	vars = make(map[string]any)
+	p.fillVariables(cfg, &inventory.Host{Name: "host2"}, vars)
+	if _, ok := vars["ansible_facts"]; ok {
+		t.Fatalf("Unexpected facts for the host without cache: %v", vars["ansible_facts"])
+	}
+}
+
+// Setup module stub counting the facts gatherings
+type testSetupModule struct {
+	runs *int
+}
+
+func (t *testSetupModule) GetData() (data OrderedMap) {
+	data.Set("setup", OrderedMap{})
+	return data
+}
+
+func (t *testSetupModule) SetData(data *OrderedMap) error {
+	data.Pop("setup")
+	return nil
+}
+
+func (t *testSetupModule) Run(ctx *TaskV2Context) (out OrderedMap, err error) {
+	*t.runs++
+	out.Set("ansible_os_family", "Debian")
+	return out, nil
+}
+
+func TestGatherFactsSmart(t *testing.T) {
+	runs := 0
+	orig := getTask
+	t.Cleanup(func() { getTask = orig })
+	getTask = func(name string) (TaskV2Interface, error) {
+		if name != "setup" {
+			return nil, fmt.Errorf("Unable to find module %q", name)
+		}
+		return &testSetupModule{runs: &runs}, nil
+	}
+
+	cache, err := factcache.New("memory", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &core.PlaybookConfig{FactCache: cache, Gathering: "smart", InjectFactsAsVars: true}
+	p := &Playbook{Name: "test"}
+	host := &inventory.Host{Name: "host1"}
+
+	// Cacheable facts of set_fact are not the gathered ones
+	vars := map[string]any{"ansible_facts": map[string]any{"custom": "value"}}
+	if err = p.gatherFacts(context.Background(), cfg, host, vars); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 1 {
+		t.Fatalf("Facts are not gathered with only set_fact facts present, runs: %d", runs)
+	}
+	facts, _ := vars["ansible_facts"].(map[string]any)
+	if facts["module_setup"] != true || facts["os_family"] != "Debian" || facts["custom"] != "value" {
+		t.Fatalf("Bad facts after gathering: %v", facts)
+	}
+	if vars["ansible_module_setup"] != true {
+		t.Errorf("Setup marker is not injected as var: %v", vars["ansible_module_setup"])
+	}
+
+	// Cached gathered facts are skipping the next gathering
+	vars = make(map[string]any)
+	p.loadCachedFacts(cfg, host, vars)
+	if err = p.gatherFacts(context.Background(), cfg, host, vars); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 1 {
+		t.Errorf("Facts are gathered again with cached setup facts, runs: %d", runs)
+	}
+
+	// Implicit gathering is not affected by the cache
+	cfg.Gathering = "implicit"
+	if err = p.gatherFacts(context.Background(), cfg, host, vars); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 2 {
+		t.Errorf("Facts are not gathered with implicit gathering, runs: %d", runs)
+	}
+}
@@ -1,6 +1,7 @@
 package ansible
 
 import (
+	"context"
 	"io/ioutil"
 
 	"gopkg.in/yaml.v3"
@@ -12,6 +13,7 @@ type Role struct {
 	Name        string      `yaml:"role"`
 	Environment *OrderedMap `yaml:",omitempty"`
 	Vars        *OrderedMap `yaml:",omitempty"`
+	Tags        Tags        `yaml:",omitempty"`
 }
 
 func (r *Role) Load(yml_path string) error {
@@ -36,7 +38,10 @@ func (r *Role) Yaml() (string, error) {
 	return ToYaml(r)
 }
 
-func (r *Role) Run(vars map[string]any) (OrderedMap, error) {
+func (r *Role) Run(ctx context.Context, vars map[string]any) (OrderedMap, error) {
+	// Role environment is applied to all the role tasks
+	defer overrideVar(vars, environment_var, mergeEnvironment(vars, orderedMapEnvironment(r.Environment)))()
+
 	log.Warnf("TODO: Executing role %q", r.Name)
 	return OrderedMap{}, nil
 }
@@ -0,0 +1,265 @@
+package ansible
+
+// Strategies to run the play steps on the hosts in parallel
+// Doc: https://docs.ansible.com/ansible/2.9/user_guide/playbooks_strategies.html
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/inventory"
+	"github.com/state-of-the-art/ansiblego/pkg/core"
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+)
+
+// One unit of the play execution for a host, the linear strategy waits for all the hosts to
+// complete the step before moving to the next one
+type playStep struct {
+	name string
+	run  func(hr *hostRun) error
+}
+
+// Execution state of the play for a single host
+type hostRun struct {
+	host *inventory.Host
+	vars map[string]any
+	// Host failed and will not run the next steps
+	err error
+}
+
+// Runs the step applying the facts delegated to the host by the tasks of the other hosts
+func (hr *hostRun) runStep(ctx context.Context, step playStep) error {
+	if state := playStateFrom(ctx); state != nil {
+		state.applyDelegatedFacts(hr.host.Name, hr.vars)
+	}
+	return step.run(hr)
+}
+
+// Runs the play on the hosts using the play or configured strategy, forks and serial batches
+func (p *Playbook) Run(ctx context.Context, cfg *core.PlaybookConfig, hosts []*inventory.Host) error {
+	strategy := p.Strategy
+	if strategy == "" {
+		strategy = cfg.Strategy
+	}
+	if strategy == "" {
+		strategy = "linear"
+	}
+	if strategy != "linear" && strategy != "free" {
+		return log.Errorf("Unknown strategy '%s' for playbook '%s'", strategy, p.Name)
+	}
+
+	batches, err := p.Serial.Batches(len(hosts))
+	if err != nil {
+		return log.Errorf("Invalid serial for playbook '%s': %v", p.Name, err)
+	}
+
+	log.Infof("Running playbook '%s' on %d hosts with strategy '%s' in %d batches...", p.Name, len(hosts), strategy, len(batches))
+
+	// Tasks are sharing the run_once results and delegated facts through the play state
+	state := newPlayState(cfg.Inventory, hosts)
+	defer state.closeConnections()
+	ctx = withPlayState(ctx, state)
+	steps := p.steps(ctx, cfg)
+
+	var failed []string
+	pos := 0
+	for _, size := range batches {
+		if ctx.Err() != nil {
+			return log.Errorf("Playbook '%s' execution is interrupted", p.Name)
+		}
+		runs := make([]*hostRun, 0, size)
+		for _, host := range hosts[pos : pos+size] {
+			hr := &hostRun{host: host, vars: make(map[string]any)}
+			p.fillVariables(cfg, host, hr.vars)
+			runs = append(runs, hr)
+		}
+		pos += size
+		state.newBatch()
+
+		if strategy == "free" {
+			p.runFree(ctx, cfg, steps, runs)
+		} else {
+			p.runLinear(ctx, cfg, steps, runs)
+		}
+
+		batch_failed := 0
+		for _, hr := range runs {
+			if hr.err != nil {
+				batch_failed++
+				failed = append(failed, hr.host.Name)
+			}
+		}
+		if batch_failed == 0 {
+			continue
+		}
+
+		if p.Any_errors_fatal {
+			log.Errorf("Stopping playbook '%s': any_errors_fatal is set and %d hosts failed", p.Name, batch_failed)
+			break
+		}
+		if percentage, exceeded := p.failLimitExceeded(runs); exceeded {
+			log.Errorf("Stopping playbook '%s': %.1f%% of hosts failed in batch which exceeds max_fail_percentage %v", p.Name, percentage, *p.Max_fail_percentage)
+			break
+		}
+	}
+
+	if ctx.Err() != nil {
+		return log.Errorf("Playbook '%s' execution is interrupted", p.Name)
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return log.Errorf("Playbook '%s' failed on hosts: %s", p.Name, strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// Prepares the ordered list of the play steps
+func (p *Playbook) steps(ctx context.Context, cfg *core.PlaybookConfig) (out []playStep) {
+	out = append(out, playStep{"Gathering facts", func(hr *hostRun) error {
+		return p.gatherFacts(ctx, cfg, hr.host, hr.vars)
+	}})
+
+	task_step := func(task *Task) playStep {
+		if task = task.FilterTags(p.Tags, cfg.Tags, cfg.SkipTags); task == nil {
+			return playStep{}
+		}
+		name := task.ModuleName
+		if !task.Name.IsEmpty() {
+			name = task.Name.String()
+		}
+		return playStep{name, func(hr *hostRun) error {
+			if _, err := task.Run(ctx, hr.vars); err != nil {
+				return log.Errorf("Error during playbook execution: %v", err)
+			}
+			return nil
+		}}
+	}
+	for _, task := range p.Pre_tasks {
+		out = appendStep(out, task_step(task))
+	}
+	for _, task := range p.Tasks {
+		out = appendStep(out, task_step(task))
+	}
+	for _, role := range p.Roles {
+		if !role.Tags.Inherit(p.Tags).Match(cfg.Tags, cfg.SkipTags) {
+			log.Debugf("Skipping role '%s' of playbook '%s' due to tags", role.Name, p.Name)
+			continue
+		}
+		role := role
+		out = append(out, playStep{"Role " + role.Name, func(hr *hostRun) error {
+			if _, err := role.Run(ctx, hr.vars); err != nil {
+				return log.Errorf("Error during playbook execution: %v", err)
+			}
+			return nil
+		}})
+	}
+	for _, task := range p.Post_tasks {
+		out = appendStep(out, task_step(task))
+	}
+
+	// Storing facts again to keep the cacheable facts set during execution
+	out = append(out, playStep{"Caching facts", func(hr *hostRun) error {
+		p.cacheFacts(cfg, hr.host, hr.vars)
+		return nil
+	}})
+
+	return out
+}
+
+// Skips the empty steps of the tasks filtered out by tags
+func appendStep(steps []playStep, step playStep) []playStep {
+	if step.run == nil {
+		return steps
+	}
+	return append(steps, step)
+}
+
+// Checks if the part of the failed hosts in the batch is over the max_fail_percentage
+func (p *Playbook) failLimitExceeded(runs []*hostRun) (percentage float64, exceeded bool) {
+	if p.Max_fail_percentage == nil || len(runs) == 0 {
+		return 0, false
+	}
+	failed := 0
+	for _, hr := range runs {
+		if hr.err != nil {
+			failed++
+		}
+	}
+	percentage = float64(failed) * 100 / float64(len(runs))
+	return percentage, percentage > *p.Max_fail_percentage
+}
+
+// Every step is executed on all the hosts of the batch before moving to the next one. The
+// failures are checked after each step, but role and block are running as a single step, so
+// the hosts are synced and max_fail_percentage is checked only after the whole role or block.
+func (p *Playbook) runLinear(ctx context.Context, cfg *core.PlaybookConfig, steps []playStep, runs []*hostRun) {
+	forks := make(chan struct{}, cfg.ForksNum())
+
+	for _, step := range steps {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Debugf("Running step '%s' of playbook '%s'", step.name, p.Name)
+
+		var wg sync.WaitGroup
+		var step_failed atomic.Bool
+		for _, hr := range runs {
+			if hr.err != nil {
+				continue
+			}
+			wg.Add(1)
+			forks <- struct{}{}
+			go func(hr *hostRun) {
+				defer wg.Done()
+				defer func() { <-forks }()
+				if hr.err = hr.runStep(ctx, step); hr.err != nil {
+					log.Errorf("Host '%s' failed on step '%s': %v", hr.host.Name, step.name, hr.err)
+					step_failed.Store(true)
+				}
+			}(hr)
+		}
+		wg.Wait()
+
+		if p.Any_errors_fatal && step_failed.Load() {
+			return
+		}
+		if _, exceeded := p.failLimitExceeded(runs); exceeded {
+			return
+		}
+	}
+}
+
+// Every host runs through the steps on its own pace, the forks are limiting the number of
+// steps running at the same time
+func (p *Playbook) runFree(ctx context.Context, cfg *core.PlaybookConfig, steps []playStep, runs []*hostRun) {
+	forks := make(chan struct{}, cfg.ForksNum())
+
+	var wg sync.WaitGroup
+	var abort atomic.Bool
+	for _, hr := range runs {
+		wg.Add(1)
+		go func(hr *hostRun) {
+			defer wg.Done()
+			for _, step := range steps {
+				if abort.Load() || ctx.Err() != nil {
+					return
+				}
+				forks <- struct{}{}
+				hr.err = hr.runStep(ctx, step)
+				<-forks
+				if hr.err != nil {
+					log.Errorf("Host '%s' failed on step '%s': %v", hr.host.Name, step.name, hr.err)
+					if p.Any_errors_fatal {
+						abort.Store(true)
+					}
+					return
+				}
+			}
+		}(hr)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,172 @@
+package ansible
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/inventory"
+	"github.com/state-of-the-art/ansiblego/pkg/core"
+	"github.com/state-of-the-art/ansiblego/pkg/factcache"
+)
+
+// Module keeps the host in its state to catch the module object shared between the forks
+type testModule struct {
+	Value string
+	host  string
+}
+
+func (t *testModule) GetData() (data OrderedMap) {
+	var fmap OrderedMap
+	fmap.Set("value", t.Value)
+	data.Set("test_module", fmap)
+	return data
+}
+
+func (t *testModule) SetData(data *OrderedMap) error {
+	d, _ := data.Pop("test_module")
+	fmap, ok := d.(OrderedMap)
+	if !ok {
+		return fmt.Errorf("The 'test_module' is not the OrderedMap")
+	}
+	val, _ := fmap.Get("value")
+	t.Value, _ = val.(string)
+	return nil
+}
+
+func (t *testModule) Run(ctx *TaskV2Context) (out OrderedMap, err error) {
+	t.host, _ = ctx.Vars["inventory_hostname"].(string)
+	if t.Value == "fail-"+t.host {
+		return out, fmt.Errorf("Module failed on host %q", t.host)
+	}
+	var facts OrderedMap
+	facts.Set("test_result", t.Value+"-"+t.host)
+	out.Set("ansible_facts", facts)
+	out.Set("_ansible_facts_cacheable", true)
+	return out, nil
+}
+
+func stubModules(t *testing.T) {
+	orig := getTask
+	t.Cleanup(func() { getTask = orig })
+	getTask = func(name string) (TaskV2Interface, error) {
+		if name != "test_module" {
+			return nil, fmt.Errorf("Unable to find module %q", name)
+		}
+		return &lockedTask{task: &testModule{}, mu: &sync.Mutex{}}, nil
+	}
+}
+
+func TestRunStrategiesForks(t *testing.T) {
+	stubModules(t)
+
+	for _, strategy := range []string{"linear", "free"} {
+		t.Run(strategy, func(t *testing.T) {
+			inv, err := inventory.ReadHostList("host1,host2,host3,host4,host5,host6,host7,host8")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hosts []*inventory.Host
+			for _, host := range inv.Hosts {
+				host.Vars["ansible_connection"] = "local"
+				hosts = append(hosts, host)
+			}
+			cache, err := factcache.New("memory", "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := &core.PlaybookConfig{Inventory: inv, Forks: 4, FactCache: cache}
+
+			task := &Task{Name: NewTString("Test"), ModuleName: "test_module", ModuleData: &testModule{Value: "test"}}
+			gather := false
+			p := &Playbook{Name: "test", Strategy: strategy, Gather_facts: &gather}
+			for i := 0; i < 5; i++ {
+				p.Tasks = append(p.Tasks, task)
+			}
+			if err = p.Run(context.Background(), cfg, hosts); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, host := range hosts {
+				facts, _ := cache.Get(host.Name)
+				if expected := "test-" + host.Name; facts["test_result"] != expected {
+					t.Errorf("Host %q result is %v, expected %q", host.Name, facts["test_result"], expected)
+				}
+			}
+		})
+	}
+}
+
+func TestRunLinearMaxFailPercentage(t *testing.T) {
+	stubModules(t)
+
+	for name, test := range map[string]struct {
+		percentage float64
+		completed  bool
+	}{
+		"exceeded":     {20, false},
+		"not_exceeded": {25, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			inv, err := inventory.ReadHostList("host1,host2,host3,host4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hosts []*inventory.Host
+			for _, host := range inv.Hosts {
+				host.Vars["ansible_connection"] = "local"
+				hosts = append(hosts, host)
+			}
+			cache, err := factcache.New("memory", "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := &core.PlaybookConfig{Inventory: inv, Forks: 4, FactCache: cache}
+
+			// One of four hosts fails on the first task, the limit is checked before the next one
+			gather := false
+			p := &Playbook{Name: "test", Gather_facts: &gather, Max_fail_percentage: &test.percentage}
+			p.Tasks = append(p.Tasks,
+				&Task{Name: NewTString("Fail"), ModuleName: "test_module", ModuleData: &testModule{Value: "fail-host1"}},
+				&Task{Name: NewTString("Test"), ModuleName: "test_module", ModuleData: &testModule{Value: "test"}},
+			)
+			if err = p.Run(context.Background(), cfg, hosts); err == nil {
+				t.Fatal("Expected playbook error for the failed host")
+			}
+
+			for _, host := range hosts {
+				if host.Name == "host1" {
+					continue
+				}
+				facts, _ := cache.Get(host.Name)
+				if _, ok := facts["test_result"]; ok != test.completed {
+					t.Errorf("Host %q completed the play: %v, expected %v", host.Name, ok, test.completed)
+				}
+			}
+		})
+	}
+}
+
+func TestLockedTaskConcurrent(t *testing.T) {
+	// Module objects of the same interp are sharing the lock
+	mu := &sync.Mutex{}
+	module := &testModule{Value: "test"}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			task := &lockedTask{task: module, mu: mu}
+			vars := map[string]any{"inventory_hostname": fmt.Sprintf("host%d", i)}
+			if _, err := task.Run(&TaskV2Context{Vars: vars}); err != nil {
+				t.Error(err)
+			}
+			data := task.GetData()
+			if err := task.SetData(&data); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,166 @@
+package ansible
+
+// Doc: https://docs.ansible.com/ansible/2.9/user_guide/playbooks_tags.html
+// The tags are applied to the play tasks, blocks and roles. The dynamic includes (like
+// `include_role`) are not implemented yet, so the tags of the included tasks are out of scope.
+
+import (
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Tags could be set as a comma separated string or a list of strings
+type Tags []string
+
+func (tg *Tags) UnmarshalYAML(node *yaml.Node) error {
+	var tags []string
+	if node.Kind == yaml.ScalarNode {
+		var val string
+		if err := node.Decode(&val); err != nil {
+			return err
+		}
+		tags = strings.Split(val, ",")
+	} else if err := node.Decode(&tags); err != nil {
+		return err
+	}
+
+	*tg = nil
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			*tg = append(*tg, tag)
+		}
+	}
+	return nil
+}
+
+// Returns new tags list with the inherited parent tags and own tags
+func (tg Tags) Inherit(parent Tags) (out Tags) {
+	out = append(out, parent...)
+	for _, tag := range tg {
+		if !out.Has(tag) {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+func (tg Tags) Has(tag string) bool {
+	for _, t := range tg {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (tg Tags) hasAny(tags []string) bool {
+	for _, tag := range tags {
+		if tg.Has(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the tags against --tags (only) and --skip-tags (skip) the same way Ansible does:
+// * `always` runs unless skipped explicitly, `never` runs only when requested explicitly
+// * `tagged` and `untagged` are matching the items with or without tags
+// * `all` (default for only) matches everything except for `never`
+func (tg Tags) Match(only, skip []string) bool {
+	tags := tg
+	if len(tags) == 0 {
+		tags = Tags{"untagged"}
+	}
+	untagged := len(tg) == 0
+	only_tags, skip_tags := Tags(only), Tags(skip)
+	if len(only_tags) == 0 {
+		only_tags = Tags{"all"}
+	}
+
+	switch {
+	case tags.Has("always"):
+	case only_tags.Has("all") && !tags.Has("never"):
+	case tags.hasAny(only_tags):
+	case only_tags.Has("tagged") && !untagged && !tags.Has("never"):
+	default:
+		return false
+	}
+
+	switch {
+	case skip_tags.Has("all"):
+		return tags.Has("always") && !skip_tags.Has("always")
+	case tags.hasAny(skip_tags):
+		return false
+	case skip_tags.Has("tagged") && !untagged:
+		return false
+	}
+
+	return true
+}
+
+// Returns the task with only the subtasks matching the tags or nil if there is nothing to run,
+// the block tags are inherited by the subtasks
+func (t *Task) FilterTags(parent Tags, only, skip []string) *Task {
+	tags := t.Tags.Inherit(parent)
+	if len(t.Block) < 1 {
+		if tags.Match(only, skip) {
+			return t
+		}
+		return nil
+	}
+
+	var block []*Task
+	for _, task := range t.Block {
+		if filtered := task.FilterTags(tags, only, skip); filtered != nil {
+			block = append(block, filtered)
+		}
+	}
+	if len(block) < 1 {
+		return nil
+	}
+	filtered := *t
+	filtered.Block = block
+	return &filtered
+}
+
+// Collects the tags of the task and the subtasks matching the filter
+func (t *Task) listTags(parent Tags, only, skip []string, found map[string]bool) {
+	tags := t.Tags.Inherit(parent)
+	if len(t.Block) < 1 {
+		if tags.Match(only, skip) {
+			for _, tag := range tags {
+				found[tag] = true
+			}
+		}
+		return
+	}
+	for _, task := range t.Block {
+		task.listTags(tags, only, skip, found)
+	}
+}
+
+// Returns the sorted list of tags used by the play tasks and roles which are selected to run
+func (p *Playbook) ListTags(only, skip []string) (out []string) {
+	found := map[string]bool{}
+	for _, tasks := range [][]*Task{p.Pre_tasks, p.Tasks, p.Post_tasks} {
+		for _, task := range tasks {
+			task.listTags(p.Tags, only, skip, found)
+		}
+	}
+	for _, role := range p.Roles {
+		tags := role.Tags.Inherit(p.Tags)
+		if tags.Match(only, skip) {
+			for _, tag := range tags {
+				found[tag] = true
+			}
+		}
+	}
+
+	for tag := range found {
+		out = append(out, tag)
+	}
+	sort.Strings(out)
+	return out
+}
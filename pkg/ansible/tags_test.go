@@ -0,0 +1,108 @@
+package ansible
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestTagsMatch(t *testing.T) {
+	for name, test := range map[string]struct {
+		tags     Tags
+		only     []string
+		skip     []string
+		expected bool
+	}{
+		"default_untagged":         {nil, nil, nil, true},
+		"default_tagged":           {Tags{"a"}, nil, nil, true},
+		"default_never":            {Tags{"never"}, nil, nil, false},
+		"default_always":           {Tags{"always"}, nil, nil, true},
+		"only_match":               {Tags{"a", "b"}, []string{"b"}, nil, true},
+		"only_no_match":            {Tags{"a"}, []string{"b"}, nil, false},
+		"only_untagged_item":       {nil, []string{"a"}, nil, false},
+		"only_always":              {Tags{"always"}, []string{"a"}, nil, true},
+		"only_never_requested":     {Tags{"never", "debug"}, []string{"debug"}, nil, true},
+		"only_never_not_requested": {Tags{"never", "debug"}, []string{"a"}, nil, false},
+		"only_never_by_name":       {Tags{"never"}, []string{"never"}, nil, true},
+		"all":                      {Tags{"a"}, []string{"all"}, nil, true},
+		"all_untagged":             {nil, []string{"all"}, nil, true},
+		"all_never":                {Tags{"never", "a"}, []string{"all"}, nil, false},
+		"tagged":                   {Tags{"a"}, []string{"tagged"}, nil, true},
+		"tagged_untagged_item":     {nil, []string{"tagged"}, nil, false},
+		"tagged_never":             {Tags{"never", "a"}, []string{"tagged"}, nil, false},
+		"untagged":                 {nil, []string{"untagged"}, nil, true},
+		"untagged_tagged_item":     {Tags{"a"}, []string{"untagged"}, nil, false},
+		"skip_match":               {Tags{"a", "b"}, nil, []string{"b"}, false},
+		"skip_no_match":            {Tags{"a"}, nil, []string{"b"}, true},
+		"skip_wins_over_only":      {Tags{"a"}, []string{"a"}, []string{"a"}, false},
+		"skip_always_by_name":      {Tags{"always"}, nil, []string{"always"}, false},
+		"skip_other_keeps_always":  {Tags{"always", "a"}, nil, []string{"a"}, false},
+		"skip_all":                 {Tags{"a"}, nil, []string{"all"}, false},
+		"skip_all_keeps_always":    {Tags{"always"}, nil, []string{"all"}, true},
+		"skip_all_and_always":      {Tags{"always"}, nil, []string{"all", "always"}, false},
+		"skip_tagged":              {Tags{"a"}, nil, []string{"tagged"}, false},
+		"skip_tagged_untagged":     {nil, nil, []string{"tagged"}, true},
+		"skip_untagged":            {nil, nil, []string{"untagged"}, false},
+		"skip_untagged_tagged":     {Tags{"a"}, nil, []string{"untagged"}, true},
+		"skip_never_requested":     {Tags{"never", "debug"}, []string{"debug"}, []string{"never"}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if out := test.tags.Match(test.only, test.skip); out != test.expected {
+				t.Errorf("Tags %q with only %q and skip %q matched: %v, expected %v", test.tags, test.only, test.skip, out, test.expected)
+			}
+		})
+	}
+}
+
+func TestTagsUnmarshal(t *testing.T) {
+	for name, test := range map[string]struct {
+		data     string
+		expected Tags
+	}{
+		"string": {"tags: a, b ,,c", Tags{"a", "b", "c"}},
+		"list":   {"tags: [a, ' b ', '']", Tags{"a", "b"}},
+		"empty":  {"tags: ''", nil},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var out struct{ Tags Tags }
+			if err := yaml.Unmarshal([]byte(test.data), &out); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Tags, test.expected) {
+				t.Errorf("Tags are %q, expected %q", out.Tags, test.expected)
+			}
+		})
+	}
+}
+
+func TestFilterTagsBlock(t *testing.T) {
+	block := &Task{
+		Name: NewTString("Block"),
+		Tags: Tags{"block"},
+		Block: []*Task{
+			{Name: NewTString("First"), Tags: Tags{"first"}},
+			{Name: NewTString("Second")},
+		},
+	}
+
+	// Block tags are inherited by the subtasks
+	filtered := block.FilterTags(Tags{"play"}, []string{"block"}, nil)
+	if filtered == nil || len(filtered.Block) != 2 {
+		t.Fatalf("Block subtasks are filtered out: %v", filtered)
+	}
+	if filtered = block.FilterTags(nil, []string{"play"}, nil); filtered != nil {
+		t.Fatalf("Block is not filtered out: %v", filtered)
+	}
+	if filtered = block.FilterTags(Tags{"play"}, []string{"play"}, []string{"first"}); filtered == nil || len(filtered.Block) != 1 || filtered.Block[0].Name.String() != "Second" {
+		t.Fatalf("Skipped subtask is not filtered out: %v", filtered)
+	}
+	if len(block.Block) != 2 {
+		t.Fatalf("Original block is modified: %v", block.Block)
+	}
+
+	p := &Playbook{Tags: Tags{"play"}, Tasks: []*Task{block}, Roles: []*Role{{Name: "role", Tags: Tags{"role"}}}}
+	if out := p.ListTags(nil, []string{"first"}); !reflect.DeepEqual(out, []string{"block", "play", "role"}) {
+		t.Errorf("Listed tags are %q", out)
+	}
+}
@@ -1,20 +1,18 @@
 package ansible
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"reflect"
-	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 
-	"github.com/state-of-the-art/ansiblego/pkg/embedbin"
 	"github.com/state-of-the-art/ansiblego/pkg/log"
-	"github.com/state-of-the-art/ansiblego/pkg/transport"
-	"github.com/state-of-the-art/ansiblego/pkg/transport/ssh"
-	"github.com/state-of-the-art/ansiblego/pkg/transport/winrm"
+	"github.com/state-of-the-art/ansiblego/pkg/template"
+	"github.com/state-of-the-art/ansiblego/pkg/util"
 )
 
 type Task struct {
@@ -27,15 +25,31 @@ type Task struct {
 	When TString `yaml:",omitempty"` // Only string right now, array looks confusing
 	// Boolean that controls if privilege escalation is used or not on Task execution.
 	Become TBool `yaml:",omitempty"`
+	// User that you 'become' after using privilege escalation.
+	Become_user TString `yaml:",omitempty"`
+	// Which method of privilege escalation to use (such as sudo, su, doas or runas).
+	Become_method TString `yaml:",omitempty"`
 	// Dictionary/map of variables specified in task
 	Vars *TAnyMap `yaml:",omitempty"`
+	// Overrides the check mode for the task, it will not change the system when enabled
+	Check_mode TBool `yaml:",omitempty"`
+	// Overrides the diff mode for the task to show the changes it makes
+	Diff TBool `yaml:",omitempty"`
+	// Tags applied to the task, allow selecting or skipping the task with --tags and --skip-tags
+	Tags Tags `yaml:",omitempty"`
 	// Name of variable that will contain task status and module return data.
 	Register TString `yaml:",omitempty"`
 
 	// Host to execute task instead of the target (inventory_hostname). Connection vars from the delegated host will also be used for the task.
 	Delegate_to TString `yaml:",omitempty"`
+	// Applies the facts gathered by the delegated task to the delegated host instead of the target.
+	Delegate_facts TBool `yaml:",omitempty"`
+	// Executes the task on the first host of the batch only and applies the result to all of them.
+	Run_once TBool `yaml:",omitempty"`
 	// Conditional expression that overrides the task’s normal ‘failed’ status.
 	Failed_when TString `yaml:",omitempty"`
+	// Time limit for the task to execute in seconds, the task is interrupted and fails if exceeded.
+	Timeout TInt `yaml:",omitempty"`
 
 	// Loop through list of items
 	With_items TStringList `yaml:",omitempty"`
@@ -50,7 +64,7 @@ type Task struct {
 	// Found task module name
 	ModuleName string `yaml:"-"`
 	// Loaded implementation of the task module
-	ModuleData TaskV1Interface `yaml:"-"`
+	ModuleData TaskV2Interface `yaml:"-"`
 }
 
 type tmpTask Task // Used for quick yml unmarshal
@@ -97,11 +111,20 @@ func (t *Task) UnmarshalYAML(value *yaml.Node) (err error) {
 	t.Block = tmp_task.Block
 	t.When = tmp_task.When
 	t.Become = tmp_task.Become
+	t.Become_user = tmp_task.Become_user
+	t.Become_method = tmp_task.Become_method
 	t.Vars = tmp_task.Vars
 	t.With_items = tmp_task.With_items
 	t.With_dict = tmp_task.With_dict
 	t.Failed_when = tmp_task.Failed_when
 	t.Register = tmp_task.Register
+	t.Tags = tmp_task.Tags
+	t.Check_mode = tmp_task.Check_mode
+	t.Diff = tmp_task.Diff
+	t.Delegate_to = tmp_task.Delegate_to
+	t.Delegate_facts = tmp_task.Delegate_facts
+	t.Run_once = tmp_task.Run_once
+	t.Timeout = tmp_task.Timeout
 
 	// Collecting the structure fields to fill
 	struct_v := reflect.ValueOf(t)
@@ -126,6 +149,21 @@ func (t *Task) UnmarshalYAML(value *yaml.Node) (err error) {
 	}
 
 	var task_fields OrderedMap
+	// The local_action is a short form of the module delegated to localhost
+	if node, ok := tmp_fields["local_action"]; ok {
+		delete(tmp_fields, "local_action")
+		name, args, err := parseLocalAction(&node)
+		if err != nil {
+			return fmt.Errorf("Unable to parse local_action of task `%s`: %v", t.Name, err)
+		}
+		if !ModuleIsTask(name) {
+			return fmt.Errorf("Task module `%s` of local_action in task `%s` is not implemented", name, t.Name)
+		}
+		t.ModuleName = name
+		t.Delegate_to = NewTString("localhost")
+		task_fields.Set(name, args)
+	}
+
 	// Searching the unknown fields in yaml map
 	for k, node := range tmp_fields {
 		// Removing prefix for the `win_` field since ansiblego have universal ones
@@ -167,7 +205,7 @@ func (t *Task) UnmarshalYAML(value *yaml.Node) (err error) {
 		}
 
 		// Getting task module
-		t.ModuleData, err = GetTaskV1(t.ModuleName)
+		t.ModuleData, err = getTask(t.ModuleName)
 		if err != nil {
 			return fmt.Errorf("Unable to get definition variable from task module `%s`: %s", t.ModuleName, err)
 		}
@@ -213,136 +251,249 @@ func (t *Task) MarshalYAML() (any, error) {
 	return node, nil
 }
 
-func (t *Task) Run(vars map[string]any) (data OrderedMap, err error) {
+func (t *Task) Run(ctx context.Context, vars map[string]any) (data OrderedMap, err error) {
+	// Task and block could override the modes and become for itself and the subtasks
+	defer t.overrideKeywords(vars)()
+
 	if len(t.Block) > 0 {
 		if !t.Name.IsEmpty() {
 			log.Warnf("Executing task block '%s'", t.Name)
 		}
 		for _, task := range t.Block {
-			if _, err = task.Run(vars); err != nil {
+			if _, err = task.Run(ctx, vars); err != nil {
 				return
 			}
 		}
-	} else {
-		// In case need to be executed remotely - route task to the proper transport
-		if t.IsRemote(vars) {
-			log.Infof("Executing task '%s' remotely", t.Name)
-			var client transport.Transport
-
-			if vars["ansible_connection"] == "ssh" {
-				user, ok1 := vars["ansible_ssh_user"].(string)
-				host, ok2 := vars["ansible_ssh_host"].(string)
-				port_str, ok3 := vars["ansible_ssh_port"].(string)
-				if !(ok1 && ok2 && ok3) {
-					return data, log.Error("Unable to get the necessary vars to connect via SSH")
-				}
-
-				port, err := strconv.Atoi(port_str)
-				if err != nil {
-					return data, log.Errorf("Unable to use non-int port: %q", port_str)
-				}
+		return
+	}
 
-				log.Debugf("Connecting via SSH to '%s@%s:%d'", user, host, port)
-
-				// Check if password or key provided and create needed ssh connection
-				if password, ok4 := vars["ansible_password"].(string); ok4 {
-					if client, err = ssh.NewPass(user, password, host, port); err != nil {
-						return data, log.Error("Unable to connect to SSH by password:", err)
-					}
-				} else if password, ok4 := vars["ansible_ssh_private_key_file"].(string); ok4 {
-					if client, err = ssh.NewKey(user, password, host, port); err != nil {
-						return data, log.Error("Unable to connect to SSH by key:", err)
-					}
-				} else {
-					return data, log.Error("Unable to get password or key to connect via SSH")
-				}
-			} else if vars["ansible_connection"] == "winrm" {
-				user, ok1 := vars["ansible_winrm_user"].(string)
-				password, ok2 := vars["ansible_winrm_password"].(string)
-				host, ok3 := vars["ansible_winrm_host"].(string)
-				port_str, ok4 := vars["ansible_winrm_port"].(string)
-				if !(ok1 && ok2 && ok3 && ok4) {
-					return data, log.Error("Unable to get the necessary vars to connect via WinRM")
-				}
+	timeout, err := t.timeout(vars)
+	if err != nil {
+		return data, log.Errorf("Invalid timeout of task '%s': %v", t.Name, err)
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-				port, err := strconv.Atoi(port_str)
-				if err != nil {
-					return data, log.Errorf("Unable to use non-int port: %q", port_str)
-				}
+	if state := playStateFrom(ctx); state != nil && varBool(vars[run_once_var]) {
+		return state.runOnce(ctx, t, vars)
+	}
+	return t.runModule(ctx, vars)
+}
 
-				log.Debugf("Connecting via WinRM to '%s@%s:%d'", user, host, port)
+// Module loader, could be replaced to run the tasks without interp
+var getTask = GetTask
 
-				if client, err = winrm.New(user, password, host, port); err != nil {
-					return data, log.Error("Unable to connect to WinRM:", err)
-				}
-				/*kern, arch, err := client.Check()
-				if err != nil {
-					return data, log.Error("Failed to execute WinRM check:", err)
-				}
-				log.Info("WinRM Remote system is:", kern, arch)
+// Var to execute the local tasks through the local transport and agent instead of in-process
+const local_subprocess_var = "ansible_local_subprocess"
 
-				if err := client.Execute("ipconfig /all", os.Stdout, os.Stderr); err != nil {
-					return data, log.Error("Failed to execute command over WinRM:", err)
-				}
+// Executes the task module locally or on the remote host, delegated tasks are using the
+// connection of the delegated host
+func (t *Task) runModule(ctx context.Context, target_vars map[string]any) (data OrderedMap, err error) {
+	delegate_host, err := t.delegateHost(target_vars)
+	if err != nil {
+		return data, log.Errorf("Unable to delegate task '%s': %v", t.Name, err)
+	}
+	vars := target_vars
+	if delegate_host != "" {
+		log.Debugf("Delegating task '%s' to host '%s'", t.Name, delegate_host)
+		vars = t.delegateVars(ctx, delegate_host, target_vars)
+	}
 
-				// WinRM Embed binary test
-				embed_fd, err := embedbin.GetEmbeddedBinary(kern, arch)
-				if err != nil {
-					return data, log.Error("Unable to find required binary for remote system:", err)
-				}
-				defer embed_fd.Close()
+	module, err := t.newModule()
+	if err != nil {
+		return data, log.Errorf("Unable to prepare module of task '%s': %v", t.Name, err)
+	}
 
-				// Copy embed file with WinRM
-				if err := client.Copy(embed_fd, "C:\\ansiblego.exe", 0750); err != nil {
-					return data, log.Error("Failed to execute command over WinRM:", err)
-				}*/
-			} else {
-				return data, log.Errorf("Unable to find connection plugin for %q", vars["ansible_connection"])
+	if TaskV1CheckMode(vars) && !taskSupportsCheckMode(module) {
+		log.Infof("Skipping task '%s': module '%s' does not support check mode", t.Name, t.ModuleName)
+		data.Set("skipped", true)
+		data.Set("msg", "remote module ("+t.ModuleName+") does not support check mode")
+	} else {
+		// In case need to be executed remotely - route task to the proper transport
+		if t.IsRemote(vars) {
+			log.Infof("Executing task '%s' remotely", t.Name)
+			conn, err := ConnectionFromVars(vars)
+			if err != nil {
+				return data, log.Errorf("Unable to execute task '%s': %v", t.Name, err)
 			}
-
-			// Getting the system info
-			kern, arch, err := client.Check()
+			client, release, err := connectHost(ctx, conn)
 			if err != nil {
-				return data, log.Error("Failed to execute remote system check:", err)
+				return data, log.Errorf("Unable to execute task '%s': %v", t.Name, err)
 			}
-			log.Debug("Remote system is:", kern, arch)
+			defer release()
 
-			// Getting fitting embed ansiblego exec data
-			embed_fd, err := embedbin.GetEmbeddedBinary(kern, arch)
+			kern, exe, err := uploadAgent(client)
 			if err != nil {
-				return data, log.Error("Unable to find ansiblego binary for target system:", err)
+				return data, log.Errorf("Unable to execute task '%s': %v", t.Name, err)
 			}
-			defer embed_fd.Close()
-
-			// Copy embed file to the target system
-			if err := client.Copy(embed_fd, "/tmp/ansiblego", 0750); err != nil {
-				return data, log.Error("Failed to copy ansiblego agent to target system:", err)
+			cleanup, err := t.prepareFiles(ctx, client, kern, module, vars)
+			if err != nil {
+				return data, log.Errorf("Unable to prepare files of task '%s': %v", t.Name, err)
 			}
-
-			// TODO: Execute the module via ansiblego agent
-			// Check ansiblego can be running
-			if err := client.Execute("/tmp/ansiblego", os.Stdout, os.Stderr); err != nil {
-				return data, log.Error("Failed to execute ansiblego agent:", err)
+			defer cleanup()
+			if data, err = RunAgent(ctx, client, kern, exe, module, vars); err != nil {
+				return data, err
 			}
 		} else {
 			log.Infof("Executing task '%s' locally", t.Name)
-			return t.ModuleData.Run(vars)
+			if _, err = t.prepareFiles(ctx, nil, "", module, vars); err != nil {
+				return data, log.Errorf("Unable to prepare files of task '%s': %v", t.Name, err)
+			}
+			if b, ok := BecomeFromVars(vars); ok {
+				log.Debugf("Executing task '%s' as user %q with %s", t.Name, b.User, b.Method)
+				if data, err = RunBecome(ctx, b, module, vars); err != nil {
+					return data, err
+				}
+			} else {
+				task_ctx, err := t.newContext(ctx, vars)
+				if err != nil {
+					return data, log.Errorf("Unable to prepare task '%s': %v", t.Name, err)
+				}
+				defer task_ctx.Cleanup()
+				if data, err = module.Run(task_ctx); err != nil {
+					return data, err
+				}
+			}
 		}
+		// Facts and diff are processed the same way for the local and remote execution
+		t.applyResult(ctx, data, target_vars)
+		t.showDiff(data, vars)
 	}
 
 	return
 }
 
-func (t *Task) IsRemote(vars map[string]any) bool {
-	if t.Delegate_to.Val() == "localhost" {
-		return false
+// Task is shared between the forks, so every execution gets its own module object with the task
+// data to not share the module state between the hosts
+func (t *Task) newModule() (TaskV2Interface, error) {
+	module, err := getTask(t.ModuleName)
+	if err != nil {
+		return nil, err
 	}
-	if t.Delegate_to.Val() == "" {
-		// Refer to the variables
-		if val, ok := vars["ansible_connection"]; ok && val.(string) == "local" || !ok {
-			return false
+	data := t.ModuleData.GetData()
+	if err = module.SetData(&data); err != nil {
+		return nil, err
+	}
+	return module, nil
+}
+
+// Returns the task time limit, zero means no limit
+func (t *Task) timeout(vars map[string]any) (time.Duration, error) {
+	if t.Timeout.IsEmpty() {
+		return 0, nil
+	}
+	val := t.Timeout.String()
+	if template.IsTemplate(val) {
+		var err error
+		if val, err = template.Process(val, vars); err != nil {
+			return 0, err
 		}
 	}
+	seconds, err := varInt(val)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
 
-	return true
+// Prepares the execution context for the task module
+func (t *Task) newContext(ctx context.Context, vars map[string]any) (*TaskV2Context, error) {
+	out, err := NewTaskV2Context(ctx, vars)
+	if err != nil {
+		return nil, err
+	}
+	out.TaskName = t.Name.String()
+	out.ModuleName = t.ModuleName
+	out.Log.prefix = fmt.Sprintf("[%s] ", t.Name)
+	return out, nil
+}
+
+// Sets the task keywords like check mode, become or environment to vars and returns function to
+// restore them
+func (t *Task) overrideKeywords(vars map[string]any) func() {
+	var restore []func()
+	override := func(key string, empty bool, val any) {
+		if !empty {
+			restore = append(restore, overrideVar(vars, key, val))
+		}
+	}
+	override("ansible_check_mode", t.Check_mode.IsEmpty(), t.Check_mode.Val())
+	override("ansible_diff_mode", t.Diff.IsEmpty(), t.Diff.Val())
+	override("ansible_become", t.Become.IsEmpty(), t.Become.Val())
+	override("ansible_become_user", t.Become_user.IsEmpty(), t.Become_user.Val())
+	override("ansible_become_method", t.Become_method.IsEmpty(), t.Become_method.Val())
+	override(environment_var, t.Environment == nil, mergeEnvironment(vars, t.environment()))
+	override(run_once_var, t.Run_once.IsEmpty(), t.Run_once.Val())
+
+	return func() {
+		for _, f := range restore {
+			f()
+		}
+	}
+}
+
+// Prints the changes the task made (or would make in check mode) if diff mode is enabled
+func (t *Task) showDiff(data OrderedMap, vars map[string]any) {
+	if !TaskV1DiffMode(vars) {
+		return
+	}
+	diff_data, ok := data.Get("diff")
+	if !ok {
+		return
+	}
+	diff, ok := diff_data.(OrderedMap)
+	if !ok {
+		return
+	}
+
+	// Module could prepare the diff by itself
+	if prepared, ok := diff.Get("prepared"); ok {
+		log.Infof("Diff of task '%s':\n%v", t.Name, prepared)
+		return
+	}
+	get := func(key string) string {
+		val, _ := diff.Get(key)
+		str, _ := val.(string)
+		return str
+	}
+	if out := util.UnifiedDiff(get("before"), get("after"), "before: "+get("before_header"), "after: "+get("after_header")); out != "" {
+		log.Infof("Diff of task '%s':\n%s", t.Name, out)
+	}
+}
+
+// Modules could return facts (like set_fact does) which are becoming variables for the next tasks
+// and the cacheable ones are placed to `ansible_facts` to be stored in the fact cache
+func applyFacts(data OrderedMap, vars map[string]any) {
+	facts_data, _ := data.Get("ansible_facts")
+	facts, ok := facts_data.(OrderedMap)
+	if !ok {
+		return
+	}
+	cacheable, _ := data.Get("_ansible_facts_cacheable")
+
+	for _, key := range facts.Keys() {
+		val, _ := facts.Get(key)
+		log.Tracef("Setting fact '%s': %q", key, val)
+		vars[key] = val
+		if cacheable == true {
+			ansible_facts, ok := vars["ansible_facts"].(map[string]any)
+			if !ok {
+				ansible_facts = make(map[string]any)
+				vars["ansible_facts"] = ansible_facts
+			}
+			ansible_facts[strings.TrimPrefix(key, "ansible_")] = val
+		}
+	}
+}
+
+// Delegation is resolved before, so the connection vars are pointing to the execution host.
+// Local tasks are running the agent in subprocess like the remote ones if it's enabled.
+func (t *Task) IsRemote(vars map[string]any) bool {
+	if val, ok := vars["ansible_connection"]; ok {
+		return val != "local" || varBool(vars[local_subprocess_var])
+	}
+	return false
 }
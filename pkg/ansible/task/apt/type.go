@@ -4,12 +4,17 @@ package apt
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/state-of-the-art/ansiblego/pkg/ansible"
 	"github.com/state-of-the-art/ansiblego/pkg/log"
+	"github.com/state-of-the-art/ansiblego/pkg/util"
 )
 
 type TaskV1 struct {
+	ansible.TaskV1SupportsCheckMode
+
 	// A list of package names, like foo, or package specifier with version, like foo=1.0. Name wildcards (fnmatch) like apt* and version wildcards like foo=1.0* are also supported.
 	Name ansible.TStringList `task:",alias:package,alias:pkg"`
 
@@ -17,7 +22,7 @@ type TaskV1 struct {
 	Update_cache ansible.TBool
 
 	// Indicates the desired package state.
-	//State string `task:",def:present,list:absent build-dep latest present fixed"`
+	State ansible.TString `task:",def:present,list:absent build-dep latest present fixed"`
 
 	// Ignore if packages cannot be authenticated.
 	//Allow_unauthenticated bool
@@ -71,7 +76,74 @@ func (t *TaskV1) GetData() (data ansible.OrderedMap) {
 }
 
 func (t *TaskV1) Run(vars map[string]any) (out ansible.OrderedMap, err error) {
-	log.Error("TODO: Implement apt.Run")
+	check := ansible.TaskV1CheckMode(vars)
+	changed := false
+
+	// Environment allows to set the proxy or the debconf frontend for the package manager
+	env, err := ansible.TaskV1Environ(vars)
+	if err != nil {
+		return out, log.Errorf("Unable to prepare apt environment: %v", err)
+	}
+
+	if t.Update_cache.Val() {
+		// Cache update is not changing the installed packages, so in check mode it's skipped
+		if !check {
+			if _, _, err := util.RunCommandRetryEnv(3, 5*time.Minute, env, "apt-get", "update"); err != nil {
+				return out, log.Errorf("Unable to update apt cache: %v", err)
+			}
+			changed = true
+		}
+	}
+
+	var args []string
+	var todo []string
+	switch state := t.State.Val(); state {
+	case "present", "latest":
+		args = []string{"install", "-y"}
+		for _, name := range t.Name.Val() {
+			if state == "latest" || !installed(name) {
+				todo = append(todo, name)
+			}
+		}
+	case "absent":
+		args = []string{"remove", "-y"}
+		for _, name := range t.Name.Val() {
+			if installed(name) {
+				todo = append(todo, name)
+			}
+		}
+	default:
+		return out, log.Errorf("State '%s' is not supported yet", state)
+	}
+
+	if len(todo) > 0 {
+		if check {
+			// Simulation shows what will be changed without touching the system
+			args = append([]string{"-s"}, args...)
+		}
+		stdout, _, err := util.RunCommandEnv(30*time.Minute, env, "apt-get", append(args, todo...)...)
+		if err != nil {
+			return out, log.Errorf("Unable to process packages %q: %v", todo, err)
+		}
+		// Latest could be already installed, so checking the apt output
+		changed = changed || !strings.Contains(stdout, "0 upgraded, 0 newly installed, 0 to remove")
+		out.Set("stdout", stdout)
+		if ansible.TaskV1DiffMode(vars) {
+			var diff ansible.OrderedMap
+			diff.Set("prepared", stdout)
+			out.Set("diff", diff)
+		}
+	}
+
+	out.Set("changed", changed)
+
+	return out, nil
+}
 
-	return
+// Checks if the package is installed with dpkg
+func installed(name string) bool {
+	// Version specifier is not needed to check the package
+	name = strings.SplitN(name, "=", 2)[0]
+	stdout, _, err := util.RunCommand(time.Minute, "dpkg-query", "-W", "-f=${Status}", name)
+	return err == nil && strings.Contains(stdout, "ok installed")
 }
@@ -52,7 +52,7 @@ func (t *TaskV1) SetData(data *ansible.OrderedMap) (err error) {
 		if ok {
 			// "command" is a string
 			t.command_is_string = true
-			t.Cmd.SetUnknown(cmdline)
+			fmap.Set("cmd", cmdline)
 			// Args are confusing and instead module need to be used, so skip processing
 			/*if args_data, ok := data.Get("args"); ok {
 				fmap, _ = args_data.(ansible.OrderedMap)
@@ -65,13 +65,12 @@ func (t *TaskV1) SetData(data *ansible.OrderedMap) (err error) {
 		return fmt.Errorf("The 'command' is not string or OrderedMap")
 	}
 	return ansible.TaskV1SetData(t, fmap)
-
 }
 
 func (t *TaskV1) GetData() (data ansible.OrderedMap) {
 	fmap := ansible.TaskV1GetData(t)
 	if t.command_is_string {
-		data.Set("command", strings.Join([]string{t.Cmd.Val(), strings.Join(t.Argv.Val(), " ")}, " "))
+		data.Set("command", t.Cmd.Val())
 		// Args are confusing and instead module need to be used, so skip processing
 		/*// Filter out the cmd and vars from the fmap
 		fmap.Pop("argv")
@@ -120,15 +119,54 @@ func runAndLog(cmd *exec.Cmd) (string, string, error) {
 }
 
 func (t *TaskV1) Run(vars map[string]any) (out ansible.OrderedMap, err error) {
-	var cmd *exec.Cmd
-	if !t.Cmd.IsEmpty() {
-		cmd = exec.Command(t.Cmd.Val(), t.Argv.Val()...)
-	} else {
-		// If it's just argv then use it's first item as cmd
-		cmd = exec.Command(t.Argv.Val()[0], t.Argv.Val()[1:]...)
+	argv := t.Argv.Val()
+	if t.command_is_string {
+		// Free form command line is split like shell does, but without shell features
+		if argv, err = ansible.TaskV1SplitCmdline(t.Cmd.Val()); err != nil {
+			return out, log.Errorf("Unable to parse command: %v", err)
+		}
+	} else if !t.Cmd.IsEmpty() {
+		argv = append([]string{t.Cmd.Val()}, argv...)
+	}
+	if len(argv) < 1 {
+		return out, log.Errorf("No command to execute")
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = t.Chdir.Val()
+	if cmd.Env, err = ansible.TaskV1Environ(vars); err != nil {
+		return out, log.Errorf("Unable to prepare command environment: %v", err)
+	}
+	if !t.Stdin.IsEmpty() {
+		stdin := t.Stdin.Val()
+		if t.Stdin_add_newline.Val() {
+			stdin += "\n"
+		}
+		cmd.Stdin = strings.NewReader(stdin)
 	}
-	runAndLog(cmd)
-	log.Error("TODO: Implement command.Run output")
 
-	return
+	stdout, stderr, err := runAndLog(cmd)
+	if t.Strip_empty_ends.Val() {
+		stdout = strings.TrimRight(stdout, "\n")
+		stderr = strings.TrimRight(stderr, "\n")
+	}
+
+	out.Set("cmd", argv)
+	out.Set("rc", cmd.ProcessState.ExitCode())
+	out.Set("stdout", stdout)
+	out.Set("stderr", stderr)
+	out.Set("stdout_lines", splitLines(stdout))
+	out.Set("stderr_lines", splitLines(stderr))
+	out.Set("changed", true)
+
+	if err != nil {
+		return out, log.Errorf("Command %q failed: %v", argv, err)
+	}
+	return out, nil
+}
+
+func splitLines(data string) []string {
+	if data == "" {
+		return []string{}
+	}
+	return strings.Split(data, "\n")
 }
@@ -4,16 +4,23 @@ package copy
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/state-of-the-art/ansiblego/pkg/ansible"
 	"github.com/state-of-the-art/ansiblego/pkg/log"
 )
 
 type TaskV1 struct {
+	ansible.TaskV1SupportsCheckMode
+
 	// Local path to a file to copy to the remote server.
 	Src ansible.TString
 	// Influence whether src needs to be transferred or already is present remotely.
 	Remote_src ansible.TString
+	// Name of the controller file uploaded to the temp src path (set by the task runner).
+	Original_basename ansible.TString `task:"_original_basename"`
 	// Remote absolute path where the file should be copied to.
 	Dest ansible.TString `task:",req"`
 
@@ -76,7 +83,50 @@ func (t *TaskV1) GetData() (data ansible.OrderedMap) {
 }
 
 func (t *TaskV1) Run(vars map[string]any) (out ansible.OrderedMap, err error) {
-	log.Error("TODO: Implement copy.Run")
+	check := ansible.TaskV1CheckMode(vars)
+	dest := t.Dest.Val()
+
+	var content string
+	if !t.Content.IsEmpty() {
+		content = t.Content.Val()
+	} else if !t.Src.IsEmpty() {
+		// Controller file is resolved and uploaded by the task runner, the remote_src is read as is
+		src := t.Src.Val()
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return out, log.Errorf("Unable to read src file %q: %v", src, err)
+		}
+		content = string(data)
+		// Copying into directory keeps the source file name
+		if info, err := os.Stat(dest); strings.HasSuffix(dest, "/") || err == nil && info.IsDir() {
+			name := filepath.Base(src)
+			if !t.Original_basename.IsEmpty() {
+				name = t.Original_basename.Val()
+			}
+			dest = filepath.Join(dest, name)
+		}
+	} else {
+		return out, log.Errorf("One of 'src' or 'content' is required")
+	}
+
+	if _, err := os.Stat(filepath.Dir(dest)); err != nil {
+		return out, log.Errorf("Destination directory %q does not exist", filepath.Dir(dest))
+	}
+
+	changed, before, err := ansible.TaskV1WriteFile(dest, content, check)
+	if err != nil {
+		return out, log.Errorf("Unable to copy to %q: %v", dest, err)
+	}
+	attrs_changed, err := ansible.TaskV1FileAttrs(dest, t.Owner.Val(), t.Group.Val(), t.Mode.Val(), check)
+	if err != nil {
+		return out, log.Errorf("Unable to set attributes of %q: %v", dest, err)
+	}
+
+	out.Set("changed", changed || attrs_changed)
+	out.Set("dest", dest)
+	if changed && ansible.TaskV1DiffMode(vars) {
+		out.Set("diff", ansible.TaskV1Diff(before, content, dest, dest))
+	}
 
-	return
+	return out, nil
 }
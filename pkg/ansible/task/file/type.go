@@ -4,12 +4,16 @@ package file
 
 import (
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/state-of-the-art/ansiblego/pkg/ansible"
 	"github.com/state-of-the-art/ansiblego/pkg/log"
 )
 
 type TaskV1 struct {
+	ansible.TaskV1SupportsCheckMode
+
 	// Path of the file to link to.
 	Src ansible.TString
 	// Path to the file being managed.
@@ -76,7 +80,135 @@ func (t *TaskV1) GetData() (data ansible.OrderedMap) {
 }
 
 func (t *TaskV1) Run(vars map[string]any) (out ansible.OrderedMap, err error) {
-	log.Error("TODO: Implement file.Run")
+	check := ansible.TaskV1CheckMode(vars)
+	path := t.Path.Val()
+	state := t.State.Val()
+
+	before := currentState(path)
+	changed := false
+
+	switch state {
+	case "absent":
+		if before != "absent" {
+			changed = true
+			if !check {
+				if err = os.RemoveAll(path); err != nil {
+					return out, log.Errorf("Unable to remove %q: %v", path, err)
+				}
+			}
+		}
+	case "directory":
+		if before != "directory" {
+			if before != "absent" {
+				return out, log.Errorf("Path %q exists and is not a directory but %s", path, before)
+			}
+			changed = true
+			if !check {
+				if err = os.MkdirAll(path, 0755); err != nil {
+					return out, log.Errorf("Unable to create directory %q: %v", path, err)
+				}
+			}
+		}
+	case "file":
+		if before == "absent" {
+			return out, log.Errorf("File %q does not exist, use state 'touch' to create it", path)
+		}
+		if before != "file" {
+			return out, log.Errorf("Path %q is not a file but %s", path, before)
+		}
+	case "touch":
+		changed = true
+		if !check {
+			if before == "absent" {
+				f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+				if err != nil {
+					return out, log.Errorf("Unable to create file %q: %v", path, err)
+				}
+				f.Close()
+			} else {
+				now := time.Now()
+				if err = os.Chtimes(path, now, now); err != nil {
+					return out, log.Errorf("Unable to touch %q: %v", path, err)
+				}
+			}
+		}
+	case "link", "hard":
+		src := t.Src.Val()
+		if src == "" {
+			return out, log.Errorf("The 'src' is required for state '%s'", state)
+		}
+		if changed, err = t.link(path, src, state, before, check); err != nil {
+			return out, err
+		}
+	}
+
+	// Attributes are not applicable to removed path
+	if state != "absent" {
+		attrs_changed, err := ansible.TaskV1FileAttrs(path, t.Owner.Val(), t.Group.Val(), t.Mode.Val(), check)
+		if err != nil {
+			return out, log.Errorf("Unable to set attributes of %q: %v", path, err)
+		}
+		changed = changed || attrs_changed
+	}
 
-	return
+	out.Set("changed", changed)
+	out.Set("path", path)
+	out.Set("state", state)
+	if changed && ansible.TaskV1DiffMode(vars) {
+		out.Set("diff", ansible.TaskV1Diff("path: "+path+"\nstate: "+before+"\n", "path: "+path+"\nstate: "+state+"\n", path, path))
+	}
+
+	return out, nil
+}
+
+// Creates symbolic or hard link to src if the path is not already the link to it
+func (t *TaskV1) link(path, src, state, before string, check bool) (bool, error) {
+	if state == "link" && before == "link" {
+		if cur, err := os.Readlink(path); err == nil && cur == src {
+			return false, nil
+		}
+	}
+	if state == "hard" && before == "file" {
+		src_info, err1 := os.Stat(src)
+		path_info, err2 := os.Stat(path)
+		if err1 == nil && err2 == nil && os.SameFile(src_info, path_info) {
+			return false, nil
+		}
+	}
+	if before == "directory" {
+		return false, log.Errorf("Unable to replace directory %q with the link", path)
+	}
+	if check {
+		return true, nil
+	}
+
+	if before != "absent" {
+		if err := os.Remove(path); err != nil {
+			return false, log.Errorf("Unable to remove %q to replace it with link: %v", path, err)
+		}
+	}
+	var err error
+	if state == "link" {
+		err = os.Symlink(src, path)
+	} else {
+		err = os.Link(src, path)
+	}
+	if err != nil {
+		return false, log.Errorf("Unable to create %s link %q to %q: %v", state, path, src, err)
+	}
+	return true, nil
+}
+
+// Returns the current state of the path: absent, directory, link or file
+func currentState(path string) string {
+	info, err := os.Lstat(path)
+	switch {
+	case err != nil:
+		return "absent"
+	case info.IsDir():
+		return "directory"
+	case info.Mode()&os.ModeSymlink != 0:
+		return "link"
+	}
+	return "file"
 }
@@ -0,0 +1,5 @@
+package lineinfile
+
+func main() {
+	// TODO: commandline interface
+}
@@ -0,0 +1,201 @@
+package lineinfile
+
+// Doc: https://docs.ansible.com/ansible/2.9/modules/lineinfile_module.html
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible"
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+)
+
+type TaskV1 struct {
+	ansible.TaskV1SupportsCheckMode
+
+	// The file to modify.
+	Path ansible.TString `task:",req,alias:dest,alias:destfile,alias:name"`
+	// The regular expression to look for in every line of the file.
+	Regexp ansible.TString `task:",alias:regex"`
+	// The line to insert/replace into the file.
+	Line ansible.TString `task:",alias:value"`
+	// Whether the line should be there or not.
+	State ansible.TString `task:",def:present,list:absent present"`
+
+	// Used with state=present. If specified, the line will be inserted after the last match of specified regular expression.
+	Insertafter ansible.TString
+	// Used with state=present. If specified, the line will be inserted before the last match of specified regular expression.
+	Insertbefore ansible.TString
+	// Used with state=present. If specified, the file will be created if it does not already exist.
+	Create ansible.TBool
+
+	// Name of the user that should own the file/directory, as would be fed to chown.
+	Owner ansible.TString
+	// Name of the group that should own the file/directory, as would be fed to chown.
+	Group ansible.TString
+	// The permissions the resulting file or directory should have.
+	Mode ansible.TString
+
+	// Used with state=present. If set, line can contain backreferences that will get populated if the regexp matches.
+	//Backrefs bool
+	// Create a backup file including the timestamp information so you can get the original file back if you somehow clobbered it incorrectly.
+	//Backup bool
+	// Used with insertafter or insertbefore. If set, insertafter and insertbefore will work with the first line that matches the given regular expression.
+	//Firstmatch bool
+	// The validation command to run before copying into place.
+	//Validate string
+}
+
+// Here the fields comes as complete values never as jinja2 templates
+func (t *TaskV1) SetData(data *ansible.OrderedMap) error {
+	d, ok := data.Pop("lineinfile")
+	if !ok {
+		return fmt.Errorf("Unable to find the 'lineinfile' map in task data")
+	}
+	fmap, ok := d.(ansible.OrderedMap)
+	if !ok {
+		return fmt.Errorf("The 'lineinfile' is not the OrderedMap")
+	}
+	return ansible.TaskV1SetData(t, fmap)
+}
+
+func (t *TaskV1) GetData() (data ansible.OrderedMap) {
+	fmap := ansible.TaskV1GetData(t)
+	data.Set("lineinfile", fmap)
+	return data
+}
+
+func (t *TaskV1) Run(vars map[string]any) (out ansible.OrderedMap, err error) {
+	check := ansible.TaskV1CheckMode(vars)
+	path := t.Path.Val()
+	line := t.Line.Val()
+
+	var re *regexp.Regexp
+	if !t.Regexp.IsEmpty() {
+		if re, err = regexp.Compile(t.Regexp.Val()); err != nil {
+			return out, log.Errorf("Unable to compile regexp %q: %v", t.Regexp.Val(), err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if t.State.Val() == "absent" {
+			out.Set("changed", false)
+			out.Set("msg", "file not present")
+			return out, nil
+		}
+		if !t.Create.Val() {
+			return out, log.Errorf("Destination %q does not exist", path)
+		}
+	} else if err != nil {
+		return out, log.Errorf("Unable to read %q: %v", path, err)
+	}
+	before := string(data)
+
+	var lines []string
+	if before != "" {
+		lines = strings.Split(strings.TrimSuffix(before, "\n"), "\n")
+	}
+	matches := func(l string) bool {
+		if re != nil {
+			return re.MatchString(l)
+		}
+		return l == line
+	}
+
+	var msg string
+	if t.State.Val() == "absent" {
+		var kept []string
+		for _, l := range lines {
+			if !matches(l) {
+				kept = append(kept, l)
+			}
+		}
+		if removed := len(lines) - len(kept); removed > 0 {
+			msg = fmt.Sprintf("%d line(s) removed", removed)
+		}
+		lines = kept
+	} else {
+		if t.Line.IsEmpty() {
+			return out, log.Errorf("The 'line' is required with state 'present'")
+		}
+		if lines, msg, err = t.present(lines, line, matches); err != nil {
+			return out, err
+		}
+	}
+
+	after := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		after += "\n"
+	}
+	changed, _, err := ansible.TaskV1WriteFile(path, after, check)
+	if err != nil {
+		return out, log.Errorf("Unable to write %q: %v", path, err)
+	}
+	attrs_changed, err := ansible.TaskV1FileAttrs(path, t.Owner.Val(), t.Group.Val(), t.Mode.Val(), check)
+	if err != nil {
+		return out, log.Errorf("Unable to set attributes of %q: %v", path, err)
+	}
+
+	out.Set("changed", changed || attrs_changed)
+	out.Set("msg", msg)
+	if changed && ansible.TaskV1DiffMode(vars) {
+		out.Set("diff", ansible.TaskV1Diff(before, after, path+" (content)", path+" (content)"))
+	}
+
+	return out, nil
+}
+
+// Replaces the last line matching regexp or inserts the line if it's not found
+func (t *TaskV1) present(lines []string, line string, matches func(string) bool) ([]string, string, error) {
+	found := -1
+	for i, l := range lines {
+		if matches(l) {
+			found = i
+		}
+	}
+	if found >= 0 {
+		if lines[found] == line {
+			return lines, "", nil
+		}
+		lines[found] = line
+		return lines, "line replaced", nil
+	}
+
+	// Line could already exist even if regexp is not matching it
+	for _, l := range lines {
+		if l == line {
+			return lines, "", nil
+		}
+	}
+
+	pos := len(lines)
+	if after := t.Insertafter.Val(); after != "" && after != "EOF" {
+		insert_re, err := regexp.Compile(after)
+		if err != nil {
+			return nil, "", log.Errorf("Unable to compile insertafter %q: %v", after, err)
+		}
+		for i, l := range lines {
+			if insert_re.MatchString(l) {
+				pos = i + 1
+			}
+		}
+	} else if before := t.Insertbefore.Val(); before == "BOF" {
+		pos = 0
+	} else if before != "" {
+		insert_re, err := regexp.Compile(before)
+		if err != nil {
+			return nil, "", log.Errorf("Unable to compile insertbefore %q: %v", before, err)
+		}
+		for i, l := range lines {
+			if insert_re.MatchString(l) {
+				pos = i
+			}
+		}
+	}
+
+	lines = append(lines[:pos], append([]string{line}, lines[pos:]...)...)
+	return lines, "line added", nil
+}
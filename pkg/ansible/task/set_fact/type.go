@@ -4,12 +4,17 @@ package set_fact
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/state-of-the-art/ansiblego/pkg/ansible"
-	"github.com/state-of-the-art/ansiblego/pkg/log"
 )
 
 type TaskV1 struct {
+	ansible.TaskV1SupportsCheckMode
+
+	// This boolean converts the variable into an actual 'fact' which will also be added to the fact cache.
+	Cacheable ansible.TBool
+
 	// Storage for key:value to process
 	keyval ansible.TAnyMap
 }
@@ -25,6 +30,11 @@ func (t *TaskV1) SetData(data *ansible.OrderedMap) error {
 		return fmt.Errorf("The 'set_fact' is not the OrderedMap")
 	}
 
+	// Cacheable is the only special key in set_fact map
+	if v, ok := fmap.Pop("cacheable"); ok {
+		t.Cacheable.SetUnknown(v)
+	}
+
 	if fmap.Size() < 1 {
 		return fmt.Errorf("The 'set_fact' data is empty")
 	}
@@ -43,12 +53,40 @@ func (t *TaskV1) SetData(data *ansible.OrderedMap) error {
 }
 
 func (t *TaskV1) GetData() (data ansible.OrderedMap) {
-	data.Set("set_fact", t.keyval)
+	// Cacheable is the special key of set_fact map, so it's placed back there
+	keys := make([]ansible.TString, 0, len(t.keyval))
+	for key := range t.keyval {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	var fmap ansible.OrderedMap
+	for _, key := range keys {
+		fmap.Set(key.String(), t.keyval[key])
+	}
+	if t.Cacheable.Val() {
+		fmap.Set("cacheable", true)
+	}
+	data.Set("set_fact", fmap)
 	return data
 }
 
 func (t *TaskV1) Run(vars map[string]any) (out ansible.OrderedMap, err error) {
-	log.Error("TODO: Implement set_fact.Run")
+	// Sorting the keys to have the same order of facts every time
+	keys := make([]ansible.TString, 0, len(t.keyval))
+	for key := range t.keyval {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Val() < keys[j].Val() })
+
+	var facts ansible.OrderedMap
+	for _, key := range keys {
+		val := t.keyval[key]
+		facts.Set(key.Val(), val.Val())
+	}
+
+	out.Set("ansible_facts", facts)
+	out.Set("_ansible_facts_cacheable", t.Cacheable.Val())
 
-	return
+	return out, nil
 }
@@ -4,57 +4,256 @@ package setup
 
 import (
 	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/state-of-the-art/ansiblego/pkg/ansible"
 	"github.com/state-of-the-art/ansiblego/pkg/log"
 )
 
 type TaskV1 struct {
+	ansible.TaskV1SupportsCheckMode
+
 	// Path used for local ansible facts (*.fact) - files in this dir will be run (if executable) and their results be added to ansible_local facts if a file is not executable it is read.
-	//Fact_path string `task:"def:/etc/ansible/facts.d"`
+	Fact_path ansible.TString `task:",def:/etc/ansible/facts.d"`
 	// If supplied, only return facts that match this shell-style (fnmatch) wildcard.
-	//Filter string `task:"def:*"`
+	Filter ansible.TString `task:",def:*"`
 	// If supplied, restrict the additional facts collected to the given subset. Possible values: all, min, hardware, network, virtual, ohai, and facter.
-	//Father_subset string `task:"def:all"`
+	Gather_subset ansible.TStringList
 	// Set the default timeout in seconds for individual fact gathering.
-	//Gather_timeout int `task:"def:10"`
+	Gather_timeout ansible.TInt `task:",def:10"`
 }
 
+// Special collector which is processed by the setup module itself
+const local_collector = "local"
+
+// Subsets of the collectors, collector name can be used as subset as well. The collectors
+// which are not listed here are gathered only by `all` subset or by their name.
+var collector_subsets = map[string][]string{
+	"apparmor":         {"min"},
+	"caps":             {"min"},
+	local_collector:    {"min"},
+	"windows_env":      {"min"},
+	"windows_os":       {"min"},
+	"windows_hardware": {"hardware"},
+	"windows_network":  {"network"},
+}
+
+var valid_subsets = []string{"all", "min", "hardware", "network", "virtual", "ohai", "facter"}
+
 // Here the fields comes as complete values never as jinja2 templates
 func (t *TaskV1) SetData(data *ansible.OrderedMap) error {
-	_, ok := data.Pop("setup")
+	d, ok := data.Pop("setup")
 	if !ok {
 		return fmt.Errorf("Unable to find 'setup' key in task data")
 	}
-	/*fmap, ok := d.(ansible.OrderedMap)
-	if !ok {
+	// Setup could be used without any options
+	fmap, ok := d.(ansible.OrderedMap)
+	if !ok && d != nil {
 		return fmt.Errorf("The 'setup' is not the OrderedMap")
-	}*/
+	}
 
-	return nil
+	return ansible.TaskV1SetData(t, fmap)
 }
 
 func (t *TaskV1) GetData() (data ansible.OrderedMap) {
+	fmap := ansible.TaskV1GetData(t)
+	data.Set("setup", fmap)
 	return data
 }
 
 func (t *TaskV1) Run(vars map[string]any) (out ansible.OrderedMap, err error) {
-	for _, mod := range ansible.ModulesList("fact") {
-		log.Tracef("Running fact collector %q...", mod)
-		if collected_facts, err := ansible.CollectV1(mod); err == nil {
-			for _, key := range collected_facts.Keys() {
-				log.Tracef("Received data key from fact collector %q: %q", mod, key)
-				if _, exists := out.Get(key); exists {
-					log.Warnf("Fact module '%s' overrides existing fact '%s'", mod, key)
-				}
-				val, _ := collected_facts.Get(key)
-				out.Set(key, val)
+	collectors := append(ansible.ModulesList("fact"), local_collector)
+	sort.Strings(collectors)
+
+	collectors, err = selectCollectors(collectors, t.gatherSubset())
+	if err != nil {
+		return out, err
+	}
+	log.Debugf("Selected fact collectors: %q", collectors)
+
+	timeout := time.Duration(t.Gather_timeout.Val()) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	// Running collectors concurrently and placing the results by index to merge them in order
+	results := make([]*ansible.OrderedMap, len(collectors))
+	var wg sync.WaitGroup
+	for i, mod := range collectors {
+		wg.Add(1)
+		go func(i int, mod string) {
+			defer wg.Done()
+			log.Tracef("Running fact collector %q...", mod)
+			var collected_facts *ansible.OrderedMap
+			var err error
+			if mod == local_collector {
+				collected_facts, err = t.collectLocal(timeout)
+			} else {
+				collected_facts, err = ansible.CollectV1Timeout(mod, timeout)
+			}
+			if err != nil {
+				// Fact collectors can fail, but it should not be a disaster
+				log.Warnf("Error while collecting facts from %q: %v", mod, err)
+				return
+			}
+			results[i] = collected_facts
+		}(i, mod)
+	}
+	wg.Wait()
+
+	filter := t.Filter.Val()
+	if filter == "" {
+		filter = "*"
+	}
+	for i, mod := range collectors {
+		if results[i] == nil {
+			continue
+		}
+		for _, key := range results[i].Keys() {
+			val, _ := results[i].Get(key)
+			// Collectors are not required to prefix the facts, so doing it here to be consistent
+			if !strings.HasPrefix(key, "ansible_") {
+				key = "ansible_" + key
+			}
+			if !matchFilter(filter, key) {
+				continue
+			}
+			log.Tracef("Received data key from fact collector %q: %q", mod, key)
+			if _, exists := out.Get(key); exists {
+				log.Warnf("Fact module '%s' overrides existing fact '%s'", mod, key)
+			}
+			out.Set(key, val)
+		}
+	}
+
+	return out, nil
+}
+
+// Collects the local facts and places them under the `local` key
+func (t *TaskV1) collectLocal(timeout time.Duration) (*ansible.OrderedMap, error) {
+	fact_path := t.Fact_path.Val()
+	if fact_path == "" {
+		fact_path = "/etc/ansible/facts.d"
+	}
+	local_facts, err := ansible.FactV1Local(fact_path, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var out ansible.OrderedMap
+	out.Set(local_collector, local_facts)
+
+	return &out, nil
+}
+
+// Subsets could be provided as list or as comma separated string
+func (t *TaskV1) gatherSubset() (out []string) {
+	for _, item := range t.Gather_subset.Val() {
+		for _, subset := range strings.Split(item, ",") {
+			if subset = strings.TrimSpace(subset); subset != "" {
+				out = append(out, subset)
 			}
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, "all")
+	}
+	return out
+}
+
+// Filters the collectors by gather_subset the same way Ansible does: the `min` subset is always
+// collected unless `!min` is set and if only exclusions are provided - `all` is used as base.
+// Exclusions are not removing the explicitly requested collectors, so the order doesn't matter.
+func selectCollectors(collectors, gather_subset []string) (out []string, err error) {
+	// Building the subsets index to quickly resolve the collectors
+	subset_collectors := map[string][]string{}
+	for _, mod := range collectors {
+		subset_collectors["all"] = append(subset_collectors["all"], mod)
+		subset_collectors[mod] = append(subset_collectors[mod], mod)
+		for _, subset := range collector_subsets[mod] {
+			subset_collectors[subset] = append(subset_collectors[subset], mod)
+		}
+	}
+
+	include := map[string]bool{}
+	exclude := map[string]bool{}
+	explicit := map[string]bool{}
+	only_exclude := true
+	for _, subset := range gather_subset {
+		is_exclude := strings.HasPrefix(subset, "!")
+		target := include
+		if is_exclude {
+			target = exclude
+			subset = subset[1:]
 		} else {
-			// Fact collectors can fail, but it should not be a disaster
-			err = log.Errorf("Error while collecting facts from %q: %v", mod, err)
+			only_exclude = false
+		}
+		mods, ok := subset_collectors[subset]
+		if !ok && !isValidSubset(subset) {
+			return nil, fmt.Errorf("Bad subset %q given, could only be one of %q or collector name", subset, valid_subsets)
+		}
+		if subset == "all" && is_exclude {
+			// Excluding all is not excluding the minimal subset
+			for _, mod := range mods {
+				if !isMinimal(mod) {
+					exclude[mod] = true
+				}
+			}
+			continue
+		}
+		for _, mod := range mods {
+			target[mod] = true
+			if !is_exclude && subset != "all" && subset != "min" {
+				explicit[mod] = true
+			}
+		}
+	}
+
+	if only_exclude {
+		for _, mod := range subset_collectors["all"] {
+			include[mod] = true
+		}
+	}
+	for _, mod := range subset_collectors["min"] {
+		include[mod] = true
+	}
+
+	for _, mod := range collectors {
+		if include[mod] && (!exclude[mod] || explicit[mod]) {
+			out = append(out, mod)
+		}
+	}
+
+	return out, nil
+}
+
+func isValidSubset(subset string) bool {
+	for _, s := range valid_subsets {
+		if s == subset {
+			return true
+		}
+	}
+	return false
+}
+
+func isMinimal(mod string) bool {
+	for _, subset := range collector_subsets[mod] {
+		if subset == "min" {
+			return true
 		}
 	}
+	return false
+}
 
-	return out, err
+// Filter is matched to the prefixed fact key and to the key without `ansible_` prefix
+func matchFilter(filter, key string) bool {
+	if ok, _ := path.Match(filter, key); ok {
+		return true
+	}
+	ok, _ := path.Match(filter, strings.TrimPrefix(key, "ansible_"))
+	return ok
 }
@@ -0,0 +1,60 @@
+package setup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSelectCollectors(t *testing.T) {
+	collectors := []string{"apparmor", "caps", "custom", "local", "windows_env", "windows_hardware", "windows_network", "windows_os"}
+	min := []string{"apparmor", "caps", "local", "windows_env", "windows_os"}
+
+	for name, test := range map[string]struct {
+		subset   []string
+		expected []string
+	}{
+		"all":             {[]string{"all"}, collectors},
+		"min":             {[]string{"min"}, min},
+		"hardware":        {[]string{"hardware"}, []string{"apparmor", "caps", "local", "windows_env", "windows_hardware", "windows_os"}},
+		"by_name":         {[]string{"custom"}, []string{"apparmor", "caps", "custom", "local", "windows_env", "windows_os"}},
+		"not_all":         {[]string{"!all"}, min},
+		"not_all_network": {[]string{"!all", "network"}, []string{"apparmor", "caps", "local", "windows_env", "windows_network", "windows_os"}},
+		"network_not_all": {[]string{"network", "!all"}, []string{"apparmor", "caps", "local", "windows_env", "windows_network", "windows_os"}},
+		"only_network":    {[]string{"!all", "!min", "network"}, []string{"windows_network"}},
+		"not_min":         {[]string{"!min"}, []string{"custom", "windows_hardware", "windows_network"}},
+		"not_all_not_min": {[]string{"!all", "!min"}, nil},
+		"only_exclude":    {[]string{"!hardware", "!custom"}, []string{"apparmor", "caps", "local", "windows_env", "windows_network", "windows_os"}},
+		"include_wins":    {[]string{"hardware", "!windows_hardware"}, []string{"apparmor", "caps", "local", "windows_env", "windows_hardware", "windows_os"}},
+		"all_excluded":    {[]string{"all", "!hardware"}, []string{"apparmor", "caps", "custom", "local", "windows_env", "windows_network", "windows_os"}},
+		"exclude_min_one": {[]string{"!local"}, []string{"apparmor", "caps", "custom", "windows_env", "windows_hardware", "windows_network", "windows_os"}},
+		"no_collectors":   {[]string{"virtual"}, min},
+	} {
+		t.Run(name, func(t *testing.T) {
+			out, err := selectCollectors(collectors, test.subset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, test.expected) {
+				t.Errorf("Selected %q, expected %q", out, test.expected)
+			}
+		})
+	}
+
+	for _, subset := range []string{"unknown", "!unknown"} {
+		if _, err := selectCollectors(collectors, []string{subset}); err == nil || !strings.Contains(err.Error(), "Bad subset") {
+			t.Errorf("Expected bad subset error for %q, got: %v", subset, err)
+		}
+	}
+}
+
+func TestGatherSubset(t *testing.T) {
+	module := &TaskV1{}
+	if out := module.gatherSubset(); !reflect.DeepEqual(out, []string{"all"}) {
+		t.Errorf("Default subset is %q", out)
+	}
+	module.Gather_subset.SetUnknown([]any{"!all, network", " hardware ,"})
+	if out := module.gatherSubset(); !reflect.DeepEqual(out, []string{"!all", "network", "hardware"}) {
+		t.Errorf("Subset is %q", out)
+	}
+}
@@ -13,15 +13,15 @@ import (
 )
 
 type TaskV1 struct {
-	// Executable to run.
-	Cmd string
+	// Shell command line to run.
+	Cmd ansible.TString `task:",req"`
 	// Change into this directory before running the command.
-	Chdir string
+	Chdir ansible.TString
 	// Set the stdin of the command directly to the specified value.
-	Stdin string
+	Stdin ansible.TString
 
 	// Change the shell used to execute the command.
-	//Executable string
+	Executable ansible.TString `task:",def:/bin/sh"`
 	// The shell module takes a free form command to run, as a string.
 	//Free_form string
 	// A filename or glob pattern. If it already exists, this step won't be run.
@@ -30,7 +30,7 @@ type TaskV1 struct {
 	//Removes string
 
 	// If set to true, append a newline to stdin data.
-	Stdin_add_newline bool `task:",def:true"`
+	Stdin_add_newline ansible.TBool `task:",def:true"`
 
 	// Enable or disable task warnings.
 	//Warn bool `task:",def:true"`
@@ -39,8 +39,8 @@ type TaskV1 struct {
 	shell_is_string bool // In case the shell originally is string
 }
 
-func (t *TaskV1) SetData(data ansible.OrderedMap) error {
-	shell_data, ok := data.Get("shell")
+func (t *TaskV1) SetData(data *ansible.OrderedMap) error {
+	shell_data, ok := data.Pop("shell")
 	if !ok {
 		return fmt.Errorf("Unable to find the 'shell' string or map in task data")
 	}
@@ -52,7 +52,7 @@ func (t *TaskV1) SetData(data ansible.OrderedMap) error {
 		if ok {
 			// "shell" is a string
 			t.shell_is_string = true
-			t.Cmd = cmdline
+			fmap.Set("cmd", cmdline)
 			// Args are confusing and instead module need to be used, so skip processing
 			/*if args_data, ok := data.Get("args"); ok {
 				fmap, _ = args_data.(ansible.OrderedMap)
@@ -68,7 +68,7 @@ func (t *TaskV1) SetData(data ansible.OrderedMap) error {
 func (t *TaskV1) GetData() (data ansible.OrderedMap) {
 	fmap := ansible.TaskV1GetData(t)
 	if t.shell_is_string {
-		data.Set("shell", t.Cmd)
+		data.Set("shell", t.Cmd.Val())
 		// Args are confusing and instead module need to be used, so skip processing
 		/*// Filter out the cmd and vars from the fmap
 		fmap.Pop("argv")
@@ -117,11 +117,33 @@ func runAndLog(cmd *exec.Cmd) (string, string, error) {
 }
 
 func (t *TaskV1) Run(vars map[string]any) (out ansible.OrderedMap, err error) {
-	log.Error("TODO: Implement shell.Run")
-	cmd := exec.Command("/usr/bin/sh", "-c", fmt.Sprintf("%v", vars["shell"]))
-	runAndLog(cmd)
+	cmd := exec.Command(t.Executable.Val(), "-c", t.Cmd.Val())
+	cmd.Dir = t.Chdir.Val()
+	if cmd.Env, err = ansible.TaskV1Environ(vars); err != nil {
+		return out, log.Errorf("Unable to prepare shell environment: %v", err)
+	}
+	if !t.Stdin.IsEmpty() {
+		stdin := t.Stdin.Val()
+		if t.Stdin_add_newline.Val() {
+			stdin += "\n"
+		}
+		cmd.Stdin = strings.NewReader(stdin)
+	}
 
-	return
+	stdout, stderr, err := runAndLog(cmd)
+	stdout = strings.TrimRight(stdout, "\n")
+	stderr = strings.TrimRight(stderr, "\n")
+
+	out.Set("cmd", t.Cmd.Val())
+	out.Set("rc", cmd.ProcessState.ExitCode())
+	out.Set("stdout", stdout)
+	out.Set("stderr", stderr)
+	out.Set("changed", true)
+
+	if err != nil {
+		return out, log.Errorf("Shell command %q failed: %v", t.Cmd.Val(), err)
+	}
+	return out, nil
 }
 
 func main() {
@@ -10,6 +10,8 @@ import (
 )
 
 type TaskV1 struct {
+	ansible.TaskV1SupportsCheckMode
+
 	// Path to the file being managed.
 	Path ansible.TString `task:",req,alias:dest,alias:name"`
 
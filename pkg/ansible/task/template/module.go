@@ -0,0 +1,5 @@
+package template
+
+func main() {
+	// TODO: commandline interface
+}
@@ -0,0 +1,88 @@
+package template
+
+// Doc: https://docs.ansible.com/ansible/2.9/modules/template_module.html
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible"
+	"github.com/state-of-the-art/ansiblego/pkg/template"
+)
+
+type TaskV2 struct {
+	ansible.TaskV2SupportsCheckMode
+
+	// Path of a Jinja2 formatted template on the Ansible controller.
+	Src ansible.TString `task:",req"`
+	// Location to render the template to on the remote machine.
+	Dest ansible.TString `task:",req"`
+
+	// Name of the user that should own the file/directory, as would be fed to chown.
+	Owner ansible.TString
+	// Name of the group that should own the file/directory, as would be fed to chown.
+	Group ansible.TString
+	// The permissions the resulting file or directory should have.
+	Mode ansible.TString
+
+	// Create a backup file including the timestamp information so you can get the original file back if you somehow clobbered it incorrectly.
+	//Backup bool
+	// Influence whether the remote file must always be replaced.
+	//Force bool `task:",def:true"`
+	// Specify the newline sequence to use for templating files.
+	//Newline_sequence string `task:",def:\n"`
+	// The validation command to run before copying into place.
+	//Validate string
+}
+
+// Here the fields comes as complete values never as jinja2 templates
+func (t *TaskV2) SetData(data *ansible.OrderedMap) error {
+	d, ok := data.Pop("template")
+	if !ok {
+		return fmt.Errorf("Unable to find the 'template' map in task data")
+	}
+	fmap, ok := d.(ansible.OrderedMap)
+	if !ok {
+		return fmt.Errorf("The 'template' is not the OrderedMap")
+	}
+	return ansible.TaskV1SetData(t, fmap)
+}
+
+func (t *TaskV2) GetData() (data ansible.OrderedMap) {
+	fmap := ansible.TaskV1GetData(t)
+	data.Set("template", fmap)
+	return data
+}
+
+func (t *TaskV2) Run(ctx *ansible.TaskV2Context) (out ansible.OrderedMap, err error) {
+	dest := t.Dest.Val()
+
+	src, err := ctx.FindFile("templates", t.Src.Val())
+	if err != nil {
+		return out, ctx.Log.Errorf("Unable to find template: %v", err)
+	}
+	tmpl, err := os.ReadFile(src)
+	if err != nil {
+		return out, ctx.Log.Errorf("Unable to read template %q: %v", src, err)
+	}
+	content, err := template.Process(string(tmpl), ctx.Vars)
+	if err != nil {
+		return out, ctx.Log.Errorf("Unable to render template %q: %v", src, err)
+	}
+
+	changed, before, err := ansible.TaskV1WriteFile(dest, content, ctx.CheckMode)
+	if err != nil {
+		return out, ctx.Log.Errorf("Unable to write template to %q: %v", dest, err)
+	}
+	attrs_changed, err := ansible.TaskV1FileAttrs(dest, t.Owner.Val(), t.Group.Val(), t.Mode.Val(), ctx.CheckMode)
+	if err != nil {
+		return out, ctx.Log.Errorf("Unable to set attributes of %q: %v", dest, err)
+	}
+
+	result := ctx.Result().Changed(changed || attrs_changed).Set("dest", dest)
+	if changed && ctx.DiffMode {
+		result.Diff(before, content, dest, src)
+	}
+
+	return result.Data(), nil
+}
@@ -0,0 +1,139 @@
+package ansible
+
+// Modules like copy and template are reading the source files of the controller, so the files
+// are resolved in the playbook dir and uploaded to the remote host before the module runs there
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+	"github.com/state-of-the-art/ansiblego/pkg/template"
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+// Modules with the controller file in `src` and the playbook subdir to look for it
+var controller_files = map[string]string{
+	"copy":     "files",
+	"template": "templates",
+}
+
+// Looks for the file the same way Ansible does: absolute path as is, otherwise relative to the
+// playbook `<subdir>` (like `files` or `templates`) and then to the playbook dir itself
+func findFile(playbook_dir, subdir, name string) (string, error) {
+	var paths []string
+	if filepath.IsAbs(name) {
+		paths = append(paths, name)
+	} else {
+		if subdir != "" {
+			paths = append(paths, filepath.Join(playbook_dir, subdir, name))
+		}
+		paths = append(paths, filepath.Join(playbook_dir, name))
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("Unable to find file %q in %q", name, paths)
+}
+
+// Resolves the controller source file of the module and uploads it to the remote host if the
+// client is set. The module `src` is replaced with the path to read and the returned function
+// removes the uploaded file.
+func (t *Task) prepareFiles(ctx context.Context, client transport.Transport, kernel string, module TaskV2Interface, vars map[string]any) (cleanup func(), err error) {
+	cleanup = func() {}
+	subdir, ok := controller_files[t.ModuleName]
+	if !ok {
+		return cleanup, nil
+	}
+
+	data := module.GetData()
+	val, _ := data.Get(t.ModuleName)
+	fmap, ok := val.(OrderedMap)
+	if !ok {
+		return cleanup, nil
+	}
+	src := fieldString(fmap, "src")
+	remote_src, _ := fmap.Get("remote_src")
+	if field, ok := remote_src.(TString); ok {
+		remote_src = field.TAny.Val()
+	}
+	if src == "" || varBool(remote_src) {
+		return cleanup, nil
+	}
+	if template.IsTemplate(src) {
+		tmpl := src
+		if src, err = template.Process(tmpl, vars); err != nil {
+			return cleanup, fmt.Errorf("Unable to render src %q: %v", tmpl, err)
+		}
+	}
+	playbook_dir, _ := vars["playbook_dir"].(string)
+	path, err := findFile(playbook_dir, subdir, src)
+	if err != nil {
+		return cleanup, err
+	}
+
+	if client != nil {
+		f, err := os.Open(path)
+		if err != nil {
+			return cleanup, fmt.Errorf("Unable to read src file: %v", err)
+		}
+		defer f.Close()
+
+		suffix := make([]byte, 8)
+		if _, err = rand.Read(suffix); err != nil {
+			return cleanup, fmt.Errorf("Unable to generate src file name: %v", err)
+		}
+		remote_path := agent_path + "-src-" + hex.EncodeToString(suffix)
+
+		// The become user of the agent should be able to read the file
+		mode := os.FileMode(0600)
+		if varBool(vars["ansible_become"]) {
+			mode = 0644
+		}
+		if err = client.Copy(f, remote_path, mode); err != nil {
+			return cleanup, fmt.Errorf("Unable to upload src file %q: %v", path, err)
+		}
+		cleanup = func() {
+			cmd := "rm -f " + shellQuote(remote_path)
+			if kernel == "windows" {
+				cmd = fmt.Sprintf("del /f /q \"%s\"", remote_path)
+			}
+			if _, err := client.Execute(ctx, cmd, io.Discard, io.Discard); err != nil {
+				log.Warnf("Unable to remove uploaded src file %q: %v", remote_path, err)
+			}
+		}
+		// Copy keeps the source file name when the destination is a directory
+		if t.ModuleName == "copy" {
+			fmap.Set("_original_basename", filepath.Base(path))
+		}
+		path = remote_path
+	}
+
+	fmap.Set("src", path)
+	data.Set(t.ModuleName, fmap)
+	if err = module.SetData(&data); err != nil {
+		cleanup()
+		return func() {}, fmt.Errorf("Unable to set src file: %v", err)
+	}
+	return cleanup, nil
+}
+
+// Returns the string or template of the module data field
+func fieldString(fmap OrderedMap, key string) string {
+	switch val, _ := fmap.Get(key); v := val.(type) {
+	case string:
+		return v
+	case TString:
+		if !v.IsEmpty() {
+			return v.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+package ansible
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+// Module with the controller src like copy has
+type testFileModule struct {
+	Src               TString
+	Remote_src        TString
+	Original_basename TString `task:"_original_basename"`
+}
+
+func (t *testFileModule) GetData() (data OrderedMap) {
+	data.Set("copy", TaskV1GetData(t))
+	return data
+}
+
+func (t *testFileModule) SetData(data *OrderedMap) error {
+	d, _ := data.Pop("copy")
+	fmap, _ := d.(OrderedMap)
+	return TaskV1SetData(t, fmap)
+}
+
+func (t *testFileModule) Run(ctx *TaskV2Context) (out OrderedMap, err error) {
+	return out, nil
+}
+
+// Transport recording the uploaded files and the executed commands
+type testFilesTransport struct {
+	files    map[string]string
+	modes    map[string]os.FileMode
+	commands []string
+}
+
+func (tr *testFilesTransport) Execute(ctx context.Context, cmd string, stdout, stderr io.Writer) (*transport.Result, error) {
+	tr.commands = append(tr.commands, cmd)
+	return &transport.Result{}, nil
+}
+func (tr *testFilesTransport) ExecuteInput(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*transport.Result, error) {
+	return tr.Execute(ctx, cmd, stdout, stderr)
+}
+func (tr *testFilesTransport) Check() (string, string, error) {
+	return "linux", "amd64", nil
+}
+func (tr *testFilesTransport) Copy(content io.Reader, dst string, mode os.FileMode) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	tr.files[dst] = string(data)
+	tr.modes[dst] = mode
+	return nil
+}
+func (tr *testFilesTransport) Fetch(src string, dst io.Writer) error {
+	return nil
+}
+func (tr *testFilesTransport) Close() error {
+	return nil
+}
+
+func TestPrepareFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "files"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "files", "app.conf"), []byte("from files"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "root.conf"), []byte("from playbook dir"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, test := range map[string]struct {
+		src        string
+		remote_src string
+		become     bool
+		content    string
+		basename   string
+	}{
+		"files_dir":    {"app.conf", "", false, "from files", "app.conf"},
+		"playbook_dir": {"root.conf", "", false, "from playbook dir", "root.conf"},
+		"absolute":     {filepath.Join(dir, "root.conf"), "", false, "from playbook dir", "root.conf"},
+		"become":       {"app.conf", "", true, "from files", "app.conf"},
+		"remote_src":   {"/etc/remote.conf", "yes", false, "", ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			module := &testFileModule{}
+			module.Src.SetUnknown(test.src)
+			if test.remote_src != "" {
+				module.Remote_src.SetUnknown(test.remote_src)
+			}
+			vars := map[string]any{"playbook_dir": dir}
+			if test.become {
+				vars["ansible_become"] = true
+			}
+			client := &testFilesTransport{files: map[string]string{}, modes: map[string]os.FileMode{}}
+			task := &Task{Name: NewTString("Test"), ModuleName: "copy"}
+
+			cleanup, err := task.prepareFiles(context.Background(), client, "linux", module, vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := module.Src.Val()
+			if test.content == "" {
+				// Remote src is read by the module on the target as is
+				if src != test.src || len(client.files) > 0 {
+					t.Fatalf("Remote src is changed to %q, uploaded: %v", src, client.files)
+				}
+				return
+			}
+
+			if !strings.HasPrefix(src, agent_path+"-src-") || client.files[src] != test.content {
+				t.Fatalf("Src is %q, uploaded: %v", src, client.files)
+			}
+			if module.Original_basename.Val() != test.basename {
+				t.Errorf("Original basename is %q", module.Original_basename.Val())
+			}
+			if mode := client.modes[src]; test.become && mode != 0644 || !test.become && mode != 0600 {
+				t.Errorf("Uploaded file mode is %v", mode)
+			}
+
+			cleanup()
+			if len(client.commands) != 1 || client.commands[0] != "rm -f '"+src+"'" {
+				t.Errorf("Uploaded file is not removed: %q", client.commands)
+			}
+		})
+	}
+
+	// Local execution reads the resolved controller file in place
+	module := &testFileModule{}
+	module.Src.SetUnknown("app.conf")
+	task := &Task{Name: NewTString("Test"), ModuleName: "copy"}
+	if _, err := task.prepareFiles(context.Background(), nil, "", module, map[string]any{"playbook_dir": dir}); err != nil {
+		t.Fatal(err)
+	}
+	if src := module.Src.Val(); src != filepath.Join(dir, "files", "app.conf") {
+		t.Errorf("Local src is %q", src)
+	}
+
+	module = &testFileModule{}
+	module.Src.SetUnknown("missing.conf")
+	if _, err := task.prepareFiles(context.Background(), nil, "", module, map[string]any{"playbook_dir": dir}); err == nil {
+		t.Error("Expected error for missing src file")
+	}
+}
@@ -58,6 +58,10 @@ func (t *TaskV1Default) Run(vars map[string]any) error {
 }
 
 func taskInterp(name string) (*fast.Interp, error) {
+	mu := moduleCreateLock("task", name)
+	mu.Lock()
+	defer mu.Unlock()
+
 	// Looking in cache first
 	interp := ModuleGetCache("task", name)
 	if interp != nil {
@@ -130,6 +134,10 @@ func GetTaskV1(name string) (out TaskV1Interface, err error) {
 		return nil, err
 	}
 
+	mu := ModuleLock(interp)
+	mu.Lock()
+	defer mu.Unlock()
+
 	task_structv, _ := interp.Eval1("sys_modules.TaskV1Interface(&TaskV1{})")
 	if err != nil { // Could be an error after interp.Eval1 panic
 		return nil, fmt.Errorf("Task '%s' can't convert the struct `TaskV1` to pointer `TaskV1Interface`: %s", name, err)
@@ -141,3 +149,7 @@ func GetTaskV1(name string) (out TaskV1Interface, err error) {
 
 	return task_struct, nil
 }
+
+// Embed into the TaskV1 struct to declare the module supports check mode, the modules without it
+// are skipped when check mode is enabled. The modes are available for Run through the vars.
+type TaskV1SupportsCheckMode struct{}
@@ -5,10 +5,14 @@ package ansible
 import (
 	"bytes"
 	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 
+	"github.com/mattn/go-shellwords"
 	"gopkg.in/yaml.v3"
 )
 
@@ -82,7 +86,7 @@ func TaskV1SetData(task_ptr any, fmap OrderedMap) error {
 		}*/
 
 		rval := reflect.ValueOf(val)
-		rfield.Interface().MethodByName("SetUnknown").Call([]reflect.Value{rval})
+		rfield.Addr().MethodByName("SetUnknown").Call([]reflect.Value{rval})
 
 		/*if rfield.Kind() != rval.Kind() {
 			// Those are not the same types which is alarming, so check if field is an Slice
@@ -159,7 +163,7 @@ func TaskV1GetData(task_ptr any) (fmap OrderedMap) {
 				}
 			}
 		}
-		fmap.Set(strings.ToLower(fieldt.Name), rval.Field(i).Interface())
+		fmap.Set(info.Name, rval.Field(i).Interface())
 	}
 
 	return fmap
@@ -211,7 +215,17 @@ func TaskV1FieldInfo(field *reflect.StructField) (info fieldInfo, err error) {
 				aliases = append(aliases, kv[1])
 			case "def":
 				info.Default = true
-				switch field.Type.Kind() {
+				// The T-types are containing the values of the related basic types
+				kind := field.Type.Kind()
+				switch field.Type.Name() {
+				case "TBool":
+					kind = reflect.Bool
+				case "TInt":
+					kind = reflect.Int
+				case "TString":
+					kind = reflect.String
+				}
+				switch kind {
 				case reflect.Bool:
 					if info.DefaultVal, err = strconv.ParseBool(kv[1]); err != nil {
 						return info, fmt.Errorf("Incorrect field `%s` bool value '%s': %s", field.Name, flag, err)
@@ -260,3 +274,138 @@ func ToYaml(obj any) (string, error) {
 	}
 	return "---\n" + buf.String(), nil
 }
+
+// Returns true if the task is running in check mode and should not change the system
+func TaskV1CheckMode(vars map[string]any) bool {
+	check, _ := vars["ansible_check_mode"].(bool)
+	return check
+}
+
+// Returns true if the task should report the diff of the changes it makes
+func TaskV1DiffMode(vars map[string]any) bool {
+	diff, _ := vars["ansible_diff_mode"].(bool)
+	return diff
+}
+
+// Splits the free form command line to args like shell does, but without expanding the variables
+func TaskV1SplitCmdline(cmdline string) ([]string, error) {
+	args, err := shellwords.Parse(cmdline)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse command line %q: %v", cmdline, err)
+	}
+	return args, nil
+}
+
+// Prepares the `diff` value of the task result which is shown as unified diff in diff mode
+func TaskV1Diff(before, after, before_header, after_header string) (out OrderedMap) {
+	out.Set("before", before)
+	out.Set("after", after)
+	out.Set("before_header", before_header)
+	out.Set("after_header", after_header)
+	return out
+}
+
+// Writes the content to the file through the temp file in the same directory if it differs
+// from the current content. Returns the previous content to prepare the diff. In check mode
+// the file is not touched, but the changed status is still reported.
+func TaskV1WriteFile(path, content string, check bool) (changed bool, before string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, "", fmt.Errorf("Unable to read file %q: %v", path, err)
+	}
+	before = string(data)
+	if err == nil && before == content {
+		return false, before, nil
+	}
+	if check {
+		return true, before, nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return false, before, fmt.Errorf("Unable to create temp file for %q: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return false, before, fmt.Errorf("Unable to write temp file for %q: %v", path, err)
+	}
+	if err = tmp.Close(); err != nil {
+		return false, before, fmt.Errorf("Unable to write temp file for %q: %v", path, err)
+	}
+	// Keeping the mode of the existing file, otherwise using the usual 0644
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return false, before, fmt.Errorf("Unable to set mode of temp file for %q: %v", path, err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return false, before, fmt.Errorf("Unable to replace file %q: %v", path, err)
+	}
+
+	return true, before, nil
+}
+
+// Sets owner, group and octal mode of the path if they are not empty and differ from the
+// current ones. In check mode just reports the change.
+func TaskV1FileAttrs(path, owner, group, mode string, check bool) (changed bool, err error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if check && os.IsNotExist(err) {
+			// The file could be created by the task in check mode, so it will be changed
+			return owner != "" || group != "" || mode != "", nil
+		}
+		return false, fmt.Errorf("Unable to get attributes of %q: %v", path, err)
+	}
+
+	if mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return false, fmt.Errorf("Unable to parse mode %q, only octal modes are supported: %v", mode, err)
+		}
+		if info.Mode().Perm() != os.FileMode(perm)&os.ModePerm {
+			changed = true
+			if !check {
+				if err = os.Chmod(path, os.FileMode(perm)); err != nil {
+					return changed, fmt.Errorf("Unable to set mode of %q: %v", path, err)
+				}
+			}
+		}
+	}
+
+	if owner == "" && group == "" {
+		return changed, nil
+	}
+	uid, gid := -1, -1
+	if owner != "" {
+		if uid, err = strconv.Atoi(owner); err != nil {
+			found, err := user.Lookup(owner)
+			if err != nil {
+				return changed, fmt.Errorf("Unable to find user %q: %v", owner, err)
+			}
+			uid, _ = strconv.Atoi(found.Uid)
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			found, err := user.LookupGroup(group)
+			if err != nil {
+				return changed, fmt.Errorf("Unable to find group %q: %v", group, err)
+			}
+			gid, _ = strconv.Atoi(found.Gid)
+		}
+	}
+	cur_uid, cur_gid, ok := fileOwner(info)
+	if ok && (uid == -1 || uid == cur_uid) && (gid == -1 || gid == cur_gid) {
+		return changed, nil
+	}
+	if check {
+		return true, nil
+	}
+	if err = os.Lchown(path, uid, gid); err != nil {
+		return changed, fmt.Errorf("Unable to set owner of %q: %v", path, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package ansible
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the numeric owner and group of the file
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
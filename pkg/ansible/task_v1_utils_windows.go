@@ -0,0 +1,12 @@
+//go:build windows
+
+package ansible
+
+import (
+	"os"
+)
+
+// Windows files have no numeric owner and group
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return -1, -1, false
+}
@@ -0,0 +1,289 @@
+package ansible
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+)
+
+// TaskV2 modules are receiving the execution context instead of just vars
+type TaskV2Interface interface {
+	Run(ctx *TaskV2Context) (OrderedMap, error)
+	SetData(data *OrderedMap) error
+	GetData() OrderedMap
+}
+
+// Proxy is needed for interface conversion from script to be compiled
+// WARNING: the order of func fields in proxy is ABC: https://github.com/cosmos72/gomacro/issues/128
+type P_TaskV2Interface struct {
+	Object   any
+	GetData_ func(_obj_ any) OrderedMap
+	Run_     func(_obj_ any, ctx *TaskV2Context) (OrderedMap, error)
+	SetData_ func(_obj_ any, data *OrderedMap) error
+}
+
+func (P *P_TaskV2Interface) GetData() OrderedMap {
+	return P.GetData_(P.Object)
+}
+func (P *P_TaskV2Interface) SetData(data *OrderedMap) error {
+	return P.SetData_(P.Object, data)
+}
+func (P *P_TaskV2Interface) Run(ctx *TaskV2Context) (OrderedMap, error) {
+	return P.Run_(P.Object, ctx)
+}
+
+// Embed into the TaskV2 struct to declare the module supports check mode
+type TaskV2SupportsCheckMode = TaskV1SupportsCheckMode
+
+// Privilege escalation settings of the task
+type TaskV2Become struct {
+	Enabled bool
+	User    string
+	Method  string
+}
+
+// Execution context of the task passed to the TaskV2 modules
+type TaskV2Context struct {
+	// Cancelled when the execution is interrupted, long running modules should respect it
+	Ctx context.Context
+	// Variables available for the task
+	Vars map[string]any
+
+	// Do not change the system, just report what would be changed
+	CheckMode bool
+	// Report the changes as diff in the result
+	DiffMode bool
+	// Privilege escalation settings
+	Become TaskV2Become
+	// Environment variables to set for the executed commands
+	Environment map[string]string
+	// Connection type used to reach the host (ssh, winrm, local...)
+	Connection string
+	// Directory of the playbook to lookup the relative files
+	PlaybookDir string
+
+	// Name of the task and the module
+	TaskName   string
+	ModuleName string
+
+	// Logger with the task name prefix
+	Log TaskV2Logger
+
+	tmp_dir string
+	result  TaskV2Result
+}
+
+// Creates the context from the vars filling the known modes and settings
+func NewTaskV2Context(ctx context.Context, vars map[string]any) (*TaskV2Context, error) {
+	env, err := TaskV1Environment(vars)
+	if err != nil {
+		return nil, err
+	}
+	out := &TaskV2Context{
+		Ctx:         ctx,
+		Vars:        vars,
+		CheckMode:   TaskV1CheckMode(vars),
+		DiffMode:    TaskV1DiffMode(vars),
+		Environment: env,
+	}
+	out.Connection, _ = vars["ansible_connection"].(string)
+	out.PlaybookDir, _ = vars["playbook_dir"].(string)
+	out.Become.Enabled = varBool(vars["ansible_become"])
+	out.Become.User, _ = vars["ansible_become_user"].(string)
+	out.Become.Method, _ = vars["ansible_become_method"].(string)
+	return out, nil
+}
+
+// Returns the process environment with the task environment applied to use in exec.Cmd.Env
+func (c *TaskV2Context) Environ() []string {
+	return environ(c.Environment)
+}
+
+// Returns the temp directory for the task, it's created on the first call and removed by Cleanup
+func (c *TaskV2Context) TempDir() (string, error) {
+	if c.tmp_dir != "" {
+		return c.tmp_dir, nil
+	}
+	dir, err := os.MkdirTemp("", "ansiblego-"+c.ModuleName+"-")
+	if err != nil {
+		return "", fmt.Errorf("Unable to create task temp dir: %v", err)
+	}
+	c.tmp_dir = dir
+	return dir, nil
+}
+
+// Removes the task temp data
+func (c *TaskV2Context) Cleanup() {
+	if c.tmp_dir != "" {
+		if err := os.RemoveAll(c.tmp_dir); err != nil {
+			c.Log.Warnf("Unable to remove temp dir %q: %v", c.tmp_dir, err)
+		}
+		c.tmp_dir = ""
+	}
+}
+
+// Looks for the file in the playbook dir and its `<subdir>` (like `files` or `templates`)
+func (c *TaskV2Context) FindFile(subdir, name string) (string, error) {
+	return findFile(c.PlaybookDir, subdir, name)
+}
+
+// Returns the result builder of the task
+func (c *TaskV2Context) Result() *TaskV2Result {
+	return &c.result
+}
+
+// Logs the messages with the task name prefix
+type TaskV2Logger struct {
+	prefix string
+}
+
+func (l TaskV2Logger) Debugf(format string, args ...any) {
+	log.Debugf(l.prefix+format, args...)
+}
+func (l TaskV2Logger) Infof(format string, args ...any) {
+	log.Infof(l.prefix+format, args...)
+}
+func (l TaskV2Logger) Warnf(format string, args ...any) {
+	log.Warnf(l.prefix+format, args...)
+}
+func (l TaskV2Logger) Errorf(format string, args ...any) error {
+	return log.Errorf(l.prefix+format, args...)
+}
+
+// Builds the task output with the common Ansible result keys
+type TaskV2Result struct {
+	data OrderedMap
+}
+
+func (r *TaskV2Result) Set(key string, val any) *TaskV2Result {
+	r.data.Set(key, val)
+	return r
+}
+func (r *TaskV2Result) Changed(changed bool) *TaskV2Result {
+	return r.Set("changed", changed)
+}
+func (r *TaskV2Result) Msg(format string, args ...any) *TaskV2Result {
+	return r.Set("msg", fmt.Sprintf(format, args...))
+}
+func (r *TaskV2Result) Diff(before, after, before_header, after_header string) *TaskV2Result {
+	return r.Set("diff", TaskV1Diff(before, after, before_header, after_header))
+}
+func (r *TaskV2Result) Data() OrderedMap {
+	return r.data
+}
+
+// Allows to use TaskV1 modules as TaskV2
+type TaskV1Adapter struct {
+	Task TaskV1Interface
+}
+
+func (a *TaskV1Adapter) GetData() OrderedMap {
+	return a.Task.GetData()
+}
+func (a *TaskV1Adapter) SetData(data *OrderedMap) error {
+	return a.Task.SetData(data)
+}
+func (a *TaskV1Adapter) Run(ctx *TaskV2Context) (OrderedMap, error) {
+	return a.Task.Run(ctx.Vars)
+}
+
+func GetTaskV2(name string) (out TaskV2Interface, err error) {
+	defer func() {
+		if pan := recover(); pan != nil {
+			err = fmt.Errorf("Error during executing the task module '%s': %s", name, pan)
+		}
+	}()
+
+	interp, err := taskInterp(name)
+	if err != nil { // Could be an error after taskInterp panic
+		return nil, err
+	}
+
+	mu := ModuleLock(interp)
+	mu.Lock()
+	defer mu.Unlock()
+
+	task_structv, _ := interp.Eval1("sys_modules.TaskV2Interface(&TaskV2{})")
+	if err != nil { // Could be an error after interp.Eval1 panic
+		return nil, fmt.Errorf("Task '%s' can't convert the struct `TaskV2` to pointer `TaskV2Interface`: %s", name, err)
+	}
+	if task_structv.Kind() != reflect.Interface {
+		return nil, fmt.Errorf("Task '%s' has issues with struct `TaskV2`", name)
+	}
+	task_struct := task_structv.Interface().(TaskV2Interface)
+
+	return task_struct, nil
+}
+
+// Returns TaskV2 module or TaskV1 module wrapped into adapter if the module has no TaskV2
+func GetTask(name string) (out TaskV2Interface, err error) {
+	if out, err = GetTaskV2(name); err != nil {
+		log.Tracef("Task module '%s' has no TaskV2, trying TaskV1: %v", name, err)
+
+		v1, err := GetTaskV1(name)
+		if err != nil {
+			return nil, err
+		}
+		out = &TaskV1Adapter{Task: v1}
+	}
+
+	interp, err := taskInterp(name)
+	if err != nil {
+		return nil, err
+	}
+	return &lockedTask{task: out, mu: ModuleLock(interp)}, nil
+}
+
+// Module objects of the same interp could be used by the forks in parallel, but the interp is
+// not safe for concurrent use, so the calls are serialized
+type lockedTask struct {
+	task TaskV2Interface
+	mu   *sync.Mutex
+}
+
+func (l *lockedTask) GetData() OrderedMap {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.task.GetData()
+}
+func (l *lockedTask) SetData(data *OrderedMap) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.task.SetData(data)
+}
+func (l *lockedTask) Run(ctx *TaskV2Context) (OrderedMap, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.task.Run(ctx)
+}
+
+// Checks if the task module struct embeds TaskV1SupportsCheckMode
+func taskSupportsCheckMode(task TaskV2Interface) bool {
+	var obj any = task
+	switch t := task.(type) {
+	case *lockedTask:
+		return taskSupportsCheckMode(t.task)
+	case *TaskV1Adapter:
+		obj = t.Task
+		if proxy, ok := t.Task.(*P_TaskV1Interface); ok {
+			obj = proxy.Object
+		}
+	case *P_TaskV2Interface:
+		obj = t.Object
+	}
+	rval := reflect.Indirect(reflect.ValueOf(obj))
+	if rval.Kind() != reflect.Struct {
+		return false
+	}
+	marker := reflect.TypeOf(TaskV1SupportsCheckMode{})
+	for i := 0; i < rval.NumField(); i++ {
+		if field := rval.Type().Field(i); field.Anonymous && field.Type == marker {
+			return true
+		}
+	}
+	return false
+}
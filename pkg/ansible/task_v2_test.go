@@ -0,0 +1,37 @@
+package ansible
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewTaskV2ContextBecome(t *testing.T) {
+	for name, test := range map[string]struct {
+		become   any
+		expected bool
+	}{
+		"bool":         {true, true},
+		"bool_false":   {false, false},
+		"string_yes":   {"yes", true},
+		"string_true":  {"True", true},
+		"string_false": {"no", false},
+		"unset":        {nil, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			vars := map[string]any{"ansible_become_user": "admin", "ansible_become_method": "su"}
+			if test.become != nil {
+				vars["ansible_become"] = test.become
+			}
+			ctx, err := NewTaskV2Context(context.Background(), vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ctx.Become.Enabled != test.expected {
+				t.Errorf("Become enabled is %v, expected %v", ctx.Become.Enabled, test.expected)
+			}
+			if ctx.Become.User != "admin" || ctx.Become.Method != "su" {
+				t.Errorf("Become is %+v", ctx.Become)
+			}
+		})
+	}
+}
@@ -62,7 +62,9 @@ func (t *TAny) UnmarshalYAML(val *yaml.Node) error {
 	}
 	return val.Decode(&t.value)
 }
-func (t *TAny) MarshalYAML() (any, error) {
+
+// Value receiver to encode the module fields and the map keys, they are not addressable
+func (t TAny) MarshalYAML() (any, error) {
 	node := &yaml.Node{}
 
 	// If it's a template value - return template, otherwise static value
@@ -107,6 +109,22 @@ func (t *TAny) SetUnknown(val any) {
 	t.value = val
 }
 
+// List could be set from the yaml sequence or from a single value
+func (t *TStringList) SetUnknown(val any) {
+	*t = nil
+	if lst, ok := val.([]any); ok {
+		for _, v := range lst {
+			item := TString{}
+			item.SetUnknown(v)
+			*t = append(*t, item)
+		}
+		return
+	}
+	item := TString{}
+	item.SetUnknown(val)
+	*t = append(*t, item)
+}
+
 func (t *TString) SetValue(val string) {
 	t.value = val
 }
@@ -119,6 +137,13 @@ func (t *TBool) SetValue(val bool) {
 	t.value = val
 }
 
+func (t *TAny) Val() any {
+	if t.value == nil && t.meta.Default {
+		return t.meta.DefaultVal
+	}
+	return t.value
+}
+
 func (t *TString) Val() string {
 	if t.value == nil {
 		if t.meta.Default {
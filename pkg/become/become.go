@@ -0,0 +1,158 @@
+package become
+
+// Privilege escalation to run commands as another user
+// Doc: https://docs.ansible.com/ansible/2.9/user_guide/become.html
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Become settings, the methods are sudo, su and doas on unix and runas on windows
+type Become struct {
+	Method   string
+	User     string
+	Password string
+	// Additional flags for the become method executable
+	Flags string
+}
+
+// Default become methods for the platforms
+const (
+	DefaultMethod        = "sudo"
+	DefaultWindowsMethod = "runas"
+)
+
+// Prompts of su and doas which are not configurable
+var password_prompt = regexp.MustCompile(`(?i)(password|passwort|mot de passe|contraseña|пароль)[^:\n]*[:：]\s*$`)
+
+func (b *Become) user() string {
+	if b.User == "" {
+		return "root"
+	}
+	return b.User
+}
+
+func (b *Become) flags() []string {
+	return strings.Fields(b.Flags)
+}
+
+// Random key to recognize the escalation prompt and success marker in the output
+func newKey() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("Unable to generate become key: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Watches the output of the become command to answer the password prompt and to find the
+// success marker which means the privileges are escalated and the actual command is started
+type watcher struct {
+	mu sync.Mutex
+
+	password string
+	prompt   *regexp.Regexp
+	success  string
+
+	// Where to send the password
+	input io.Writer
+	// Called when the success marker is found
+	escalated func()
+	// Stops the command in case of the password issues
+	cancel context.CancelFunc
+
+	prompted bool
+	done     bool
+	err      error
+}
+
+// Creates writer for one of the command outputs which passes through the data after escalation
+func (w *watcher) output(out io.Writer) io.Writer {
+	return &watcherOutput{w: w, out: out}
+}
+
+func (w *watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+type watcherOutput struct {
+	w   *watcher
+	out io.Writer
+	buf []byte
+}
+
+func (o *watcherOutput) Write(p []byte) (int, error) {
+	w := o.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.done {
+		return o.forward(p, len(p))
+	}
+
+	o.buf = append(o.buf, p...)
+	if idx := bytes.Index(o.buf, []byte(w.success)); idx >= 0 {
+		w.done = true
+		rest := bytes.TrimLeft(o.buf[idx+len(w.success):], "\r\n")
+		o.buf = nil
+		if w.escalated != nil {
+			go w.escalated()
+		}
+		return o.forward(rest, len(p))
+	}
+
+	if w.prompt.Match(o.buf) {
+		o.buf = nil
+		switch {
+		case w.password == "":
+			w.err = fmt.Errorf("Password is required to escalate privileges, set ansible_become_password")
+			w.cancel()
+		case w.prompted:
+			w.err = fmt.Errorf("Incorrect become password")
+			w.cancel()
+		default:
+			w.prompted = true
+			if _, err := io.WriteString(w.input, w.password+"\n"); err != nil {
+				w.err = fmt.Errorf("Unable to send become password: %v", err)
+				w.cancel()
+			}
+		}
+	}
+
+	return len(p), nil
+}
+
+func (o *watcherOutput) forward(data []byte, n int) (int, error) {
+	if o.out != nil && len(data) > 0 {
+		if _, err := o.out.Write(data); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Returns the escalation output collected before the success to show it in error
+func collected(outs ...io.Writer) string {
+	var parts []string
+	for _, out := range outs {
+		if o, ok := out.(*watcherOutput); ok && len(o.buf) > 0 {
+			parts = append(parts, strings.TrimSpace(string(o.buf)))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Quotes the argument for the posix shell
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'"'"'`) + "'"
+}
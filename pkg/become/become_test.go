@@ -0,0 +1,82 @@
+//go:build linux
+
+package become
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteBase64Lines(t *testing.T) {
+	for name, size := range map[string]int{"empty": 0, "short": 10, "exact_line": 57, "long": 1000} {
+		t.Run(name, func(t *testing.T) {
+			data := bytes.Repeat([]byte{0, 'a', '\n', 0xff}, size)[:size]
+			var out bytes.Buffer
+			if err := writeBase64Lines(&out, bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(out.String(), "\n\x04") {
+				t.Fatalf("Output is not ended with EOF: %q", out.String())
+			}
+			var encoded string
+			for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\x04"), "\n") {
+				if len(line) > 76 {
+					t.Fatalf("Line is too long: %d", len(line))
+				}
+				encoded += line
+			}
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Errorf("Decoded data is %q, expected %q", decoded, data)
+			}
+		})
+	}
+}
+
+// Places fake su asking for the password on the terminal to the PATH
+func fakeSu(t *testing.T) {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+printf 'Password: '
+read -r pass
+if [ "$pass" != "secret" ]; then
+	echo "su: Authentication failure"
+	exit 1
+fi
+# Skipping the user and -c
+exec /bin/sh -c "$3"
+`
+	if err := os.WriteFile(filepath.Join(dir, "su"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+}
+
+func TestRunPtyStdin(t *testing.T) {
+	fakeSu(t)
+
+	// The input is longer than the terminal line limit and has no trailing newline
+	input := strings.Repeat("line of the input\n", 500) + strings.Repeat("x", 5000)
+	b := &Become{Method: "su", User: "other", Password: "secret"}
+	var stdout bytes.Buffer
+	if err := b.Run(context.Background(), strings.NewReader(input), &stdout, nil, "cat"); err != nil {
+		t.Fatal(err)
+	}
+	// Terminal is translating the newlines of the output
+	if out := strings.ReplaceAll(stdout.String(), "\r\n", "\n"); out != input {
+		t.Errorf("Command got %d bytes of stdin, expected %d", len(out), len(input))
+	}
+
+	b.Password = "wrong"
+	if err := b.Run(context.Background(), strings.NewReader(input), &stdout, nil, "cat"); err == nil || !strings.Contains(err.Error(), "Authentication failure") {
+		t.Errorf("Expected authentication error, got: %v", err)
+	}
+}
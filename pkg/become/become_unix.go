@@ -0,0 +1,213 @@
+//go:build !windows
+
+package become
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"strings"
+)
+
+// Runs the command as the become user. The password prompt is answered with the become password
+// and the stdin is passed to the command once the privileges are escalated.
+func (b *Become) Run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	success := "BECOME-SUCCESS-" + key
+
+	// su and doas are reading the password from the terminal only
+	use_pty := (b.Method == "su" || b.Method == "doas") && b.Password != ""
+
+	// Shell prints the success marker right before executing the actual command
+	wrapper := "echo " + success + "; exec \"$0\" \"$@\""
+	if use_pty {
+		// Terminal has no separate stream for stderr, so it's dropped to keep the stdout clean
+		wrapper = "echo " + success + "; exec \"$0\" \"$@\" 2>/dev/null"
+		if stdin != nil {
+			// Terminal is echoing the input and limits the line length, so the stdin is passed
+			// as base64 lines without echo
+			wrapper = "stty -echo; echo " + success + "; base64 -d | \"$0\" \"$@\" 2>/dev/null"
+		}
+	}
+	shell_args := []string{"/bin/sh", "-c", wrapper, name}
+	shell_args = append(shell_args, args...)
+
+	prompt := password_prompt
+	var become_args []string
+	switch b.Method {
+	case "", "sudo":
+		sudo_prompt := "[sudo via ansiblego, key=" + key + "] password:"
+		prompt = regexp.MustCompile(regexp.QuoteMeta(sudo_prompt))
+		become_args = append([]string{"sudo"}, b.flags()...)
+		if b.Password == "" {
+			// Fail instead of waiting for the password forever
+			become_args = append(become_args, "-n")
+		}
+		become_args = append(become_args, "-H", "-S", "-p", sudo_prompt, "-u", b.user())
+		become_args = append(become_args, shell_args...)
+	case "su":
+		become_args = append([]string{"su"}, b.flags()...)
+		quoted := make([]string, len(shell_args))
+		for i, arg := range shell_args {
+			quoted[i] = shellQuote(arg)
+		}
+		become_args = append(become_args, b.user(), "-c", strings.Join(quoted, " "))
+	case "doas":
+		become_args = append([]string{"doas"}, b.flags()...)
+		if b.Password == "" {
+			become_args = append(become_args, "-n")
+		}
+		become_args = append(become_args, "-u", b.user())
+		become_args = append(become_args, shell_args...)
+	default:
+		return fmt.Errorf("Unsupported become method %q", b.Method)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, become_args[0], become_args[1:]...)
+	w := &watcher{
+		password: b.Password,
+		prompt:   prompt,
+		success:  success,
+		cancel:   cancel,
+	}
+
+	if use_pty {
+		return b.runPty(cmd, w, stdin, stdout)
+	}
+
+	stdin_pipe, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("Unable to create stdin pipe for become: %v", err)
+	}
+	w.input = stdin_pipe
+	w.escalated = func() {
+		if stdin != nil {
+			io.Copy(stdin_pipe, stdin)
+		}
+		stdin_pipe.Close()
+	}
+	out, errout := w.output(stdout), w.output(stderr)
+	cmd.Stdout = out
+	cmd.Stderr = errout
+
+	err = cmd.Run()
+	if werr := w.Err(); werr != nil {
+		return werr
+	}
+	if !w.done {
+		return fmt.Errorf("Unable to escalate privileges with %s: %v: %s", b.Method, err, collected(out, errout))
+	}
+	return err
+}
+
+// Runs the command with terminal to answer the password prompt
+func (b *Become) runPty(cmd *exec.Cmd, w *watcher, stdin io.Reader, stdout io.Writer) error {
+	master, slave, err := openPty()
+	if err != nil {
+		return fmt.Errorf("Unable to open terminal for become method %q: %v", b.Method, err)
+	}
+	defer master.Close()
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	setControllingTerminal(cmd)
+	w.input = master
+	if stdin != nil {
+		w.escalated = func() {
+			if err := writeBase64Lines(master, stdin); err != nil {
+				w.mu.Lock()
+				w.err = fmt.Errorf("Unable to pass stdin to become command: %v", err)
+				w.mu.Unlock()
+				w.cancel()
+			}
+		}
+	}
+
+	if err = cmd.Start(); err != nil {
+		slave.Close()
+		return fmt.Errorf("Unable to start become method %q: %v", b.Method, err)
+	}
+	slave.Close()
+
+	out := w.output(stdout)
+	// Reading of the master returns error when the command closes the terminal
+	copy_done := make(chan struct{})
+	go func() {
+		io.Copy(out, master)
+		close(copy_done)
+	}()
+
+	<-copy_done
+	err = cmd.Wait()
+
+	if werr := w.Err(); werr != nil {
+		return werr
+	}
+	if !w.done {
+		return fmt.Errorf("Unable to escalate privileges with %s: %v: %s", b.Method, err, collected(out))
+	}
+	return err
+}
+
+// Returns true if the process is already running as the user
+func IsUser(name string) bool {
+	if name == "" || name == "root" {
+		return os.Geteuid() == 0
+	}
+	current, err := user.Current()
+	return err == nil && current.Username == name
+}
+
+// Writes the data to the terminal as base64 lines followed by EOF control character
+func writeBase64Lines(term io.Writer, data io.Reader) error {
+	enc := base64.NewEncoder(base64.StdEncoding, &lineWriter{out: term, size: 76})
+	if _, err := io.Copy(enc, data); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	// EOF is recognized by the terminal only at the beginning of the line
+	_, err := io.WriteString(term, "\n\x04")
+	return err
+}
+
+// Splits the written data to the lines of the size
+type lineWriter struct {
+	out  io.Writer
+	size int
+	col  int
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := l.size - l.col
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := l.out.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		l.col += n
+		p = p[n:]
+		if l.col == l.size {
+			if _, err := l.out.Write([]byte{'\n'}); err != nil {
+				return written, err
+			}
+			l.col = 0
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,101 @@
+//go:build windows
+
+package become
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"os/user"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	logon32_logon_interactive = 2
+	logon32_provider_default  = 0
+)
+
+var proc_logon_user = windows.NewLazySystemDLL("advapi32.dll").NewProc("LogonUserW")
+
+// Runs the command as the become user with the logon token, only runas method is supported
+func (b *Become) Run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+	if b.Method != "" && b.Method != "runas" {
+		return fmt.Errorf("Unsupported become method %q on windows", b.Method)
+	}
+
+	if b.User == "" {
+		return fmt.Errorf("The become user is required for runas method")
+	}
+	token, err := logonUser(b.User, b.Password)
+	if err != nil {
+		return err
+	}
+	defer token.Close()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Token: syscall.Token(token)}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+
+	return cmd.Run()
+}
+
+// Logs in the user which could be set as `DOMAIN\user` or `user@domain`
+func logonUser(name, password string) (windows.Token, error) {
+	domain := "."
+	if parts := strings.SplitN(name, `\`, 2); len(parts) == 2 {
+		domain, name = parts[0], parts[1]
+	} else if strings.Contains(name, "@") {
+		domain = ""
+	}
+
+	name_ptr, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	domain_ptr, err := windows.UTF16PtrFromString(domain)
+	if err != nil {
+		return 0, err
+	}
+	password_ptr, err := windows.UTF16PtrFromString(password)
+	if err != nil {
+		return 0, err
+	}
+
+	var token windows.Token
+	r1, _, e1 := proc_logon_user.Call(
+		uintptr(unsafe.Pointer(name_ptr)),
+		uintptr(unsafe.Pointer(domain_ptr)),
+		uintptr(unsafe.Pointer(password_ptr)),
+		logon32_logon_interactive,
+		logon32_provider_default,
+		uintptr(unsafe.Pointer(&token)),
+	)
+	if r1 == 0 {
+		return 0, fmt.Errorf("Unable to logon user %q: %v", name, e1)
+	}
+	return token, nil
+}
+
+// Returns true if the process is already running as the user
+func IsUser(name string) bool {
+	current, err := user.Current()
+	if err != nil {
+		return false
+	}
+	if name == "" {
+		name = "SYSTEM"
+	}
+	// Username on windows contains the domain part
+	username := current.Username
+	if !strings.Contains(name, `\`) {
+		if idx := strings.LastIndex(username, `\`); idx >= 0 {
+			username = username[idx+1:]
+		}
+	}
+	return strings.EqualFold(username, name)
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !windows
+
+package become
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func openPty() (master, slave *os.File, err error) {
+	return nil, nil, fmt.Errorf("Pseudo terminal is not supported on this platform")
+}
+
+func setControllingTerminal(cmd *exec.Cmd) {}
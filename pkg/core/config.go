@@ -3,9 +3,11 @@ package core
 import (
 	"io/ioutil"
 
+	"github.com/creasty/defaults"
 	"gopkg.in/yaml.v3"
 
 	"github.com/state-of-the-art/ansiblego/pkg/ansible/inventory"
+	"github.com/state-of-the-art/ansiblego/pkg/factcache"
 )
 
 // Common configuration for the framework
@@ -19,19 +21,69 @@ type PlaybookConfig struct {
 
 	// Additional variables to use during execution
 	ExtraVars map[string]any `json:"extra_vars"`
+	// Runs only tasks with provided tags
+	Tags []string `json:"tags"`
 	// Skips tasks with provided tags
 	SkipTags []string `json:"skip_tags"`
+	// Further limits the hosts selected by play with additional pattern
+	Limit string `json:"limit"`
+	// Do not make any changes, just report what would be changed
+	Check bool `json:"check"`
+	// Show the differences of the changed files
+	Diff bool `json:"diff"`
+	// Run operations with become
+	Become bool `json:"become"`
+	// Run operations as this user
+	BecomeUser string `json:"become_user"`
+	// Privilege escalation method to use: sudo, su, doas or runas
+	BecomeMethod string `json:"become_method"`
+	// Password for privilege escalation, usually asked with --ask-become-pass
+	BecomePassword string `json:"become_password"`
+	// Number of hosts to run the play steps in parallel
+	Forks int `json:"forks" default:"5"`
+	// Default strategy of the plays: linear or free
+	Strategy string `json:"strategy" default:"linear"`
+	// SSH host key checking: true (strict), false, or accept-new to trust the keys on first use
+	HostKeyChecking string `json:"host_key_checking" default:"true"`
+
+	// Facts are available as `ansible_facts.*` and if enabled - as top-level `ansible_*` vars too
+	InjectFactsAsVars bool `json:"inject_facts_as_vars" default:"true"`
+	// Facts gathering policy: implicit (unless gather_facts: false), explicit (only if gather_facts: true)
+	// or smart (like implicit but skips gathering if the host facts are in the cache)
+	Gathering string `json:"gathering" default:"implicit"`
+	// Fact cache plugin name: memory or jsonfile
+	FactCaching string `json:"fact_caching" default:"memory"`
+	// Fact cache plugin specific connection, for jsonfile it's the directory to store host files
+	FactCachingConnection string `json:"fact_caching_connection"`
+	// Expiration timeout of the cached facts in seconds, 0 means facts never expire
+	FactCachingTimeout int `json:"fact_caching_timeout" default:"86400"`
+
+	// Initialized fact cache to use during the run
+	FactCache factcache.FactCache `json:"-" yaml:"-"`
 
 	// Parsed inventory data
 	Inventory *inventory.Inventory `json:"inventory"`
 }
 
+// Returns the number of forks, at least one
+func (c *PlaybookConfig) ForksNum() int {
+	if c.Forks < 1 {
+		return 1
+	}
+	return c.Forks
+}
+
 // Agent execution config
 type AgentConfig struct {
 	CommonConfig
 }
 
 func ReadConfigFile(obj any, cfg_path string) error {
+	// Filling the defaults from struct definition
+	if err := defaults.Set(obj); err != nil {
+		return err
+	}
+
 	if cfg_path != "" {
 		// Open and parse
 		data, err := ioutil.ReadFile(cfg_path)
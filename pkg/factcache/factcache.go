@@ -0,0 +1,31 @@
+package factcache
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/state-of-the-art/ansiblego/pkg/factcache/jsonfile"
+	"github.com/state-of-the-art/ansiblego/pkg/factcache/memory"
+)
+
+// Fact caches are used to store the gathered facts of the host between the playbook runs to
+// skip the expensive facts gathering when `gathering: smart` is used and to keep the facts
+// set by `set_fact` with `cacheable: yes`. The facts are stored without `ansible_` prefix.
+type FactCache interface {
+	Get(host string) (facts map[string]any, ok bool)
+	Set(host string, facts map[string]any) (err error)
+	Delete(host string) (err error)
+}
+
+// Creates the fact cache by plugin name, connection is plugin-specific (directory for jsonfile)
+// and timeout is facts expiration period (0 means facts never expire)
+func New(plugin, connection string, timeout time.Duration) (FactCache, error) {
+	switch plugin {
+	case "", "memory":
+		return memory.New(timeout), nil
+	case "jsonfile":
+		return jsonfile.New(connection, timeout)
+	}
+
+	return nil, fmt.Errorf("Unable to find fact cache plugin %q", plugin)
+}
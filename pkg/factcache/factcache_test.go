@@ -0,0 +1,140 @@
+package factcache
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFactCache(t *testing.T) {
+	for _, plugin := range []string{"memory", "jsonfile"} {
+		t.Run(plugin, func(t *testing.T) {
+			cache, err := New(plugin, t.TempDir(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := cache.Get("host1"); ok {
+				t.Fatal("Unexpected facts of not cached host")
+			}
+
+			facts := map[string]any{"os_family": "Debian", "module_setup": true}
+			if err = cache.Set("host1", facts); err != nil {
+				t.Fatal(err)
+			}
+			// Cache is not affected by the changes of the stored and the returned facts
+			facts["os_family"] = "RedHat"
+			out, ok := cache.Get("host1")
+			if !ok || !reflect.DeepEqual(out, map[string]any{"os_family": "Debian", "module_setup": true}) {
+				t.Fatalf("Cached facts are %v, %v", out, ok)
+			}
+			out["os_family"] = "Alpine"
+			if out, _ = cache.Get("host1"); out["os_family"] != "Debian" {
+				t.Fatalf("Cached facts are modified: %v", out)
+			}
+			if _, ok = cache.Get("host2"); ok {
+				t.Fatal("Facts of the other host are returned")
+			}
+
+			if err = cache.Delete("host1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok = cache.Get("host1"); ok {
+				t.Fatal("Facts are not deleted")
+			}
+			if err = cache.Delete("host1"); err != nil {
+				t.Fatalf("Deleting not cached host failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestFactCacheTimeout(t *testing.T) {
+	memory_cache, err := New("memory", "", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = memory_cache.Set("host1", map[string]any{"key": "value"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := memory_cache.Get("host1"); !ok {
+		t.Fatal("Facts are expired too early")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := memory_cache.Get("host1"); ok {
+		t.Fatal("Facts are not expired")
+	}
+
+	dir := t.TempDir()
+	json_cache, err := New("jsonfile", dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json_cache.Set("host1", map[string]any{"key": "value"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := json_cache.Get("host1"); !ok {
+		t.Fatal("Facts are expired too early")
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err = os.Chtimes(filepath.Join(dir, "host1"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := json_cache.Get("host1"); ok {
+		t.Fatal("Facts are not expired")
+	}
+
+	// Zero timeout means the facts are never expiring
+	json_cache, err = New("jsonfile", dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := json_cache.Get("host1"); !ok {
+		t.Fatal("Facts are expired without timeout")
+	}
+}
+
+func TestFactCacheJsonfile(t *testing.T) {
+	if _, err := New("jsonfile", "", 0); err == nil {
+		t.Fatal("Expected error for jsonfile cache without directory")
+	}
+	if _, err := New("unknown", "", 0); err == nil {
+		t.Fatal("Expected error for unknown plugin")
+	}
+
+	dir := t.TempDir()
+	cache, err := New("jsonfile", dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupted file is treated as not cached and is replaced by the next set
+	path := filepath.Join(dir, "host1")
+	if err = os.WriteFile(path, []byte(`{"broken": `), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get("host1"); ok {
+		t.Fatal("Corrupted facts are returned")
+	}
+	if err = cache.Set("host1", map[string]any{"key": "value"}); err != nil {
+		t.Fatal(err)
+	}
+	if out, ok := cache.Get("host1"); !ok || out["key"] != "value" {
+		t.Fatalf("Facts are %v, %v", out, ok)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Temp file is left: %v", err)
+	}
+
+	// Host name is not able to escape the cache directory
+	if err = cache.Set("../escape", map[string]any{"key": "value"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "escape")); err != nil {
+		t.Errorf("Facts file is not in the cache dir: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(filepath.Dir(dir), "escape")); !os.IsNotExist(err) {
+		t.Errorf("Facts file escaped the cache dir: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package jsonfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/state-of-the-art/ansiblego/pkg/log"
+)
+
+// Stores facts of each host in a separated json file in the directory. The facts keys are stored
+// without `ansible_` prefix, so the files are not interchangeable with Ansible `jsonfile` plugin
+type FactCacheJsonfile struct {
+	path    string
+	timeout time.Duration
+
+	mu sync.Mutex
+}
+
+func New(path string, timeout time.Duration) (*FactCacheJsonfile, error) {
+	if path == "" {
+		return nil, fmt.Errorf("The jsonfile fact cache requires the directory to be set as connection")
+	}
+	if err := os.MkdirAll(path, 0750); err != nil {
+		return nil, fmt.Errorf("Unable to create fact cache directory %q: %v", path, err)
+	}
+
+	return &FactCacheJsonfile{
+		path:    path,
+		timeout: timeout,
+	}, nil
+}
+
+func (fc *FactCacheJsonfile) hostPath(host string) string {
+	// Host name is used as file name, so making sure it's not escaping the cache dir
+	return filepath.Join(fc.path, filepath.Base(filepath.Clean("/"+host)))
+}
+
+func (fc *FactCacheJsonfile) Get(host string) (facts map[string]any, ok bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	host_path := fc.hostPath(host)
+	info, err := os.Stat(host_path)
+	if err != nil {
+		return nil, false
+	}
+	if fc.timeout > 0 && time.Since(info.ModTime()) > fc.timeout {
+		log.Debugf("Cached facts of host %q are expired", host)
+		return nil, false
+	}
+
+	data, err := os.ReadFile(host_path)
+	if err != nil {
+		log.Warnf("Unable to read cached facts of host %q: %v", host, err)
+		return nil, false
+	}
+	if err = json.Unmarshal(data, &facts); err != nil {
+		log.Warnf("Unable to parse cached facts of host %q: %v", host, err)
+		return nil, false
+	}
+
+	return facts, true
+}
+
+func (fc *FactCacheJsonfile) Set(host string, facts map[string]any) (err error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	data, err := json.MarshalIndent(facts, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode facts of host %q: %v", host, err)
+	}
+
+	// Writing to temp file and moving it in place to not leave the broken cache file
+	host_path := fc.hostPath(host)
+	tmp_path := host_path + ".tmp"
+	if err = os.WriteFile(tmp_path, data, 0640); err != nil {
+		return fmt.Errorf("Unable to write facts of host %q: %v", host, err)
+	}
+	if err = os.Rename(tmp_path, host_path); err != nil {
+		os.Remove(tmp_path)
+		return fmt.Errorf("Unable to place facts file of host %q: %v", host, err)
+	}
+
+	return nil
+}
+
+func (fc *FactCacheJsonfile) Delete(host string) (err error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if err = os.Remove(fc.hostPath(host)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to remove facts of host %q: %v", host, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package memory
+
+import (
+	"sync"
+	"time"
+)
+
+type cacheItem struct {
+	facts   map[string]any
+	updated time.Time
+}
+
+// Keeps the facts just for the current run, useful for the plays which are sharing the hosts
+type FactCacheMemory struct {
+	timeout time.Duration
+
+	mu    sync.RWMutex
+	hosts map[string]cacheItem
+}
+
+func New(timeout time.Duration) *FactCacheMemory {
+	return &FactCacheMemory{
+		timeout: timeout,
+		hosts:   make(map[string]cacheItem),
+	}
+}
+
+func (fc *FactCacheMemory) Get(host string) (facts map[string]any, ok bool) {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+
+	item, ok := fc.hosts[host]
+	if !ok || fc.timeout > 0 && time.Since(item.updated) > fc.timeout {
+		return nil, false
+	}
+
+	// Copy to not allow to modify the cache data outside
+	facts = make(map[string]any, len(item.facts))
+	for key, val := range item.facts {
+		facts[key] = val
+	}
+
+	return facts, true
+}
+
+func (fc *FactCacheMemory) Set(host string, facts map[string]any) (err error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	item := cacheItem{
+		facts:   make(map[string]any, len(facts)),
+		updated: time.Now(),
+	}
+	for key, val := range facts {
+		item.facts[key] = val
+	}
+	fc.hosts[host] = item
+
+	return nil
+}
+
+func (fc *FactCacheMemory) Delete(host string) (err error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	delete(fc.hosts, host)
+
+	return nil
+}
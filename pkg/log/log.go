@@ -49,6 +49,21 @@ func SetVerbosity(level string) error {
 	return nil
 }
 
+// Returns the name of the current verbosity level to pass it to the other processes
+func VerbosityName() string {
+	switch {
+	case Verbosity >= TRACE:
+		return "trace"
+	case Verbosity >= DEBUG:
+		return "debug"
+	case Verbosity >= INFO:
+		return "info"
+	case Verbosity >= WARN:
+		return "warn"
+	}
+	return "error"
+}
+
 func InitLoggers(output *os.File) error {
 	flags := log.Lmsgprefix
 
@@ -1,54 +1,112 @@
 package sshd
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
+	"path"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/mattn/go-shellwords"
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/state-of-the-art/ansiblego/pkg/log"
 )
 
+// Additional settings of the server
+type Options struct {
+	// Addresses like `host:port` the clients are allowed to reach through the server with
+	// port forwarding (as jump host). Wildcards are supported in the host and port parts,
+	// forwarding is disabled if the list is empty.
+	ForwardAllow []string
+	// Host keys of the server, the new RSA key is generated if empty
+	HostKeys []ssh.Signer
+	// Public keys the user is allowed to login with in addition to the password
+	AuthorizedKeys []ssh.PublicKey
+	// Ask the password with keyboard-interactive method instead of the password method
+	KeyboardInteractive bool
+	// Disable the sftp subsystem, so the clients have to use scp
+	NoSFTP bool
+}
+
 // Needs just user, password and addr like "0.0.0.0:2222"
-func Run(user, password, addr string) error {
-	config := &ssh.ServerConfig{
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+func Run(user, password, addr string, opts Options) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return log.Error("Failed to listen for connection: ", err)
+	}
+	return Serve(listener, user, password, opts)
+}
+
+// Accepts the connections on the listener until it's closed
+func Serve(listener net.Listener, user, password string, opts Options) error {
+	config := &ssh.ServerConfig{}
+	if opts.KeyboardInteractive {
+		config.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client(c.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if c.User() == user && len(answers) == 1 && answers[0] == password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Password rejected for %q", c.User())
+		}
+	} else {
+		config.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
 			if c.User() == user && string(pass) == password {
 				return nil, nil
 			}
 			return nil, fmt.Errorf("Password rejected for %q", c.User())
-		},
+		}
 	}
-
-	private_key, err := rsa.GenerateKey(rand.Reader, 4096)
-	if err != nil {
-		return log.Error("Failed to generate new private key: ", err)
+	if len(opts.AuthorizedKeys) > 0 {
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, authorized := range opts.AuthorizedKeys {
+				if c.User() == user && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("Public key rejected for %q", c.User())
+		}
 	}
 
-	private, err := ssh.NewSignerFromKey(private_key)
-	if err != nil {
-		return log.Error("Failed to create signer for private key: ", err)
+	for _, key := range opts.HostKeys {
+		config.AddHostKey(key)
 	}
+	if len(opts.HostKeys) == 0 {
+		private_key, err := rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return log.Error("Failed to generate new private key: ", err)
+		}
 
-	config.AddHostKey(private)
+		private, err := ssh.NewSignerFromKey(private_key)
+		if err != nil {
+			return log.Error("Failed to create signer for private key: ", err)
+		}
 
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return log.Error("Failed to listen for connection: ", err)
+		config.AddHostKey(private)
 	}
+
 	for {
 		nconn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			log.Error("Failed to accept incoming connection: ", err)
+			continue
 		}
 
 		conn, chans, reqs, err := ssh.NewServerConn(nconn, config)
@@ -60,21 +118,150 @@ func Run(user, password, addr string) error {
 		log.Infof("User '%s' just logged in\n", conn.User())
 
 		go ssh.DiscardRequests(reqs)
-		go handleChannels(chans)
+		go handleChannels(chans, &opts)
 	}
 }
 
-func handleChannels(chans <-chan ssh.NewChannel) {
+func handleChannels(chans <-chan ssh.NewChannel, opts *Options) {
 	for new_channel := range chans {
-		go handleChannel(new_channel)
+		go handleChannel(new_channel, opts)
 	}
 }
 
+// Checks the address is in the forwarding allow list
+func (o *Options) forwardAllowed(host string, port uint32) bool {
+	port_str := fmt.Sprintf("%d", port)
+	for _, allow := range o.ForwardAllow {
+		allow_host, allow_port, err := net.SplitHostPort(allow)
+		if err != nil {
+			continue
+		}
+		host_ok, _ := path.Match(strings.ToLower(allow_host), strings.ToLower(host))
+		port_ok, _ := path.Match(allow_port, port_str)
+		if host_ok && port_ok {
+			return true
+		}
+	}
+	return false
+}
+
 type exitStatusMsg struct {
 	Status uint32
 }
 
-func handleChannel(new_channel ssh.NewChannel) {
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+// Signals the client is able to send to the command and the command could be killed with
+var signals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGHUP:  syscall.SIGHUP,
+	ssh.SIGINT:  syscall.SIGINT,
+	ssh.SIGQUIT: syscall.SIGQUIT,
+	ssh.SIGKILL: syscall.SIGKILL,
+	ssh.SIGTERM: syscall.SIGTERM,
+}
+
+// Command running in the session, receives the signals of the client
+type sessionCmd struct {
+	mu  sync.Mutex
+	cmd *exec.Cmd
+}
+
+func (s *sessionCmd) signal(name ssh.Signal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sig, ok := signals[name]
+	if !ok || s.cmd == nil || s.cmd.Process == nil {
+		return fmt.Errorf("Unable to send signal %q", name)
+	}
+	return s.cmd.Process.Signal(sig)
+}
+
+// Sends the exit status or the signal the command was killed with and closes the channel
+func sendExit(channel ssh.Channel, err error) {
+	defer channel.Close()
+	var exit_err *exec.ExitError
+	if errors.As(err, &exit_err) {
+		if status, ok := exit_err.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			for name, sig := range signals {
+				if sig == status.Signal() {
+					if _, err := channel.SendRequest("exit-signal", false, ssh.Marshal(&exitSignalMsg{Signal: string(name)})); err != nil {
+						log.Errorf("Unable to send signal: %v", err)
+					}
+					return
+				}
+			}
+		}
+	}
+	ex := exitStatusMsg{
+		Status: 0,
+	}
+	if exit_err != nil && exit_err.ExitCode() > 0 {
+		ex.Status = uint32(exit_err.ExitCode())
+	} else if err != nil {
+		ex.Status = 1
+		log.Error("Executing error:", err)
+	}
+	if _, err := channel.SendRequest("exit-status", false, ssh.Marshal(&ex)); err != nil {
+		log.Errorf("Unable to send status: %v", err)
+	}
+}
+
+// Payload of the port forwarding channel request
+type directTCPIPMsg struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// Forwards the channel to the requested address, allows to use the server as jump host
+func handleDirectTCPIP(new_channel ssh.NewChannel, opts *Options) {
+	msg := directTCPIPMsg{}
+	if err := ssh.Unmarshal(new_channel.ExtraData(), &msg); err != nil {
+		new_channel.Reject(ssh.ConnectionFailed, "unable to parse forward request")
+		return
+	}
+	if !opts.forwardAllowed(msg.Host, msg.Port) {
+		log.Warnf("Rejecting forwarding to %s:%d: not in the allow list", msg.Host, msg.Port)
+		new_channel.Reject(ssh.Prohibited, "forwarding is not allowed")
+		return
+	}
+	addr := net.JoinHostPort(msg.Host, fmt.Sprintf("%d", msg.Port))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		new_channel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := new_channel.Accept()
+	if err != nil {
+		log.Errorf("Could not accept channel: %v", err)
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	log.Debugf("Forwarding connection to %s", addr)
+
+	go func() {
+		io.Copy(conn, channel)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	go func() {
+		defer channel.Close()
+		defer conn.Close()
+		io.Copy(channel, conn)
+	}()
+}
+
+func handleChannel(new_channel ssh.NewChannel, opts *Options) {
+	if new_channel.ChannelType() == "direct-tcpip" {
+		handleDirectTCPIP(new_channel, opts)
+		return
+	}
 	if new_channel.ChannelType() != "session" {
 		new_channel.Reject(ssh.UnknownChannelType, "unknown channel type")
 		return
@@ -85,6 +272,7 @@ func handleChannel(new_channel ssh.NewChannel) {
 	}
 
 	env := os.Environ()
+	var running sessionCmd
 
 	go func(in <-chan *ssh.Request) {
 		for req := range in {
@@ -99,19 +287,38 @@ func handleChannel(new_channel ssh.NewChannel) {
 				env = appendEnv(env, kv)
 				req.Reply(true, nil)
 			case "exec":
-				cmd := string(req.Payload)
-				err := processCmd(channel, cmd[4:], env)
-				ex := exitStatusMsg{
-					Status: 0,
-				}
-				if err != nil {
-					ex.Status = 1
-					log.Error("Executing error:", err)
+				req.Reply(true, nil)
+				payload := struct{ Command string }{}
+				ssh.Unmarshal(req.Payload, &payload)
+				// Command is running in background to receive the signals
+				go func() {
+					sendExit(channel, processCmd(channel, channel, payload.Command, env, &running))
+				}()
+			case "signal":
+				sig := struct{ Signal string }{}
+				ssh.Unmarshal(req.Payload, &sig)
+				if err := running.signal(ssh.Signal(sig.Signal)); err != nil {
+					log.Error("Signal error:", err)
 				}
-				if _, err := channel.SendRequest("exit-status", false, ssh.Marshal(&ex)); err != nil {
-					log.Errorf("Unable to send status: %v", err)
+			case "subsystem":
+				name := struct{ Name string }{}
+				ssh.Unmarshal(req.Payload, &name)
+				if name.Name != "sftp" || opts.NoSFTP {
+					req.Reply(false, nil)
+					continue
 				}
-				channel.Close()
+				req.Reply(true, nil)
+				go func() {
+					defer channel.Close()
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						log.Errorf("Unable to start sftp server: %v", err)
+						return
+					}
+					if err := server.Serve(); err != nil && err != io.EOF {
+						log.Errorf("Sftp server error: %v", err)
+					}
+				}()
 			case "shell":
 				//cmd := string(req.Payload)
 				// Running shell terminal
@@ -123,7 +330,7 @@ func handleChannel(new_channel ssh.NewChannel) {
 						if err != nil {
 							break
 						}
-						err = processCmd(term, line, env)
+						err = processCmd(nil, term, line, env, nil)
 						if err != nil {
 							log.Error("Executing error:", err)
 						}
@@ -137,7 +344,8 @@ func handleChannel(new_channel ssh.NewChannel) {
 	}(requests)
 }
 
-func processCmd(connection io.Writer, command string, envs []string) error {
+// Runs the command, the running one is stored in the session cmd if it's set
+func processCmd(stdin io.Reader, connection io.Writer, command string, envs []string, running *sessionCmd) error {
 	// Special case for uname to show proper system on windows
 	if command == "uname -s -m" {
 		connection.Write([]byte(fmt.Sprintf("%s %s\n", runtime.GOOS, runtime.GOARCH)))
@@ -158,9 +366,29 @@ func processCmd(connection io.Writer, command string, envs []string) error {
 	log.Infof("Executing: %s %s", cmd.Path, strings.Join(cmd.Args[1:], " "))
 	cmd.Stdout = connection
 	cmd.Stderr = connection
-	err = cmd.Run()
-
-	return err
+	if stdin != nil {
+		// Pipe is not waited for, so the command is not stuck if the client keeps stdin open
+		pipe, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		go func() {
+			io.Copy(pipe, stdin)
+			pipe.Close()
+		}()
+	}
+	if running != nil {
+		running.mu.Lock()
+		err = cmd.Start()
+		running.cmd = cmd
+		running.mu.Unlock()
+	} else {
+		err = cmd.Start()
+	}
+	if err != nil {
+		return err
+	}
+	return cmd.Wait()
 }
 
 func appendEnv(env []string, kv string) []string {
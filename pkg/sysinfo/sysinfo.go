@@ -0,0 +1,56 @@
+package sysinfo
+
+// Provides access to the system information sources which are not available through the golang
+// stdlib. The sources are set as interfaces to be able to stub them on the other platforms.
+
+import (
+	"fmt"
+	"os"
+)
+
+// Windows registry access, keys are relative to HKEY_LOCAL_MACHINE
+type WindowsRegistry interface {
+	GetString(key, name string) (string, error)
+	GetInteger(key, name string) (uint64, error)
+}
+
+// Windows Management Instrumentation access
+type WindowsWMI interface {
+	// Returns the list of class instances with requested properties, filter is WQL where clause
+	Query(class, filter string, props []string) ([]map[string]any, error)
+}
+
+var (
+	// Set only on windows, but could be replaced by stubs to collect windows facts on other system
+	Registry WindowsRegistry
+	WMI      WindowsWMI
+
+	// Process environment in `key=value` form, could be replaced by stub like the sources above
+	Environ = os.Environ
+)
+
+// Windows facts sources are available
+func IsWindows() bool {
+	return Registry != nil && WMI != nil
+}
+
+func RegistryGetString(key, name string) (string, error) {
+	if Registry == nil {
+		return "", fmt.Errorf("Windows registry is not available")
+	}
+	return Registry.GetString(key, name)
+}
+
+func RegistryGetInteger(key, name string) (uint64, error) {
+	if Registry == nil {
+		return 0, fmt.Errorf("Windows registry is not available")
+	}
+	return Registry.GetInteger(key, name)
+}
+
+func WMIQuery(class, filter string, props []string) ([]map[string]any, error) {
+	if WMI == nil {
+		return nil, fmt.Errorf("Windows WMI is not available")
+	}
+	return WMI.Query(class, filter, props)
+}
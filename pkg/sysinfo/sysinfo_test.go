@@ -0,0 +1,177 @@
+package sysinfo_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/state-of-the-art/ansiblego/pkg/ansible"
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/fact/windows_env"
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/fact/windows_hardware"
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/fact/windows_network"
+	"github.com/state-of-the-art/ansiblego/pkg/ansible/fact/windows_os"
+	"github.com/state-of-the-art/ansiblego/pkg/sysinfo"
+)
+
+type stubRegistry map[string]any
+
+func (r stubRegistry) GetString(key, name string) (string, error) {
+	if val, ok := r[key+`\`+name].(string); ok {
+		return val, nil
+	}
+	return "", fmt.Errorf("Not found %s %s", key, name)
+}
+
+func (r stubRegistry) GetInteger(key, name string) (uint64, error) {
+	if val, ok := r[key+`\`+name].(uint64); ok {
+		return val, nil
+	}
+	return 0, fmt.Errorf("Not found %s %s", key, name)
+}
+
+type stubWMI map[string][]map[string]any
+
+func (w stubWMI) Query(class, filter string, props []string) ([]map[string]any, error) {
+	if out, ok := w[class]; ok {
+		return out, nil
+	}
+	return nil, fmt.Errorf("Invalid class %q", class)
+}
+
+const (
+	key_current_version = `SOFTWARE\Microsoft\Windows NT\CurrentVersion`
+	key_environment     = `SYSTEM\CurrentControlSet\Control\Session Manager\Environment`
+	key_powershell      = `SOFTWARE\Microsoft\PowerShell\3\PowerShellEngine`
+)
+
+// Replaces the windows sources with stubs until the end of the test
+func stubSources(t *testing.T) {
+	registry, wmi, environ := sysinfo.Registry, sysinfo.WMI, sysinfo.Environ
+	t.Cleanup(func() {
+		sysinfo.Registry, sysinfo.WMI, sysinfo.Environ = registry, wmi, environ
+	})
+
+	sysinfo.Registry = stubRegistry{
+		key_current_version + `\ProductName`:               "Windows Server 2022 Datacenter",
+		key_current_version + `\CurrentVersion`:            "6.3",
+		key_current_version + `\CurrentMajorVersionNumber`: uint64(10),
+		key_current_version + `\CurrentMinorVersionNumber`: uint64(0),
+		key_current_version + `\CurrentBuildNumber`:        "20348",
+		key_current_version + `\UBR`:                       uint64(2113),
+		key_current_version + `\DisplayVersion`:            "21H2",
+		key_environment + `\PROCESSOR_ARCHITECTURE`:        "AMD64",
+		key_powershell + `\PowerShellVersion`:              "5.1.20348.1",
+	}
+	sysinfo.WMI = stubWMI{
+		"Win32_OperatingSystem": {{"ProductType": float64(3)}},
+		"Win32_ComputerSystem": {{
+			"Name": "WIN01", "DNSHostName": "win01", "Domain": "example.com", "PartOfDomain": true,
+			"TotalPhysicalMemory": "8589934592", "NumberOfProcessors": float64(1),
+			"NumberOfLogicalProcessors": float64(4), "Manufacturer": "QEMU", "Model": "Standard PC",
+		}},
+		"Win32_Processor": {{"Name": "Intel Xeon", "NumberOfCores": float64(2)}},
+		"Win32_Bios":      {{"SerialNumber": "SN123", "SMBIOSBIOSVersion": "1.16"}},
+		"Win32_NetworkAdapterConfiguration": {{
+			"Description": "Red Hat VirtIO Ethernet Adapter", "InterfaceIndex": float64(4),
+			"MACAddress": "52:54:00:12:34:56", "IPAddress": []any{"10.0.0.5", "fe80::1"},
+			"DefaultIPGateway": []any{"10.0.0.1"}, "DNSDomain": "example.com",
+		}},
+		"Win32_NetworkAdapter": {{"InterfaceIndex": float64(4), "NetConnectionID": "Ethernet"}},
+	}
+	sysinfo.Environ = func() []string {
+		return []string{"=C:=C:\\", `PATH=C:\Windows`, "USERNAME=admin", "EMPTY="}
+	}
+}
+
+func checkFacts(t *testing.T, data ansible.OrderedMap, expected map[string]any) {
+	t.Helper()
+	for key, exp := range expected {
+		val, ok := data.Get(key)
+		if !ok {
+			t.Errorf("Fact %q is not set", key)
+			continue
+		}
+		if !reflect.DeepEqual(val, exp) {
+			t.Errorf("Fact %q is %#v, expected %#v", key, val, exp)
+		}
+	}
+}
+
+func TestWindowsOS(t *testing.T) {
+	stubSources(t)
+	checkFacts(t, windows_os.Collect(), map[string]any{
+		"os_family":                  "Windows",
+		"distribution":               "Windows Server 2022 Datacenter",
+		"distribution_version":       "10.0.20348.2113",
+		"distribution_major_version": "10",
+		"distribution_release":       "21H2",
+		"os_product_type":            "server",
+		"architecture":               "64-bit",
+		"machine":                    "amd64",
+		"hostname":                   "win01",
+		"fqdn":                       "win01.example.com",
+		"domain":                     "example.com",
+		"windows_domain_member":      true,
+		"netbios_name":               "WIN01",
+		"powershell_version":         "5",
+	})
+}
+
+func TestWindowsHardware(t *testing.T) {
+	stubSources(t)
+	checkFacts(t, windows_hardware.Collect(), map[string]any{
+		"memtotal_mb":     int64(8192),
+		"processor_count": float64(1),
+		"processor_vcpus": float64(4),
+		"processor":       []any{"0", "Intel Xeon"},
+		"processor_cores": 2,
+		"system_vendor":   "QEMU",
+		"product_serial":  "SN123",
+		"bios_version":    "1.16",
+	})
+}
+
+func TestWindowsNetwork(t *testing.T) {
+	stubSources(t)
+	data := windows_network.Collect()
+	checkFacts(t, data, map[string]any{
+		"ip_addresses": []any{"10.0.0.5", "fe80::1"},
+	})
+	interfaces, _ := data.Get("interfaces")
+	list, ok := interfaces.([]any)
+	if !ok || len(list) != 1 {
+		t.Fatalf("Expected one interface, got: %#v", interfaces)
+	}
+	checkFacts(t, list[0].(ansible.OrderedMap), map[string]any{
+		"connection_name": "Ethernet",
+		"default_gateway": "10.0.0.1",
+		"interface_index": float64(4),
+		"macaddress":      "52:54:00:12:34:56",
+	})
+}
+
+func TestWindowsEnv(t *testing.T) {
+	stubSources(t)
+	data := windows_env.Collect()
+	env, _ := data.Get("env")
+	var expected ansible.OrderedMap
+	expected.Set("PATH", `C:\Windows`)
+	expected.Set("USERNAME", "admin")
+	expected.Set("EMPTY", "")
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("Unexpected env facts: %#v", env)
+	}
+}
+
+func TestNotWindows(t *testing.T) {
+	stubSources(t)
+	sysinfo.Registry, sysinfo.WMI = nil, nil
+	for name, collect := range map[string]func() ansible.OrderedMap{
+		"os": windows_os.Collect, "hardware": windows_hardware.Collect,
+		"network": windows_network.Collect, "env": windows_env.Collect,
+	} {
+		if data := collect(); data.Size() != 0 {
+			t.Errorf("Windows %s facts are collected without the sources: %v", name, data.Keys())
+		}
+	}
+}
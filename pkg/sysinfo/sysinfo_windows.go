@@ -0,0 +1,84 @@
+//go:build windows
+
+package sysinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/state-of-the-art/ansiblego/pkg/util"
+)
+
+func init() {
+	Registry = &nativeRegistry{}
+	WMI = &powershellWMI{}
+}
+
+type nativeRegistry struct{}
+
+func (r *nativeRegistry) GetString(key, name string) (string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, key, registry.QUERY_VALUE)
+	if err != nil {
+		return "", fmt.Errorf("Unable to open registry key %q: %v", key, err)
+	}
+	defer k.Close()
+
+	val, _, err := k.GetStringValue(name)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get registry value %q of %q: %v", name, key, err)
+	}
+	return val, nil
+}
+
+func (r *nativeRegistry) GetInteger(key, name string) (uint64, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, key, registry.QUERY_VALUE)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to open registry key %q: %v", key, err)
+	}
+	defer k.Close()
+
+	val, _, err := k.GetIntegerValue(name)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to get registry value %q of %q: %v", name, key, err)
+	}
+	return val, nil
+}
+
+// There is no WMI in golang stdlib, so using powershell CIM cmdlets to get the data as json
+type powershellWMI struct{}
+
+func (w *powershellWMI) Query(class, filter string, props []string) ([]map[string]any, error) {
+	script := "Get-CimInstance -ClassName '" + class + "'"
+	if filter != "" {
+		script += " -Filter '" + strings.ReplaceAll(filter, "'", "''") + "'"
+	}
+	if len(props) > 0 {
+		script += " | Select-Object -Property " + strings.Join(props, ",")
+	}
+	script += " | ConvertTo-Json -Compress -Depth 3"
+
+	stdout, _, err := util.RunCommand(30*time.Second, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query WMI class %q: %v", class, err)
+	}
+
+	stdout = strings.TrimSpace(stdout)
+	if stdout == "" {
+		return nil, nil
+	}
+
+	// ConvertTo-Json returns object instead of list when there is just one instance
+	if !strings.HasPrefix(stdout, "[") {
+		stdout = "[" + stdout + "]"
+	}
+	var out []map[string]any
+	if err = json.Unmarshal([]byte(stdout), &out); err != nil {
+		return nil, fmt.Errorf("Unable to parse WMI class %q data: %v", class, err)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,154 @@
+package chroot
+
+// Transport to the root filesystem directory, like unpacked image or mounted disk image,
+// the commands are running in chroot and the files are written directly under the root
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+	"github.com/state-of-the-art/ansiblego/pkg/transport/local"
+)
+
+// Limit of the symlinks to follow while resolving the path, the same as in Linux
+const max_symlinks = 40
+
+// Settings of the chroot connection
+type Config struct {
+	// Directory of the target root filesystem
+	Root string
+	// Run in user namespace as root mapped to the current user, it's used automatically when
+	// the process is not running as root
+	UserNamespace bool
+}
+
+type TransportChroot struct {
+	root   string
+	userns bool
+}
+
+func New(cfg *Config) (*TransportChroot, error) {
+	root, err := filepath.Abs(cfg.Root)
+	if err != nil {
+		return nil, fmt.Errorf("Bad chroot path %q: %v", cfg.Root, err)
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("Chroot path %q is not a directory", root)
+	}
+
+	tr := &TransportChroot{
+		root:   root,
+		userns: cfg.UserNamespace || os.Geteuid() != 0,
+	}
+	if _, _, err := tr.Check(); err != nil {
+		return nil, fmt.Errorf("Unable to verify chroot: %v", err)
+	}
+	return tr, nil
+}
+
+func (tr *TransportChroot) Execute(ctx context.Context, cmd string, stdout, stderr io.Writer) (*transport.Result, error) {
+	return tr.run(ctx, cmd, nil, stdout, stderr)
+}
+
+func (tr *TransportChroot) ExecuteInput(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*transport.Result, error) {
+	return tr.run(ctx, cmd, stdin, stdout, stderr)
+}
+
+func (tr *TransportChroot) Check() (kernel, arch string, err error) {
+	stderr_buf := bytes.Buffer{}
+	stdout_buf := bytes.Buffer{}
+	if _, err = tr.Execute(context.Background(), "uname -s -m", &stdout_buf, &stderr_buf); err != nil {
+		return kernel, arch, fmt.Errorf("Unable to get the chroot system kernel: %v, %v", err, stderr_buf.String())
+	}
+
+	kernel_arch_list := strings.Fields(stdout_buf.String())
+	if len(kernel_arch_list) != 2 {
+		return kernel, arch, fmt.Errorf("Bad output from uname: %v, %v", stdout_buf.String(), stderr_buf.String())
+	}
+
+	kernel = strings.ToLower(kernel_arch_list[0])
+	arch = strings.ToLower(kernel_arch_list[1])
+
+	if arch == "x86_64" || arch == "x64" {
+		arch = "amd64"
+	}
+
+	return kernel, arch, nil
+}
+
+// Writes the file directly under the root
+func (tr *TransportChroot) Copy(content io.Reader, dst string, mode os.FileMode) error {
+	path, err := tr.resolve(dst)
+	if err != nil {
+		return err
+	}
+	return local.WriteFile(path, content, mode)
+}
+
+func (tr *TransportChroot) Fetch(src string, dst io.Writer) error {
+	path, err := tr.resolve(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Unable to open file %q: %v", src, err)
+	}
+	defer f.Close()
+	if _, err = io.Copy(dst, f); err != nil {
+		return fmt.Errorf("Error while fetching file: %v", err)
+	}
+	return nil
+}
+
+// Nothing to release, the commands are local processes
+func (tr *TransportChroot) Close() error {
+	return nil
+}
+
+// Returns the host path of the path in chroot. The symlinks are resolved the way they are seen
+// from the chroot, so the absolute links of the root filesystem are not pointing to the host
+// files. Missing path components are kept as is to be created.
+func (tr *TransportChroot) resolve(path string) (string, error) {
+	out := tr.root
+	rest := strings.Split(filepath.ToSlash(path), "/")
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if out != tr.root {
+				out = filepath.Dir(out)
+			}
+			continue
+		}
+
+		next := filepath.Join(out, name)
+		info, err := os.Lstat(next)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			out = next
+			continue
+		}
+		if links++; links > max_symlinks {
+			return "", fmt.Errorf("Too many levels of symbolic links in %q", path)
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read link %q: %v", next, err)
+		}
+		if strings.HasPrefix(target, "/") {
+			out = tr.root
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return out, nil
+}
@@ -0,0 +1,117 @@
+//go:build !windows
+
+package chroot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Creates the root filesystem with the links trying to escape it and returns the transport
+func testRoot(t *testing.T) (*TransportChroot, string) {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	for _, dir := range []string{"etc", "usr/lib", "outside"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The host directory near the root the links could point to
+	if err := os.MkdirAll(filepath.Join(base, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	links := map[string]string{
+		"abs_etc":         "/etc",
+		"rel_etc":         "../../etc",
+		"usr/lib/rel_etc": "../../../../etc",
+		"usr/lib/up":      "..",
+		"loop_a":          "loop_b",
+		"loop_b":          "loop_a",
+	}
+	// Chains of 40 and 41 links to the etc
+	for _, size := range []int{40, 41} {
+		for i := 0; i < size; i++ {
+			target := fmt.Sprintf("chain%d_%d", size, i+1)
+			if i == size-1 {
+				target = "/etc"
+			}
+			links[fmt.Sprintf("chain%d_%d", size, i)] = target
+		}
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &TransportChroot{root: root}, root
+}
+
+func TestResolve(t *testing.T) {
+	tr, root := testRoot(t)
+
+	for path, expected := range map[string]string{
+		"/etc/passwd":                "etc/passwd",
+		"etc/passwd":                 "etc/passwd",
+		"/../../etc/passwd":          "etc/passwd",
+		"/usr/../../../etc/passwd":   "etc/passwd",
+		"/abs_etc/passwd":            "etc/passwd",
+		"/rel_etc/passwd":            "etc/passwd",
+		"/usr/lib/rel_etc/passwd":    "etc/passwd",
+		"/usr/lib/up/lib/up/bin/sh":  "usr/bin/sh",
+		"/missing/../etc/passwd":     "etc/passwd",
+		"/missing/../../etc/passwd":  "etc/passwd",
+		"/":                          "",
+		"/..":                        "",
+		"/chain40_0/passwd":          "etc/passwd",
+		"/./etc/./nested/../passwd":  "etc/passwd",
+		"/outside/../../outside/bin": "outside/bin",
+	} {
+		t.Run(path, func(t *testing.T) {
+			out, err := tr.resolve(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != filepath.Join(root, expected) {
+				t.Errorf("Resolved to %q, expected %q", out, filepath.Join(root, expected))
+			}
+		})
+	}
+
+	for _, path := range []string{"/loop_a", "/loop_b/file", "/chain41_0/passwd"} {
+		if out, err := tr.resolve(path); err == nil || !strings.Contains(err.Error(), "Too many levels") {
+			t.Errorf("Expected symlinks limit error for %q, got: %q %v", path, out, err)
+		}
+	}
+}
+
+func TestCopyStaysInRoot(t *testing.T) {
+	tr, root := testRoot(t)
+	base := filepath.Dir(root)
+
+	for _, dst := range []string{"/abs_etc/test", "/rel_etc/test", "/usr/lib/rel_etc/test", "/../../etc/test"} {
+		t.Run(dst, func(t *testing.T) {
+			if err := tr.Copy(strings.NewReader(dst), dst, 0644); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(root, "etc/test"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != dst {
+				t.Errorf("Bad content of the copied file: %q", data)
+			}
+			if _, err = os.Stat(filepath.Join(base, "etc/test")); err == nil {
+				t.Fatal("File is written outside of the root")
+			}
+		})
+	}
+
+	if err := tr.Copy(strings.NewReader("data"), "/loop_a/test", 0644); err == nil {
+		t.Error("Copy through the symlink loop is not failed")
+	}
+}
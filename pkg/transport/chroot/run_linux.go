@@ -0,0 +1,29 @@
+//go:build linux
+
+package chroot
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+	"github.com/state-of-the-art/ansiblego/pkg/transport/local"
+)
+
+// Runs the command with the shell of the root filesystem
+func (tr *TransportChroot) run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*transport.Result, error) {
+	c := exec.Command("/bin/sh", "-c", cmd)
+	c.Dir = "/"
+	c.Stdin, c.Stdout, c.Stderr = stdin, stdout, stderr
+	c.SysProcAttr = &syscall.SysProcAttr{Chroot: tr.root}
+	if tr.userns {
+		// Current user is root in the namespace, so chroot is allowed without privileges
+		c.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER
+		c.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		c.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	}
+	return local.Run(ctx, c)
+}
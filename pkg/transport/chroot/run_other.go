@@ -0,0 +1,16 @@
+//go:build !linux
+
+package chroot
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+// Chroot and user namespaces are used the Linux way
+func (tr *TransportChroot) run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*transport.Result, error) {
+	return nil, fmt.Errorf("Chroot connection is supported only on Linux")
+}
@@ -0,0 +1,122 @@
+package docker
+
+// File transfer with the tar archives of the engine archive API
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Uploads the content as tar archive extracted to the container root, so the engine creates
+// the missing parent directories
+func (tr *TransportDocker) Copy(content io.Reader, dst string, mode os.FileMode) error {
+	size, content, cleanup, err := contentSize(content)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	name := strings.TrimPrefix(path.Clean("/"+dst), "/")
+	if name == "" {
+		return fmt.Errorf("Bad destination path %q", dst)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     size,
+			Mode:     int64(mode.Perm()),
+			ModTime:  time.Now(),
+		})
+		if err == nil {
+			_, err = io.Copy(tw, content)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err = tr.request(context.Background(), "PUT", "/containers/"+url.PathEscape(tr.container)+"/archive?path=%2F", pr, "application/x-tar", nil)
+	pr.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to copy file %q: %v", dst, err)
+	}
+	return nil
+}
+
+// Tar header needs the size before the content, so the content is stored to the temp file if
+// the size can't be found by seeking
+func contentSize(content io.Reader) (int64, io.Reader, func(), error) {
+	if seeker, ok := content.(io.Seeker); ok {
+		cur, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			var end int64
+			if end, err = seeker.Seek(0, io.SeekEnd); err == nil {
+				_, err = seeker.Seek(cur, io.SeekStart)
+			}
+			if err == nil {
+				return end - cur, content, func() {}, nil
+			}
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "ansiblego-copy-")
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("Unable to create temp file: %v", err)
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, content)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return 0, nil, nil, fmt.Errorf("Unable to store content to temp file: %v", err)
+	}
+	return size, tmp, cleanup, nil
+}
+
+// Downloads the file from the archive the engine returns for the path
+func (tr *TransportDocker) Fetch(src string, dst io.Writer) error {
+	req_path := "/containers/" + url.PathEscape(tr.container) + "/archive?path=" + url.QueryEscape(src)
+	req, err := http.NewRequest("GET", "http://engine"+req_path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := tr.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Engine request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Unable to fetch file %q: %v", src, apiError(resp))
+	}
+
+	tr_reader := tar.NewReader(resp.Body)
+	hdr, err := tr_reader.Next()
+	if err != nil {
+		return fmt.Errorf("Bad archive of file %q: %v", src, err)
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return fmt.Errorf("Unable to fetch %q: not a regular file", src)
+	}
+	if _, err = io.Copy(dst, tr_reader); err != nil {
+		return fmt.Errorf("Error while fetching file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+package docker
+
+// Transport to the docker or podman containers through the engine API
+// Doc: https://docs.docker.com/engine/api/v1.41/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+// Supported container engines, podman provides docker compatible API
+const (
+	EngineDocker = "docker"
+	EnginePodman = "podman"
+)
+
+const (
+	default_docker_host = "unix:///var/run/docker.sock"
+	// Time the interrupted command has to exit before it's killed
+	interrupt_grace = 5 * time.Second
+)
+
+// Settings of the container connection
+type Config struct {
+	// Engine API address like `unix:///var/run/docker.sock` or `tcp://host:2375`
+	Host string
+	// Name or id of the running container
+	Container string
+	// User to run the commands, the container one is used if empty
+	User string
+}
+
+// The commands are running with exec API and the files are copied with archive API
+type TransportDocker struct {
+	container string
+	user      string
+
+	network string
+	addr    string
+	client  *http.Client
+}
+
+// Returns the engine API address from the environment or the default socket of the engine
+func DefaultHost(engine string) string {
+	if engine != EnginePodman {
+		if host := os.Getenv("DOCKER_HOST"); host != "" {
+			return host
+		}
+		return default_docker_host
+	}
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+	// Rootless podman socket is in the user runtime dir
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Geteuid() != 0 {
+		return "unix://" + dir + "/podman/podman.sock"
+	}
+	return "unix:///run/podman/podman.sock"
+}
+
+func New(cfg *Config) (*TransportDocker, error) {
+	u, err := url.Parse(cfg.Host)
+	if err != nil {
+		return nil, fmt.Errorf("Bad engine address %q: %v", cfg.Host, err)
+	}
+	tr := &TransportDocker{
+		container: cfg.Container,
+		user:      cfg.User,
+	}
+	switch u.Scheme {
+	case "unix":
+		tr.network, tr.addr = "unix", u.Path
+	case "tcp":
+		tr.network, tr.addr = "tcp", u.Host
+	default:
+		return nil, fmt.Errorf("Unsupported engine address %q, only unix:// and tcp:// are supported", cfg.Host)
+	}
+	tr.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return tr.dial(ctx)
+		},
+	}}
+
+	if _, _, err := tr.Check(); err != nil {
+		tr.Close()
+		return nil, fmt.Errorf("Unable to verify container connection: %v", err)
+	}
+
+	return tr, nil
+}
+
+func (tr *TransportDocker) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	return dialer.DialContext(ctx, tr.network, tr.addr)
+}
+
+// Sends the request to the engine API and decodes the json response to out if it's not nil
+func (tr *TransportDocker) request(ctx context.Context, method, path string, body io.Reader, content_type string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, "http://engine"+path, body)
+	if err != nil {
+		return err
+	}
+	if content_type != "" {
+		req.Header.Set("Content-Type", content_type)
+	}
+	resp, err := tr.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Engine request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return apiError(resp)
+	}
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("Bad engine response: %v", err)
+	}
+	return nil
+}
+
+// Returns the error with the message from the engine response
+func apiError(resp *http.Response) error {
+	var msg struct {
+		Message string `json:"message"`
+	}
+	data, _ := io.ReadAll(resp.Body)
+	if json.Unmarshal(data, &msg) != nil || msg.Message == "" {
+		msg.Message = strings.TrimSpace(string(data))
+	}
+	return fmt.Errorf("Engine returned %d: %s", resp.StatusCode, msg.Message)
+}
+
+// Creates the exec instance of the command in the container
+func (tr *TransportDocker) execCreate(ctx context.Context, cmd []string, attach_stdin bool) (string, error) {
+	req, _ := json.Marshal(map[string]any{
+		"AttachStdin":  attach_stdin,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          false,
+		"User":         tr.user,
+		"Cmd":          cmd,
+	})
+	var resp struct {
+		Id string
+	}
+	err := tr.request(ctx, "POST", "/containers/"+url.PathEscape(tr.container)+"/exec", bytes.NewReader(req), "application/json", &resp)
+	if err != nil {
+		return "", fmt.Errorf("Unable to create exec: %v", err)
+	}
+	return resp.Id, nil
+}
+
+// Starts the exec and hijacks the connection to stream stdin and the multiplexed output
+func (tr *TransportDocker) execStart(ctx context.Context, id string) (net.Conn, *bufio.Reader, error) {
+	conn, err := tr.dial(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Engine request failed: %v", err)
+	}
+	body, _ := json.Marshal(map[string]any{"Detach": false, "Tty": false})
+	req, _ := http.NewRequest("POST", "http://engine/exec/"+url.PathEscape(id)+"/start", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Engine request failed: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Bad engine response: %v", err)
+	}
+	// Old engines are not switching protocols, but streaming in the same way
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		err = apiError(resp)
+		conn.Close()
+		return nil, nil, fmt.Errorf("Unable to start exec: %v", err)
+	}
+	return conn, reader, nil
+}
+
+// Returns the exit code of the finished exec, the engine could update the state a bit later
+// than the output stream is closed
+func (tr *TransportDocker) execExitCode(id string) (int, error) {
+	var resp struct {
+		Running  bool
+		ExitCode int
+	}
+	for attempt := 0; ; attempt++ {
+		if err := tr.request(context.Background(), "GET", "/exec/"+url.PathEscape(id)+"/json", nil, "", &resp); err != nil {
+			return -1, fmt.Errorf("Unable to inspect exec: %v", err)
+		}
+		if !resp.Running {
+			return resp.ExitCode, nil
+		}
+		if attempt >= 50 {
+			return -1, fmt.Errorf("Exec is still running after the output is closed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (tr *TransportDocker) Execute(ctx context.Context, cmd string, stdout, stderr io.Writer) (*transport.Result, error) {
+	return tr.run(ctx, cmd, nil, stdout, stderr)
+}
+
+func (tr *TransportDocker) ExecuteInput(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*transport.Result, error) {
+	return tr.run(ctx, cmd, stdin, stdout, stderr)
+}
+
+// Runs the command through the shell of the container. Exec API has no way to signal the
+// command, so the shell reports its pid in the first stderr line before replacing itself with
+// the command and the interruption is sending INT and after the grace period KILL to the pid.
+func (tr *TransportDocker) run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*transport.Result, error) {
+	script := `echo "$$" >&2; exec /bin/sh -c ` + quoteShell(cmd)
+	id, err := tr.execCreate(ctx, []string{"/bin/sh", "-c", script}, stdin != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	conn, reader, err := tr.execStart(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if stdin != nil {
+		go func() {
+			io.Copy(conn, stdin)
+			// Closing the write side is the stdin EOF for the command
+			if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+		}()
+	}
+
+	pid := &pidWriter{out: stderr, found: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- demux(reader, stdout, pid)
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		res := &transport.Result{ExitCode: -1, Duration: time.Since(start)}
+		select {
+		case <-pid.found:
+			res.Signal = "INT"
+			tr.signal(pid.pid, res.Signal)
+			select {
+			case <-done:
+			case <-time.After(interrupt_grace):
+				res.Signal = "KILL"
+				tr.signal(pid.pid, res.Signal)
+			}
+		default:
+		}
+		// The engine keeps the stream open while the command is running
+		conn.Close()
+		res.Duration = time.Since(start)
+		return res, fmt.Errorf("Command was interrupted: %v", ctx.Err())
+	}
+
+	res := &transport.Result{Duration: time.Since(start)}
+	if err != nil {
+		res.ExitCode = -1
+		return res, fmt.Errorf("Failed to run command: %v", err)
+	}
+	if res.ExitCode, err = tr.execExitCode(id); err != nil {
+		return res, err
+	}
+	// Engine reports the command killed by signal as 128+N exit code, but the command could exit
+	// with such code too, so it's kept as is and only the interruption reports the signal
+	if res.ExitCode != 0 || res.Signal != "" {
+		return res, &transport.ExitError{Result: res}
+	}
+	return res, nil
+}
+
+// Sends the signal to the process and its children in the container, the shell is not
+// passing the signal to the running command
+func (tr *TransportDocker) signal(pid int, sig string) {
+	script := `t() { for c in $(cat /proc/$1/task/*/children 2>/dev/null); do t "$c"; done; kill -` + sig + ` "$1" 2>/dev/null; }; t ` + strconv.Itoa(pid)
+	id, err := tr.execCreate(context.Background(), []string{"/bin/sh", "-c", script}, false)
+	if err != nil {
+		return
+	}
+	body, _ := json.Marshal(map[string]any{"Detach": true, "Tty": false})
+	tr.request(context.Background(), "POST", "/exec/"+url.PathEscape(id)+"/start", bytes.NewReader(body), "application/json", nil)
+}
+
+// Splits the multiplexed exec stream: each frame has 8 bytes header with the stream type
+// (1 - stdout, 2 - stderr) and big endian size of the payload
+func demux(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		var out io.Writer
+		switch header[0] {
+		case 1:
+			out = stdout
+		case 2:
+			out = stderr
+		default:
+			out = io.Discard
+		}
+		if out == nil {
+			out = io.Discard
+		}
+		if _, err := io.CopyN(out, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+// Takes the pid line from the beginning of stderr and passes the rest to the output
+type pidWriter struct {
+	out   io.Writer
+	buf   []byte
+	pid   int
+	found chan struct{}
+}
+
+func (w *pidWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.found:
+		if w.out == nil {
+			return len(p), nil
+		}
+		return w.out.Write(p)
+	default:
+	}
+	w.buf = append(w.buf, p...)
+	pos := bytes.IndexByte(w.buf, '\n')
+	if pos < 0 {
+		return len(p), nil
+	}
+	w.pid, _ = strconv.Atoi(strings.TrimSpace(string(w.buf[:pos])))
+	rest := w.buf[pos+1:]
+	w.buf = nil
+	close(w.found)
+	if len(rest) > 0 && w.out != nil {
+		if _, err := w.out.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (tr *TransportDocker) Check() (kernel, arch string, err error) {
+	stderr_buf := bytes.Buffer{}
+	stdout_buf := bytes.Buffer{}
+	if _, err = tr.Execute(context.Background(), "uname -s -m", &stdout_buf, &stderr_buf); err != nil {
+		return kernel, arch, fmt.Errorf("Unable to get the container system kernel: %v, %v", err, stderr_buf.String())
+	}
+
+	kernel_arch_list := strings.Fields(stdout_buf.String())
+	if len(kernel_arch_list) != 2 {
+		return kernel, arch, fmt.Errorf("Bad output from uname: %v, %v", stdout_buf.String(), stderr_buf.String())
+	}
+
+	kernel = strings.ToLower(kernel_arch_list[0])
+	arch = strings.ToLower(kernel_arch_list[1])
+
+	if arch == "x86_64" || arch == "x64" {
+		arch = "amd64"
+	}
+
+	return kernel, arch, nil
+}
+
+// Engine API is stateless HTTP, so only the idle connections are closed
+func (tr *TransportDocker) Close() error {
+	tr.client.CloseIdleConnections()
+	return nil
+}
+
+// Quotes the string for the posix shell
+func quoteShell(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
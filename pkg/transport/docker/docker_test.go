@@ -0,0 +1,462 @@
+//go:build linux
+
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+const test_container = "test-container"
+
+type fakeExec struct {
+	cmd       []string
+	stdin     bool
+	running   bool
+	exit_code int
+}
+
+// Engine API fake running the exec commands on the local system, the archive API is storing
+// the files in memory
+type fakeEngine struct {
+	mu    sync.Mutex
+	execs map[string]*fakeExec
+	files map[string]*tar.Header
+	data  map[string][]byte
+	// Scripts of the detached execs
+	detached []string
+}
+
+// Starts the fake engine on the unix socket and returns the transport connected to it
+func startEngine(t *testing.T) (*fakeEngine, *TransportDocker) {
+	t.Helper()
+	engine := &fakeEngine{
+		execs: map[string]*fakeExec{},
+		files: map[string]*tar.Header{},
+		data:  map[string][]byte{},
+	}
+	sock := filepath.Join(t.TempDir(), "engine.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(engine)
+	srv.Listener = listener
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	tr, err := New(&Config{Host: "unix://" + sock, Container: test_container})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tr.Close() })
+	return engine, tr
+}
+
+func (e *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "containers" && parts[2] == "exec":
+		e.create(w, r, parts[1])
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "exec" && parts[2] == "start":
+		e.start(w, r, parts[1])
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "exec" && parts[2] == "json":
+		e.mu.Lock()
+		ex, ok := e.execs[parts[1]]
+		var resp map[string]any
+		if ok {
+			resp = map[string]any{"Running": ex.running, "ExitCode": ex.exit_code}
+		}
+		e.mu.Unlock()
+		if !ok {
+			apiErr(w, http.StatusNotFound, "No such exec instance")
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	case r.Method == "PUT" && len(parts) == 3 && parts[0] == "containers" && parts[2] == "archive":
+		e.put(w, r, parts[1])
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "containers" && parts[2] == "archive":
+		e.get(w, r, parts[1])
+	default:
+		apiErr(w, http.StatusNotFound, "page not found")
+	}
+}
+
+func apiErr(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+func (e *fakeEngine) create(w http.ResponseWriter, r *http.Request, container string) {
+	if container != test_container {
+		apiErr(w, http.StatusNotFound, "No such container: "+container)
+		return
+	}
+	var req struct {
+		AttachStdin bool
+		Cmd         []string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	e.mu.Lock()
+	id := fmt.Sprintf("exec%d", len(e.execs))
+	e.execs[id] = &fakeExec{cmd: req.Cmd, stdin: req.AttachStdin}
+	e.mu.Unlock()
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"Id": id})
+}
+
+func (e *fakeEngine) start(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		Detach bool
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	e.mu.Lock()
+	ex, ok := e.execs[id]
+	if ok {
+		ex.running = true
+	}
+	e.mu.Unlock()
+	if !ok {
+		apiErr(w, http.StatusNotFound, "No such exec instance")
+		return
+	}
+
+	cmd := exec.Command(ex.cmd[0], ex.cmd[1:]...)
+	if req.Detach {
+		e.mu.Lock()
+		e.detached = append(e.detached, ex.cmd[len(ex.cmd)-1])
+		e.mu.Unlock()
+		err := cmd.Run()
+		e.finish(ex, cmd, err)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Header.Get("Upgrade") != "tcp" {
+		apiErr(w, http.StatusBadRequest, "Upgrade header is missing")
+		return
+	}
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+
+	out := &frameWriter{conn: conn}
+	cmd.Stdout = out.stream(1)
+	cmd.Stderr = out.stream(2)
+	if ex.stdin {
+		// Buffered reader could already contain the beginning of stdin
+		cmd.Stdin = rw.Reader
+	}
+	err = cmd.Run()
+	// Exec is not running anymore when the stream is closed
+	e.finish(ex, cmd, err)
+}
+
+func (e *fakeEngine) finish(ex *fakeExec, cmd *exec.Cmd, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ex.running = false
+	var exit_err *exec.ExitError
+	if !errors.As(err, &exit_err) {
+		return
+	}
+	if status := exit_err.Sys().(syscall.WaitStatus); status.Signaled() {
+		ex.exit_code = 128 + int(status.Signal())
+	} else {
+		ex.exit_code = status.ExitStatus()
+	}
+}
+
+func (e *fakeEngine) put(w http.ResponseWriter, r *http.Request, container string) {
+	if r.URL.Query().Get("path") != "/" || r.Header.Get("Content-Type") != "application/x-tar" {
+		apiErr(w, http.StatusBadRequest, "unexpected archive request")
+		return
+	}
+	tr_reader := tar.NewReader(r.Body)
+	for {
+		hdr, err := tr_reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			apiErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		data, err := io.ReadAll(tr_reader)
+		if err != nil {
+			apiErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		e.mu.Lock()
+		e.files[hdr.Name], e.data[hdr.Name] = hdr, data
+		e.mu.Unlock()
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *fakeEngine) get(w http.ResponseWriter, r *http.Request, container string) {
+	name := strings.TrimPrefix(r.URL.Query().Get("path"), "/")
+	e.mu.Lock()
+	hdr, ok := e.files[name]
+	data := e.data[name]
+	e.mu.Unlock()
+	if !ok {
+		apiErr(w, http.StatusNotFound, "Could not find the file "+name+" in container "+container)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	tw := tar.NewWriter(w)
+	out := *hdr
+	// Engine is putting the base name of the path to the archive
+	out.Name = filepath.Base(hdr.Name)
+	tw.WriteHeader(&out)
+	tw.Write(data)
+	tw.Close()
+}
+
+// Writes the output of the streams as multiplexed frames
+type frameWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+type frameStream struct {
+	w   *frameWriter
+	typ byte
+}
+
+func (f *frameWriter) stream(typ byte) io.Writer {
+	return &frameStream{w: f, typ: typ}
+}
+
+func (s *frameStream) Write(p []byte) (int, error) {
+	header := make([]byte, 8)
+	header[0] = s.typ
+	binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	if _, err := s.w.conn.Write(append(header, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func TestExecute(t *testing.T) {
+	_, tr := startEngine(t)
+
+	for name, test := range map[string]struct {
+		cmd    string
+		stdout string
+		stderr string
+		code   int
+		signal string
+	}{
+		"output":   {`echo out; echo err >&2; echo "it's quoted"`, "out\nit's quoted\n", "err\n", 0, ""},
+		"exit":     {"echo failed >&2; exit 3", "", "failed\n", 3, ""},
+		"signal":   {"kill -TERM $$", "", "", 143, ""},
+		"exit_143": {"exit 143", "", "", 143, ""},
+		"no_line":  {"printf partial >&2", "", "partial", 0, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			res, err := tr.Execute(context.Background(), test.cmd, &stdout, &stderr)
+			if test.code == 0 && test.signal == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				var exit_err *transport.ExitError
+				if !errors.As(err, &exit_err) {
+					t.Fatalf("Expected ExitError, got: %v", err)
+				}
+			}
+			if res.ExitCode != test.code || res.Signal != test.signal {
+				t.Errorf("Bad result: %d %q, expected: %d %q", res.ExitCode, res.Signal, test.code, test.signal)
+			}
+			if stdout.String() != test.stdout {
+				t.Errorf("Bad stdout: %q, expected: %q", stdout.String(), test.stdout)
+			}
+			// The pid line is not passed to the output
+			if stderr.String() != test.stderr {
+				t.Errorf("Bad stderr: %q, expected: %q", stderr.String(), test.stderr)
+			}
+		})
+	}
+}
+
+func TestExecuteInput(t *testing.T) {
+	_, tr := startEngine(t)
+
+	input := strings.Repeat("line of the input\n", 10000)
+	var stdout bytes.Buffer
+	if _, err := tr.ExecuteInput(context.Background(), "cat", strings.NewReader(input), &stdout, nil); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != input {
+		t.Errorf("Bad stdout of %d bytes, expected %d bytes", stdout.Len(), len(input))
+	}
+}
+
+func TestExecuteInterrupt(t *testing.T) {
+	engine, tr := startEngine(t)
+
+	pid_file := filepath.Join(t.TempDir(), "pid")
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	// The command is running in the child of the shell to check the children are signaled too
+	res, err := tr.Execute(ctx, "/bin/sh -c 'echo $$ > "+pid_file+"; exec sleep 30'; echo after", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Fatalf("Expected interruption error, got: %v", err)
+	}
+	if res.Signal != "INT" || res.ExitCode != -1 {
+		t.Errorf("Bad result: %d %q", res.ExitCode, res.Signal)
+	}
+	if res.Duration >= interrupt_grace {
+		t.Errorf("Command was not stopped by INT: %v", res.Duration)
+	}
+
+	engine.mu.Lock()
+	detached := engine.detached
+	engine.mu.Unlock()
+	if len(detached) != 1 || !strings.Contains(detached[0], "kill -INT") {
+		t.Fatalf("Unexpected signal execs: %q", detached)
+	}
+
+	data, err := os.ReadFile(pid_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pid int
+	fmt.Sscan(string(data), &pid)
+	if pid == 0 || syscall.Kill(pid, 0) == nil {
+		t.Errorf("Child process %d is still running", pid)
+	}
+}
+
+func TestDemux(t *testing.T) {
+	frame := func(typ byte, data string) []byte {
+		header := make([]byte, 8)
+		header[0] = typ
+		binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+		return append(header, data...)
+	}
+	var stream []byte
+	stream = append(stream, frame(1, "out1")...)
+	stream = append(stream, frame(2, "err")...)
+	stream = append(stream, frame(0, "stdin is skipped")...)
+	stream = append(stream, frame(1, "out2")...)
+
+	var stdout, stderr bytes.Buffer
+	if err := demux(bytes.NewReader(stream), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out1out2" || stderr.String() != "err" {
+		t.Errorf("Bad demux output: %q %q", stdout.String(), stderr.String())
+	}
+	if err := demux(bytes.NewReader(stream), nil, nil); err != nil {
+		t.Errorf("Unable to discard the output: %v", err)
+	}
+	if err := demux(bytes.NewReader(stream[:len(stream)-2]), &stdout, &stderr); err == nil {
+		t.Error("Truncated frame is not detected")
+	}
+}
+
+func TestPidWriter(t *testing.T) {
+	var stderr bytes.Buffer
+	w := &pidWriter{out: &stderr, found: make(chan struct{})}
+	for _, part := range []string{"12", "34\nfirst ", "line\n", "second\n"} {
+		io.WriteString(w, part)
+	}
+	select {
+	case <-w.found:
+	default:
+		t.Fatal("Pid is not found")
+	}
+	if w.pid != 1234 || stderr.String() != "first line\nsecond\n" {
+		t.Errorf("Bad pid writer state: %d %q", w.pid, stderr.String())
+	}
+}
+
+func TestCopy(t *testing.T) {
+	engine, tr := startEngine(t)
+
+	for name, content := range map[string]io.Reader{
+		"seeker": strings.NewReader("seekable content"),
+		"stream": io.MultiReader(strings.NewReader("streamed "), strings.NewReader("content")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := tr.Copy(content, "/tmp/../opt/"+name+"/file.txt", 0640); err != nil {
+				t.Fatal(err)
+			}
+			engine.mu.Lock()
+			hdr := engine.files["opt/"+name+"/file.txt"]
+			data := engine.data["opt/"+name+"/file.txt"]
+			engine.mu.Unlock()
+			if hdr == nil {
+				t.Fatalf("File is not uploaded: %v", engine.files)
+			}
+			if hdr.Typeflag != tar.TypeReg || hdr.Mode != 0640 || hdr.Size != int64(len(data)) {
+				t.Errorf("Bad tar header: %+v", hdr)
+			}
+			if !strings.HasSuffix(string(data), "content") {
+				t.Errorf("Bad content: %q", data)
+			}
+		})
+	}
+
+	if err := tr.Copy(strings.NewReader(""), "/", 0644); err == nil {
+		t.Error("Root destination is accepted")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	engine, tr := startEngine(t)
+
+	engine.files["etc/test.conf"] = &tar.Header{Typeflag: tar.TypeReg, Name: "etc/test.conf", Size: 5, Mode: 0644}
+	engine.data["etc/test.conf"] = []byte("value")
+	engine.files["etc"] = &tar.Header{Typeflag: tar.TypeDir, Name: "etc", Mode: 0755}
+
+	var out bytes.Buffer
+	if err := tr.Fetch("/etc/test.conf", &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "value" {
+		t.Errorf("Bad fetched content: %q", out.String())
+	}
+
+	if err := tr.Fetch("/etc", &out); err == nil || !strings.Contains(err.Error(), "not a regular file") {
+		t.Errorf("Expected not a regular file error, got: %v", err)
+	}
+	if err := tr.Fetch("/missing", &out); err == nil || !strings.Contains(err.Error(), "Could not find the file") {
+		t.Errorf("Expected engine error, got: %v", err)
+	}
+}
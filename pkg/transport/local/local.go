@@ -0,0 +1,140 @@
+package local
+
+// Transport to the local system, the commands are running as subprocesses and the files are
+// copied directly, so the local tasks are executed the same way as on the remote hosts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+// Time the interrupted command has to exit before it's killed
+const interrupt_grace = 5 * time.Second
+
+type TransportLocal struct{}
+
+func New() (*TransportLocal, error) {
+	return &TransportLocal{}, nil
+}
+
+func (tr *TransportLocal) Execute(ctx context.Context, cmd string, stdout, stderr io.Writer) (*transport.Result, error) {
+	return tr.ExecuteInput(ctx, cmd, nil, stdout, stderr)
+}
+
+func (tr *TransportLocal) ExecuteInput(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*transport.Result, error) {
+	c := shellCommand(cmd)
+	c.Stdin, c.Stdout, c.Stderr = stdin, stdout, stderr
+	return Run(ctx, c)
+}
+
+// The agent is the same binary, so the system is the one it was built for
+func (tr *TransportLocal) Check() (kernel, arch string, err error) {
+	return runtime.GOOS, runtime.GOARCH, nil
+}
+
+func (tr *TransportLocal) Copy(content io.Reader, dst string, mode os.FileMode) error {
+	return WriteFile(dst, content, mode)
+}
+
+func (tr *TransportLocal) Fetch(src string, dst io.Writer) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Unable to open file %q: %v", src, err)
+	}
+	defer f.Close()
+	if _, err = io.Copy(dst, f); err != nil {
+		return fmt.Errorf("Error while fetching file: %v", err)
+	}
+	return nil
+}
+
+// Nothing to release, the commands are local processes
+func (tr *TransportLocal) Close() error {
+	return nil
+}
+
+// Runs the prepared command in own process group, when the context is done the group receives
+// INT signal and after the grace period KILL
+func Run(ctx context.Context, c *exec.Cmd) (*transport.Result, error) {
+	setProcessGroup(c)
+
+	start := time.Now()
+	if err := c.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to run command: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		signalGroup(c.Process, false)
+		select {
+		case err = <-done:
+		case <-time.After(interrupt_grace):
+			signalGroup(c.Process, true)
+			err = <-done
+		}
+	}
+
+	res := &transport.Result{Duration: time.Since(start)}
+	var exit_err *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exit_err):
+		exitResult(res, exit_err.ProcessState)
+	default:
+		res.ExitCode = -1
+	}
+
+	if ctx.Err() != nil {
+		return res, fmt.Errorf("Command was interrupted: %v", ctx.Err())
+	}
+	if err != nil && res.ExitCode == -1 && res.Signal == "" {
+		return res, fmt.Errorf("Failed to run command: %v", err)
+	}
+	if res.ExitCode != 0 || res.Signal != "" {
+		return res, &transport.ExitError{Result: res}
+	}
+	return res, nil
+}
+
+// Writes the content to the temp file next to destination and moves it in place, so the running
+// executable (like the agent) could be replaced
+func WriteFile(path string, content io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Unable to create directory for %q: %v", path, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".ansiblego-")
+	if err != nil {
+		return fmt.Errorf("Unable to create file %q: %v", path, err)
+	}
+	_, err = io.Copy(tmp, content)
+	if close_err := tmp.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Error while copying file %q: %v", path, err)
+	}
+	return nil
+}
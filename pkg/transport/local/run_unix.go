@@ -0,0 +1,49 @@
+//go:build !windows
+
+package local
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+// Names of the signals without `SIG` prefix like ssh returns them
+var signal_names = map[syscall.Signal]string{
+	syscall.SIGHUP: "HUP", syscall.SIGINT: "INT", syscall.SIGQUIT: "QUIT", syscall.SIGABRT: "ABRT",
+	syscall.SIGKILL: "KILL", syscall.SIGPIPE: "PIPE", syscall.SIGTERM: "TERM",
+}
+
+func shellCommand(cmd string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", cmd)
+}
+
+// Keeps the other attributes set by the caller, like chroot
+func setProcessGroup(c *exec.Cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+}
+
+func signalGroup(p *os.Process, kill bool) {
+	sig := syscall.SIGINT
+	if kill {
+		sig = syscall.SIGKILL
+	}
+	syscall.Kill(-p.Pid, sig)
+}
+
+func exitResult(res *transport.Result, state *os.ProcessState) {
+	status := state.Sys().(syscall.WaitStatus)
+	res.ExitCode = status.ExitStatus()
+	if status.Signaled() {
+		res.ExitCode = -1
+		if res.Signal = signal_names[status.Signal()]; res.Signal == "" {
+			res.Signal = fmt.Sprintf("%d", int(status.Signal()))
+		}
+	}
+}
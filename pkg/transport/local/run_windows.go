@@ -0,0 +1,34 @@
+//go:build windows
+
+package local
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+// Command line is passed as is, cmd is not following the quoting rules of the arguments
+func shellCommand(cmd string) *exec.Cmd {
+	c := exec.Command("cmd")
+	c.SysProcAttr = &syscall.SysProcAttr{CmdLine: "cmd /C " + cmd}
+	return c
+}
+
+func setProcessGroup(c *exec.Cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// There is no interrupt signal for the processes, so the command is terminated right away
+func signalGroup(p *os.Process, kill bool) {
+	p.Kill()
+}
+
+func exitResult(res *transport.Result, state *os.ProcessState) {
+	res.ExitCode = state.ExitCode()
+}
@@ -0,0 +1,301 @@
+package ssh
+
+// Authentication methods: public keys (files, certificates and agent), keyboard-interactive and password
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// Authentication settings, the server is receiving the public keys first (the agent keys and
+// then the key files with their certificates), then keyboard-interactive and password methods
+type AuthConfig struct {
+	Password string
+	// Private key files, the load errors are failing the connection
+	PrivateKeyFiles []string
+	// Identity files of ssh_config used if the private key files are not set, the missing and
+	// broken ones are skipped. The default identity files are used if not set.
+	IdentityFiles []string
+	// Passphrase of the encrypted private keys, asked in terminal if not set
+	Passphrase string
+	// OpenSSH user certificate, by default `<private key>-cert.pub` is used if exists
+	CertificateFile string
+	// Use keys of ssh agent from SSH_AUTH_SOCK
+	UseAgent bool
+}
+
+// Identity files OpenSSH client is using by default
+var default_identities = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// Returns the existing default identity files of the current user
+func DefaultKeyFiles() (out []string) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	for _, name := range default_identities {
+		path := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(path); err == nil {
+			out = append(out, path)
+		}
+	}
+	return out
+}
+
+// Prepares the auth methods, the returned agent connection needs to be closed by the caller
+func (c *AuthConfig) methods() (methods []ssh.AuthMethod, agent_conn net.Conn, err error) {
+	var key_signers []ssh.Signer
+
+	explicit := len(c.PrivateKeyFiles) > 0
+	key_files := c.PrivateKeyFiles
+	if !explicit {
+		key_files = c.IdentityFiles
+	}
+	if len(key_files) == 0 {
+		key_files = DefaultKeyFiles()
+	}
+	for _, path := range key_files {
+		signers, err := c.loadKey(path)
+		if err != nil {
+			if explicit {
+				return nil, nil, err
+			}
+			// Like OpenSSH the missing and broken identities are just skipped
+			continue
+		}
+		key_signers = append(key_signers, signers...)
+	}
+
+	var agent_client agent.ExtendedAgent
+	if sock := os.Getenv("SSH_AUTH_SOCK"); c.UseAgent && sock != "" {
+		// Agent is optional when the other methods are available
+		if agent_conn, err = net.Dial("unix", sock); err == nil {
+			agent_client = agent.NewClient(agent_conn)
+		} else {
+			agent_conn = nil
+		}
+	}
+
+	// Public keys are requested on every auth, so the agent keys are fresh on reconnect. Like
+	// OpenSSH the agent keys are offered first, so the encrypted key files are not decrypted
+	// if the server accepts one of them.
+	if len(key_signers) > 0 || agent_client != nil {
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			var signers []ssh.Signer
+			if agent_client != nil {
+				if agent_signers, err := agent_client.Signers(); err == nil {
+					signers = append(signers, agent_signers...)
+				}
+			}
+			return append(signers, key_signers...), nil
+		}))
+	}
+	// Keyboard-interactive is also used for the one-time codes, so it's offered without password
+	methods = append(methods, ssh.KeyboardInteractive(c.keyboardInteractive))
+	if c.Password != "" {
+		methods = append(methods, ssh.Password(c.Password))
+	}
+
+	return methods, agent_conn, nil
+}
+
+// Loads the private key and its certificate if exists, certificate signer goes first. The
+// encrypted key is decrypted only when the server accepts its public key.
+func (c *AuthConfig) loadKey(path string) ([]ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read ssh key file: %v", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		decrypt := func() (ssh.Signer, error) {
+			if c.Passphrase != "" {
+				return ssh.ParsePrivateKeyWithPassphrase(data, []byte(c.Passphrase))
+			}
+			return promptPassphrase(path, data)
+		}
+		if pub := encryptedPublicKey(path, missing); pub != nil {
+			signer, err = &lazySigner{pub: pub, path: path, decrypt: decrypt}, nil
+		} else {
+			signer, err = decrypt()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse private key %q: %v", path, err)
+	}
+
+	cert_path := c.CertificateFile
+	if cert_path == "" {
+		cert_path = path + "-cert.pub"
+		if _, err := os.Stat(cert_path); err != nil {
+			return []ssh.Signer{signer}, nil
+		}
+	}
+	cert_signer, err := certSigner(cert_path, signer)
+	if err != nil {
+		return nil, err
+	}
+	return []ssh.Signer{cert_signer, signer}, nil
+}
+
+// Returns the public key of the encrypted private key: OpenSSH format keeps it unencrypted,
+// for the legacy PEM keys the `<private key>.pub` file is used
+func encryptedPublicKey(path string, missing *ssh.PassphraseMissingError) ssh.PublicKey {
+	if missing.PublicKey != nil {
+		return missing.PublicKey
+	}
+	data, err := os.ReadFile(path + ".pub")
+	if err != nil {
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil
+	}
+	return pub
+}
+
+// Signer of the encrypted key, decrypts the key on the first signature
+type lazySigner struct {
+	pub     ssh.PublicKey
+	path    string
+	decrypt func() (ssh.Signer, error)
+
+	once   sync.Once
+	signer ssh.AlgorithmSigner
+	err    error
+}
+
+func (s *lazySigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *lazySigner) load() (ssh.AlgorithmSigner, error) {
+	s.once.Do(func() {
+		signer, err := s.decrypt()
+		if err != nil {
+			s.err = fmt.Errorf("Unable to parse private key %q: %v", s.path, err)
+			return
+		}
+		var ok bool
+		if s.signer, ok = signer.(ssh.AlgorithmSigner); !ok {
+			s.err = fmt.Errorf("Private key %q is not supporting signature algorithms", s.path)
+		}
+	})
+	return s.signer, s.err
+}
+
+func (s *lazySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(rand, data)
+}
+
+func (s *lazySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return signer.SignWithAlgorithm(rand, data, algorithm)
+}
+
+func certSigner(path string, signer ssh.Signer) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read ssh certificate: %v", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse ssh certificate %q: %v", path, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("The file %q is not an ssh certificate", path)
+	}
+	cert_signer, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to use ssh certificate %q: %v", path, err)
+	}
+	return cert_signer, nil
+}
+
+// Answers the hidden questions (usually the password prompt of PAM) with the password if set,
+// the other questions (like one-time codes) are asked in terminal
+func (c *AuthConfig) keyboardInteractive(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i, question := range questions {
+		if c.Password != "" && !echos[i] {
+			answers[i] = c.Password
+			continue
+		}
+		if instruction != "" {
+			fmt.Fprintln(os.Stderr, instruction)
+			instruction = ""
+		}
+		answer, err := promptInput(question, echos[i])
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = answer
+	}
+	return answers, nil
+}
+
+// Passphrases entered in terminal are cached to not ask for the same key on every host
+var passphrases = map[string]string{}
+var passphrases_mu sync.Mutex
+
+func promptPassphrase(path string, data []byte) (ssh.Signer, error) {
+	passphrases_mu.Lock()
+	defer passphrases_mu.Unlock()
+
+	if passphrase, ok := passphrases[path]; ok {
+		return ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+
+	passphrase, err := promptInput(fmt.Sprintf("Enter passphrase for key '%s': ", path), false)
+	if err != nil {
+		return nil, fmt.Errorf("Key is encrypted, set ansible_ssh_private_key_passphrase: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	if err == nil {
+		passphrases[path] = passphrase
+	}
+	return signer, err
+}
+
+// Asks the user in terminal, replaced in tests
+var promptInput = func(prompt string, echo bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("Unable to ask %q: stdin is not a terminal", strings.TrimSpace(prompt))
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	var input []byte
+	var err error
+	if echo {
+		input, err = bufio.NewReader(os.Stdin).ReadBytes('\n')
+	} else {
+		input, err = term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to read input: %v", err)
+	}
+	return strings.TrimRight(string(input), "\r\n"), nil
+}
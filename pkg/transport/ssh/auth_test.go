@@ -0,0 +1,257 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/state-of-the-art/ansiblego/pkg/sshd"
+)
+
+// Writes the new private key file, encrypted if passphrase is set
+func writeKey(t *testing.T, path, passphrase string) ssh.PublicKey {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block *pem.Block
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ssh_pub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh_pub
+}
+
+// Runs ssh agent with the new key and points SSH_AUTH_SOCK to it
+func startAgent(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err = keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	signers, err := keyring.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signers[0].PublicKey()
+}
+
+// Replaces the terminal prompt with the answer and counts the prompts
+func fakePrompt(t *testing.T, answer string, err error) *int {
+	prompts := 0
+	orig := promptInput
+	promptInput = func(prompt string, echo bool) (string, error) {
+		prompts++
+		return answer, err
+	}
+	t.Cleanup(func() { promptInput = orig })
+	return &prompts
+}
+
+func connectAuth(port int, auth AuthConfig) error {
+	tr, err := New(&Config{
+		User:    test_user,
+		Host:    "127.0.0.1",
+		Port:    port,
+		Auth:    auth,
+		HostKey: HostKeyConfig{Mode: HostKeyIgnore},
+	})
+	if err == nil {
+		tr.Close()
+	}
+	return err
+}
+
+func TestAuthPublicKeys(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	plain_path, encrypted_path := filepath.Join(dir, "id_plain"), filepath.Join(dir, "id_encrypted")
+	plain_key, encrypted_key := writeKey(t, plain_path, ""), writeKey(t, encrypted_path, "pass")
+
+	for name, test := range map[string]struct {
+		agent      bool
+		authorized string
+		key        string
+		auth       AuthConfig
+		prompt     string
+		prompts    int
+		err        string
+	}{
+		"plain_key":         {false, "plain", plain_path, AuthConfig{}, "", 0, ""},
+		"agent_first":       {true, "agent_encrypted", encrypted_path, AuthConfig{UseAgent: true}, "", 0, ""},
+		"agent_disabled":    {true, "agent", plain_path, AuthConfig{}, "", 0, "unable to authenticate"},
+		"lazy_passphrase":   {false, "encrypted", encrypted_path, AuthConfig{Passphrase: "pass"}, "", 0, ""},
+		"prompt_passphrase": {false, "encrypted", encrypted_path, AuthConfig{}, "pass", 1, ""},
+		"not_accepted":      {false, "plain", encrypted_path, AuthConfig{Password: test_password}, "", 0, ""},
+		"wrong_passphrase":  {false, "encrypted", encrypted_path, AuthConfig{Passphrase: "wrong"}, "", 0, "Unable to parse private key"},
+		"missing_explicit":  {false, "plain", filepath.Join(dir, "id_missing"), AuthConfig{Password: test_password}, "", 0, "Unable to read ssh key file"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("SSH_AUTH_SOCK", "")
+			var authorized []ssh.PublicKey
+			if test.agent {
+				agent_key := startAgent(t)
+				if strings.Contains(test.authorized, "agent") {
+					authorized = append(authorized, agent_key)
+				}
+			}
+			if strings.Contains(test.authorized, "plain") {
+				authorized = append(authorized, plain_key)
+			}
+			if strings.Contains(test.authorized, "encrypted") {
+				authorized = append(authorized, encrypted_key)
+			}
+			// Passphrases entered in terminal are cached
+			passphrases_mu.Lock()
+			delete(passphrases, encrypted_path)
+			passphrases_mu.Unlock()
+			prompts := fakePrompt(t, test.prompt, nil)
+
+			port := startSSHD(t, sshd.Options{HostKeys: []ssh.Signer{testHostKey(t, "ed25519")}, AuthorizedKeys: authorized})
+			test.auth.PrivateKeyFiles = []string{test.key}
+			err := connectAuth(port, test.auth)
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("Expected error %q, got: %v", test.err, err)
+			}
+			if *prompts != test.prompts {
+				t.Errorf("Passphrase is asked %d times, expected %d", *prompts, test.prompts)
+			}
+		})
+	}
+}
+
+func TestAuthDefaultKeys(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Broken default identity is skipped
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "id_ed25519"), []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key := writeKey(t, filepath.Join(home, ".ssh", "id_rsa"), "")
+
+	port := startSSHD(t, sshd.Options{HostKeys: []ssh.Signer{testHostKey(t, "ed25519")}, AuthorizedKeys: []ssh.PublicKey{key}})
+	if err := connectAuth(port, AuthConfig{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthKeyboardInteractive(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SSH_AUTH_SOCK", "")
+	port := startSSHD(t, sshd.Options{HostKeys: []ssh.Signer{testHostKey(t, "ed25519")}, KeyboardInteractive: true})
+
+	for name, test := range map[string]struct {
+		password   string
+		prompt     string
+		prompt_err error
+		prompts    int
+		err        string
+	}{
+		"password":    {test_password, "", nil, 0, ""},
+		"prompt":      {"", test_password, nil, 1, ""},
+		"wrong":       {"", "wrong", nil, 1, "unable to authenticate"},
+		"no_terminal": {"", "", fmt.Errorf("stdin is not a terminal"), 1, "stdin is not a terminal"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			prompts := fakePrompt(t, test.prompt, test.prompt_err)
+			err := connectAuth(port, AuthConfig{Password: test.password})
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("Expected error %q, got: %v", test.err, err)
+			}
+			if *prompts != test.prompts {
+				t.Errorf("Asked %d times, expected %d", *prompts, test.prompts)
+			}
+		})
+	}
+}
+
+func TestAuthIdentityFiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	fakePrompt(t, "", fmt.Errorf("stdin is not a terminal"))
+	dir := t.TempDir()
+	key := writeKey(t, filepath.Join(dir, "id_config"), "")
+	// Default identity is not used when ssh_config sets the identity files
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	default_key := writeKey(t, filepath.Join(home, ".ssh", "id_ed25519"), "")
+	port := startSSHD(t, sshd.Options{HostKeys: []ssh.Signer{testHostKey(t, "ed25519")}, AuthorizedKeys: []ssh.PublicKey{key}})
+	default_port := startSSHD(t, sshd.Options{HostKeys: []ssh.Signer{testHostKey(t, "ed25519")}, AuthorizedKeys: []ssh.PublicKey{default_key}})
+
+	// Missing identity of ssh_config is skipped
+	identities := []string{filepath.Join(dir, "id_missing"), filepath.Join(dir, "id_config")}
+	if err := connectAuth(port, AuthConfig{IdentityFiles: identities}); err != nil {
+		t.Fatal(err)
+	}
+	if err := connectAuth(default_port, AuthConfig{IdentityFiles: identities}); err == nil {
+		t.Error("Default identity is used together with the ssh_config ones")
+	}
+	if err := connectAuth(default_port, AuthConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	// Explicit private key is used instead of the identity files
+	if err := connectAuth(port, AuthConfig{PrivateKeyFiles: []string{filepath.Join(home, ".ssh", "id_ed25519")}, IdentityFiles: identities}); err == nil {
+		t.Error("Identity files are used together with the explicit private key")
+	}
+
+	// Jump host identities are not failing on the missing files either
+	jump := &JumpHost{User: test_user, Host: "127.0.0.1", Port: port, IdentityFiles: identities}
+	auth := &AuthConfig{PrivateKeyFiles: []string{filepath.Join(dir, "id_config")}}
+	if _, _, err := jump.clientConfig(auth, &HostKeyConfig{Mode: HostKeyIgnore}, &ssh.ClientConfig{}); err != nil {
+		t.Fatal(err)
+	}
+}
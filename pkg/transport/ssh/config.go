@@ -0,0 +1,226 @@
+package ssh
+
+// Reading of the host settings from OpenSSH client config files
+// Doc: https://man.openbsd.org/ssh_config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Default system-wide ssh client config, the user one is ~/.ssh/config
+const system_ssh_config = "/etc/ssh/ssh_config"
+
+// Settings of the host from ssh_config, empty if not set
+type HostConfig struct {
+	// Real address to connect to
+	HostName string
+	User     string
+	Port     int
+	// Identity files in order they are found in the config
+	IdentityFiles []string
+	// Jump hosts chain in ProxyJump format
+	ProxyJump string
+}
+
+// Reads the settings for the host from the user and system ssh_config files. Like OpenSSH
+// does the first obtained value is used, so the user config is overriding the system one.
+func LookupConfig(host string) (*HostConfig, error) {
+	out := &HostConfig{}
+	var files []string
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".ssh", "config"))
+	}
+	files = append(files, system_ssh_config)
+
+	for _, file := range files {
+		if err := out.readFile(file, host, 0); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Parses the config file, the missing files are skipped
+func (c *HostConfig) readFile(file, host string, depth int) error {
+	// Protects from the include loops the same way OpenSSH does
+	if depth > 16 {
+		return fmt.Errorf("Too many recursive includes of ssh config in %q", file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Unable to read ssh config: %v", err)
+	}
+	defer f.Close()
+
+	// The options before the first Host are applied to all the hosts
+	matched := true
+	scanner := bufio.NewScanner(f)
+	for line_num := 1; scanner.Scan(); line_num++ {
+		key, args := parseConfigLine(scanner.Text())
+		if key == "" {
+			continue
+		}
+		switch key {
+		case "host":
+			matched = matchHostPatterns(host, args)
+			continue
+		case "match":
+			// Match criteria are not supported, so the block is skipped
+			matched = false
+			continue
+		}
+		if !matched || len(args) == 0 {
+			continue
+		}
+
+		switch key {
+		case "include":
+			for _, pattern := range args {
+				if err := c.include(file, pattern, host, depth); err != nil {
+					return err
+				}
+			}
+		case "hostname":
+			if c.HostName == "" {
+				c.HostName = expandTokens(args[0], host, "")
+			}
+		case "user":
+			if c.User == "" {
+				c.User = args[0]
+			}
+		case "port":
+			if c.Port == 0 {
+				port, err := strconv.Atoi(args[0])
+				if err != nil || port < 1 || port > 65535 {
+					return fmt.Errorf("Bad port %q in ssh config %s:%d", args[0], file, line_num)
+				}
+				c.Port = port
+			}
+		case "identityfile":
+			// Multiple identity files are allowed
+			c.IdentityFiles = append(c.IdentityFiles, expandTokens(args[0], host, c.User))
+		case "proxyjump":
+			if c.ProxyJump == "" {
+				c.ProxyJump = args[0]
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Unable to read ssh config %q: %v", file, err)
+	}
+	return nil
+}
+
+// Processes the Include directive, relative paths of the user config are in ~/.ssh
+func (c *HostConfig) include(file, pattern, host string, depth int) error {
+	pattern = expandTokens(pattern, host, "")
+	if !filepath.IsAbs(pattern) {
+		dir := filepath.Dir(system_ssh_config)
+		if file != system_ssh_config {
+			if home, err := os.UserHomeDir(); err == nil {
+				dir = filepath.Join(home, ".ssh")
+			}
+		}
+		pattern = filepath.Join(dir, pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("Bad include pattern %q in ssh config %q: %v", pattern, file, err)
+	}
+	for _, inc := range files {
+		if err := c.readFile(inc, host, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns lowercase keyword and the arguments, supports `Key value` and `Key=value` forms
+func parseConfigLine(line string) (key string, args []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	pos := strings.IndexAny(line, " \t=")
+	if pos < 0 {
+		return strings.ToLower(line), nil
+	}
+	key = strings.ToLower(line[:pos])
+	rest := strings.TrimLeft(line[pos:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+
+	// Arguments are separated by spaces and could be quoted
+	var arg strings.Builder
+	quoted, has_arg := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			has_arg = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if has_arg {
+				args = append(args, arg.String())
+				arg.Reset()
+				has_arg = false
+			}
+		default:
+			arg.WriteRune(r)
+			has_arg = true
+		}
+	}
+	if has_arg {
+		args = append(args, arg.String())
+	}
+	return key, args
+}
+
+// Checks the host against the Host patterns, the negated patterns (`!pattern`) are excluding
+func matchHostPatterns(host string, patterns []string) (matched bool) {
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		// Only `*` and `?` wildcards are supported by ssh_config
+		pattern = strings.NewReplacer("[", "\\[", "]", "\\]", "\\", "\\\\").Replace(pattern)
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host)); !ok {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// Expands the `~` and the common tokens: %h - host, %r - remote user, %u - local user,
+// %d - local home dir and %% - literal percent
+func expandTokens(val, host, remote_user string) string {
+	home, _ := os.UserHomeDir()
+	if val == "~" || strings.HasPrefix(val, "~/") {
+		val = home + val[1:]
+	}
+	if !strings.Contains(val, "%") {
+		return val
+	}
+	local_user := ""
+	if current, err := user.Current(); err == nil {
+		local_user = current.Username
+	}
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", host,
+		"%r", remote_user,
+		"%u", local_user,
+		"%d", home,
+	).Replace(val)
+}
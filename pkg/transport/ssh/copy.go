@@ -0,0 +1,291 @@
+package ssh
+
+// File transfer through SFTP with fallback to scp when the server has no sftp subsystem
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bramvdbogaerde/go-scp"
+	"github.com/pkg/sftp"
+)
+
+// Suffix of the temp file the content is uploaded to before the rename, the interrupted upload
+// is resumed from it next time
+const partial_suffix = ".ansiblego-part"
+
+// Returned when the server does not support sftp, so scp could be used instead
+var errNoSFTP = errors.New("sftp subsystem is not available")
+
+// Starts sftp on the shared connection, the returned function closes it
+func (tr *TransportSSH) sftpClient() (*sftp.Client, func(), error) {
+	session, closeSession, err := tr.session()
+	if err != nil {
+		return nil, nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		closeSession()
+		return nil, nil, fmt.Errorf("Unable to open sftp input: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		closeSession()
+		return nil, nil, fmt.Errorf("Unable to open sftp output: %v", err)
+	}
+	if err = session.RequestSubsystem("sftp"); err != nil {
+		closeSession()
+		return nil, nil, errNoSFTP
+	}
+	client, err := sftp.NewClientPipe(stdout, stdin, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		closeSession()
+		return nil, nil, errNoSFTP
+	}
+	return client, func() {
+		client.Close()
+		closeSession()
+	}, nil
+}
+
+// Locks the destination path to not mix the uploads of the same file in parallel
+func (tr *TransportSSH) lockPath(path string) func() {
+	tr.mu.Lock()
+	if tr.copying == nil {
+		tr.copying = make(map[string]*sync.Mutex)
+	}
+	mu, ok := tr.copying[path]
+	if !ok {
+		mu = &sync.Mutex{}
+		tr.copying[path] = mu
+	}
+	tr.mu.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// Runs the function with sftp client, the session is closed right after to not hold it while
+// the other commands are executed
+func (tr *TransportSSH) withSFTP(f func(client *sftp.Client) error) error {
+	client, closeClient, err := tr.sftpClient()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	return f(client)
+}
+
+// Uploads the content to the temp file, verifies the checksum and moves it to destination. If the
+// content is seekable the previous interrupted upload is continued.
+func (tr *TransportSSH) Copy(content io.Reader, dst string, mode os.FileMode) error {
+	unlock := tr.lockPath(dst)
+	defer unlock()
+
+	client, closeClient, err := tr.sftpClient()
+	if err == errNoSFTP {
+		return tr.scpCopy(content, dst, mode)
+	}
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+
+	tmp := dst + partial_suffix
+	sum := sha256.New()
+	var offset int64
+	if info, err := client.Stat(tmp); err == nil {
+		if offset, err = tr.resumeOffset(client, content, tmp, info.Size(), sum); err != nil {
+			return err
+		}
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := client.OpenFile(tmp, flags)
+	if err != nil {
+		return fmt.Errorf("Unable to create file %q: %v", tmp, err)
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err == nil {
+		_, err = f.ReadFrom(io.TeeReader(content, sum))
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		// The partial file is kept to continue the upload with the next try
+		return fmt.Errorf("Error while copying file: %v", err)
+	}
+
+	local_sum := hex.EncodeToString(sum.Sum(nil))
+	remote_sum, err := tr.remoteSHA256(client, tmp)
+	if err != nil {
+		return fmt.Errorf("Unable to verify copied file: %v", err)
+	}
+	if remote_sum != local_sum {
+		client.Remove(tmp)
+		return fmt.Errorf("Copy failed due to checksums mismatch: %v != %v", remote_sum, local_sum)
+	}
+	if err = client.Chmod(tmp, mode); err != nil {
+		return fmt.Errorf("Unable to set mode of %q: %v", tmp, err)
+	}
+	// Plain sftp rename fails when destination exists
+	if err = client.PosixRename(tmp, dst); err != nil {
+		client.Remove(dst)
+		if err = client.Rename(tmp, dst); err != nil {
+			return fmt.Errorf("Unable to move %q to %q: %v", tmp, dst, err)
+		}
+	}
+	return nil
+}
+
+// Returns the size of the partial upload if it matches the beginning of the content, the
+// skipped content is added to the sum
+func (tr *TransportSSH) resumeOffset(client *sftp.Client, content io.Reader, tmp string, partial int64, sum hash.Hash) (int64, error) {
+	seeker, ok := content.(io.Seeker)
+	if !ok || partial == 0 {
+		return 0, nil
+	}
+	remote_sum, err := tr.remoteSHA256(client, tmp)
+	if err != nil {
+		return 0, nil
+	}
+
+	size, err := io.CopyN(sum, content, partial)
+	if err == nil && hex.EncodeToString(sum.Sum(nil)) == remote_sum {
+		return size, nil
+	}
+
+	// The partial file is from the other content, starting from the beginning
+	sum.Reset()
+	if _, err = seeker.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("Unable to rewind the content: %v", err)
+	}
+	return 0, nil
+}
+
+// Downloads the file, the checksum is verified if the remote system is able to calculate it
+func (tr *TransportSSH) Fetch(src string, dst io.Writer) error {
+	sum := sha256.New()
+	out := io.MultiWriter(dst, sum)
+
+	err := tr.withSFTP(func(client *sftp.Client) error {
+		f, err := client.Open(src)
+		if err != nil {
+			return fmt.Errorf("Unable to open file %q: %v", src, err)
+		}
+		defer f.Close()
+		if _, err = f.WriteTo(out); err != nil {
+			return fmt.Errorf("Error while fetching file: %v", err)
+		}
+		return nil
+	})
+	if err == errNoSFTP {
+		session, closeSession, err := tr.session()
+		if err != nil {
+			return err
+		}
+		scp_client := scp.NewConfigurer("", nil).Session(session).Create()
+		err = scp_client.CopyFromRemotePassThru(context.Background(), out, src, nil)
+		closeSession()
+		if err != nil {
+			return fmt.Errorf("Error while fetching file: %v", err)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if remote_sum, err := tr.execSHA256(src); err == nil {
+		if local_sum := hex.EncodeToString(sum.Sum(nil)); remote_sum != local_sum {
+			return fmt.Errorf("Fetch failed due to checksums mismatch: %v != %v", remote_sum, local_sum)
+		}
+	}
+	return nil
+}
+
+// Copies through scp to the temp file and moves it to destination with shell commands
+func (tr *TransportSSH) scpCopy(content io.Reader, dst string, mode os.FileMode) error {
+	tmp := dst + partial_suffix
+	sum := sha256.New()
+
+	session, closeSession, err := tr.session()
+	if err != nil {
+		return err
+	}
+	scp_client := scp.NewConfigurer("", nil).Session(session).Create()
+	err = scp_client.CopyFile(context.Background(), io.TeeReader(content, sum), tmp, fmt.Sprintf("%#o", mode))
+	closeSession()
+	if err != nil {
+		return fmt.Errorf("Error while copying file: %v", err)
+	}
+
+	// Verification is skipped only if the remote system has no tools for that
+	if remote_sum, err := tr.execSHA256(tmp); err == nil {
+		if local_sum := hex.EncodeToString(sum.Sum(nil)); remote_sum != local_sum {
+			tr.Execute(context.Background(), "rm -f "+quotePath(tmp), io.Discard, io.Discard)
+			return fmt.Errorf("Copy failed due to checksums mismatch: %v != %v", remote_sum, local_sum)
+		}
+	}
+
+	stderr_buf := bytes.Buffer{}
+	if _, err = tr.Execute(context.Background(), "mv -f "+quotePath(tmp)+" "+quotePath(dst), io.Discard, &stderr_buf); err != nil {
+		return fmt.Errorf("Unable to move %q to %q: %v, %v", tmp, dst, err, stderr_buf.String())
+	}
+	return nil
+}
+
+// Calculates sha256 of the remote file with the common unix tools
+func (tr *TransportSSH) execSHA256(path string) (string, error) {
+	var err error
+	for _, tool := range []string{"sha256sum", "shasum -a 256"} {
+		stdout_buf := bytes.Buffer{}
+		if _, err = tr.Execute(context.Background(), tool+" "+quotePath(path), &stdout_buf, io.Discard); err != nil {
+			continue
+		}
+		if fields := strings.Fields(stdout_buf.String()); len(fields) > 0 && len(fields[0]) == sha256.Size*2 {
+			return strings.ToLower(fields[0]), nil
+		}
+		err = fmt.Errorf("Bad checksum output: %q", stdout_buf.String())
+	}
+	return "", err
+}
+
+// Calculates sha256 of the remote file, it's read back through sftp if the remote system has no
+// tools for that or the command session can't be opened along with the sftp one
+func (tr *TransportSSH) remoteSHA256(client *sftp.Client, path string) (string, error) {
+	if cap(tr.sessions) > 1 {
+		if sum, err := tr.execSHA256(path); err == nil {
+			return sum, nil
+		}
+	}
+	return readSHA256(client, path)
+}
+
+func readSHA256(client *sftp.Client, path string) (string, error) {
+	f, err := client.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err = f.WriteTo(sum); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// Quotes the path for the remote posix shell
+func quotePath(path string) string {
+	return "'" + strings.ReplaceAll(path, "'", `'\''`) + "'"
+}
@@ -0,0 +1,149 @@
+//go:build linux
+
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/state-of-the-art/ansiblego/pkg/sshd"
+)
+
+// Returns the test content of the size
+func testContent(size int) []byte {
+	return bytes.Repeat([]byte("0123456789abcdef\n"), size/17+1)[:size]
+}
+
+// Checks the copied file content and mode, the partial file should be removed
+func checkCopied(t *testing.T, dst string, content []byte, mode os.FileMode) {
+	t.Helper()
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("Copied %d bytes, expected %d", len(data), len(content))
+	}
+	if info, _ := os.Stat(dst); info.Mode().Perm() != mode {
+		t.Errorf("Copied file mode is %v, expected %v", info.Mode().Perm(), mode)
+	}
+	if _, err = os.Stat(dst + partial_suffix); !os.IsNotExist(err) {
+		t.Errorf("Partial file is left: %v", err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"default": {},
+		// Checksum is read back through sftp when the command session is not available
+		"one_session": {MaxSessions: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tr, _ := connectProxy(t, cfg)
+			dst := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(dst, []byte("previous"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			content := testContent(100000)
+			if err := tr.Copy(bytes.NewReader(content), dst, 0640); err != nil {
+				t.Fatal(err)
+			}
+			checkCopied(t, dst, content, 0640)
+
+			var out bytes.Buffer
+			if err := tr.Fetch(dst, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), content) {
+				t.Errorf("Fetched %d bytes, expected %d", out.Len(), len(content))
+			}
+		})
+	}
+}
+
+func TestCopyResume(t *testing.T) {
+	content := testContent(1000000)
+
+	for name, test := range map[string]struct {
+		partial  []byte
+		seekable bool
+		resumed  bool
+	}{
+		"resume":        {content[:900000], true, true},
+		"other_content": {testContent(900001)[1:], true, false},
+		"not_seekable":  {content[:900000], false, false},
+		"longer":        {append(append([]byte{}, content...), "tail"...), true, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tr, proxy := connectProxy(t, Config{})
+			dst := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(dst+partial_suffix, test.partial, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			var reader io.Reader = bytes.NewReader(content)
+			if !test.seekable {
+				reader = io.MultiReader(reader)
+			}
+			before := proxy.uploadedBytes()
+			if err := tr.Copy(reader, dst, 0644); err != nil {
+				t.Fatal(err)
+			}
+			checkCopied(t, dst, content, 0644)
+
+			// Resumed upload sends just the rest of the content
+			uploaded := proxy.uploadedBytes() - before
+			if resumed := uploaded < int64(len(content))/2; resumed != test.resumed {
+				t.Errorf("Uploaded %d bytes of %d, expected resume: %v", uploaded, len(content), test.resumed)
+			}
+		})
+	}
+}
+
+func TestCopyChecksumMismatch(t *testing.T) {
+	tr, _ := connectProxy(t, Config{})
+	dst := filepath.Join(t.TempDir(), "file")
+
+	// Remote checksum tools are returning the wrong sum
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho " + strings.Repeat("0", 64) + " \"$1\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "sha256sum"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	err := tr.Copy(bytes.NewReader(testContent(1000)), dst, 0644)
+	if err == nil || !strings.Contains(err.Error(), "checksums mismatch") {
+		t.Fatalf("Expected checksum error, got: %v", err)
+	}
+	if _, err = os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("Destination is created: %v", err)
+	}
+	if _, err = os.Stat(dst + partial_suffix); !os.IsNotExist(err) {
+		t.Errorf("Broken partial file is left: %v", err)
+	}
+}
+
+func TestCopySCP(t *testing.T) {
+	tr, _ := connectProxyOptions(t, Config{}, sshd.Options{NoSFTP: true})
+	dst := filepath.Join(t.TempDir(), "file")
+
+	content := testContent(100000)
+	if err := tr.Copy(bytes.NewReader(content), dst, 0640); err != nil {
+		t.Fatal(err)
+	}
+	checkCopied(t, dst, content, 0640)
+
+	var out bytes.Buffer
+	if err := tr.Fetch(dst, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("Fetched %d bytes, expected %d", out.Len(), len(content))
+	}
+}
@@ -0,0 +1,231 @@
+package ssh
+
+// Verification of the host keys with known_hosts files and pinned fingerprints
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key checking modes
+const (
+	// Host key must be in the known_hosts
+	HostKeyStrict = "strict"
+	// Trust on first use: unknown host keys are added to known_hosts, changed keys are rejected
+	HostKeyAcceptNew = "accept-new"
+	// Host key is not checked at all
+	HostKeyIgnore = "ignore"
+)
+
+// Default system-wide known hosts file, it's used only for reading
+const system_known_hosts = "/etc/ssh/ssh_known_hosts"
+
+// Guards the known_hosts file writes when multiple hosts are connecting in parallel
+var known_hosts_mu sync.Mutex
+
+// Host key verification settings
+type HostKeyConfig struct {
+	// One of the host key checking modes, strict by default
+	Mode string
+	// User known_hosts file, new keys are added to it. By default it's ~/.ssh/known_hosts
+	KnownHostsFile string
+	// Pinned fingerprints of the host key (like `SHA256:...` or `MD5:..`), if set the key must
+	// match one of them regardless of the mode and known_hosts
+	Fingerprints []string
+}
+
+// Returns the known_hosts file path to store the new keys
+func (c *HostKeyConfig) knownHostsFile() (string, error) {
+	if c.KnownHostsFile != "" {
+		return c.KnownHostsFile, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("Unable to find user home dir for known_hosts: %v", err)
+	}
+	return filepath.Join(home, ".ssh", "known_hosts"), nil
+}
+
+// Creates the callback to verify the host key during the handshake
+func (c *HostKeyConfig) Callback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if len(c.Fingerprints) > 0 {
+			return c.checkFingerprints(hostname, key)
+		}
+
+		switch c.Mode {
+		case HostKeyIgnore:
+			return nil
+		case "", HostKeyStrict, HostKeyAcceptNew:
+		default:
+			return fmt.Errorf("Unknown host key checking mode %q", c.Mode)
+		}
+
+		err := c.checkKnownHosts(hostname, remote, key)
+		var key_err *knownhosts.KeyError
+		if !errors.As(err, &key_err) {
+			return err
+		}
+
+		if len(key_err.Want) > 0 {
+			known := make([]string, len(key_err.Want))
+			for i, want := range key_err.Want {
+				known[i] = fmt.Sprintf("%s:%d", want.Filename, want.Line)
+			}
+			return fmt.Errorf("REMOTE HOST IDENTIFICATION HAS CHANGED: host key %s of %q does not match the known key in %s",
+				ssh.FingerprintSHA256(key), hostname, strings.Join(known, ", "))
+		}
+
+		if c.Mode == HostKeyAcceptNew {
+			return c.addKnownHost(hostname, remote, key)
+		}
+		return fmt.Errorf("Host key %s of %q is not known, add it to known_hosts or set host key checking to %q",
+			ssh.FingerprintSHA256(key), hostname, HostKeyAcceptNew)
+	}
+}
+
+// Host key algorithms in the default preference order of the ssh package
+var default_host_key_algorithms = []string{
+	ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSASHA512v01,
+	ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512,
+	ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+
+	ssh.KeyAlgoED25519,
+}
+
+// Address of the host to look up in known_hosts
+type lookupAddr string
+
+func (a lookupAddr) Network() string { return "tcp" }
+func (a lookupAddr) String() string  { return string(a) }
+
+// Returns the host key algorithms with the types of the keys known for the address going first
+// in the default order, like OpenSSH does, so the server presents the key which could be
+// verified. Nil means the default algorithms are used.
+func (c *HostKeyConfig) Algorithms(address string) []string {
+	if len(c.Fingerprints) > 0 || c.Mode == HostKeyIgnore {
+		return nil
+	}
+
+	// Known keys are returned in the error for the key which is not known for sure
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil
+	}
+	var key_err *knownhosts.KeyError
+	if !errors.As(c.checkKnownHosts(address, lookupAddr(address), probe.PublicKey()), &key_err) || len(key_err.Want) == 0 {
+		return nil
+	}
+
+	known := map[string]bool{}
+	for _, want := range key_err.Want {
+		known[want.Key.Type()] = true
+	}
+	var out, rest []string
+	for _, algo := range default_host_key_algorithms {
+		typ := algo
+		if algo == ssh.KeyAlgoRSASHA256 || algo == ssh.KeyAlgoRSASHA512 {
+			// RSA key is used with the SHA-2 signatures
+			typ = ssh.KeyAlgoRSA
+		}
+		if known[typ] {
+			out = append(out, algo)
+		} else {
+			rest = append(rest, algo)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	// The other algorithms are still allowed to show the changed key error instead of the
+	// handshake failure
+	out = append(out, rest...)
+	return out
+}
+
+func (c *HostKeyConfig) checkFingerprints(hostname string, key ssh.PublicKey) error {
+	sha256 := ssh.FingerprintSHA256(key)
+	md5 := ssh.FingerprintLegacyMD5(key)
+	for _, fp := range c.Fingerprints {
+		fp = strings.TrimSpace(fp)
+		if fp == sha256 || strings.TrimPrefix(fp, "MD5:") == md5 {
+			return nil
+		}
+	}
+	return fmt.Errorf("Host key %s of %q does not match the pinned fingerprints %q", sha256, hostname, c.Fingerprints)
+}
+
+// The files are read on every check to see the keys added by the other connections
+func (c *HostKeyConfig) checkKnownHosts(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	user_file, err := c.knownHostsFile()
+	if err != nil {
+		return err
+	}
+
+	var files []string
+	for _, path := range []string{user_file, system_known_hosts} {
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	if len(files) == 0 {
+		// Nothing is known yet
+		return &knownhosts.KeyError{}
+	}
+
+	known_hosts_mu.Lock()
+	callback, err := knownhosts.New(files...)
+	known_hosts_mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("Unable to read known_hosts: %v", err)
+	}
+	return callback(hostname, remote, key)
+}
+
+func (c *HostKeyConfig) addKnownHost(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	path, err := c.knownHostsFile()
+	if err != nil {
+		return err
+	}
+
+	known_hosts_mu.Lock()
+	defer known_hosts_mu.Unlock()
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Unable to create known_hosts dir: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open known_hosts: %v", err)
+	}
+	defer f.Close()
+
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil {
+		if addr := knownhosts.Normalize(remote.String()); addr != addresses[0] {
+			addresses = append(addresses, addr)
+		}
+	}
+	if _, err = fmt.Fprintln(f, knownhosts.Line(addresses, key)); err != nil {
+		return fmt.Errorf("Unable to write known_hosts: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/state-of-the-art/ansiblego/pkg/sshd"
+)
+
+const (
+	test_user     = "test"
+	test_password = "secret"
+)
+
+// Starts the embedded sshd on the random local port and returns its port
+func startSSHD(t *testing.T, opts sshd.Options) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go sshd.Serve(listener, test_user, test_password, opts)
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// Generates the host key of the type
+func testHostKey(t *testing.T, typ string) ssh.Signer {
+	t.Helper()
+	var key any
+	var err error
+	switch typ {
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		t.Fatalf("Unknown key type %q", typ)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// Writes the known_hosts file with the keys of the address
+func writeKnownHosts(t *testing.T, path, addr string, keys ...ssh.PublicKey) {
+	t.Helper()
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(addr)}, key))
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func connectHostKey(port int, host_key HostKeyConfig) error {
+	tr, err := New(&Config{
+		User:    test_user,
+		Host:    "127.0.0.1",
+		Port:    port,
+		Auth:    AuthConfig{Password: test_password},
+		HostKey: host_key,
+	})
+	if err == nil {
+		tr.Close()
+	}
+	return err
+}
+
+func TestHostKeyKnownHosts(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	// Default preference of the client is ecdsa, but only ed25519 key is known
+	ed_key, ecdsa_key := testHostKey(t, "ed25519"), testHostKey(t, "ecdsa")
+	port := startSSHD(t, sshd.Options{HostKeys: []ssh.Signer{ecdsa_key, ed_key}})
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	known_hosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	for name, test := range map[string]struct {
+		keys []ssh.PublicKey
+		err  string
+	}{
+		"known":       {[]ssh.PublicKey{ed_key.PublicKey()}, ""},
+		"both_known":  {[]ssh.PublicKey{ed_key.PublicKey(), ecdsa_key.PublicKey()}, ""},
+		"changed":     {[]ssh.PublicKey{testHostKey(t, "ed25519").PublicKey()}, "REMOTE HOST IDENTIFICATION HAS CHANGED"},
+		"unknown":     {nil, "is not known"},
+		"other_host":  {nil, "is not known"},
+		"other_port":  {nil, "is not known"},
+		"ecdsa_known": {[]ssh.PublicKey{ecdsa_key.PublicKey()}, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			switch name {
+			case "other_host":
+				writeKnownHosts(t, known_hosts, net.JoinHostPort("127.0.0.2", strconv.Itoa(port)), ed_key.PublicKey())
+			case "other_port":
+				writeKnownHosts(t, known_hosts, net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1)), ed_key.PublicKey())
+			default:
+				writeKnownHosts(t, known_hosts, addr, test.keys...)
+			}
+			err := connectHostKey(port, HostKeyConfig{Mode: HostKeyStrict, KnownHostsFile: known_hosts})
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("Expected error %q, got: %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestHostKeyAcceptNew(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	key := testHostKey(t, "ed25519")
+	port := startSSHD(t, sshd.Options{HostKeys: []ssh.Signer{key}})
+	known_hosts := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+
+	if err := connectHostKey(port, HostKeyConfig{Mode: HostKeyAcceptNew, KnownHostsFile: known_hosts}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(known_hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))}, key.PublicKey())
+	if strings.TrimSpace(string(data)) != expected {
+		t.Fatalf("Known hosts is %q, expected %q", data, expected)
+	}
+
+	// Accepted key is known for the strict mode and is not added again
+	if err = connectHostKey(port, HostKeyConfig{Mode: HostKeyStrict, KnownHostsFile: known_hosts}); err != nil {
+		t.Fatal(err)
+	}
+	if err = connectHostKey(port, HostKeyConfig{Mode: HostKeyAcceptNew, KnownHostsFile: known_hosts}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ = os.ReadFile(known_hosts); strings.Count(string(data), "\n") != 1 {
+		t.Fatalf("Known key is added again: %q", data)
+	}
+
+	// Changed key is not accepted
+	changed_port := startSSHD(t, sshd.Options{HostKeys: []ssh.Signer{testHostKey(t, "ed25519")}})
+	writeKnownHosts(t, known_hosts, net.JoinHostPort("127.0.0.1", strconv.Itoa(changed_port)), key.PublicKey())
+	err = connectHostKey(changed_port, HostKeyConfig{Mode: HostKeyAcceptNew, KnownHostsFile: known_hosts})
+	if err == nil || !strings.Contains(err.Error(), "REMOTE HOST IDENTIFICATION HAS CHANGED") {
+		t.Fatalf("Expected changed key error, got: %v", err)
+	}
+
+	// Ignore mode doesn't need known hosts at all
+	if err = connectHostKey(changed_port, HostKeyConfig{Mode: HostKeyIgnore, KnownHostsFile: filepath.Join(t.TempDir(), "none")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostKeyFingerprints(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	key := testHostKey(t, "ed25519")
+	port := startSSHD(t, sshd.Options{HostKeys: []ssh.Signer{key}})
+	// Pinned fingerprints are not using known hosts
+	known_hosts := filepath.Join(t.TempDir(), "known_hosts")
+	writeKnownHosts(t, known_hosts, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), testHostKey(t, "ed25519").PublicKey())
+
+	other := testHostKey(t, "ed25519").PublicKey()
+	for name, test := range map[string]struct {
+		fingerprints []string
+		ok           bool
+	}{
+		"sha256":       {[]string{ssh.FingerprintSHA256(key.PublicKey())}, true},
+		"md5":          {[]string{"MD5:" + ssh.FingerprintLegacyMD5(key.PublicKey())}, true},
+		"md5_no_pref":  {[]string{ssh.FingerprintLegacyMD5(key.PublicKey())}, true},
+		"one_of":       {[]string{ssh.FingerprintSHA256(other), " " + ssh.FingerprintSHA256(key.PublicKey()) + " "}, true},
+		"wrong":        {[]string{ssh.FingerprintSHA256(other)}, false},
+		"wrong_md5":    {[]string{"MD5:" + ssh.FingerprintLegacyMD5(other)}, false},
+		"ignored_mode": {[]string{ssh.FingerprintSHA256(other)}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mode := HostKeyStrict
+			if name == "ignored_mode" {
+				mode = HostKeyIgnore
+			}
+			err := connectHostKey(port, HostKeyConfig{Mode: mode, KnownHostsFile: known_hosts, Fingerprints: test.fingerprints})
+			if test.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !test.ok && (err == nil || !strings.Contains(err.Error(), "does not match the pinned fingerprints")) {
+				t.Fatalf("Expected fingerprint error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	known_hosts := filepath.Join(t.TempDir(), "known_hosts")
+	addr := "example.com:2222"
+
+	for name, test := range map[string]struct {
+		keys  []ssh.PublicKey
+		first []string
+	}{
+		"unknown": {nil, nil},
+		"ed25519": {[]ssh.PublicKey{testHostKey(t, "ed25519").PublicKey()}, []string{ssh.KeyAlgoED25519}},
+		"ecdsa":   {[]ssh.PublicKey{testHostKey(t, "ecdsa").PublicKey()}, []string{ssh.KeyAlgoECDSA256}},
+		"rsa":     {[]ssh.PublicKey{testHostKey(t, "rsa").PublicKey()}, []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA}},
+		"several": {[]ssh.PublicKey{testHostKey(t, "ed25519").PublicKey(), testHostKey(t, "ecdsa").PublicKey()}, []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoED25519}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			writeKnownHosts(t, known_hosts, addr, test.keys...)
+			out := (&HostKeyConfig{KnownHostsFile: known_hosts}).Algorithms(addr)
+			if test.first == nil {
+				if out != nil {
+					t.Fatalf("Algorithms for unknown host are %q", out)
+				}
+				return
+			}
+			if len(out) != len(default_host_key_algorithms) || fmt.Sprint(out[:len(test.first)]) != fmt.Sprint(test.first) {
+				t.Fatalf("Algorithms are %q, expected to start with %q", out, test.first)
+			}
+		})
+	}
+
+	// Pinned fingerprints and ignore mode are accepting any key
+	writeKnownHosts(t, known_hosts, addr, testHostKey(t, "ecdsa").PublicKey())
+	if out := (&HostKeyConfig{KnownHostsFile: known_hosts, Mode: HostKeyIgnore}).Algorithms(addr); out != nil {
+		t.Errorf("Algorithms for ignore mode are %q", out)
+	}
+	if out := (&HostKeyConfig{KnownHostsFile: known_hosts, Fingerprints: []string{"SHA256:x"}}).Algorithms(addr); out != nil {
+		t.Errorf("Algorithms for fingerprints are %q", out)
+	}
+}
@@ -0,0 +1,178 @@
+package ssh
+
+// Connecting through the chain of jump hosts like OpenSSH ProxyJump does
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Jump host to connect through, empty values are taken from ssh_config or defaults
+type JumpHost struct {
+	User string
+	Host string
+	Port int
+	// Identity files from ssh_config, the target host ones are used if empty
+	IdentityFiles []string
+}
+
+func (j *JumpHost) addr() string {
+	return net.JoinHostPort(j.Host, strconv.Itoa(j.Port))
+}
+
+// Parses the ProxyJump chain `[user@]host[:port][,[user@]host[:port]...]`, the value `none`
+// disables the jumps. ssh:// URIs are supported too.
+func ParseProxyJump(spec string) (out []JumpHost, err error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || strings.EqualFold(spec, "none") {
+		return nil, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimPrefix(strings.TrimSpace(item), "ssh://")
+		if item == "" {
+			return nil, fmt.Errorf("Empty jump host in ProxyJump %q", spec)
+		}
+		var jump JumpHost
+		if pos := strings.LastIndex(item, "@"); pos >= 0 {
+			jump.User, item = item[:pos], item[pos+1:]
+		}
+		jump.Host = item
+		if host, port, err := net.SplitHostPort(item); err == nil {
+			jump.Host = host
+			if jump.Port, err = strconv.Atoi(port); err != nil || jump.Port < 1 || jump.Port > 65535 {
+				return nil, fmt.Errorf("Bad port of jump host %q in ProxyJump %q", item, spec)
+			}
+		}
+		jump.Host = strings.Trim(jump.Host, "[]")
+		if jump.Host == "" {
+			return nil, fmt.Errorf("Empty jump host address in ProxyJump %q", spec)
+		}
+		out = append(out, jump)
+	}
+	return out, nil
+}
+
+// Parses the ProxyJump chain and fills the jump hosts settings from ssh_config. The jump user
+// is the local one if not set, like in OpenSSH.
+func ResolveProxyJump(spec string) ([]JumpHost, error) {
+	jumps, err := ParseProxyJump(spec)
+	if err != nil {
+		return nil, err
+	}
+	for i := range jumps {
+		jump := &jumps[i]
+		cfg, err := LookupConfig(jump.Host)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.HostName != "" {
+			jump.Host = cfg.HostName
+		}
+		if jump.User == "" {
+			jump.User = cfg.User
+		}
+		if jump.User == "" {
+			if current, err := user.Current(); err == nil {
+				jump.User = current.Username
+			}
+		}
+		if jump.Port == 0 {
+			jump.Port = cfg.Port
+		}
+		if jump.Port == 0 {
+			jump.Port = 22
+		}
+		jump.IdentityFiles = cfg.IdentityFiles
+	}
+	return jumps, nil
+}
+
+// Connects to the address through the jump hosts, the jump connections are closed together
+// with the returned client
+func dialJumps(jumps []JumpHost, auth *AuthConfig, host_key *HostKeyConfig, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var clients []*ssh.Client
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+
+	hop := func(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		if len(clients) == 0 {
+			return ssh.Dial("tcp", addr, config)
+		}
+		conn, err := clients[len(clients)-1].Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return ssh.NewClient(c, chans, reqs), nil
+	}
+
+	for _, jump := range jumps {
+		jump_config, done, err := jump.clientConfig(auth, host_key, config)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		client, err := hop(jump.addr(), jump_config)
+		done()
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("Unable to connect to jump host %q: %v", jump.addr(), err)
+		}
+		clients = append(clients, client)
+	}
+
+	client, err := hop(addr, config)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	if len(clients) > 0 {
+		go func() {
+			client.Wait()
+			closeAll()
+		}()
+	}
+	return client, nil
+}
+
+// Jump hosts are using the same auth as the target, but with own identity files if set in
+// ssh_config. The pinned fingerprints belong to the target host, so not checked for jumps. The
+// returned function closes the agent connection used to authenticate on the jump host.
+func (j *JumpHost) clientConfig(auth *AuthConfig, host_key *HostKeyConfig, target *ssh.ClientConfig) (*ssh.ClientConfig, func(), error) {
+	methods := target.Auth
+	done := func() {}
+	if len(j.IdentityFiles) > 0 {
+		// The explicit key belongs to the target host
+		jump_auth := *auth
+		jump_auth.PrivateKeyFiles = nil
+		jump_auth.IdentityFiles = j.IdentityFiles
+		var agent_conn net.Conn
+		var err error
+		if methods, agent_conn, err = jump_auth.methods(); err != nil {
+			return nil, nil, fmt.Errorf("Unable to prepare auth for jump host %q: %v", j.addr(), err)
+		}
+		if agent_conn != nil {
+			done = func() { agent_conn.Close() }
+		}
+	}
+	jump_key := *host_key
+	jump_key.Fingerprints = nil
+	return &ssh.ClientConfig{
+		User:              j.User,
+		Auth:              methods,
+		HostKeyCallback:   jump_key.Callback(),
+		HostKeyAlgorithms: jump_key.Algorithms(j.addr()),
+	}, done, nil
+}
@@ -0,0 +1,62 @@
+package ssh
+
+import (
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/state-of-the-art/ansiblego/pkg/sshd"
+)
+
+func TestProxyJump(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	target_port := startSSHD(t, sshd.Options{})
+	target_addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(target_port))
+
+	for name, test := range map[string]struct {
+		allow []string
+		ok    bool
+	}{
+		"disabled":  {nil, false},
+		"allowed":   {[]string{target_addr}, true},
+		"wildcard":  {[]string{"127.0.0.*:*"}, true},
+		"not_in":    {[]string{"127.0.0.1:22", "example.com:*"}, false},
+		"bad_entry": {[]string{"127.0.0.1"}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			bastion_port := startSSHD(t, sshd.Options{ForwardAllow: test.allow})
+			tr, err := New(&Config{
+				User:    test_user,
+				Host:    "127.0.0.1",
+				Port:    target_port,
+				Auth:    AuthConfig{Password: test_password},
+				HostKey: HostKeyConfig{Mode: HostKeyIgnore},
+				Jumps:   []JumpHost{{User: test_user, Host: "127.0.0.1", Port: bastion_port}},
+			})
+			if !test.ok {
+				if err == nil {
+					tr.Close()
+					t.Fatal("Connected through the bastion which is not allowed to forward")
+				}
+				if !strings.Contains(err.Error(), "forwarding is not allowed") {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Close()
+
+			kern, arch, err := tr.Check()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kern != runtime.GOOS || arch != runtime.GOARCH {
+				t.Fatalf("Unexpected target system: %s %s", kern, arch)
+			}
+		})
+	}
+}
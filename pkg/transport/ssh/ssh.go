@@ -3,128 +3,319 @@ package ssh
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/bramvdbogaerde/go-scp"
 	"golang.org/x/crypto/ssh"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+// Defaults of the connection reuse settings
+const (
+	default_keepalive_interval  = 15 * time.Second
+	default_keepalive_count_max = 3
+	// OpenSSH server allows 10 sessions per connection by default (MaxSessions)
+	default_max_sessions = 10
 )
 
+// Time the interrupted command has to exit before it's killed
+var interrupt_grace = 5 * time.Second
+
+// Settings of the ssh connection
+type Config struct {
+	User string
+	Host string
+	Port int
+
+	Auth    AuthConfig
+	HostKey HostKeyConfig
+	// Chain of jump hosts to connect through, the first one is connected directly
+	Jumps []JumpHost
+
+	// Interval of the keepalive requests, negative disables them
+	KeepaliveInterval time.Duration
+	// Number of unanswered keepalives to consider the connection dead
+	KeepaliveCountMax int
+	// Limit of the concurrent sessions on the connection
+	MaxSessions int
+}
+
+// The transport keeps one connection to the host and opens the sessions on it, the connection
+// is restored on the next use if it's broken
 type TransportSSH struct {
 	host   string
 	port   int
 	config *ssh.ClientConfig
-}
 
-func NewPass(user, pass, host string, port int) (*TransportSSH, error) {
-	tr := &TransportSSH{
-		host: host,
-		port: port,
-		config: &ssh.ClientConfig{
-			User: user,
-			Auth: []ssh.AuthMethod{ssh.Password(pass)},
+	auth     *AuthConfig
+	host_key *HostKeyConfig
+	jumps    []JumpHost
 
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		},
-	}
+	keepalive_interval  time.Duration
+	keepalive_count_max int
 
-	if _, _, err := tr.Check(); err != nil {
-		return nil, err
-	}
+	// Connection to ssh agent used to sign with the agent keys
+	agent_conn net.Conn
 
-	return tr, nil
+	mu     sync.Mutex
+	client *ssh.Client
+	closed bool
+	// Semaphore limiting the concurrent sessions
+	sessions chan struct{}
+	// Locks of the files being copied
+	copying map[string]*sync.Mutex
 }
 
-func NewKey(user, key_path, host string, port int) (*TransportSSH, error) {
-	key, err := os.ReadFile(key_path)
+func New(cfg *Config) (*TransportSSH, error) {
+	methods, agent_conn, err := cfg.Auth.methods()
 	if err != nil {
-		return nil, fmt.Errorf("Unable to read ssh key file: %v", err)
-	}
-
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to parse private key: %v", err)
+		return nil, err
 	}
 
 	tr := &TransportSSH{
-		host: host,
-		port: port,
+		host: cfg.Host,
+		port: cfg.Port,
 		config: &ssh.ClientConfig{
-			User: user,
-			Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			User: cfg.User,
+			Auth: methods,
 
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			HostKeyCallback:   cfg.HostKey.Callback(),
+			HostKeyAlgorithms: cfg.HostKey.Algorithms(net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))),
 		},
+		auth:       &cfg.Auth,
+		host_key:   &cfg.HostKey,
+		jumps:      cfg.Jumps,
+		agent_conn: agent_conn,
+
+		keepalive_interval:  cfg.KeepaliveInterval,
+		keepalive_count_max: cfg.KeepaliveCountMax,
+	}
+	if tr.keepalive_interval == 0 {
+		tr.keepalive_interval = default_keepalive_interval
+	}
+	if tr.keepalive_count_max <= 0 {
+		tr.keepalive_count_max = default_keepalive_count_max
 	}
+	max_sessions := cfg.MaxSessions
+	if max_sessions <= 0 {
+		max_sessions = default_max_sessions
+	}
+	tr.sessions = make(chan struct{}, max_sessions)
 
+	// The check is using the same connection the following commands will use
 	if _, _, err := tr.Check(); err != nil {
+		tr.Close()
 		return nil, fmt.Errorf("Unable to verify ssh connection: %v", err)
 	}
 
 	return tr, nil
 }
 
-func (tr *TransportSSH) connect() (*ssh.Client, *ssh.Session, error) {
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", tr.host, tr.port), tr.config)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to connect: %v", err)
+func NewPass(user, pass, host string, port int, host_key *HostKeyConfig) (*TransportSSH, error) {
+	return New(&Config{User: user, Host: host, Port: port, Auth: AuthConfig{Password: pass}, HostKey: *host_key})
+}
+
+func NewKey(user, key_path, host string, port int, host_key *HostKeyConfig) (*TransportSSH, error) {
+	return New(&Config{User: user, Host: host, Port: port, Auth: AuthConfig{PrivateKeyFiles: []string{key_path}}, HostKey: *host_key})
+}
+
+// Connects to the host directly or through the jump hosts
+func (tr *TransportSSH) dial() (*ssh.Client, error) {
+	addr := net.JoinHostPort(tr.host, strconv.Itoa(tr.port))
+	if len(tr.jumps) == 0 {
+		return ssh.Dial("tcp", addr, tr.config)
 	}
+	return dialJumps(tr.jumps, tr.auth, tr.host_key, addr, tr.config)
+}
 
-	session, err := client.NewSession()
+// Returns the established connection or connects to the host
+func (tr *TransportSSH) getClient() (*ssh.Client, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if tr.closed {
+		return nil, fmt.Errorf("Transport is closed")
+	}
+	if tr.client != nil {
+		return tr.client, nil
+	}
+
+	client, err := tr.dial()
 	if err != nil {
-		client.Close()
-		return nil, nil, fmt.Errorf("Failed to create SSH session: %v", err)
+		return nil, fmt.Errorf("Failed to connect: %v", err)
+	}
+	tr.client = client
+
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+		tr.dropClient(client)
+	}()
+	if tr.keepalive_interval > 0 {
+		go tr.keepalive(client, done)
 	}
 
-	return client, session, nil
+	return client, nil
 }
 
-func (tr *TransportSSH) Execute(cmd string, stdout, stderr io.Writer) (err error) {
-	client, session, err := tr.connect()
-	if err != nil {
-		return err
+// Forgets the broken connection, so the next use will connect again
+func (tr *TransportSSH) dropClient(client *ssh.Client) {
+	tr.mu.Lock()
+	if tr.client == client {
+		tr.client = nil
 	}
-	defer client.Close()
-	defer session.Close()
+	tr.mu.Unlock()
+	client.Close()
+}
 
-	stdout_pipe, _ := session.StdoutPipe()
-	go io.Copy(stdout, stdout_pipe)
-	stderr_pipe, _ := session.StderrPipe()
-	go io.Copy(stderr, stderr_pipe)
-	err = session.Run(cmd)
-	if err != nil {
-		return fmt.Errorf("Failed to run command: %v", err)
+// Sends the keepalive requests like OpenSSH ServerAliveInterval does and drops the connection
+// if the server is not answering
+func (tr *TransportSSH) keepalive(client *ssh.Client, done <-chan struct{}) {
+	ticker := time.NewTicker(tr.keepalive_interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			if err == nil {
+				missed = 0
+				continue
+			}
+		case <-time.After(tr.keepalive_interval):
+		}
+
+		if missed++; missed >= tr.keepalive_count_max {
+			tr.dropClient(client)
+			return
+		}
 	}
-	return nil
 }
 
-func (tr *TransportSSH) ExecuteInput(cmd string, stdin io.Reader, stdout, stderr io.Writer) (err error) {
-	client, session, err := tr.connect()
-	if err != nil {
-		return err
-	}
-	defer client.Close()
-	defer session.Close()
-
-	stdin_pipe, _ := session.StdinPipe()
-	go io.Copy(stdin_pipe, stdin)
-	stdout_pipe, _ := session.StdoutPipe()
-	go io.Copy(stdout, stdout_pipe)
-	stderr_pipe, _ := session.StderrPipe()
-	go io.Copy(stderr, stderr_pipe)
-	err = session.Run(cmd)
+// Opens the session on the shared connection, the broken connection is restored once. The
+// returned function closes the session and frees the slot for the next one.
+func (tr *TransportSSH) session() (*ssh.Session, func(), error) {
+	tr.sessions <- struct{}{}
+	release := func() { <-tr.sessions }
+
+	for attempt := 0; ; attempt++ {
+		client, err := tr.getClient()
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		session, err := client.NewSession()
+		if err == nil {
+			return session, func() {
+				session.Close()
+				release()
+			}, nil
+		}
+		// Rejected channel means the connection is alive, but the server refused the session
+		var open_err *ssh.OpenChannelError
+		if attempt > 0 || errors.As(err, &open_err) {
+			release()
+			return nil, nil, fmt.Errorf("Failed to create SSH session: %v", err)
+		}
+		tr.dropClient(client)
+	}
+}
+
+func (tr *TransportSSH) Execute(ctx context.Context, cmd string, stdout, stderr io.Writer) (*transport.Result, error) {
+	return tr.run(ctx, cmd, nil, stdout, stderr)
+}
+
+func (tr *TransportSSH) ExecuteInput(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*transport.Result, error) {
+	return tr.run(ctx, cmd, stdin, stdout, stderr)
+}
+
+// Runs the command in the new session, when the context is done the remote command receives
+// INT signal and after the grace period KILL
+func (tr *TransportSSH) run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*transport.Result, error) {
+	session, closeSession, err := tr.session()
 	if err != nil {
-		return fmt.Errorf("Failed to run command: %v", err)
+		return nil, err
 	}
-	return nil
+	defer closeSession()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	start := time.Now()
+	if err = session.Start(cmd); err != nil {
+		return nil, fmt.Errorf("Failed to run command: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGINT)
+		select {
+		case err = <-done:
+		case <-time.After(interrupt_grace):
+			session.Signal(ssh.SIGKILL)
+			// Server could ignore the signals, so closing the channel to not wait forever
+			session.Close()
+			err = <-done
+		}
+	}
+
+	res := &transport.Result{Duration: time.Since(start)}
+	var exit_err *ssh.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exit_err):
+		res.ExitCode = exit_err.ExitStatus()
+		res.Signal = exit_err.Signal()
+		if res.Signal != "" {
+			res.ExitCode = -1
+		}
+	default:
+		res.ExitCode = -1
+	}
+
+	if ctx.Err() != nil {
+		return res, fmt.Errorf("Command was interrupted: %v", ctx.Err())
+	}
+	if err != nil && res.ExitCode == -1 && res.Signal == "" {
+		return res, fmt.Errorf("Failed to run command: %v", err)
+	}
+	if res.ExitCode != 0 || res.Signal != "" {
+		return res, &transport.ExitError{Result: res}
+	}
+	return res, nil
 }
 
 func (tr *TransportSSH) Check() (kernel, arch string, err error) {
 	stderr_buf := bytes.Buffer{}
 	stdout_buf := bytes.Buffer{}
-	if err = tr.Execute("uname -s -m", &stdout_buf, &stderr_buf); err != nil {
+	if _, err = tr.Execute(context.Background(), "uname -s -m", &stdout_buf, &stderr_buf); err != nil {
 		return kernel, arch, fmt.Errorf("Unable to get the remote system kernel: %v, %v", err, stderr_buf.String())
 	}
 
@@ -143,23 +334,20 @@ func (tr *TransportSSH) Check() (kernel, arch string, err error) {
 	return kernel, arch, nil
 }
 
-func (tr *TransportSSH) Copy(content io.Reader, dst string, mode os.FileMode) (err error) {
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", tr.host, tr.port), tr.config)
-	if err != nil {
-		return fmt.Errorf("Failed to connect: %v", err)
-	}
-	defer client.Close()
+// Closes the connection, the transport can't be used after that
+func (tr *TransportSSH) Close() error {
+	tr.mu.Lock()
+	client := tr.client
+	tr.client = nil
+	tr.closed = true
+	tr.mu.Unlock()
 
-	scp_client, err := scp.NewClientBySSH(client)
-	if err != nil {
-		return fmt.Errorf("Failed to create SCP session: %v", err)
+	if client != nil {
+		client.Close()
 	}
-	defer scp_client.Close()
-
-	scp_client.CopyFile(context.Background(), content, dst, fmt.Sprintf("%#o", mode))
-	if err != nil {
-		return fmt.Errorf("Error while copying file: %v", err)
+	if tr.agent_conn != nil {
+		tr.agent_conn.Close()
+		tr.agent_conn = nil
 	}
-
 	return nil
 }
@@ -0,0 +1,289 @@
+//go:build linux
+
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/state-of-the-art/ansiblego/pkg/sshd"
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+// TCP proxy to the server able to break the connections
+type testProxy struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	frozen   map[net.Conn]bool
+	accepted int
+	// Bytes sent by the clients
+	uploaded int64
+}
+
+func startProxy(t *testing.T, port int) *testProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProxy{listener: listener, frozen: map[net.Conn]bool{}}
+	t.Cleanup(func() {
+		listener.Close()
+		p.drop()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, conn, server)
+			p.accepted++
+			p.mu.Unlock()
+			go p.pipe(conn, server, conn)
+			go p.pipe(conn, conn, server)
+		}
+	}()
+	return p
+}
+
+// Forwards the data until the connection is closed, the data of frozen connection is lost
+func (p *testProxy) pipe(client net.Conn, dst io.Writer, src io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		frozen := p.frozen[client]
+		if src == io.Reader(client) {
+			p.uploaded += int64(n)
+		}
+		p.mu.Unlock()
+		if frozen {
+			continue
+		}
+		if _, err = dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (p *testProxy) port() int {
+	return p.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Closes the established connections like the server went down
+func (p *testProxy) drop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+// Stops forwarding the data of the established connections like the network went down
+func (p *testProxy) freeze() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		p.frozen[conn] = true
+	}
+}
+
+func (p *testProxy) connections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.accepted
+}
+
+func (p *testProxy) uploadedBytes() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.uploaded
+}
+
+func connectProxy(t *testing.T, cfg Config) (*TransportSSH, *testProxy) {
+	return connectProxyOptions(t, cfg, sshd.Options{})
+}
+
+func connectProxyOptions(t *testing.T, cfg Config, opts sshd.Options) (*TransportSSH, *testProxy) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SSH_AUTH_SOCK", "")
+	opts.HostKeys = []ssh.Signer{testHostKey(t, "ed25519")}
+	proxy := startProxy(t, startSSHD(t, opts))
+	cfg.User, cfg.Host, cfg.Port = test_user, "127.0.0.1", proxy.port()
+	cfg.Auth = AuthConfig{Password: test_password}
+	cfg.HostKey = HostKeyConfig{Mode: HostKeyIgnore}
+	tr, err := New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tr.Close() })
+	return tr, proxy
+}
+
+func execute(tr *TransportSSH, cmd string) (string, error) {
+	var stdout bytes.Buffer
+	_, err := tr.Execute(context.Background(), cmd, &stdout, io.Discard)
+	return stdout.String(), err
+}
+
+func TestSSHReuseAndReconnect(t *testing.T) {
+	tr, proxy := connectProxy(t, Config{})
+
+	for i := 0; i < 3; i++ {
+		if out, err := execute(tr, "echo test"); err != nil || out != "test\n" {
+			t.Fatalf("Output is %q, error: %v", out, err)
+		}
+	}
+	if n := proxy.connections(); n != 1 {
+		t.Fatalf("Commands are using %d connections, expected one", n)
+	}
+
+	res, err := tr.Execute(context.Background(), "sh -c 'exit 3'", io.Discard, io.Discard)
+	var exit_err *transport.ExitError
+	if !errors.As(err, &exit_err) || res.ExitCode != 3 {
+		t.Fatalf("Expected exit code 3, got: %v, %v", res, err)
+	}
+
+	// Server dropped the connection, so the next command connects again
+	proxy.drop()
+	if out, err := execute(tr, "echo test"); err != nil || out != "test\n" {
+		t.Fatalf("Output after drop is %q, error: %v", out, err)
+	}
+	if n := proxy.connections(); n != 2 {
+		t.Fatalf("Connected %d times, expected to reconnect once", n)
+	}
+
+	tr.Close()
+	if _, err = execute(tr, "echo test"); err == nil || !strings.Contains(err.Error(), "Transport is closed") {
+		t.Fatalf("Expected closed transport error, got: %v", err)
+	}
+}
+
+func TestSSHKeepalive(t *testing.T) {
+	tr, proxy := connectProxy(t, Config{KeepaliveInterval: 50 * time.Millisecond, KeepaliveCountMax: 2})
+
+	// Unanswered keepalives are dropping the connection
+	proxy.freeze()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tr.mu.Lock()
+		client := tr.client
+		tr.mu.Unlock()
+		if client == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Dead connection is not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if out, err := execute(tr, "echo test"); err != nil || out != "test\n" {
+		t.Fatalf("Output after keepalive drop is %q, error: %v", out, err)
+	}
+	if n := proxy.connections(); n != 2 {
+		t.Fatalf("Connected %d times, expected to reconnect once", n)
+	}
+
+	// Answered keepalives are keeping the connection
+	time.Sleep(300 * time.Millisecond)
+	if _, err := execute(tr, "echo test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := proxy.connections(); n != 2 {
+		t.Fatalf("Alive connection is dropped, connected %d times", n)
+	}
+}
+
+func TestSSHMaxSessions(t *testing.T) {
+	tr, proxy := connectProxy(t, Config{MaxSessions: 1})
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := execute(tr, "sleep 0.2")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One session at a time, all on the same connection
+	if duration := time.Since(start); duration < 600*time.Millisecond {
+		t.Errorf("Sessions are running concurrently, took %v", duration)
+	}
+	if n := proxy.connections(); n != 1 {
+		t.Errorf("Commands are using %d connections, expected one", n)
+	}
+}
+
+func TestSSHContextCancel(t *testing.T) {
+	orig := interrupt_grace
+	interrupt_grace = 300 * time.Millisecond
+	t.Cleanup(func() { interrupt_grace = orig })
+	tr, _ := connectProxy(t, Config{})
+
+	for name, test := range map[string]struct {
+		cmd    string
+		signal string
+		min    time.Duration
+	}{
+		// Interrupted command exits on INT
+		"interrupt": {"sleep 10", "INT", 0},
+		// Command ignoring INT is killed after the grace period
+		"kill": {"sh -c \"trap '' INT; while true; do sleep 0.1; done\"", "", 300 * time.Millisecond},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			res, err := tr.Execute(ctx, test.cmd, io.Discard, io.Discard)
+			duration := time.Since(start) - 200*time.Millisecond
+			if err == nil || !strings.Contains(err.Error(), "Command was interrupted") {
+				t.Fatalf("Expected interrupted error, got: %v", err)
+			}
+			if duration < test.min || duration > 3*time.Second {
+				t.Errorf("Command is stopped %v after the cancel", duration)
+			}
+			if test.signal != "" && (res == nil || res.Signal != test.signal) {
+				t.Errorf("Command result is %+v, expected signal %q", res, test.signal)
+			}
+		})
+	}
+
+	// Connection is still usable after the interrupted commands
+	if out, err := execute(tr, "echo test"); err != nil || out != "test\n" {
+		t.Fatalf("Output after interrupt is %q, error: %v", out, err)
+	}
+}
@@ -1,8 +1,11 @@
 package transport
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"os"
+	"time"
 )
 
 // Transports are used internally to communicate with remote system and
@@ -10,10 +13,64 @@ import (
 // the tasks. Transports should not be used to directly execute commands
 // of tasks anyhow.
 type Transport interface {
-	Execute(cmd string, stdout, stderr io.Writer) (err error)
-	ExecuteInput(cmd string, stdin io.Reader, stdout, stderr io.Writer) (err error)
+	// Runs the command, the context cancellation interrupts the remote command. The result is
+	// returned if the command was started, for failed command with ExitError.
+	Execute(ctx context.Context, cmd string, stdout, stderr io.Writer) (res *Result, err error)
+	ExecuteInput(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (res *Result, err error)
 
 	Check() (kernel, arch string, err error)
 
 	Copy(content io.Reader, dst string, mode os.FileMode) (err error)
+	// Reads the remote file to the writer
+	Fetch(src string, dst io.Writer) (err error)
+
+	// Releases the connection to the remote system
+	Close() error
+}
+
+// Result of the executed command
+type Result struct {
+	// Exit code of the command, -1 if it's unknown (killed by signal or interrupted)
+	ExitCode int
+	// Signal killed the command without `SIG` prefix (like `TERM`), empty if exited by itself
+	Signal string
+	// Time the command was running
+	Duration time.Duration
+}
+
+// Returned when the command was executed but failed
+type ExitError struct {
+	*Result
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("Command was killed by signal %s", e.Signal)
+	}
+	return fmt.Sprintf("Command exited with code %d", e.ExitCode)
+}
+
+// File to upload with CopyFiles
+type File struct {
+	Content io.Reader
+	Dst     string
+	Mode    os.FileMode
+}
+
+// Implemented by the transports able to upload multiple files at once cheaper than one by one
+type FilesCopier interface {
+	CopyFiles(files []File) error
+}
+
+// Uploads the files in one batch if the transport supports it or one by one
+func CopyFiles(tr Transport, files []File) error {
+	if copier, ok := tr.(FilesCopier); ok {
+		return copier.CopyFiles(files)
+	}
+	for _, f := range files {
+		if err := tr.Copy(f.Content, f.Dst, f.Mode); err != nil {
+			return fmt.Errorf("Unable to copy %q: %v", f.Dst, err)
+		}
+	}
+	return nil
 }
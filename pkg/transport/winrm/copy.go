@@ -0,0 +1,270 @@
+package winrm
+
+// File transfer through the PowerShell stdin and stdout with base64 encoded chunks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+// Size of the fetched file chunk, it's one line of the script output
+const fetch_chunk_size = 48 * 1024
+
+// Receives the files from stdin: each file starts with `file:<base64 path>:<mode>` line and
+// followed by the base64 content lines. The sha256 of the file is printed when it's written.
+// POSIX mode is mapped to Windows: no owner write permission sets read-only attribute and no
+// group/other permissions leave access only to the owner, SYSTEM and Administrators.
+const copy_script = `begin {
+	$DebugPreference = "Continue"
+	$ErrorActionPreference = "Stop"
+	Set-StrictMode -Version 2
+	$script:fd = $null
+
+	function Set-Mode($path, $mode) {
+		$item = Get-Item -LiteralPath $path
+		# Only access rules are changed, so the owner is kept as is
+		$acl = $item.GetAccessControl("Access")
+		if (($mode -band 0x3F) -eq 0) {
+			$acl.SetAccessRuleProtection($true, $false)
+			foreach ($rule in @($acl.Access)) {
+				[void]$acl.RemoveAccessRuleSpecific($rule)
+			}
+			$owners = @(
+				[System.Security.Principal.WindowsIdentity]::GetCurrent().User,
+				(New-Object System.Security.Principal.SecurityIdentifier("S-1-5-18")),
+				(New-Object System.Security.Principal.SecurityIdentifier("S-1-5-32-544"))
+			)
+			foreach ($sid in $owners) {
+				$acl.AddAccessRule((New-Object System.Security.AccessControl.FileSystemAccessRule($sid, "FullControl", "Allow")))
+			}
+			$item.SetAccessControl($acl)
+		} elseif ($acl.AreAccessRulesProtected) {
+			$acl.SetAccessRuleProtection($false, $false)
+			$item.SetAccessControl($acl)
+		}
+		$item.IsReadOnly = ($mode -band 0x80) -eq 0
+	}
+
+	function Close-File {
+		if ($script:fd -eq $null) {
+			return
+		}
+		[void]$script:sha256.TransformFinalBlock([byte[]]@(), 0, 0)
+		$script:fd.Close()
+		$script:fd = $null
+		Set-Mode $script:path $script:mode
+		Write-Output ([System.BitConverter]::ToString($script:sha256.Hash).Replace("-", "").ToLowerInvariant())
+	}
+}
+process {
+	foreach ($line in $input) {
+		if ($line.StartsWith("file:")) {
+			Close-File
+			$parts = $line.Split(":")
+			$script:path = [System.Text.Encoding]::UTF8.GetString([System.Convert]::FromBase64String($parts[1]))
+			$script:mode = [int]$parts[2]
+			$dir = [System.IO.Path]::GetDirectoryName($script:path)
+			if ($dir) {
+				[void][System.IO.Directory]::CreateDirectory($dir)
+			}
+			# Read-only file can't be overwritten
+			if ([System.IO.File]::Exists($script:path)) {
+				$attrs = [System.IO.File]::GetAttributes($script:path)
+				[System.IO.File]::SetAttributes($script:path, $attrs -band -bnot [System.IO.FileAttributes]::ReadOnly)
+			}
+			$script:fd = [System.IO.File]::Create($script:path)
+			$script:sha256 = [System.Security.Cryptography.SHA256]::Create()
+		} else {
+			$bytes = [System.Convert]::FromBase64String($line)
+			[void]$script:sha256.TransformBlock($bytes, 0, $bytes.Length, $bytes, 0)
+			$script:fd.Write($bytes, 0, $bytes.Length)
+		}
+	}
+}
+end {
+	Close-File
+}`
+
+// Prints the file as base64 lines and the last line is `sha256:<hash>`
+const fetch_script = `$ErrorActionPreference = "Stop"
+$fd = [System.IO.File]::OpenRead(%s)
+$sha256 = [System.Security.Cryptography.SHA256]::Create()
+$buf = New-Object byte[] %d
+try {
+	while (($n = $fd.Read($buf, 0, $buf.Length)) -gt 0) {
+		[void]$sha256.TransformBlock($buf, 0, $n, $buf, 0)
+		[Console]::Out.WriteLine([System.Convert]::ToBase64String($buf, 0, $n))
+	}
+	[void]$sha256.TransformFinalBlock($buf, 0, 0)
+	[Console]::Out.WriteLine("sha256:" + [System.BitConverter]::ToString($sha256.Hash).Replace("-", "").ToLowerInvariant())
+} finally {
+	$fd.Close()
+}`
+
+func (tr *TransportWinRM) Copy(content io.Reader, dst string, mode os.FileMode) error {
+	return tr.CopyFiles([]transport.File{{Content: content, Dst: dst, Mode: mode}})
+}
+
+// Rewritten for simplicity version of very quick winrm file copy through stdin
+// for io.Reader from: https://github.com/jbrekelmans/go-winrm/blob/master/copier.go
+// All the files are uploaded by one PowerShell process and verified with sha256.
+func (tr *TransportWinRM) CopyFiles(files []transport.File) error {
+	shell, err := tr.client.CreateShell()
+	if err != nil {
+		return err
+	}
+	defer shell.Close()
+
+	cmd, err := shell.Execute(powerShellScript(copy_script))
+	if err != nil {
+		return err
+	}
+	defer cmd.Close()
+
+	var wg sync.WaitGroup
+	copyFunc := func(w io.Writer, r io.Reader) {
+		defer wg.Done()
+		io.Copy(w, r)
+	}
+
+	stdout_buf := bytes.Buffer{}
+	stderr_buf := bytes.Buffer{}
+	wg.Add(2)
+	go copyFunc(&stdout_buf, cmd.Stdout)
+	go copyFunc(&stderr_buf, cmd.Stderr)
+
+	sums, err := writeCopyStream(cmd.Stdin, files, tr.client.Parameters.EnvelopeSize-1000)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin.Close()
+
+	cmd.Wait()
+	wg.Wait()
+
+	if cmd.ExitCode() != 0 {
+		return fmt.Errorf("Copy operation returned code=%d: %s", cmd.ExitCode(), strings.TrimSpace(stderr_buf.String()))
+	}
+
+	// Verify sha256 to validate the data was copied correctly
+	sums_rem := strings.Fields(stdout_buf.String())
+	for i, f := range files {
+		if i >= len(sums_rem) {
+			return fmt.Errorf("Copy of %q was not completed: %s", f.Dst, strings.TrimSpace(stderr_buf.String()))
+		}
+		if sums_rem[i] != sums[i] {
+			return fmt.Errorf("Copy of %q failed due to checksums mismatch: %v != %v", f.Dst, sums_rem[i], sums[i])
+		}
+	}
+
+	return nil
+}
+
+// Writes the files for the copy script: the header line of each file and its content in base64
+// lines not longer than the line size. Returns the sha256 of the files.
+func writeCopyStream(w io.Writer, files []transport.File, line_size int) (sums []string, err error) {
+	// Making chunk buffer for base64 encoding (which is 4 bytes for 3 bytes of data)
+	chunk := make([]byte, line_size/4*3)
+	b64_chunk := make([]byte, line_size+2)
+	for _, f := range files {
+		header := fmt.Sprintf("file:%s:%d\r\n", base64.StdEncoding.EncodeToString([]byte(f.Dst)), f.Mode.Perm())
+		if _, err := w.Write([]byte(header)); err != nil {
+			return nil, fmt.Errorf("Error during copying %q: %v", f.Dst, err)
+		}
+
+		// Preparing sha256 calculate object
+		sha256_loc_obj := sha256.New()
+		for {
+			chunk_len, err := io.ReadFull(f.Content, chunk)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("Unable to read content of %q: %v", f.Dst, err)
+			}
+			if chunk_len == 0 {
+				break
+			}
+
+			sha256_loc_obj.Write(chunk[:chunk_len])
+
+			// Using base64 encoding because it's quite hard to transfer binary data through winrm
+			base64.StdEncoding.Encode(b64_chunk, chunk[:chunk_len])
+			// 2 additional bytes for CRLF in the end of b64 encoded buffer
+			b64_len := base64.StdEncoding.EncodedLen(chunk_len) + 2
+			b64_chunk[b64_len-2] = '\r'
+			b64_chunk[b64_len-1] = '\n'
+			if written_len, err := w.Write(b64_chunk[:b64_len]); b64_len != written_len || err != nil {
+				return nil, fmt.Errorf("Error during copying chunk (bytes: %d, written: %d): %v", b64_len, written_len, err)
+			}
+		}
+		sums = append(sums, hex.EncodeToString(sha256_loc_obj.Sum(nil)))
+	}
+	return sums, nil
+}
+
+// Streams the file in base64 lines and verifies the sha256 printed in the end
+func (tr *TransportWinRM) Fetch(src string, dst io.Writer) error {
+	out := &fetchWriter{dst: dst, sum: sha256.New()}
+	stderr_buf := bytes.Buffer{}
+	script := fmt.Sprintf(fetch_script, powerShellQuotedStringLiteral(src), fetch_chunk_size)
+	if _, err := tr.Execute(context.Background(), powerShellScript(script), out, &stderr_buf); err != nil {
+		return fmt.Errorf("Unable to fetch file %q: %v, %s", src, err, strings.TrimSpace(stderr_buf.String()))
+	}
+	if out.err != nil {
+		return fmt.Errorf("Error while fetching file %q: %v", src, out.err)
+	}
+	if out.buf.Len() > 0 || out.remote_sum == "" {
+		return fmt.Errorf("Fetch of %q was not completed", src)
+	}
+	if local_sum := hex.EncodeToString(out.sum.Sum(nil)); out.remote_sum != local_sum {
+		return fmt.Errorf("Fetch failed due to checksums mismatch: %v != %v", out.remote_sum, local_sum)
+	}
+	return nil
+}
+
+// Decodes the fetch script output lines and writes the content to destination
+type fetchWriter struct {
+	dst        io.Writer
+	sum        hash.Hash
+	buf        bytes.Buffer
+	remote_sum string
+	err        error
+}
+
+func (w *fetchWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for w.err == nil {
+		pos := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if pos < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(w.buf.Next(pos + 1)))
+		if sum, ok := strings.CutPrefix(line, "sha256:"); ok {
+			w.remote_sum = sum
+			continue
+		}
+		if line == "" || w.remote_sum != "" {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			w.err = fmt.Errorf("Bad output chunk: %v", err)
+			break
+		}
+		w.sum.Write(data)
+		if _, err = w.dst.Write(data); err != nil {
+			w.err = err
+		}
+	}
+	// Errors are kept to not break the command output reading
+	return len(p), nil
+}
@@ -0,0 +1,163 @@
+package winrm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+func TestWriteCopyStream(t *testing.T) {
+	contents := map[string][]byte{
+		`C:\dir\empty.txt`:  nil,
+		`C:\dir\short.txt`:  []byte("short"),
+		`C:\dir\exact.bin`:  bytes.Repeat([]byte{0xff}, 75),
+		`C:\dir\long.bin`:   bytes.Repeat([]byte{0, 1, 2, '\n'}, 1000),
+		`C:\dir\ünicode.md`: []byte("# Title\r\n"),
+	}
+	var files []transport.File
+	modes := map[string]os.FileMode{}
+	for dst, content := range contents {
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(dst, ".bin") {
+			mode = 0400
+		}
+		modes[dst] = mode
+		// Only permission bits are sent
+		files = append(files, transport.File{Content: bytes.NewReader(content), Dst: dst, Mode: mode | os.ModeSetuid})
+	}
+
+	var out bytes.Buffer
+	line_size := 100
+	sums, err := writeCopyStream(&out, files, line_size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != len(files) {
+		t.Fatalf("Got %d sums for %d files", len(sums), len(files))
+	}
+
+	// Parsing the stream the same way the copy script does
+	if !strings.HasSuffix(out.String(), "\r\n") {
+		t.Fatalf("Stream is not ended with CRLF: %q", out.String())
+	}
+	received := map[string][]byte{}
+	var dst string
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\r\n"), "\r\n") {
+		if len(line) > line_size {
+			t.Fatalf("Line is longer than %d: %d", line_size, len(line))
+		}
+		if strings.HasPrefix(line, "file:") {
+			parts := strings.Split(line, ":")
+			if len(parts) != 3 {
+				t.Fatalf("Bad header %q", line)
+			}
+			path, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst = string(path)
+			if expected := fmt.Sprint(uint32(modes[dst])); parts[2] != expected {
+				t.Errorf("Mode of %q is %s, expected %s", dst, parts[2], expected)
+			}
+			received[dst] = []byte{}
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			t.Fatalf("Bad chunk %q: %v", line, err)
+		}
+		received[dst] = append(received[dst], data...)
+	}
+
+	for i, f := range files {
+		content := contents[f.Dst]
+		if !bytes.Equal(received[f.Dst], content) {
+			t.Errorf("Content of %q is %q, expected %q", f.Dst, received[f.Dst], content)
+		}
+		sum := sha256.Sum256(content)
+		if sums[i] != hex.EncodeToString(sum[:]) {
+			t.Errorf("Sum of %q is %s", f.Dst, sums[i])
+		}
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestWriteCopyStreamError(t *testing.T) {
+	var out bytes.Buffer
+	files := []transport.File{{Content: errReader{}, Dst: `C:\file`, Mode: 0644}}
+	if _, err := writeCopyStream(&out, files, 100); err == nil || !strings.Contains(err.Error(), "read failed") {
+		t.Errorf("Expected read error, got: %v", err)
+	}
+}
+
+func TestFetchWriter(t *testing.T) {
+	content := bytes.Repeat([]byte{0, 'a', '\n', 0xff, 'z'}, 100)
+	sum := sha256.Sum256(content)
+	var lines []string
+	for chunk := content; len(chunk) > 0; {
+		n := len(chunk)
+		if n > 48 {
+			n = 48
+		}
+		lines = append(lines, base64.StdEncoding.EncodeToString(chunk[:n]))
+		chunk = chunk[n:]
+	}
+	output := strings.Join(lines, "\r\n") + "\r\nsha256:" + hex.EncodeToString(sum[:]) + "\r\n"
+
+	for name, step := range map[string]int{"whole": len(output), "byte": 1, "odd": 7} {
+		t.Run(name, func(t *testing.T) {
+			var dst bytes.Buffer
+			w := &fetchWriter{dst: &dst, sum: sha256.New()}
+			for i := 0; i < len(output); i += step {
+				chunk := output[i:]
+				if len(chunk) > step {
+					chunk = chunk[:step]
+				}
+				if n, err := w.Write([]byte(chunk)); err != nil || n != len(chunk) {
+					t.Fatalf("Written %d of %d: %v", n, len(chunk), err)
+				}
+			}
+			if w.err != nil {
+				t.Fatal(w.err)
+			}
+			if !bytes.Equal(dst.Bytes(), content) {
+				t.Errorf("Fetched %q, expected %q", dst.Bytes(), content)
+			}
+			if w.remote_sum != hex.EncodeToString(sum[:]) || hex.EncodeToString(w.sum.Sum(nil)) != w.remote_sum {
+				t.Errorf("Remote sum is %q, local %x", w.remote_sum, w.sum.Sum(nil))
+			}
+			if w.buf.Len() > 0 {
+				t.Errorf("Output is left in buffer: %q", w.buf.String())
+			}
+		})
+	}
+
+	// Not completed output has no sum or the partial line
+	w := &fetchWriter{dst: &bytes.Buffer{}, sum: sha256.New()}
+	w.Write([]byte(lines[0] + "\r\n" + lines[1][:10]))
+	if w.remote_sum != "" || w.buf.Len() == 0 {
+		t.Errorf("Not completed output is accepted: %q, %q", w.remote_sum, w.buf.String())
+	}
+
+	// Broken chunk is kept as error and the following output is consumed
+	w = &fetchWriter{dst: &bytes.Buffer{}, sum: sha256.New()}
+	if n, err := w.Write([]byte("not base64!\r\n" + lines[0] + "\r\n")); err != nil || n == 0 {
+		t.Fatalf("Write failed: %d, %v", n, err)
+	}
+	if w.err == nil || !strings.Contains(w.err.Error(), "Bad output chunk") {
+		t.Errorf("Expected chunk error, got: %v", w.err)
+	}
+}
@@ -0,0 +1,230 @@
+package winrm
+
+// WinRM message encryption with NTLM session security, it's required by the default Windows
+// configuration (AllowUnencrypted=false) to use HTTP
+// Doc: https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-wsmv/08ca1c72-0e3d-4c08-9a3b-b6ba6dbbd7d5
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masterzen/winrm"
+	"github.com/masterzen/winrm/soap"
+)
+
+const (
+	encrypted_boundary     = "Encrypted Boundary"
+	encrypted_protocol     = "application/HTTP-SPNEGO-session-encrypted"
+	encrypted_content_type = `multipart/encrypted;protocol="` + encrypted_protocol + `";boundary="` + encrypted_boundary + `"`
+)
+
+// NTLM authentication is bound to the TCP connection, so each connection has own http
+// transport limited to one connection and the security context established on it
+type ntlmConn struct {
+	client  *http.Client
+	session *ntlmSession
+}
+
+// Transporter sending the encrypted messages, the parallel requests are using separated
+// connections to not block the command input by the long output polling
+type clientNTLMEncrypted struct {
+	user     string
+	password string
+	url      string
+	tls      *tls.Config
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	idle []*ntlmConn
+}
+
+func newClientNTLMEncrypted(user, password string) *clientNTLMEncrypted {
+	return &clientNTLMEncrypted{user: user, password: password}
+}
+
+func (c *clientNTLMEncrypted) Transport(endpoint *winrm.Endpoint) error {
+	scheme := "http"
+	if endpoint.HTTPS {
+		scheme = "https"
+	}
+	c.url = fmt.Sprintf("%s://%s/wsman", scheme, net.JoinHostPort(endpoint.Host, fmt.Sprint(endpoint.Port)))
+	c.timeout = endpoint.Timeout
+
+	var err error
+	c.tls, err = tlsConfig(endpoint)
+	return err
+}
+
+func (c *clientNTLMEncrypted) Post(_ *winrm.Client, request *soap.SoapMessage) (string, error) {
+	c.mu.Lock()
+	var conn *ntlmConn
+	if n := len(c.idle); n > 0 {
+		conn, c.idle = c.idle[n-1], c.idle[:n-1]
+	} else {
+		conn = &ntlmConn{client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			TLSClientConfig:       c.tls,
+			MaxConnsPerHost:       1,
+			MaxIdleConnsPerHost:   1,
+			ResponseHeaderTimeout: c.timeout,
+		}}}
+	}
+	c.mu.Unlock()
+
+	body, err := c.post(conn, []byte(request.String()))
+	if err != nil {
+		// The security context could be broken, so the connection is not reused
+		conn.client.CloseIdleConnections()
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.idle = append(c.idle, conn)
+	c.mu.Unlock()
+	return body, nil
+}
+
+// Sends the message and returns the decrypted response, authenticates when the connection
+// is new or the server dropped it
+func (c *clientNTLMEncrypted) post(conn *ntlmConn, msg []byte) (string, error) {
+	var resp *http.Response
+	var err error
+	if conn.session != nil {
+		resp, err = c.send(conn, msg, "")
+		if err == nil && resp.StatusCode == http.StatusUnauthorized {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			conn.session = nil
+		}
+	}
+	if conn.session == nil {
+		resp, err = c.authenticate(conn, msg)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read response: %v", err)
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/encrypted") {
+		if data, err = unwrapMessage(conn.session, data); err != nil {
+			conn.session = nil
+			return "", err
+		}
+	}
+	// Error text is the same as in winrm library, so the operation timeouts are handled
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("http error %d: %s", resp.StatusCode, data)
+	}
+	return string(data), nil
+}
+
+// Runs the NTLM handshake on the connection, the message is sent with the last step
+func (c *clientNTLMEncrypted) authenticate(conn *ntlmConn, msg []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Negotiate and challenge messages are protected by the MIC of the authenticate message
+	negotiate := ntlmNegotiate()
+	req.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(negotiate))
+	resp, err := conn.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	var challenge []byte
+	for _, header := range resp.Header.Values("Www-Authenticate") {
+		if token, ok := strings.CutPrefix(header, "Negotiate "); ok {
+			challenge, err = base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+			break
+		}
+	}
+	if resp.StatusCode != http.StatusUnauthorized || challenge == nil || err != nil {
+		return nil, fmt.Errorf("Server does not support NTLM authentication (http status %d)", resp.StatusCode)
+	}
+
+	auth, session, err := ntlmAuthenticate(negotiate, challenge, c.user, c.password)
+	if err != nil {
+		return nil, err
+	}
+	conn.session = session
+	resp, err = c.send(conn, msg, "Negotiate "+base64.StdEncoding.EncodeToString(auth))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		conn.session = nil
+		return nil, errors.New("NTLM authentication failed: invalid user or password")
+	}
+	return resp, nil
+}
+
+func (c *clientNTLMEncrypted) send(conn *ntlmConn, msg []byte, auth string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(wrapMessage(conn.session, msg)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", encrypted_content_type)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := conn.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to send request: %v", err)
+	}
+	return resp, nil
+}
+
+// Encrypts the SOAP message and puts it into the multipart body
+func wrapMessage(session *ntlmSession, msg []byte) []byte {
+	sealed, signature := session.seal(msg)
+
+	out := bytes.Buffer{}
+	out.WriteString("--" + encrypted_boundary + "\r\n")
+	out.WriteString("\tContent-Type: " + encrypted_protocol + "\r\n")
+	fmt.Fprintf(&out, "\tOriginalContent: type=application/soap+xml;charset=UTF-8;Length=%d\r\n", len(msg))
+	out.WriteString("--" + encrypted_boundary + "\r\n")
+	out.WriteString("\tContent-Type: application/octet-stream\r\n")
+	binary.Write(&out, binary.LittleEndian, uint32(len(signature)))
+	out.Write(signature)
+	out.Write(sealed)
+	out.WriteString("--" + encrypted_boundary + "--\r\n")
+	return out.Bytes()
+}
+
+// Extracts the encrypted SOAP message from the multipart body and decrypts it
+func unwrapMessage(session *ntlmSession, body []byte) ([]byte, error) {
+	header := []byte("application/octet-stream\r\n")
+	start := bytes.Index(body, header)
+	end := bytes.LastIndex(body, []byte("--"+encrypted_boundary+"--"))
+	if start < 0 || end < start+len(header)+4 {
+		return nil, errors.New("Bad encrypted message")
+	}
+	data := body[start+len(header) : end]
+	size := int(binary.LittleEndian.Uint32(data))
+	if len(data) < 4+size {
+		return nil, errors.New("Bad signature size of encrypted message")
+	}
+	msg, err := session.unseal(data[4+size:], data[4:4+size])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt message: %v", err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,280 @@
+package winrm
+
+// NTLMv2 authentication with the session security used to encrypt the messages over HTTP
+// Doc: https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-nlmp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// Negotiate flags of the NTLM messages
+const (
+	ntlm_negotiate_unicode                   = 0x00000001
+	ntlm_request_target                      = 0x00000004
+	ntlm_negotiate_sign                      = 0x00000010
+	ntlm_negotiate_seal                      = 0x00000020
+	ntlm_negotiate_ntlm                      = 0x00000200
+	ntlm_negotiate_always_sign               = 0x00008000
+	ntlm_negotiate_extended_session_security = 0x00080000
+	ntlm_negotiate_target_info               = 0x00800000
+	ntlm_negotiate_128                       = 0x20000000
+	ntlm_negotiate_key_exch                  = 0x40000000
+	ntlm_negotiate_56                        = 0x80000000
+
+	// Flags the server have to support to seal the messages
+	ntlm_sealing_flags = ntlm_negotiate_sign | ntlm_negotiate_seal | ntlm_negotiate_extended_session_security |
+		ntlm_negotiate_128 | ntlm_negotiate_key_exch
+)
+
+const (
+	ntlm_negotiate_flags = ntlm_negotiate_unicode | ntlm_request_target | ntlm_negotiate_ntlm |
+		ntlm_negotiate_always_sign | ntlm_negotiate_target_info | ntlm_negotiate_56 | ntlm_sealing_flags
+
+	// Ids of the target info pairs
+	ntlm_av_eol       = 0
+	ntlm_av_flags     = 6
+	ntlm_av_timestamp = 7
+
+	// Target info flag telling the authenticate message contains MIC
+	ntlm_av_flag_mic = 0x00000002
+
+	// Authenticate message header size with the version and MIC fields
+	ntlm_authenticate_header = 88
+	ntlm_mic_offset          = 72
+)
+
+var ntlm_signature = []byte("NTLMSSP\x00")
+
+// Security context established by the NTLM authentication, the messages are sealed with RC4
+// streams continued from message to message so the order of the messages is important
+type ntlmSession struct {
+	client_signing []byte
+	server_signing []byte
+	client_sealing *rc4.Cipher
+	server_sealing *rc4.Cipher
+	client_seq     uint32
+	server_seq     uint32
+}
+
+// Returns the first message of the handshake
+func ntlmNegotiate() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlm_signature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlm_negotiate_flags)
+	// Domain and workstation are empty, the payload offsets are pointing to the end
+	binary.LittleEndian.PutUint32(msg[20:], 32)
+	binary.LittleEndian.PutUint32(msg[28:], 32)
+	return msg
+}
+
+// Processes the server challenge and returns the authenticate message with the session to
+// seal the following messages. The user could contain domain like `DOMAIN\user`.
+func ntlmAuthenticate(negotiate, challenge []byte, user, password string) ([]byte, *ntlmSession, error) {
+	domain := ""
+	if pos := strings.Index(user, `\`); pos >= 0 {
+		domain, user = user[:pos], user[pos+1:]
+	}
+
+	client_challenge := make([]byte, 8)
+	session_key := make([]byte, 16)
+	if _, err := rand.Read(client_challenge); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(session_key); err != nil {
+		return nil, nil, err
+	}
+	return ntlmAuthenticateWith(negotiate, challenge, domain, user, password, client_challenge, session_key, time.Now())
+}
+
+// Builds the authenticate message with the provided random values to make it reproducible
+func ntlmAuthenticateWith(negotiate, challenge []byte, domain, user, password string, client_challenge, session_key []byte, now time.Time) ([]byte, *ntlmSession, error) {
+	if len(challenge) < 32 || !bytes.Equal(challenge[:8], ntlm_signature) || binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, nil, errors.New("Bad NTLM challenge message")
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:])
+	if flags&ntlm_sealing_flags != ntlm_sealing_flags {
+		return nil, nil, fmt.Errorf("Server does not support NTLM message encryption (flags %#x)", flags)
+	}
+	flags &= ntlm_negotiate_flags
+	server_challenge := challenge[24:32]
+
+	var target_info []byte
+	if len(challenge) >= 48 {
+		size := int(binary.LittleEndian.Uint16(challenge[40:]))
+		offset := int(binary.LittleEndian.Uint32(challenge[44:]))
+		if offset+size > len(challenge) {
+			return nil, nil, errors.New("Bad target info in NTLM challenge message")
+		}
+		target_info = challenge[offset : offset+size]
+	}
+
+	// Server time is preferred to not depend on the clocks difference, if the server provided it
+	// the handshake messages need to be protected with MIC
+	timestamp := ntlmAvPair(target_info, ntlm_av_timestamp)
+	with_mic := len(timestamp) == 8
+	if with_mic {
+		target_info = ntlmAvAddFlags(target_info, ntlm_av_flag_mic)
+	} else {
+		timestamp = make([]byte, 8)
+		// Windows FILETIME: 100ns intervals since 1601
+		binary.LittleEndian.PutUint64(timestamp, uint64((now.Unix()+11644473600)*10000000+int64(now.Nanosecond()/100)))
+	}
+
+	response_key := ntowfv2(domain, user, password)
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, client_challenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, target_info...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	proof := hmacMD5(response_key, server_challenge, temp)
+	nt_response := append(proof, temp...)
+	// LM response is not needed when the server provided the timestamp
+	lm_response := make([]byte, 24)
+
+	key_exchange_key := hmacMD5(response_key, proof)
+	encrypted_key := make([]byte, 16)
+	cipher, _ := rc4.NewCipher(key_exchange_key)
+	cipher.XORKeyStream(encrypted_key, session_key)
+
+	// Header is followed by the payload fields in the same order, the version is not negotiated
+	// and stays empty together with MIC until it's calculated
+	fields := [][]byte{lm_response, nt_response, utf16le(domain), utf16le(user), nil, encrypted_key}
+	msg := make([]byte, ntlm_authenticate_header)
+	copy(msg, ntlm_signature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, field := range fields {
+		pos := 12 + i*8
+		binary.LittleEndian.PutUint16(msg[pos:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(msg[pos+2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(msg[pos+4:], uint32(len(msg)))
+		msg = append(msg, field...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+	if with_mic {
+		copy(msg[ntlm_mic_offset:], hmacMD5(session_key, negotiate, challenge, msg))
+	}
+
+	return msg, newNTLMSession(session_key), nil
+}
+
+func newNTLMSession(session_key []byte) *ntlmSession {
+	derive := func(magic string) []byte {
+		sum := md5.Sum(append(append([]byte{}, session_key...), magic+"\x00"...))
+		return sum[:]
+	}
+	s := &ntlmSession{
+		client_signing: derive("session key to client-to-server signing key magic constant"),
+		server_signing: derive("session key to server-to-client signing key magic constant"),
+	}
+	s.client_sealing, _ = rc4.NewCipher(derive("session key to client-to-server sealing key magic constant"))
+	s.server_sealing, _ = rc4.NewCipher(derive("session key to server-to-client sealing key magic constant"))
+	return s
+}
+
+// Encrypts the client message and returns it with the signature
+func (s *ntlmSession) seal(msg []byte) (sealed, signature []byte) {
+	sealed = make([]byte, len(msg))
+	s.client_sealing.XORKeyStream(sealed, msg)
+	signature = ntlmMAC(s.client_sealing, s.client_signing, s.client_seq, msg)
+	s.client_seq++
+	return sealed, signature
+}
+
+// Decrypts the server message and verifies its signature
+func (s *ntlmSession) unseal(sealed, signature []byte) ([]byte, error) {
+	msg := make([]byte, len(sealed))
+	s.server_sealing.XORKeyStream(msg, sealed)
+	expected := ntlmMAC(s.server_sealing, s.server_signing, s.server_seq, msg)
+	s.server_seq++
+	if !hmac.Equal(expected, signature) {
+		return nil, errors.New("Bad signature of the encrypted message")
+	}
+	return msg, nil
+}
+
+// Signature of the message: version, encrypted checksum and the sequence number
+func ntlmMAC(sealing *rc4.Cipher, signing []byte, seq uint32, msg []byte) []byte {
+	seq_bytes := binary.LittleEndian.AppendUint32(nil, seq)
+	checksum := hmacMD5(signing, seq_bytes, msg)[:8]
+	sealing.XORKeyStream(checksum, checksum)
+
+	out := []byte{1, 0, 0, 0}
+	out = append(out, checksum...)
+	return append(out, seq_bytes...)
+}
+
+// Returns the value of the target info pair with the id
+func ntlmAvPair(target_info []byte, id uint16) []byte {
+	for len(target_info) >= 4 {
+		av_id := binary.LittleEndian.Uint16(target_info)
+		size := int(binary.LittleEndian.Uint16(target_info[2:]))
+		if av_id == 0 || len(target_info) < 4+size {
+			break
+		}
+		if av_id == id {
+			return target_info[4 : 4+size]
+		}
+		target_info = target_info[4+size:]
+	}
+	return nil
+}
+
+// Returns the target info with the flags added to the existing ones
+func ntlmAvAddFlags(target_info []byte, flags uint32) (out []byte) {
+	for len(target_info) >= 4 {
+		av_id := binary.LittleEndian.Uint16(target_info)
+		size := int(binary.LittleEndian.Uint16(target_info[2:]))
+		if av_id == ntlm_av_eol || len(target_info) < 4+size {
+			break
+		}
+		if av_id == ntlm_av_flags && size == 4 {
+			flags |= binary.LittleEndian.Uint32(target_info[4:])
+		} else {
+			out = append(out, target_info[:4+size]...)
+		}
+		target_info = target_info[4+size:]
+	}
+	out = binary.LittleEndian.AppendUint16(out, ntlm_av_flags)
+	out = binary.LittleEndian.AppendUint16(out, 4)
+	out = binary.LittleEndian.AppendUint32(out, flags)
+	// The list ends with the empty EOL pair
+	return append(out, 0, 0, 0, 0)
+}
+
+// NTLMv2 key of the user
+func ntowfv2(domain, user, password string) []byte {
+	hash := md4.New()
+	hash.Write(utf16le(password))
+	return hmacMD5(hash.Sum(nil), utf16le(strings.ToUpper(user)+domain))
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	out := []byte{}
+	for _, c := range utf16.Encode([]rune(s)) {
+		out = binary.LittleEndian.AppendUint16(out, c)
+	}
+	return out
+}
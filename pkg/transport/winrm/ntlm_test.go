@@ -0,0 +1,187 @@
+package winrm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// Values of the NTLMv2 authentication example from MS-NLMP 4.2.4
+const (
+	nlmp_user     = "User"
+	nlmp_domain   = "Domain"
+	nlmp_password = "Password"
+	nlmp_flags    = 0xe28a8233
+)
+
+var (
+	nlmp_session_key      = bytes.Repeat([]byte{0x55}, 16)
+	nlmp_client_challenge = bytes.Repeat([]byte{0xaa}, 8)
+	nlmp_server_challenge = []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	// Zero FILETIME of the example
+	nlmp_time = time.Unix(-11644473600, 0)
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	out, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func avPair(id uint16, val []byte) []byte {
+	out := binary.LittleEndian.AppendUint16(nil, id)
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(val)))
+	return append(out, val...)
+}
+
+// Builds the challenge message with the target name `Server` and the target info pairs
+func nlmpChallenge(pairs ...[]byte) []byte {
+	target_name := utf16le("Server")
+	var target_info []byte
+	for _, pair := range pairs {
+		target_info = append(target_info, pair...)
+	}
+	target_info = append(target_info, avPair(ntlm_av_eol, nil)...)
+
+	msg := make([]byte, 48)
+	copy(msg, ntlm_signature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint16(msg[12:], uint16(len(target_name)))
+	binary.LittleEndian.PutUint16(msg[14:], uint16(len(target_name)))
+	binary.LittleEndian.PutUint32(msg[16:], 48)
+	binary.LittleEndian.PutUint32(msg[20:], nlmp_flags)
+	copy(msg[24:], nlmp_server_challenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(target_info)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(target_info)))
+	binary.LittleEndian.PutUint32(msg[44:], uint32(48+len(target_name)))
+	msg = append(msg, target_name...)
+	return append(msg, target_info...)
+}
+
+// Returns the payload field of the authenticate message by its index
+func authField(msg []byte, index int) []byte {
+	pos := 12 + index*8
+	size := int(binary.LittleEndian.Uint16(msg[pos:]))
+	offset := int(binary.LittleEndian.Uint32(msg[pos+4:]))
+	return msg[offset : offset+size]
+}
+
+func TestNTLMKnownAnswers(t *testing.T) {
+	// 4.2.4.1.1 NTOWFv2
+	response_key := ntowfv2(nlmp_domain, nlmp_user, nlmp_password)
+	if !bytes.Equal(response_key, unhex(t, "0c868a403bfd7a93a3001ef22ef02e3f")) {
+		t.Fatalf("Bad NTOWFv2: %x", response_key)
+	}
+
+	challenge := nlmpChallenge(avPair(2, utf16le("Domain")), avPair(1, utf16le("Server")))
+	msg, session, err := ntlmAuthenticateWith(ntlmNegotiate(), challenge, nlmp_domain, nlmp_user, nlmp_password,
+		nlmp_client_challenge, nlmp_session_key, nlmp_time)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 4.2.4.2.2 NTLMv2 response starts with NTProofStr
+	nt_response := authField(msg, 1)
+	proof := nt_response[:16]
+	if !bytes.Equal(proof, unhex(t, "68cd0ab851e51c96aabc927bebef6a1c")) {
+		t.Errorf("Bad NTProofStr: %x", proof)
+	}
+	// 4.2.4.1.3 Session base key is the key exchange key with extended session security
+	if key := hmacMD5(response_key, proof); !bytes.Equal(key, unhex(t, "8de40ccadbc14a82f15cb0ad0de95ca3")) {
+		t.Errorf("Bad session base key: %x", key)
+	}
+	// 4.2.4.2.3 Encrypted session key
+	if key := authField(msg, 5); !bytes.Equal(key, unhex(t, "c5dad2544fc9799094ce1ce90bc9d03e")) {
+		t.Errorf("Bad encrypted session key: %x", key)
+	}
+	if user := authField(msg, 3); !bytes.Equal(user, utf16le(nlmp_user)) {
+		t.Errorf("Bad user: %x", user)
+	}
+	if flags := binary.LittleEndian.Uint32(msg[60:]); flags != nlmp_flags&ntlm_negotiate_flags {
+		t.Errorf("Bad flags: %#x", flags)
+	}
+	// No timestamp from the server - no MIC
+	if mic := msg[ntlm_mic_offset:ntlm_authenticate_header]; !bytes.Equal(mic, make([]byte, 16)) {
+		t.Errorf("Unexpected MIC: %x", mic)
+	}
+
+	// 4.2.4.4 GSS_WrapEx
+	sealed, signature := session.seal(utf16le("Plaintext"))
+	if !bytes.Equal(sealed, unhex(t, "54e50165bf1936dc996020c1811b0f06fb5f")) {
+		t.Errorf("Bad sealed data: %x", sealed)
+	}
+	if !bytes.Equal(signature, unhex(t, "010000007fb38ec5c55d497600000000")) {
+		t.Errorf("Bad signature: %x", signature)
+	}
+	// Next message continues the sequence
+	if _, signature = session.seal(utf16le("Plaintext")); binary.LittleEndian.Uint32(signature[12:]) != 1 {
+		t.Errorf("Bad sequence number of the next message: %x", signature)
+	}
+}
+
+func TestNTLMMIC(t *testing.T) {
+	negotiate := ntlmNegotiate()
+	timestamp := unhex(t, "0090d336b734c301")
+	challenge := nlmpChallenge(avPair(2, utf16le("Domain")), avPair(1, utf16le("Server")), avPair(ntlm_av_timestamp, timestamp))
+	msg, _, err := ntlmAuthenticateWith(negotiate, challenge, nlmp_domain, nlmp_user, nlmp_password,
+		nlmp_client_challenge, nlmp_session_key, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// MIC is calculated over the handshake messages with the empty MIC field
+	mic := append([]byte{}, msg[ntlm_mic_offset:ntlm_authenticate_header]...)
+	zeroed := append([]byte{}, msg...)
+	copy(zeroed[ntlm_mic_offset:], make([]byte, 16))
+	if expected := hmacMD5(nlmp_session_key, negotiate, challenge, zeroed); !bytes.Equal(mic, expected) {
+		t.Errorf("Bad MIC: %x, expected: %x", mic, expected)
+	}
+
+	// The response uses the server timestamp and tells the server about MIC
+	blob := authField(msg, 1)[16:]
+	if !bytes.Equal(blob[8:16], timestamp) {
+		t.Errorf("Server timestamp is not used: %x", blob[8:16])
+	}
+	target_info := blob[28:]
+	if flags := ntlmAvPair(target_info, ntlm_av_flags); !bytes.Equal(flags, []byte{2, 0, 0, 0}) {
+		t.Errorf("Bad target info flags: %x", flags)
+	}
+	if ts := ntlmAvPair(target_info, ntlm_av_timestamp); !bytes.Equal(ts, timestamp) {
+		t.Errorf("Target info timestamp is lost: %x", ts)
+	}
+	// NTProofStr covers the modified target info
+	response_key := ntowfv2(nlmp_domain, nlmp_user, nlmp_password)
+	if proof := hmacMD5(response_key, nlmp_server_challenge, blob); !bytes.Equal(proof, authField(msg, 1)[:16]) {
+		t.Errorf("NTProofStr does not match the response")
+	}
+}
+
+func TestNTLMUnseal(t *testing.T) {
+	client := newNTLMSession(nlmp_session_key)
+	server := newNTLMSession(nlmp_session_key)
+	// Server is using the opposite direction keys
+	server.client_signing, server.server_signing = server.server_signing, server.client_signing
+	server.client_sealing, server.server_sealing = server.server_sealing, server.client_sealing
+
+	for _, text := range []string{"first", "second"} {
+		sealed, signature := server.seal([]byte(text))
+		out, err := client.unseal(sealed, signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != text {
+			t.Errorf("Unsealed %q, expected %q", out, text)
+		}
+	}
+
+	sealed, signature := server.seal([]byte("tampered"))
+	sealed[0] ^= 1
+	if _, err := client.unseal(sealed, signature); err == nil {
+		t.Error("Tampered message is accepted")
+	}
+}
@@ -2,28 +2,92 @@ package winrm
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/hex"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/masterzen/winrm"
+
+	"github.com/state-of-the-art/ansiblego/pkg/transport"
+)
+
+// Authentication transports
+const (
+	AuthBasic       = "basic"
+	AuthNTLM        = "ntlm"
+	AuthKerberos    = "kerberos"
+	AuthCertificate = "certificate"
+)
+
+// Message encryption modes, the messages are encrypted only with NTLM auth
+const (
+	// Encrypted when HTTP is used
+	EncryptionAuto = "auto"
+	// Encrypted even over HTTPS
+	EncryptionAlways = "always"
+	// Never encrypted, the server needs AllowUnencrypted to use HTTP
+	EncryptionNever = "never"
+)
+
+// Defaults are the same as in Ansible
+const (
+	default_operation_timeout = 20 * time.Second
+	default_read_timeout      = 30 * time.Second
+	default_locale            = "en-US"
+	default_envelope_size     = 153600
 )
 
+// Settings of the WinRM connection
+type Config struct {
+	User     string
+	Password string
+	Host     string
+	Port     int
+	HTTPS    bool
+
+	// One of the authentication transports, ntlm by default
+	Transport string
+	// One of the message encryption modes, auto by default
+	MessageEncryption string
+
+	// Skip the server certificate validation
+	Insecure bool
+	// PEM file or directory with the CA certificates to validate the server, system ones by default
+	CACertPath string
+	// Client certificate and its key PEM files for the certificate auth
+	CertFile    string
+	CertKeyFile string
+
+	// Kerberos config file, KRB5_CONFIG or /etc/krb5.conf by default
+	KerberosConfig string
+	// Kerberos credentials cache used when the password is not set, KRB5CCNAME by default
+	KerberosCCache string
+	// Service principal of the host, `HTTP/<host>` by default
+	KerberosSPN string
+
+	// Time the server waits for the operation (like command output) to complete
+	OperationTimeout time.Duration
+	// Time to wait for the server response, needs to be longer than the operation timeout
+	ReadTimeout time.Duration
+}
+
 type TransportWinRM struct {
 	client *winrm.Client
 }
 
-func New(user, pass, host string, port int) (*TransportWinRM, error) {
+func New(cfg *Config) (*TransportWinRM, error) {
 	tr := &TransportWinRM{}
 
-	if err := tr.connectPassword(user, pass, host, port); err != nil {
-		return nil, fmt.Errorf("Failed to connect with password: %v", err)
+	var err error
+	if tr.client, err = newClient(cfg); err != nil {
+		return nil, fmt.Errorf("Failed to create WinRM client: %v", err)
 	}
 
 	if _, _, err := tr.Check(); err != nil {
@@ -33,165 +97,291 @@ func New(user, pass, host string, port int) (*TransportWinRM, error) {
 	return tr, nil
 }
 
-func (tr *TransportWinRM) connectPassword(user, pass, host string, port int) (err error) {
-	config := winrm.NewEndpoint(
-		host, // Host to connect to
-		port, // WinRM port
-		true, // Use TLS
-		true, // Allow insecure connection
-		nil,  // CA certificate
-		nil,  // Client Certificate
-		nil,  // Client Key
-		0,    // Timeout
-	)
-
-	tr.client, err = winrm.NewClient(config, user, pass)
-	if err != nil {
-		return fmt.Errorf("Failed to create WinRM client: %v", err)
+// Prepares the client with the auth transport, nothing is connected at this point
+func newClient(cfg *Config) (*winrm.Client, error) {
+	op_timeout, read_timeout := cfg.OperationTimeout, cfg.ReadTimeout
+	if op_timeout <= 0 {
+		op_timeout = default_operation_timeout
+	}
+	if read_timeout <= 0 {
+		read_timeout = default_read_timeout
+	}
+	if read_timeout <= op_timeout {
+		return nil, fmt.Errorf("Read timeout %v must exceed operation timeout %v", read_timeout, op_timeout)
 	}
 
-	return nil
-}
+	endpoint := &winrm.Endpoint{
+		Host:     cfg.Host,
+		Port:     cfg.Port,
+		HTTPS:    cfg.HTTPS,
+		Insecure: cfg.Insecure,
+		Timeout:  read_timeout,
+	}
+	var err error
+	if cfg.CACertPath != "" {
+		if endpoint.CACert, err = readCACerts(cfg.CACertPath); err != nil {
+			return nil, err
+		}
+	}
 
-func (tr *TransportWinRM) Execute(cmd string, stdout, stderr io.Writer) (err error) {
-	_, err = tr.client.Run(cmd, stdout, stderr)
-	if err != nil {
-		return fmt.Errorf("Failed to run command: %v", err)
+	auth := cfg.Transport
+	if auth == "" {
+		auth = AuthNTLM
+	}
+	encrypt := false
+	switch cfg.MessageEncryption {
+	case "", EncryptionAuto:
+		encrypt = auth == AuthNTLM && !cfg.HTTPS
+	case EncryptionAlways:
+		if auth != AuthNTLM {
+			return nil, fmt.Errorf("Message encryption is supported only with %q transport", AuthNTLM)
+		}
+		encrypt = true
+	case EncryptionNever:
+	default:
+		return nil, fmt.Errorf("Unknown message encryption mode %q", cfg.MessageEncryption)
 	}
-	return nil
-}
 
-func (tr *TransportWinRM) ExecuteInput(cmd string, stdin io.Reader, stdout, stderr io.Writer) (err error) {
-	_, err = tr.client.RunWithInput(cmd, stdout, stderr, stdin)
-	if err != nil {
-		return fmt.Errorf("Failed to run command: %v", err)
+	params := winrm.NewParameters(fmt.Sprintf("PT%dS", int(op_timeout.Seconds())), default_locale, default_envelope_size)
+	switch auth {
+	case AuthBasic:
+	case AuthNTLM:
+		params.TransportDecorator = func() winrm.Transporter { return &winrm.ClientNTLM{} }
+		if encrypt {
+			params.TransportDecorator = func() winrm.Transporter { return newClientNTLMEncrypted(cfg.User, cfg.Password) }
+		}
+	case AuthKerberos:
+		settings, err := kerberosSettings(cfg)
+		if err != nil {
+			return nil, err
+		}
+		params.TransportDecorator = func() winrm.Transporter { return winrm.NewClientKerberos(settings) }
+	case AuthCertificate:
+		if !cfg.HTTPS {
+			return nil, fmt.Errorf("Certificate auth requires HTTPS")
+		}
+		if endpoint.Cert, err = os.ReadFile(cfg.CertFile); err != nil {
+			return nil, fmt.Errorf("Unable to read client certificate: %v", err)
+		}
+		if endpoint.Key, err = os.ReadFile(cfg.CertKeyFile); err != nil {
+			return nil, fmt.Errorf("Unable to read client certificate key: %v", err)
+		}
+		params.TransportDecorator = func() winrm.Transporter { return &winrm.ClientAuthRequest{} }
+	default:
+		return nil, fmt.Errorf("Unknown WinRM transport %q", auth)
 	}
-	return nil
-}
 
-func (tr *TransportWinRM) Check() (kernel, arch string, err error) {
-	// TODO: most of the time it's true, but who knows those
-	// poor things who runs winrm server on linux/mac...
-	kernel = "windows"
+	return winrm.NewClientWithParameters(endpoint, cfg.User, cfg.Password, params)
+}
 
-	// Get remote system arch
-	arch_buf := bytes.Buffer{}
-	stderr_buf := bytes.Buffer{}
-	if err = tr.Execute("set processor", &arch_buf, &stderr_buf); err != nil {
-		return kernel, arch, fmt.Errorf("Unable to get the remote system arch: %v", err)
+// Kerberos is using the password of `user@REALM` or the credentials cache from kinit
+func kerberosSettings(cfg *Config) (*winrm.Settings, error) {
+	settings := &winrm.Settings{
+		WinRMHost:  cfg.Host,
+		WinRMPort:  cfg.Port,
+		WinRMProto: "http",
+		KrbConfig:  cfg.KerberosConfig,
+		KrbSpn:     cfg.KerberosSPN,
+	}
+	if cfg.HTTPS {
+		settings.WinRMProto = "https"
+	}
+	if settings.KrbConfig == "" {
+		if settings.KrbConfig = os.Getenv("KRB5_CONFIG"); settings.KrbConfig == "" {
+			settings.KrbConfig = "/etc/krb5.conf"
+		}
 	}
 
-	out_lines := strings.Split(arch_buf.String(), "\n")
-	for _, l := range out_lines {
-		if strings.HasPrefix(strings.TrimSpace(l), "PROCESSOR_ARCHITECTURE=") {
-			arch = strings.ToLower(strings.TrimSpace(strings.Split(l, "=")[1]))
+	if cfg.Password == "" {
+		if settings.KrbCCache = cfg.KerberosCCache; settings.KrbCCache == "" {
+			settings.KrbCCache = strings.TrimPrefix(os.Getenv("KRB5CCNAME"), "FILE:")
+		}
+		if settings.KrbCCache == "" {
+			return nil, fmt.Errorf("Kerberos needs the password or credentials cache from kinit")
 		}
+		return settings, nil
 	}
 
-	if arch == "" {
-		return kernel, arch, fmt.Errorf("No arch found for remote system: %v, %v", arch_buf.String(), stderr_buf.String())
+	pos := strings.LastIndex(cfg.User, "@")
+	if pos < 0 {
+		return nil, fmt.Errorf("Kerberos user %q must contain realm like user@REALM", cfg.User)
 	}
+	settings.WinRMUsername = cfg.User[:pos]
+	settings.KrbRealm = strings.ToUpper(cfg.User[pos+1:])
+	settings.WinRMPassword = cfg.Password
+	return settings, nil
+}
 
-	if arch == "x86_64" || arch == "x64" {
-		arch = "amd64"
+// Reads the PEM bundle file or all the files of the directory
+func readCACerts(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA certificates: %v", err)
 	}
+	if !info.IsDir() {
+		return os.ReadFile(path)
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA certificates: %v", err)
+	}
+	var out []byte
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA certificates: %v", err)
+		}
+		out = append(append(out, data...), '\n')
+	}
+	return out, nil
+}
 
-	return kernel, arch, nil
+// TLS settings of the endpoint for the own transporters, the same as winrm library uses
+func tlsConfig(endpoint *winrm.Endpoint) (*tls.Config, error) {
+	out := &tls.Config{
+		InsecureSkipVerify: endpoint.Insecure,
+		ServerName:         endpoint.TLSServerName,
+	}
+	if len(endpoint.CACert) > 0 {
+		out.RootCAs = x509.NewCertPool()
+		if !out.RootCAs.AppendCertsFromPEM(endpoint.CACert) {
+			return nil, fmt.Errorf("Unable to read CA certificates")
+		}
+	}
+	return out, nil
 }
 
-// Rewritten for simplicity version of very quick winrm file copy through stdin
-// for io.Reader from: https://github.com/jbrekelmans/go-winrm/blob/master/copier.go
-func (tr *TransportWinRM) Copy(content io.Reader, dst string, mode os.FileMode) error {
-	// TODO: mode
-	script := `begin {
-		$path = ` + powerShellQuotedStringLiteral(dst) + `
-		$DebugPreference = "Continue"
-		$ErrorActionPreference = "Stop"
-		Set-StrictMode -Version 2
-		$fd = [System.IO.File]::Create($path)
-		$sha256 = [System.Security.Cryptography.SHA256CryptoServiceProvider]::Create()
-		$bytes = @() #initialize for empty file case
-	}
-	process {
-		$bytes = [System.Convert]::FromBase64String($input)
-		$sha256.TransformBlock($bytes, 0, $bytes.Length, $bytes, 0) | Out-Null
-		$fd.Write($bytes, 0, $bytes.Length)
-	}
-	end {
-		$sha256.TransformFinalBlock($bytes, 0, 0) | Out-Null
-		$hash = [System.BitConverter]::ToString($sha256.Hash).Replace("-", "").ToLowerInvariant()
-		$fd.Close()
-		Write-Output $hash
-	}`
+func (tr *TransportWinRM) Execute(ctx context.Context, cmd string, stdout, stderr io.Writer) (*transport.Result, error) {
+	return tr.run(ctx, cmd, nil, stdout, stderr)
+}
+
+func (tr *TransportWinRM) ExecuteInput(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*transport.Result, error) {
+	return tr.run(ctx, cmd, stdin, stdout, stderr)
+}
 
+// Runs the command in the new shell, when the context is done the command is terminated with
+// the WinRM Signal request
+func (tr *TransportWinRM) run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*transport.Result, error) {
 	shell, err := tr.client.CreateShell()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Failed to create WinRM shell: %v", err)
 	}
 	defer shell.Close()
 
-	cmd, err := shell.Execute(powerShellScript(script))
+	start := time.Now()
+	command, err := shell.Execute(cmd)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Failed to run command: %v", err)
 	}
-	defer cmd.Close()
 
+	if stdin != nil {
+		go func() {
+			io.Copy(command.Stdin, stdin)
+			command.Stdin.Close()
+		}()
+	}
+	// Transport errors are passed through the output streams
 	var wg sync.WaitGroup
-	copyFunc := func(w io.Writer, r io.Reader) {
+	var stdout_err, stderr_err error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, stdout_err = io.Copy(stdout, command.Stdout)
+	}()
+	go func() {
 		defer wg.Done()
-		io.Copy(w, r)
+		_, stderr_err = io.Copy(stderr, command.Stderr)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		command.Wait()
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// Close is sending the terminate signal to the command
+		command.Close()
+		return &transport.Result{ExitCode: -1, Signal: "TERM", Duration: time.Since(start)},
+			fmt.Errorf("Command was interrupted: %v", ctx.Err())
 	}
+	command.Close()
 
-	stdout_buf := bytes.Buffer{}
-	wg.Add(2)
-	go copyFunc(&stdout_buf, cmd.Stdout)
-	go copyFunc(ioutil.Discard, cmd.Stderr)
-
-	// Preparing sha256 calculate object
-	sha256_loc_obj := sha256.New()
+	res := &transport.Result{ExitCode: command.ExitCode(), Duration: time.Since(start)}
+	if err = stdout_err; err == nil {
+		err = stderr_err
+	}
+	if err != nil {
+		res.ExitCode = -1
+		return res, fmt.Errorf("Failed to run command: %v", err)
+	}
+	if res.ExitCode != 0 {
+		return res, &transport.ExitError{Result: res}
+	}
+	return res, nil
+}
 
-	// Making chunk buffer for base64 encoding (which is 4 bytes for 3 bytes of data)
-	chunk := make([]byte, (tr.client.Parameters.EnvelopeSize-1000)/4*3)
-	b64_chunk := make([]byte, tr.client.Parameters.EnvelopeSize-1000+2)
-	id := 0
-	for {
-		chunk_len, err := content.Read(chunk)
-		if err != nil && err != io.EOF {
-			return err
+func (tr *TransportWinRM) Check() (kernel, arch string, err error) {
+	// Most of the time it's windows, but who knows those
+	// poor things who runs winrm server on linux/mac...
+	kernel_buf := bytes.Buffer{}
+	stderr_buf := bytes.Buffer{}
+	if _, err = tr.Execute(context.Background(), "echo %OS%", &kernel_buf, &stderr_buf); err != nil {
+		return kernel, arch, fmt.Errorf("Unable to get the remote system kernel: %v, %v", err, stderr_buf.String())
+	}
+	if strings.TrimSpace(kernel_buf.String()) == "Windows_NT" {
+		kernel = "windows"
+	} else {
+		// Not a cmd shell, so trying the unix way
+		kernel_buf.Reset()
+		stderr_buf.Reset()
+		if _, err = tr.Execute(context.Background(), "uname -s -m", &kernel_buf, &stderr_buf); err != nil {
+			return kernel, arch, fmt.Errorf("Unable to get the remote system kernel: %v, %v", err, stderr_buf.String())
 		}
-		if chunk_len == 0 {
-			cmd.Stdin.Close()
-			break
+		kernel_arch_list := strings.Fields(kernel_buf.String())
+		if len(kernel_arch_list) != 2 {
+			return kernel, arch, fmt.Errorf("Bad output from uname: %v, %v", kernel_buf.String(), stderr_buf.String())
 		}
-
-		sha256_loc_obj.Write(chunk[:chunk_len])
-
-		// Using base64 encoding because it's quite hard to transfer binary data through winrm
-		base64.StdEncoding.Encode(b64_chunk, chunk[:chunk_len])
-		// 2 additional bytes for CRLF in the end of b64 encoded buffer
-		b64_len := base64.StdEncoding.EncodedLen(chunk_len) + 2
-		b64_chunk[b64_len-2] = '\r'
-		b64_chunk[b64_len-1] = '\n'
-		if written_len, err := cmd.Stdin.Write(b64_chunk[:b64_len]); b64_len != written_len || err != nil {
-			return fmt.Errorf("Error during copying chunk (bytes: %d, written: %d): %v", b64_len, written_len, err)
+		kernel = strings.ToLower(kernel_arch_list[0])
+		arch = strings.ToLower(kernel_arch_list[1])
+		if arch == "x86_64" || arch == "x64" {
+			arch = "amd64"
 		}
-		id++
+		return kernel, arch, nil
 	}
 
-	sha256_loc := hex.EncodeToString(sha256_loc_obj.Sum(nil))
+	// Get remote system arch
+	arch_buf := bytes.Buffer{}
+	stderr_buf.Reset()
+	if _, err = tr.Execute(context.Background(), "set processor", &arch_buf, &stderr_buf); err != nil {
+		return kernel, arch, fmt.Errorf("Unable to get the remote system arch: %v", err)
+	}
 
-	cmd.Wait()
-	wg.Wait()
+	out_lines := strings.Split(arch_buf.String(), "\n")
+	for _, l := range out_lines {
+		if strings.HasPrefix(strings.TrimSpace(l), "PROCESSOR_ARCHITECTURE=") {
+			arch = strings.ToLower(strings.TrimSpace(strings.Split(l, "=")[1]))
+		}
+	}
 
-	if cmd.ExitCode() != 0 {
-		return fmt.Errorf("Copy operation returned code=%d", cmd.ExitCode())
+	if arch == "" {
+		return kernel, arch, fmt.Errorf("No arch found for remote system: %v, %v", arch_buf.String(), stderr_buf.String())
 	}
 
-	// Verify sha256 to validate the data was copied correctly
-	sha256_rem := strings.TrimSpace(stdout_buf.String())
-	if sha256_rem != sha256_loc {
-		return fmt.Errorf("Copy failed due to checksums mismatch: %v != %v", sha256_rem, sha256_loc)
+	if arch == "x86_64" || arch == "x64" {
+		arch = "amd64"
 	}
 
+	return kernel, arch, nil
+}
+
+// WinRM is stateless HTTP, the shells are closed after each command so nothing to release
+func (tr *TransportWinRM) Close() error {
 	return nil
 }
@@ -0,0 +1,136 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Number of unchanged lines to show around the changes
+const diff_context = 3
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// Creates unified diff of two texts, returns empty string if they are equal
+func UnifiedDiff(before, after, before_header, after_header string) string {
+	if before == after {
+		return ""
+	}
+	a, b := splitLines(before), splitLines(after)
+	lines := diffLines(a, b)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", before_header, after_header)
+
+	// Grouping the changes with context lines into hunks
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			i++
+			continue
+		}
+		start := i - diff_context
+		if start < 0 {
+			start = 0
+		}
+		// Extending the hunk while the next change is close enough
+		end := i
+		for j := i; j < len(lines); j++ {
+			if lines[j].op != ' ' {
+				end = j
+			} else if j-end > diff_context*2 {
+				break
+			}
+		}
+		end += diff_context + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		// Counting the hunk position in both texts
+		a_start, b_start := 1, 1
+		for _, l := range lines[:start] {
+			if l.op != '+' {
+				a_start++
+			}
+			if l.op != '-' {
+				b_start++
+			}
+		}
+		a_len, b_len := 0, 0
+		for _, l := range lines[start:end] {
+			if l.op != '+' {
+				a_len++
+			}
+			if l.op != '-' {
+				b_len++
+			}
+		}
+		if a_len == 0 {
+			a_start--
+		}
+		if b_len == 0 {
+			b_start--
+		}
+
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", a_start, a_len, b_start, b_len)
+		for _, l := range lines[start:end] {
+			out.WriteByte(l.op)
+			out.WriteString(l.text)
+			out.WriteByte('\n')
+		}
+		i = end
+	}
+
+	return out.String()
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Simple LCS line diff, good enough for the config files
+func diffLines(a, b []string) (out []diffLine) {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, diffLine{'-', a[i]})
+			i++
+		default:
+			out = append(out, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		out = append(out, diffLine{'+', b[j]})
+	}
+	return out
+}
@@ -13,6 +13,11 @@ import (
 
 // Runs & logs the executable command
 func RunCommand(timeout time.Duration, path string, arg ...string) (string, string, error) {
+	return RunCommandEnv(timeout, nil, path, arg...)
+}
+
+// Runs & logs the executable command with the environment, nil env means the current process one
+func RunCommandEnv(timeout time.Duration, env []string, path string, arg ...string) (string, string, error) {
 	var stdout, stderr bytes.Buffer
 
 	// Running command with timeout
@@ -20,6 +25,7 @@ func RunCommand(timeout time.Duration, path string, arg ...string) (string, stri
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, path, arg...)
+	cmd.Env = env
 
 	log.Trace("Executing:", cmd.Path, strings.Join(cmd.Args[1:], " "))
 	cmd.Stdout = &stdout
@@ -57,10 +63,15 @@ func RunCommand(timeout time.Duration, path string, arg ...string) (string, stri
 
 // Will retry on error and store the retry output and errors to return
 func RunCommandRetry(retry int, timeout time.Duration, path string, arg ...string) (stdout string, stderr string, err error) {
+	return RunCommandRetryEnv(retry, timeout, nil, path, arg...)
+}
+
+// Runs the command with the environment and retries it in case of failure
+func RunCommandRetryEnv(retry int, timeout time.Duration, env []string, path string, arg ...string) (stdout string, stderr string, err error) {
 	counter := 0
 	for {
 		counter++
-		rout, rerr, err := RunCommand(timeout, path, arg...)
+		rout, rerr, err := RunCommandEnv(timeout, env, path, arg...)
 		if err != nil {
 			stdout += fmt.Sprintf("\n--- Command execution attempt %d ---\n", counter)
 			stdout += rout